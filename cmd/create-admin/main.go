@@ -0,0 +1,69 @@
+// Command create-admin creates an admin account. Registration only hands out
+// buyer and seller roles, so this is how the first admin is made; further
+// admins can also be created through POST /api/admin/users.
+//
+//	ADMIN_PASSWORD=... go run ./cmd/create-admin -username alice
+//
+// Without ADMIN_PASSWORD the password is read from the first line of stdin.
+// The database is configured through the same DB_* variables as the server.
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"escrow-agent/internal/auth"
+	"escrow-agent/internal/db"
+	"escrow-agent/internal/logs"
+	"escrow-agent/pkg/models"
+)
+
+func main() {
+	username := flag.String("username", "", "username of the new admin")
+	flag.Parse()
+
+	password := os.Getenv("ADMIN_PASSWORD")
+	if password == "" {
+		fmt.Fprint(os.Stderr, "Password: ")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			log.Fatalf("Failed to read password: %v", err)
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+
+	req := auth.RegisterRequest{Username: *username, Password: password, Roles: []string{models.RoleAdmin}}
+	if err := auth.ValidateInput(req, auth.AllRoles); err != nil {
+		log.Fatalf("Invalid admin account: %v", err)
+	}
+
+	db.InitDB()
+	defer db.DB.Close()
+
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		log.Fatalf("Failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	userID, _, err := auth.CreateUser(tx, req)
+	if errors.Is(err, auth.ErrUsernameTaken) {
+		log.Fatalf("Username %s already exists", req.Username)
+	}
+	if err == nil {
+		err = logs.RecordUserEvent(tx, userID, nil, "UserCreated", fmt.Sprintf("Admin account %s created from the command line", req.Username))
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Fatalf("Failed to create admin: %v", err)
+	}
+
+	log.Printf("Admin %s created with ID %s", req.Username, userID)
+}
@@ -0,0 +1,77 @@
+// Command rotate-payment-keys rewraps the encrypted payment details and payout
+// account destinations under the current key-encryption key, the first key in
+// PAYMENT_KEK_FILE. Run it after
+// putting a new key at the top of the file and before dropping a retired key
+// from it. Details written before encryption was introduced are sealed on the
+// way.
+//
+//	PAYMENT_KEK_FILE=/run/secrets/payment-kek.json go run ./cmd/rotate-payment-keys
+//
+// Each table is walked in batches, each committed on its own, so the command
+// can be stopped and run again. The database is configured through the same
+// DB_* variables as the server.
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"escrow-agent/internal/crypto"
+	"escrow-agent/internal/db"
+	"escrow-agent/internal/payments"
+	"escrow-agent/internal/payouts"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+// rotateStep rotates one batch of rows after the given key, see
+// payments.RotateDetails.
+type rotateStep func(tx *sqlx.Tx, after uuid.UUID, limit int) (last uuid.UUID, rotated int, err error)
+
+func main() {
+	batch := flag.Int("batch", 500, "rows rotated per database transaction")
+	flag.Parse()
+
+	path := os.Getenv("PAYMENT_KEK_FILE")
+	if path == "" {
+		log.Fatal("PAYMENT_KEK_FILE is not set")
+	}
+	keyring, err := crypto.LoadKeyring(path)
+	if err != nil {
+		log.Fatalf("Invalid PAYMENT_KEK_FILE: %v", err)
+	}
+	crypto.SetKEK(keyring)
+
+	db.InitDB()
+	defer db.DB.Close()
+
+	log.Printf("Rotated %d payments to key %s", rotate("payments", payments.RotateDetails, *batch), keyring.CurrentID())
+	log.Printf("Rotated %d payout accounts to key %s", rotate("payout accounts", payouts.RotateAccounts, *batch), keyring.CurrentID())
+}
+
+// rotate walks a table with step and returns how many rows it rotated.
+func rotate(table string, step rotateStep, batch int) int {
+	total := 0
+	after := uuid.Nil
+	for {
+		tx, err := db.DB.Beginx()
+		if err != nil {
+			log.Fatalf("Failed to begin transaction: %v", err)
+		}
+		last, rotated, err := step(tx, after, batch)
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback()
+			log.Fatalf("Failed to rotate %s after %s: %v", table, after, err)
+		}
+		total += rotated
+		if last == uuid.Nil {
+			return total
+		}
+		after = last
+	}
+}
@@ -9,7 +9,7 @@ BEGIN
     END IF;
 
     IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'escrow_status') THEN
-        CREATE TYPE escrow_status AS ENUM ('pending', 'funded', 'released', 'cancelled');
+        CREATE TYPE escrow_status AS ENUM ('pending', 'funded', 'disputed', 'released', 'cancelled');
     END IF;
 
     IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'transaction_status') THEN
@@ -27,20 +27,160 @@ BEGIN
     IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'dispute_status') THEN
         CREATE TYPE dispute_status AS ENUM ('open', 'resolved', 'rejected');
     END IF;
+
+    IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'milestone_status') THEN
+        CREATE TYPE milestone_status AS ENUM ('pending', 'fulfilled', 'released', 'refunded');
+    END IF;
 END $$;
 
 CREATE TABLE IF NOT EXISTS users(
 	user_id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
 	username VARCHAR(50) UNIQUE NOT NULL,
 	password_hash VARCHAR(255) NOT NULL,
-    role user_role NOT NULL,
+    roles user_role[] NOT NULL CHECK (cardinality(roles) > 0), -- a user may both buy and sell
+    totp_secret TEXT, -- base32; pending until totp_enabled_at is set
+    totp_enabled_at TIMESTAMPTZ,
+    totp_last_step BIGINT NOT NULL DEFAULT 0, -- last accepted TOTP time step, blocks replays
     created_at TIMESTAMPTZ DEFAULT NOW()
 );
 
 CREATE UNIQUE INDEX users_username_lower_idx ON users(LOWER(username));
-CREATE INDEX users_role_idx ON users(role);
+CREATE INDEX users_roles_idx ON users USING GIN(roles);
 CREATE INDEX users_created_idx ON users USING BRIN(created_at);
 
+--account changes made by admins (creation, role changes); actor_id is the
+--admin, or NULL when made with cmd/create-admin
+CREATE TABLE user_audit_logs (
+    log_id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    actor_id UUID REFERENCES users(user_id) ON DELETE SET NULL,
+    event_type VARCHAR(50) NOT NULL,
+    event_details TEXT,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE INDEX user_audit_logs_user_idx ON user_audit_logs(user_id);
+
+--sign-in events: failed and successful logins, lockouts and unlocks;
+--username is what was typed, so failures for unknown names are kept too
+
+CREATE TABLE security_logs (
+    log_id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID REFERENCES users(user_id) ON DELETE SET NULL,
+    username TEXT,
+    ip_address TEXT NOT NULL,
+    event_type VARCHAR(50) NOT NULL,
+    event_details TEXT,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE INDEX security_logs_user_idx ON security_logs(user_id);
+CREATE INDEX security_logs_ip_idx ON security_logs(ip_address);
+CREATE INDEX security_logs_created_idx ON security_logs USING BRIN(created_at);
+
+--failed logins per username and per client address, see internal/lockout;
+--rows for usernames that do not exist are kept alike so responses match
+
+CREATE TABLE login_throttles (
+    scope VARCHAR(10) NOT NULL CHECK (scope IN ('user', 'ip', 'code')),
+    subject TEXT NOT NULL, -- the username as typed, the client address, or for two-factor codes the user id
+    failures INT NOT NULL DEFAULT 0,
+    last_failure_at TIMESTAMPTZ NOT NULL,
+    blocked_until TIMESTAMPTZ,
+    PRIMARY KEY (scope, subject)
+);
+
+CREATE INDEX login_throttles_last_failure_idx ON login_throttles(last_failure_at);
+
+
+--sessions: refresh tokens rotate on every use and are stored hashed; access
+--tokens are stateless JWTs, so logging out lists their jti as revoked until
+--they would have expired anyway
+
+CREATE TABLE refresh_tokens (
+    token_id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    session_id UUID NOT NULL, -- shared by every token rotated from the same login
+    user_id UUID NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    token_hash CHAR(64) NOT NULL UNIQUE, -- hex SHA-256 of the token
+    access_jti UUID NOT NULL, -- access token issued alongside this refresh token
+    access_expires_at TIMESTAMPTZ NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ, -- redeemed for a new pair; presenting it again revokes the session
+    mfa BOOLEAN NOT NULL DEFAULT FALSE, -- the session's login passed a second factor
+    revoked_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE INDEX refresh_tokens_session_idx ON refresh_tokens(session_id);
+CREATE INDEX refresh_tokens_user_idx ON refresh_tokens(user_id);
+
+CREATE TABLE revoked_tokens (
+    jti UUID PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    expires_at TIMESTAMPTZ NOT NULL, -- entry can be dropped once the token has expired
+    revoked_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE INDEX revoked_tokens_expires_idx ON revoked_tokens(expires_at);
+
+--API keys for server-to-server callers; a key acts as the user who owns it
+--(usually a service account) but only with the permissions listed on it
+
+CREATE TABLE api_keys (
+    key_id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    prefix VARCHAR(16) NOT NULL, -- start of the key, kept to tell keys apart
+    key_hash CHAR(64) NOT NULL UNIQUE, -- hex SHA-256 of the key
+    permissions TEXT[] NOT NULL CHECK (cardinality(permissions) > 0),
+    expires_at TIMESTAMPTZ, -- NULL: never expires
+    last_used_at TIMESTAMPTZ, -- updated at most once a minute
+    revoked_at TIMESTAMPTZ,
+    created_by UUID REFERENCES users(user_id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE INDEX api_keys_user_idx ON api_keys(user_id);
+
+--two-factor authentication: single-use recovery codes, and the challenges
+--that bridge the password and code steps of a login; both stored hashed
+
+CREATE TABLE recovery_codes (
+    code_id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    code_hash CHAR(64) NOT NULL, -- hex SHA-256 of the normalized code
+    used_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE INDEX recovery_codes_user_idx ON recovery_codes(user_id);
+
+CREATE TABLE mfa_challenges (
+    challenge_id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    attempts INT NOT NULL DEFAULT 0, -- wrong codes so far
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE INDEX mfa_challenges_expires_idx ON mfa_challenges(expires_at);
+
+--password reset tokens, stored hashed; each works once until expires_at and
+--issuing a new one deletes the user's older ones
+
+CREATE TABLE password_resets (
+    reset_id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    token_hash CHAR(64) NOT NULL UNIQUE, -- hex SHA-256 of the token
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX password_resets_user_idx ON password_resets(user_id, created_at);
+
 -- Create the base table
 CREATE TABLE transactions (
     transaction_id UUID NOT NULL DEFAULT gen_random_uuid(),
@@ -48,12 +188,14 @@ CREATE TABLE transactions (
     buyer_id UUID NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
     seller_id UUID NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
     amount DECIMAL(10, 2) NOT NULL CHECK (amount > 0),
+    currency CHAR(3) NOT NULL DEFAULT 'USD', -- ISO-4217 code
     escrow_status escrow_status NOT NULL,
     transaction_status transaction_status NOT NULL,
     dispute_id UUID,
     payment_id UUID,
     updated_at TIMESTAMPTZ DEFAULT NOW(),
-    PRIMARY KEY (transaction_id, created_at)
+    PRIMARY KEY (transaction_id, created_at),
+    CHECK (buyer_id <> seller_id)
 );
 
 CREATE INDEX transactions_buyer_idx ON transactions(buyer_id);
@@ -91,9 +233,18 @@ CREATE TABLE IF NOT EXISTS payments (
     payment_id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
     transaction_id UUID, -- FK to transactions, altered later on
     amount NUMERIC(15,2) NOT NULL CHECK (amount > 0),
+    currency CHAR(3) NOT NULL DEFAULT 'USD', -- ISO-4217 code, same as the transaction
     method payment_method NOT NULL,
     payment_status payment_status DEFAULT 'pending',
-    encrypted_details BYTEA NOT NULL, -- Secure encrypted payment details
+    gateway_reference TEXT NOT NULL DEFAULT '', -- Charge reference issued by the payment gateway
+    encrypted_details BYTEA NOT NULL, -- Gateway details, envelope-encrypted by internal/crypto
+    attempts INT NOT NULL DEFAULT 1, -- gateway attempts so far, see payments.Policy
+    last_error TEXT, -- why the last attempt failed
+    next_retry_at TIMESTAMPTZ, -- set while a charge the gateway could not take waits for its retry
+    reconciled_at TIMESTAMPTZ, -- last compared with the gateway's own record
+    mismatch TEXT, -- how the gateway's record differed, if it did
+    received_amount NUMERIC(15,2), -- what the buyer actually sent, for gateways that can tell (crypto)
+    confirmations INT NOT NULL DEFAULT 0, -- chain confirmations of a crypto deposit seen so far
     processed_at TIMESTAMPTZ,
     created_at TIMESTAMPTZ DEFAULT NOW()
 ) PARTITION BY HASH (payment_id);
@@ -104,6 +255,53 @@ CREATE TABLE payments_p2 PARTITION OF payments FOR VALUES WITH (MODULUS 2, REMAI
 CREATE INDEX payments_transaction_idx ON payments(transaction_id);
 CREATE INDEX payments_status_idx ON payments(payment_status);
 CREATE INDEX payments_created_method_idx ON payments (created_at, method);
+CREATE INDEX payments_reference_idx ON payments(gateway_reference);
+CREATE INDEX payments_retry_idx ON payments(next_retry_at) WHERE next_retry_at IS NOT NULL;
+CREATE INDEX payments_mismatch_idx ON payments(payment_id) WHERE mismatch IS NOT NULL;
+CREATE INDEX payments_crypto_pending_idx ON payments(reconciled_at) WHERE method = 'crypto' AND payment_status = 'pending';
+
+--payment webhooks: every verified gateway callback is kept, once per provider
+--event id, so redeliveries are recognised; processed_at is set when its effect
+--commits, and failed events can be replayed, see internal/webhooks
+
+CREATE TABLE webhook_events (
+    event_id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    provider VARCHAR(50) NOT NULL,
+    provider_event_id TEXT NOT NULL,
+    event_type VARCHAR(50) NOT NULL,
+    gateway_reference TEXT NOT NULL,
+    amount NUMERIC(15,2) NOT NULL,
+    currency CHAR(3) NOT NULL,
+    reason TEXT NOT NULL DEFAULT '', -- why the gateway failed the operation, if it says
+    payload TEXT NOT NULL, -- the body as received
+    attempts INT NOT NULL DEFAULT 0,
+    last_error TEXT,
+    received_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    processed_at TIMESTAMPTZ,
+    UNIQUE (provider, provider_event_id)
+);
+
+CREATE INDEX webhook_events_reference_idx ON webhook_events(gateway_reference);
+CREATE INDEX webhook_events_unprocessed_idx ON webhook_events(received_at) WHERE processed_at IS NULL;
+
+--payment deltas: what a buyer sent beyond the charge (overpayment), or the
+--whole of a deposit too small to fund the escrow (underpayment), owed back to
+--them; refunded_at is set once an admin sent it back through the gateway
+
+CREATE TABLE payment_deltas (
+    delta_id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    payment_id UUID NOT NULL REFERENCES payments(payment_id),
+    transaction_id UUID NOT NULL REFERENCES transactions(transaction_id),
+    kind VARCHAR(16) NOT NULL CHECK (kind IN ('overpayment', 'underpayment')),
+    amount NUMERIC(15,2) NOT NULL CHECK (amount > 0),
+    currency CHAR(3) NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    refunded_at TIMESTAMPTZ,
+    refunded_by UUID REFERENCES users(user_id)
+);
+
+CREATE INDEX payment_deltas_open_idx ON payment_deltas(created_at) WHERE refunded_at IS NULL;
+CREATE INDEX payment_deltas_payment_idx ON payment_deltas(payment_id);
 
 
 --disputes
@@ -129,16 +327,161 @@ CREATE TABLE escrow_accounts (
     escrow_id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
     transaction_id UUID UNIQUE REFERENCES transactions(transaction_id) ON DELETE CASCADE,
     escrowed_amount DECIMAL(10, 2) NOT NULL CHECK (escrowed_amount > 0),
+    currency CHAR(3) NOT NULL DEFAULT 'USD', -- ISO-4217 code, same as the transaction
     escrow_status escrow_status NOT NULL,
     payment_id UUID UNIQUE REFERENCES payments(payment_id) ON DELETE SET NULL,
     funded_at TIMESTAMPTZ DEFAULT NOW(),
     released_at TIMESTAMPTZ,
     cancelled_at TIMESTAMPTZ,
-    expiry_date TIMESTAMPTZ  -- If the transaction is not confirmed, escrow expires
+    expiry_date TIMESTAMPTZ  -- fulfillment deadline while deposited, end of the buyer's inspection window once fulfilled
 );
 
 CREATE INDEX escrow_transaction_idx ON escrow_accounts(transaction_id);
 CREATE INDEX escrow_status_idx ON escrow_accounts(escrow_status);
+CREATE INDEX escrow_expiry_idx ON escrow_accounts(expiry_date) WHERE escrow_status = 'funded';
+
+
+--milestones: one deposit funds the whole escrow account; each milestone's share
+--is released from it on its own, so what is still held comes from the ledger
+
+CREATE TABLE milestones (
+    milestone_id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    transaction_id UUID NOT NULL REFERENCES transactions(transaction_id) ON DELETE CASCADE,
+    position INT NOT NULL,
+    description TEXT NOT NULL,
+    amount DECIMAL(10, 2) NOT NULL CHECK (amount > 0),
+    currency CHAR(3) NOT NULL DEFAULT 'USD',
+    due_date TIMESTAMPTZ,
+    milestone_status milestone_status NOT NULL DEFAULT 'pending',
+    fulfilled_at TIMESTAMPTZ,
+    settled_at TIMESTAMPTZ, -- released to the seller or refunded to the buyer
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    UNIQUE (transaction_id, position)
+);
+
+CREATE INDEX milestones_status_idx ON milestones(milestone_status);
+CREATE INDEX milestones_fulfilled_idx ON milestones(fulfilled_at) WHERE milestone_status = 'fulfilled';
+
+
+--ledger: escrowed_amount records what was funded; what the escrow still holds
+--is derived from these immutable, balanced journal entries
+
+CREATE TABLE ledger_accounts (
+    account_id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    account_type VARCHAR(32) NOT NULL CHECK (account_type IN ('buyer_funding', 'escrow_holding', 'seller_payable', 'seller_disbursed', 'platform_fees')),
+    owner_id UUID NOT NULL, -- buyer or seller user, transaction for escrow holding, nil uuid for the platform
+    currency CHAR(3) NOT NULL DEFAULT 'USD', -- one account per currency; entries never mix currencies
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    UNIQUE (account_type, owner_id, currency)
+);
+
+CREATE TABLE ledger_entries (
+    entry_id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    transaction_id UUID NOT NULL REFERENCES transactions(transaction_id),
+    entry_type VARCHAR(32) NOT NULL CHECK (entry_type IN ('deposit', 'release', 'refund', 'fee', 'payout')),
+    description TEXT,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE INDEX ledger_entries_transaction_idx ON ledger_entries(transaction_id);
+
+CREATE TABLE ledger_postings (
+    posting_id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    entry_id UUID NOT NULL REFERENCES ledger_entries(entry_id),
+    account_id UUID NOT NULL REFERENCES ledger_accounts(account_id),
+    amount NUMERIC(15,2) NOT NULL CHECK (amount <> 0) -- positive debits, negative credits
+);
+
+CREATE INDEX ledger_postings_entry_idx ON ledger_postings(entry_id);
+CREATE INDEX ledger_postings_account_idx ON ledger_postings(account_id);
+
+CREATE OR REPLACE FUNCTION ledger_reject_change() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'ledger rows are immutable';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER ledger_entries_immutable BEFORE UPDATE OR DELETE ON ledger_entries
+    FOR EACH ROW EXECUTE FUNCTION ledger_reject_change();
+CREATE TRIGGER ledger_postings_immutable BEFORE UPDATE OR DELETE ON ledger_postings
+    FOR EACH ROW EXECUTE FUNCTION ledger_reject_change();
+
+-- checked at commit so all postings of an entry can be inserted first
+CREATE OR REPLACE FUNCTION ledger_check_balance() RETURNS trigger AS $$
+BEGIN
+    IF (SELECT SUM(amount) FROM ledger_postings WHERE entry_id = NEW.entry_id) <> 0 THEN
+        RAISE EXCEPTION 'ledger entry % is not balanced', NEW.entry_id;
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE CONSTRAINT TRIGGER ledger_postings_balanced AFTER INSERT ON ledger_postings
+    DEFERRABLE INITIALLY DEFERRED
+    FOR EACH ROW EXECUTE FUNCTION ledger_check_balance();
+
+
+--payout accounts: where a seller's payouts are sent; the destination is
+--envelope-encrypted by internal/crypto and label is a masked form safe to show.
+--Removed accounts are kept for the batches already sent to them
+
+CREATE TABLE payout_accounts (
+    account_id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    kind VARCHAR(32) NOT NULL CHECK (kind IN ('bank_account', 'crypto_address')),
+    label TEXT NOT NULL,
+    encrypted_details BYTEA NOT NULL,
+    is_default BOOLEAN NOT NULL DEFAULT FALSE, -- payouts go to the default account
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    removed_at TIMESTAMPTZ
+);
+
+CREATE INDEX payout_accounts_user_idx ON payout_accounts(user_id);
+CREATE UNIQUE INDEX payout_accounts_default_idx ON payout_accounts(user_id) WHERE is_default;
+
+--payout batches: one transfer of a seller's due payouts in one currency, see
+--internal/payouts; a batch stays processing until the provider accepted or
+--rejected it, and is sent again under the same batch_id otherwise
+
+CREATE TABLE payout_batches (
+    batch_id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    seller_id UUID NOT NULL REFERENCES users(user_id),
+    account_id UUID NOT NULL REFERENCES payout_accounts(account_id),
+    amount NUMERIC(15,2) NOT NULL CHECK (amount > 0),
+    currency CHAR(3) NOT NULL,
+    batch_status VARCHAR(16) NOT NULL DEFAULT 'processing' CHECK (batch_status IN ('processing', 'paid', 'failed')),
+    provider_reference TEXT NOT NULL DEFAULT '',
+    last_error TEXT,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    attempted_at TIMESTAMPTZ, -- last time the transfer was sent to the provider
+    settled_at TIMESTAMPTZ
+);
+
+CREATE INDEX payout_batches_processing_idx ON payout_batches(created_at) WHERE batch_status = 'processing';
+CREATE INDEX payout_batches_seller_idx ON payout_batches(seller_id);
+
+--payouts: what each release owes the seller, net of the platform fee; failed
+--payouts are batched again on the next run until attempts reaches the cap in
+--internal/payouts, then they are held until the seller picks a new default
+--payout account
+
+CREATE TABLE payouts (
+    payout_id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    transaction_id UUID NOT NULL REFERENCES transactions(transaction_id),
+    seller_id UUID NOT NULL REFERENCES users(user_id),
+    amount NUMERIC(15,2) NOT NULL CHECK (amount > 0),
+    currency CHAR(3) NOT NULL,
+    payout_status VARCHAR(16) NOT NULL DEFAULT 'pending' CHECK (payout_status IN ('pending', 'processing', 'paid', 'failed', 'held')),
+    attempts INT NOT NULL DEFAULT 0, -- batches that rejected the payout
+    batch_id UUID REFERENCES payout_batches(batch_id), -- the batch that last took the payout
+    last_error TEXT,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    paid_at TIMESTAMPTZ
+);
+
+CREATE INDEX payouts_due_idx ON payouts(seller_id, currency) WHERE payout_status IN ('pending', 'failed');
+CREATE INDEX payouts_transaction_idx ON payouts(transaction_id);
+CREATE INDEX payouts_batch_idx ON payouts(batch_id);
 
 
 --foreign keys mapping
@@ -165,13 +508,18 @@ WHERE payment_id IS NOT NULL;
 CREATE OR REPLACE FUNCTION enforce_buyer_seller_roles()
 RETURNS TRIGGER AS $$
 BEGIN
+    -- A user holding both roles still can't trade with themselves
+    IF NEW.buyer_id = NEW.seller_id THEN
+        RAISE EXCEPTION 'Invalid seller_id: Buyer and seller must be different users';
+    END IF;
+
     -- Ensure buyer has 'buyer' role
-    IF NOT EXISTS (SELECT 1 FROM users WHERE user_id = NEW.buyer_id AND (role = 'buyer' or role = 'admin')) THEN
+    IF NOT EXISTS (SELECT 1 FROM users WHERE user_id = NEW.buyer_id AND ('buyer' = ANY(roles) OR 'admin' = ANY(roles))) THEN
         RAISE EXCEPTION 'Invalid buyer_id: User is not a buyer';
     END IF;
 
     -- Ensure seller has 'seller' role
-    IF NOT EXISTS (SELECT 1 FROM users WHERE user_id = NEW.seller_id AND (role = 'seller' or role = 'admin')) THEN
+    IF NOT EXISTS (SELECT 1 FROM users WHERE user_id = NEW.seller_id AND ('seller' = ANY(roles) OR 'admin' = ANY(roles))) THEN
         RAISE EXCEPTION 'Invalid seller_id: User is not a seller';
     END IF;
 
@@ -0,0 +1,183 @@
+package admin
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"escrow-agent/internal/apikeys"
+	"escrow-agent/internal/db"
+	"escrow-agent/internal/logs"
+	"escrow-agent/internal/middleware"
+	"escrow-agent/pkg/models"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+type CreateAPIKeyRequest struct {
+	UserID      uuid.UUID  `json:"user_id"`
+	Name        string     `json:"name"`
+	Permissions []string   `json:"permissions"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+}
+
+// CreateAPIKeyResponse is the only place the key itself is ever returned.
+type CreateAPIKeyResponse struct {
+	APIKey string      `json:"api_key"`
+	Key    apikeys.Key `json:"key"`
+}
+
+// CreateAPIKeyHandler issues an API key acting as the given user, usually a
+// service account created for the integration. The key may only be scoped
+// to permissions the user's roles grant. The creation is written to the
+// user's audit log.
+func CreateAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.ClaimsFromContext(r.Context())
+	if !ok {
+		log.Printf("[ERROR] Unauthorized access attempt - missing or invalid claims")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req CreateAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.UserID == uuid.Nil || req.Name == "" || len(req.Permissions) == 0 {
+		http.Error(w, "User ID, name and at least one permission are required", http.StatusBadRequest)
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		http.Error(w, "Expiry must be in the future", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		log.Printf("[ERROR] Failed to begin transaction: %v", err)
+		http.Error(w, "Failed to create API key", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var owner models.User
+	err = tx.Get(&owner, "SELECT user_id, username, roles, created_at FROM users WHERE user_id = $1", req.UserID)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to fetch user %s: %v", req.UserID, err)
+		http.Error(w, "Failed to create API key", http.StatusInternalServerError)
+		return
+	}
+	for _, p := range req.Permissions {
+		if !middleware.RolesGrant(owner.Roles, middleware.Permission(p)) {
+			http.Error(w, fmt.Sprintf("Permission %q is not granted to %s", p, owner.Username), http.StatusBadRequest)
+			return
+		}
+	}
+
+	key := apikeys.Key{
+		UserID:      req.UserID,
+		Name:        req.Name,
+		Permissions: req.Permissions,
+		ExpiresAt:   req.ExpiresAt,
+		CreatedBy:   &claims.UserID,
+	}
+	secret, err := apikeys.Create(tx, &key)
+	if err == nil {
+		details := fmt.Sprintf("API key %s (%s) created with %s by admin %s", key.Name, key.Prefix, strings.Join(req.Permissions, ", "), claims.Username)
+		err = logs.RecordUserEvent(tx, req.UserID, &claims.UserID, "APIKeyCreated", details)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to create API key for user %s: %v", req.UserID, err)
+		http.Error(w, "Failed to create API key", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(CreateAPIKeyResponse{APIKey: secret, Key: key})
+}
+
+// GetAPIKeysHandler lists API keys, optionally only those of ?user_id=.
+func GetAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	var userID *uuid.UUID
+	if raw := r.URL.Query().Get("user_id"); raw != "" {
+		id, err := uuid.Parse(raw)
+		if err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+		userID = &id
+	}
+
+	keys, err := apikeys.List(db.DB, userID)
+	if err != nil {
+		log.Printf("[ERROR] Failed to fetch API keys: %v", err)
+		http.Error(w, "Failed to fetch API keys", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(keys)
+}
+
+// RevokeAPIKeyHandler disables an API key at once. The revocation is written
+// to the owner's audit log.
+func RevokeAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.ClaimsFromContext(r.Context())
+	if !ok {
+		log.Printf("[ERROR] Unauthorized access attempt - missing or invalid claims")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	keyID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid API key ID", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		log.Printf("[ERROR] Failed to begin transaction: %v", err)
+		http.Error(w, "Failed to revoke API key", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	key, err := apikeys.Revoke(tx, keyID)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "API key not found or already revoked", http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		details := fmt.Sprintf("API key %s (%s) revoked by admin %s", key.Name, key.Prefix, claims.Username)
+		err = logs.RecordUserEvent(tx, key.UserID, &claims.UserID, "APIKeyRevoked", details)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to revoke API key %s: %v", keyID, err)
+		http.Error(w, "Failed to revoke API key", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(key)
+}
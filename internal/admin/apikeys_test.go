@@ -0,0 +1,93 @@
+package admin_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"escrow-agent/internal/admin"
+	"escrow-agent/internal/db"
+	"escrow-agent/internal/middleware"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+)
+
+func newAPIKeyRequest(t *testing.T, body string, claims *middleware.Claims) *http.Request {
+	req, err := http.NewRequest("POST", "/admin/api-keys", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req.WithContext(middleware.WithClaims(req.Context(), claims))
+}
+
+func TestCreateAPIKeyHandler(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+
+	db.DB = sqlx.NewDb(mockDB, "sqlmock")
+
+	adminID, serviceID, keyID := uuid.New(), uuid.New(), uuid.New()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE user_id = \\$1").
+		WithArgs(serviceID).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "username", "roles", "created_at"}).
+			AddRow(serviceID, "marketplace", "{buyer}", time.Now()))
+	mock.ExpectQuery("INSERT INTO api_keys").
+		WithArgs(serviceID, "checkout", sqlmock.AnyArg(), sqlmock.AnyArg(), `{"transaction:create","escrow:deposit"}`, nil, adminID).
+		WillReturnRows(sqlmock.NewRows([]string{"key_id", "created_at"}).AddRow(keyID, time.Now()))
+	mock.ExpectExec("INSERT INTO user_audit_logs").
+		WithArgs(serviceID, adminID, "APIKeyCreated", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	claims := &middleware.Claims{UserID: adminID, Username: "root", Roles: []string{"admin"}}
+	body := `{"user_id":"` + serviceID.String() + `","name":"checkout","permissions":["transaction:create","escrow:deposit"]}`
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(admin.CreateAPIKeyHandler).ServeHTTP(rr, newAPIKeyRequest(t, body, claims))
+
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	var resp admin.CreateAPIKeyResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, strings.HasPrefix(resp.APIKey, resp.Key.Prefix))
+	assert.Equal(t, keyID, resp.Key.KeyID)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestCreateAPIKeyHandler_RejectsPermissionBeyondRoles(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+
+	db.DB = sqlx.NewDb(mockDB, "sqlmock")
+
+	serviceID := uuid.New()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE user_id = \\$1").
+		WithArgs(serviceID).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "username", "roles", "created_at"}).
+			AddRow(serviceID, "marketplace", "{buyer}", time.Now()))
+	mock.ExpectRollback()
+
+	claims := &middleware.Claims{UserID: uuid.New(), Username: "root", Roles: []string{"admin"}}
+	body := `{"user_id":"` + serviceID.String() + `","name":"checkout","permissions":["admin:users:write"]}`
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(admin.CreateAPIKeyHandler).ServeHTTP(rr, newAPIKeyRequest(t, body, claims))
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,107 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"escrow-agent/internal/db"
+	"escrow-agent/internal/logs"
+	"escrow-agent/internal/middleware"
+	"escrow-agent/internal/payments"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// paymentDeltasLimit caps how many deltas one request returns.
+const paymentDeltasLimit = 500
+
+// GetPaymentDeltasHandler lists what buyers over- or underpaid on crypto
+// deposits, newest first. ?open=true leaves out deltas already refunded.
+func GetPaymentDeltasHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	open := query.Get("open") == "true"
+	limit := paymentDeltasLimit
+	if raw := query.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 || n > paymentDeltasLimit {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	deltas, err := payments.Deltas(db.DB, open, limit)
+	if err != nil {
+		log.Printf("[ERROR] Failed to fetch payment deltas: %v", err)
+		http.Error(w, "Failed to fetch payment deltas", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(deltas)
+}
+
+// RefundPaymentDeltaHandler sends a delta back to the buyer through the
+// gateway that took the payment.
+func RefundPaymentDeltaHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.ClaimsFromContext(r.Context())
+	if !ok {
+		log.Printf("[ERROR] Unauthorized access attempt - missing or invalid claims")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	deltaID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid payment delta ID", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		log.Printf("[ERROR] Failed to begin transaction: %v", err)
+		http.Error(w, "Failed to refund payment delta", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	delta, err := payments.RefundDelta(r.Context(), tx, deltaID, claims.UserID)
+	if errors.Is(err, payments.ErrDeltaNotFound) {
+		http.Error(w, "Payment delta not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, payments.ErrDeltaRefunded) {
+		http.Error(w, "Payment delta already refunded", http.StatusConflict)
+		return
+	}
+	if errors.Is(err, payments.ErrInvalidState) {
+		http.Error(w, "The gateway cannot refund this payment", http.StatusConflict)
+		return
+	}
+	if errors.Is(err, payments.ErrUnavailable) {
+		log.Printf("[ERROR] Failed to refund payment delta %s: %v", deltaID, err)
+		http.Error(w, "Failed to reach the payment gateway", http.StatusBadGateway)
+		return
+	}
+	if err == nil {
+		details := fmt.Sprintf("%s of %s on payment %s refunded to the buyer by admin %s", delta.Amount, delta.Kind, delta.PaymentID, claims.Username)
+		err = logs.Record(tx, delta.TransactionID, "PaymentDeltaRefunded", details)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to refund payment delta %s: %v", deltaID, err)
+		http.Error(w, "Failed to refund payment delta", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(delta)
+}
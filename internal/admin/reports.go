@@ -0,0 +1,187 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"escrow-agent/internal/db"
+	"escrow-agent/internal/fx"
+	"escrow-agent/pkg/models"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// CurrencyTotal is the sum of transaction amounts in one currency.
+type CurrencyTotal struct {
+	Currency string       `db:"currency" json:"currency"`
+	Count    int          `db:"count" json:"count"`
+	Total    models.Money `db:"total" json:"total"`
+}
+
+// GetTotalsReportHandler sums transaction amounts per currency, optionally
+// filtered by ?status=. With ?currency= the totals are also normalized into
+// that reporting currency through the configured FX provider.
+func GetTotalsReportHandler(w http.ResponseWriter, r *http.Request) {
+	reportingCurrency := r.URL.Query().Get("currency")
+	if reportingCurrency != "" && !models.ValidCurrency(reportingCurrency) {
+		http.Error(w, "Unsupported currency", http.StatusBadRequest)
+		return
+	}
+
+	query := "SELECT currency, COUNT(*) AS count, SUM(amount) AS total FROM transactions"
+	args := []interface{}{}
+	if status := r.URL.Query().Get("status"); status != "" {
+		query += " WHERE transaction_status = $1"
+		args = append(args, status)
+	}
+	query += " GROUP BY currency ORDER BY currency"
+
+	var totals []CurrencyTotal
+	err := db.DB.Select(&totals, query, args...)
+	for i := 0; err == nil && i < len(totals); i++ {
+		totals[i].Total, err = totals[i].Total.WithCurrency(totals[i].Currency)
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to compute transaction totals: %v", err)
+		http.Error(w, "Failed to compute totals", http.StatusInternalServerError)
+		return
+	}
+
+	report := map[string]interface{}{"totals": totals}
+	if reportingCurrency != "" {
+		provider, ok := fx.CurrentProvider()
+		if !ok {
+			http.Error(w, "No exchange rate provider is configured", http.StatusNotImplemented)
+			return
+		}
+
+		normalized := models.NewMoney(0, reportingCurrency)
+		for _, total := range totals {
+			converted, err := fx.Convert(r.Context(), provider, total.Total, reportingCurrency)
+			if errors.Is(err, fx.ErrNoRate) {
+				http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+				return
+			}
+			if err != nil {
+				log.Printf("[ERROR] Failed to convert %s total to %s: %v", total.Currency, reportingCurrency, err)
+				http.Error(w, "Failed to compute totals", http.StatusInternalServerError)
+				return
+			}
+			normalized = normalized.Add(converted)
+		}
+		report["reporting_currency"] = reportingCurrency
+		report["normalized_total"] = normalized
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// paymentsReportLimit caps the payments listed by GetPaymentsReportHandler.
+const paymentsReportLimit = 500
+
+// PaymentIssue is a payment the payments report flags. Issue is one of
+// mismatch (the gateway's record differs, see payments.Reconcile), failed,
+// retrying (the gateway could not take the charge yet) or stuck (pending,
+// with no retry scheduled, for longer than stuck_after).
+type PaymentIssue struct {
+	models.Payment
+	Issue string `db:"issue" json:"issue"`
+}
+
+// UnbackedEscrow is a funded escrow account whose payment is missing, not
+// completed or of a different amount, i.e. escrow held without the matching
+// funds charged.
+type UnbackedEscrow struct {
+	EscrowID      uuid.UUID     `db:"escrow_id" json:"escrow_id"`
+	TransactionID uuid.UUID     `db:"transaction_id" json:"transaction_id"`
+	Amount        models.Money  `db:"escrowed_amount" json:"escrowed_amount"`
+	Currency      string        `db:"currency" json:"currency"`
+	PaymentID     uuid.NullUUID `db:"payment_id" json:"payment_id"`
+	PaymentStatus *string       `db:"payment_status" json:"payment_status"`
+}
+
+// GetPaymentsReportHandler lists payments that need attention and funded
+// escrow the charged funds do not back. Payments pending for longer than
+// ?stuck_after= (a duration, default 1h) without a retry scheduled count as
+// stuck; failed payments are listed from ?since= (RFC 3339, default a week
+// ago).
+func GetPaymentsReportHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	now := time.Now()
+	stuckAfter := time.Hour
+	if raw := query.Get("stuck_after"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d <= 0 {
+			http.Error(w, "Invalid stuck_after", http.StatusBadRequest)
+			return
+		}
+		stuckAfter = d
+	}
+	since := now.AddDate(0, 0, -7)
+	if raw := query.Get("since"); raw != "" {
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			http.Error(w, "Invalid since", http.StatusBadRequest)
+			return
+		}
+		since = t
+	}
+
+	issues := []PaymentIssue{}
+	err := db.DB.Select(&issues, `
+		SELECT payment_id, transaction_id, amount, currency, method, payment_status, gateway_reference,
+		       attempts, last_error, next_retry_at, reconciled_at, mismatch, processed_at, created_at,
+		       CASE
+		           WHEN mismatch IS NOT NULL THEN 'mismatch'
+		           WHEN payment_status = 'failed' THEN 'failed'
+		           WHEN next_retry_at IS NOT NULL THEN 'retrying'
+		           ELSE 'stuck'
+		       END AS issue
+		FROM payments
+		WHERE mismatch IS NOT NULL
+		   OR (payment_status = 'failed' AND created_at > $1)
+		   OR (payment_status = 'pending' AND (next_retry_at IS NOT NULL OR created_at < $2))
+		ORDER BY created_at DESC
+		LIMIT $3
+	`, since, now.Add(-stuckAfter), paymentsReportLimit)
+	for i := 0; err == nil && i < len(issues); i++ {
+		err = issues[i].AttachCurrency()
+	}
+
+	unbacked := []UnbackedEscrow{}
+	if err == nil {
+		err = db.DB.Select(&unbacked, `
+			SELECT e.escrow_id, e.transaction_id, e.escrowed_amount, e.currency, e.payment_id, p.payment_status
+			FROM escrow_accounts e
+			LEFT JOIN payments p ON p.payment_id = e.payment_id
+			WHERE e.escrow_status = 'funded'
+			  AND (p.payment_id IS NULL OR p.payment_status <> 'completed' OR p.amount <> e.escrowed_amount)
+			ORDER BY e.funded_at
+		`)
+	}
+	for i := 0; err == nil && i < len(unbacked); i++ {
+		unbacked[i].Amount, err = unbacked[i].Amount.WithCurrency(unbacked[i].Currency)
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to compute payments report: %v", err)
+		http.Error(w, "Failed to compute payments report", http.StatusInternalServerError)
+		return
+	}
+
+	counts := map[string]int{"mismatch": 0, "failed": 0, "retrying": 0, "stuck": 0}
+	for _, issue := range issues {
+		counts[issue.Issue]++
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"stuck_after":      stuckAfter.String(),
+		"since":            since,
+		"counts":           counts,
+		"payments":         issues,
+		"unbacked_escrows": unbacked,
+	})
+}
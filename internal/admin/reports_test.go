@@ -0,0 +1,63 @@
+package admin_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"escrow-agent/internal/admin"
+	"escrow-agent/internal/db"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetPaymentsReportHandler(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+
+	db.DB = sqlx.NewDb(mockDB, "sqlmock")
+
+	failedID, retryingID, escrowID, transactionID := uuid.New(), uuid.New(), uuid.New(), uuid.New()
+	columns := []string{"payment_id", "transaction_id", "amount", "currency", "method", "payment_status", "gateway_reference", "attempts", "last_error", "next_retry_at", "reconciled_at", "mismatch", "processed_at", "created_at", "issue"}
+
+	mock.ExpectQuery("SELECT (.+) FROM payments WHERE mismatch IS NOT NULL").
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), 500).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(failedID, uuid.New(), "50.00", "USD", "credit_card", "failed", "mock_1", 1, "capture: payment declined", nil, nil, nil, time.Now(), time.Now(), "failed").
+			AddRow(retryingID, uuid.New(), "20.00", "EUR", "credit_card", "pending", "", 2, "authorize: payment gateway unavailable", time.Now(), nil, nil, time.Now(), time.Now(), "retrying"))
+	mock.ExpectQuery("SELECT (.+) FROM escrow_accounts e LEFT JOIN payments p").
+		WillReturnRows(sqlmock.NewRows([]string{"escrow_id", "transaction_id", "escrowed_amount", "currency", "payment_id", "payment_status"}).
+			AddRow(escrowID, transactionID, "75.00", "USD", nil, nil))
+
+	req := httptest.NewRequest("GET", "/admin/reports/payments?stuck_after=30m", nil)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(admin.GetPaymentsReportHandler).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var report struct {
+		StuckAfter      string                   `json:"stuck_after"`
+		Counts          map[string]int           `json:"counts"`
+		Payments        []map[string]interface{} `json:"payments"`
+		UnbackedEscrows []map[string]interface{} `json:"unbacked_escrows"`
+	}
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &report))
+	assert.Equal(t, "30m0s", report.StuckAfter)
+	assert.Equal(t, map[string]int{"mismatch": 0, "failed": 1, "retrying": 1, "stuck": 0}, report.Counts)
+	assert.Len(t, report.Payments, 2)
+	assert.Equal(t, "retrying", report.Payments[1]["issue"])
+	assert.Len(t, report.UnbackedEscrows, 1)
+	assert.Equal(t, escrowID.String(), report.UnbackedEscrows[0]["escrow_id"])
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(admin.GetPaymentsReportHandler).ServeHTTP(rr, httptest.NewRequest("GET", "/admin/reports/payments?stuck_after=soon", nil))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
@@ -0,0 +1,117 @@
+package admin
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"escrow-agent/internal/db"
+	"escrow-agent/internal/lockout"
+	"escrow-agent/internal/logs"
+	"escrow-agent/internal/middleware"
+	"escrow-agent/pkg/models"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// securityEventsLimit caps how many events one request returns.
+const securityEventsLimit = 500
+
+// UnlockUserHandler clears a user's failed logins and any lockout, so they
+// can sign in again straight away. Locked client addresses are left to
+// expire. The unlock is written to the user's audit log and the security log.
+func UnlockUserHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.ClaimsFromContext(r.Context())
+	if !ok {
+		log.Printf("[ERROR] Unauthorized access attempt - missing or invalid claims")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	userID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		log.Printf("[ERROR] Failed to begin transaction: %v", err)
+		http.Error(w, "Failed to unlock user", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var username string
+	err = tx.Get(&username, "SELECT username FROM users WHERE user_id = $1", userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		err = lockout.Unlock(tx, username)
+	}
+	if err == nil {
+		err = logs.RecordUserEvent(tx, userID, &claims.UserID, "LoginUnlocked", "Login unlocked by admin "+claims.Username)
+	}
+	if err == nil {
+		err = logs.RecordSecurityEvent(tx, &userID, username, middleware.ClientIP(r), "AccountUnlocked", "Unlocked by admin "+claims.Username)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to unlock user %s: %v", userID, err)
+		http.Error(w, "Failed to unlock user", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "User " + username + " unlocked"})
+}
+
+// GetSecurityEventsHandler lists the most recent sign-in events, newest
+// first, optionally only those of ?user_id= or ?ip=.
+func GetSecurityEventsHandler(w http.ResponseWriter, r *http.Request) {
+	var userID *uuid.UUID
+	if raw := r.URL.Query().Get("user_id"); raw != "" {
+		id, err := uuid.Parse(raw)
+		if err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+		userID = &id
+	}
+	limit := securityEventsLimit
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 || n > securityEventsLimit {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	events := []models.SecurityLog{}
+	err := db.DB.Select(&events, `
+		SELECT log_id, user_id, username, ip_address, event_type, event_details, created_at
+		FROM security_logs
+		WHERE ($1::uuid IS NULL OR user_id = $1)
+		  AND ($2 = '' OR ip_address = $2)
+		ORDER BY created_at DESC
+		LIMIT $3
+	`, userID, r.URL.Query().Get("ip"), limit)
+	if err != nil {
+		log.Printf("[ERROR] Failed to fetch security events: %v", err)
+		http.Error(w, "Failed to fetch security events", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(events)
+}
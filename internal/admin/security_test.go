@@ -0,0 +1,54 @@
+package admin_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"escrow-agent/internal/admin"
+	"escrow-agent/internal/db"
+	"escrow-agent/internal/lockout"
+	"escrow-agent/internal/middleware"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnlockUserHandler(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+
+	db.DB = sqlx.NewDb(mockDB, "sqlmock")
+
+	adminID, userID := uuid.New(), uuid.New()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT username FROM users").
+		WithArgs(userID).
+		WillReturnRows(sqlmock.NewRows([]string{"username"}).AddRow("dave"))
+	mock.ExpectExec("DELETE FROM login_throttles").
+		WithArgs(lockout.ScopeUser, "dave").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO user_audit_logs").
+		WithArgs(userID, adminID, "LoginUnlocked", "Login unlocked by admin root").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO security_logs").
+		WithArgs(userID, "dave", "192.0.2.1", "AccountUnlocked", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	req := httptest.NewRequest("POST", "/admin/users/"+userID.String()+"/unlock", nil)
+	req = mux.SetURLVars(req, map[string]string{"id": userID.String()})
+	claims := &middleware.Claims{UserID: adminID, Username: "root", Roles: []string{"admin"}, MFA: true}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(admin.UnlockUserHandler).ServeHTTP(rr, req.WithContext(middleware.WithClaims(req.Context(), claims)))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
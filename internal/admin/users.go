@@ -0,0 +1,184 @@
+package admin
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"escrow-agent/internal/auth"
+	"escrow-agent/internal/db"
+	"escrow-agent/internal/logs"
+	"escrow-agent/internal/middleware"
+	"escrow-agent/internal/sessions"
+	"escrow-agent/pkg/models"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// CreateUserHandler lets an admin open an account with any roles, including
+// admin.
+func CreateUserHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.ClaimsFromContext(r.Context())
+	if !ok {
+		log.Printf("[ERROR] Unauthorized access attempt - missing or invalid claims")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req auth.RegisterRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if err := auth.ValidateInput(req, auth.AllRoles); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		log.Printf("[ERROR] Failed to begin transaction: %v", err)
+		http.Error(w, "Failed to create user", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	userID, createdAt, err := auth.CreateUser(tx, req)
+	if err == nil {
+		details := fmt.Sprintf("Account %s created with roles %s by admin %s", req.Username, strings.Join(req.RoleSet(), ", "), claims.Username)
+		err = logs.RecordUserEvent(tx, userID, &claims.UserID, "UserCreated", details)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		if errors.Is(err, auth.ErrUsernameTaken) {
+			http.Error(w, "Username already exists", http.StatusConflict)
+			return
+		}
+		log.Printf("[ERROR] Failed to create user %s: %v", req.Username, err)
+		http.Error(w, "Failed to create user", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(auth.RegisterResponse{
+		Message:   "User created successfully",
+		UserID:    userID,
+		CreatedAt: createdAt,
+	})
+}
+
+// UpdateRolesRequest replaces the roles a user holds. Role is the older
+// single-role form, still accepted when Roles is empty.
+type UpdateRolesRequest struct {
+	Roles []string `json:"roles"`
+	Role  string   `json:"role,omitempty"`
+}
+
+// UpdateUserRolesHandler replaces a user's roles. The change is audited and
+// the user's sessions are revoked, since their tokens still carry the old
+// roles. Admins cannot change their own roles, so the last admin cannot lock
+// everyone out by accident.
+func UpdateUserRolesHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.ClaimsFromContext(r.Context())
+	if !ok {
+		log.Printf("[ERROR] Unauthorized access attempt - missing or invalid claims")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	userID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	if userID == claims.UserID {
+		http.Error(w, "Admins cannot change their own roles", http.StatusForbidden)
+		return
+	}
+
+	var req UpdateRolesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if len(req.Roles) == 0 && req.Role != "" {
+		req.Roles = []string{req.Role}
+	}
+	roles := auth.NormalizeRoles(req.Roles)
+	if err := auth.ValidateRoles(roles, auth.AllRoles); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		log.Printf("[ERROR] Failed to begin transaction: %v", err)
+		http.Error(w, "Failed to update roles", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var user models.User
+	err = tx.Get(&user, "SELECT user_id, username, roles, created_at FROM users WHERE user_id = $1 FOR UPDATE", userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err == nil && !user.Roles.Equal(roles) {
+		_, err = tx.Exec("UPDATE users SET roles = $1 WHERE user_id = $2", roles, userID)
+		if err == nil {
+			details := fmt.Sprintf("Roles of %s changed from %s to %s by admin %s",
+				user.Username, strings.Join(user.Roles, ", "), strings.Join(roles, ", "), claims.Username)
+			err = logs.RecordUserEvent(tx, userID, &claims.UserID, "RoleChanged", details)
+		}
+		if err == nil {
+			err = sessions.RevokeUser(tx, userID)
+		}
+		user.Roles = roles
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to update roles of user %s: %v", userID, err)
+		http.Error(w, "Failed to update roles", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(user)
+}
+
+// GetUserAuditLogsHandler lists the audited changes to a user's account.
+func GetUserAuditLogsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	entries := []models.UserAuditLog{}
+	err = db.DB.Select(&entries, `
+		SELECT log_id, user_id, actor_id, event_type, event_details, created_at
+		FROM user_audit_logs
+		WHERE user_id = $1
+		ORDER BY created_at
+	`, userID)
+	if err != nil {
+		log.Printf("[ERROR] Failed to fetch audit logs for user %s: %v", userID, err)
+		http.Error(w, "Failed to fetch audit logs", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(entries)
+}
@@ -0,0 +1,96 @@
+package admin_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"escrow-agent/internal/admin"
+	"escrow-agent/internal/db"
+	"escrow-agent/internal/middleware"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+)
+
+func newRoleRequest(t *testing.T, userID uuid.UUID, body string, claims *middleware.Claims) *http.Request {
+	req, err := http.NewRequest("PUT", "/admin/users/"+userID.String()+"/roles", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = mux.SetURLVars(req, map[string]string{"id": userID.String()})
+	return req.WithContext(middleware.WithClaims(req.Context(), claims))
+}
+
+func TestUpdateUserRolesHandler_AuditsAndRevokesSessions(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+
+	db.DB = sqlx.NewDb(mockDB, "sqlmock")
+
+	adminID, userID := uuid.New(), uuid.New()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE user_id = \\$1 FOR UPDATE").
+		WithArgs(userID).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "username", "roles", "created_at"}).
+			AddRow(userID, "dave", "{buyer}", time.Now()))
+	mock.ExpectExec("UPDATE users SET roles").
+		WithArgs(`{"buyer","seller"}`, userID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO user_audit_logs").
+		WithArgs(userID, adminID, "RoleChanged", "Roles of dave changed from buyer to buyer, seller by admin root").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO revoked_tokens (.+) WHERE user_id").
+		WithArgs(userID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE refresh_tokens SET revoked_at").
+		WithArgs(userID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM revoked_tokens").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	claims := &middleware.Claims{UserID: adminID, Username: "root", Roles: []string{"admin"}}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(admin.UpdateUserRolesHandler).ServeHTTP(rr, newRoleRequest(t, userID, `{"roles":["buyer","seller","buyer"]}`, claims))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUpdateUserRolesHandler_Forbidden(t *testing.T) {
+	adminID := uuid.New()
+
+	cases := map[string]struct {
+		claims *middleware.Claims
+		target uuid.UUID
+		code   int
+	}{
+		"non-admin": {&middleware.Claims{UserID: uuid.New(), Roles: []string{"buyer"}}, uuid.New(), http.StatusForbidden},
+		"own role":  {&middleware.Claims{UserID: adminID, Roles: []string{"admin"}, MFA: true}, adminID, http.StatusForbidden},
+		"bad role":  {&middleware.Claims{UserID: adminID, Roles: []string{"admin"}, MFA: true}, uuid.New(), http.StatusBadRequest},
+		"no roles":  {&middleware.Claims{UserID: adminID, Roles: []string{"admin"}, MFA: true}, uuid.New(), http.StatusBadRequest},
+	}
+	for name, c := range cases {
+		body := `{"roles":["admin"]}`
+		switch name {
+		case "bad role":
+			body = `{"role":"root"}`
+		case "no roles":
+			body = `{"roles":[]}`
+		}
+		rr := httptest.NewRecorder()
+		handler := middleware.RequirePermission(middleware.PermAdminUsersWrite)(http.HandlerFunc(admin.UpdateUserRolesHandler))
+		handler.ServeHTTP(rr, newRoleRequest(t, c.target, body, c.claims))
+		assert.Equal(t, c.code, rr.Code, name)
+	}
+}
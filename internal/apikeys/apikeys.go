@@ -0,0 +1,156 @@
+// Package apikeys authenticates server-to-server callers, such as a
+// marketplace backend, that present an X-API-Key header instead of a JWT.
+//
+// A key belongs to a user account, usually a service account an admin
+// created for the integration, and acts as that account. It is further
+// limited to the permissions it was created with, so a caller gets a
+// permission only if both the key and the account's roles grant it. Keys are
+// stored hashed; the key itself is shown once, when it is created.
+package apikeys
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"escrow-agent/internal/tokens"
+	"escrow-agent/pkg/models"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// keyPrefix marks escrow-agent keys so they are easy to spot in config and
+// secret scanners.
+const keyPrefix = "eak_"
+
+// displayLength is how much of a key is kept in clear to tell keys apart.
+const displayLength = len(keyPrefix) + 8
+
+// lastUsedResolution limits how often authenticating a key writes its
+// last_used_at.
+const lastUsedResolution = time.Minute
+
+var ErrInvalidKey = errors.New("invalid API key")
+
+// Key is a stored API key. The key itself is never stored, only its hash.
+type Key struct {
+	KeyID       uuid.UUID      `db:"key_id" json:"key_id"`
+	UserID      uuid.UUID      `db:"user_id" json:"user_id"`
+	Name        string         `db:"name" json:"name"`
+	Prefix      string         `db:"prefix" json:"prefix"`
+	Permissions pq.StringArray `db:"permissions" json:"permissions"`
+	ExpiresAt   *time.Time     `db:"expires_at" json:"expires_at,omitempty"`
+	LastUsedAt  *time.Time     `db:"last_used_at" json:"last_used_at,omitempty"`
+	RevokedAt   *time.Time     `db:"revoked_at" json:"revoked_at,omitempty"`
+	CreatedBy   *uuid.UUID     `db:"created_by" json:"created_by,omitempty"`
+	CreatedAt   time.Time      `db:"created_at" json:"created_at"`
+}
+
+// Create stores k under a freshly generated key and returns that key. k's
+// KeyID, Prefix and CreatedAt are filled in.
+func Create(q sqlx.Queryer, k *Key) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	secret := keyPrefix + base64.RawURLEncoding.EncodeToString(raw)
+	k.Prefix = secret[:displayLength]
+
+	err := q.QueryRowx(`
+		INSERT INTO api_keys (user_id, name, prefix, key_hash, permissions, expires_at, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING key_id, created_at
+	`, k.UserID, k.Name, k.Prefix, hashKey(secret), k.Permissions, k.ExpiresAt, k.CreatedBy).Scan(&k.KeyID, &k.CreatedAt)
+	if err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// Authenticate resolves secret to the claims of the account it acts as, with
+// Scopes set to the key's permissions. Unknown, revoked and expired keys give
+// ErrInvalidKey.
+func Authenticate(db sqlx.Ext, secret string) (*tokens.Claims, error) {
+	if !strings.HasPrefix(secret, keyPrefix) {
+		return nil, ErrInvalidKey
+	}
+
+	var stored struct {
+		KeyID       uuid.UUID      `db:"key_id"`
+		Permissions pq.StringArray `db:"permissions"`
+		UserID      uuid.UUID      `db:"user_id"`
+		Username    string         `db:"username"`
+		Roles       models.Roles   `db:"roles"`
+	}
+	err := sqlx.Get(db, &stored, `
+		SELECT k.key_id, k.permissions, u.user_id, u.username, u.roles
+		FROM api_keys k
+		JOIN users u ON u.user_id = k.user_id
+		WHERE k.key_hash = $1
+		  AND k.revoked_at IS NULL
+		  AND (k.expires_at IS NULL OR k.expires_at > NOW())
+	`, hashKey(secret))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidKey
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(`
+		UPDATE api_keys SET last_used_at = NOW()
+		WHERE key_id = $1 AND (last_used_at IS NULL OR last_used_at < $2)
+	`, stored.KeyID, time.Now().Add(-lastUsedResolution))
+	if err != nil {
+		return nil, err
+	}
+
+	keyID := stored.KeyID
+	return &tokens.Claims{
+		UserID:   stored.UserID,
+		Username: stored.Username,
+		Roles:    stored.Roles,
+		APIKeyID: &keyID,
+		Scopes:   []string(stored.Permissions),
+	}, nil
+}
+
+// List returns the keys owned by userID, or every key when userID is nil.
+func List(q sqlx.Queryer, userID *uuid.UUID) ([]Key, error) {
+	keys := []Key{}
+	err := sqlx.Select(q, &keys, `
+		SELECT key_id, user_id, name, prefix, permissions, expires_at, last_used_at, revoked_at, created_by, created_at
+		FROM api_keys
+		WHERE $1::uuid IS NULL OR user_id = $1
+		ORDER BY created_at DESC
+	`, userID)
+	return keys, err
+}
+
+// Revoke disables the key and returns it. Keys that do not exist or are
+// already revoked give sql.ErrNoRows.
+func Revoke(q sqlx.Queryer, keyID uuid.UUID) (*Key, error) {
+	var k Key
+	err := sqlx.Get(q, &k, `
+		UPDATE api_keys SET revoked_at = NOW()
+		WHERE key_id = $1 AND revoked_at IS NULL
+		RETURNING key_id, user_id, name, prefix, permissions, expires_at, last_used_at, revoked_at, created_by, created_at
+	`, keyID)
+	if err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+// hashKey is what api_keys stores; keys are random, so an unsalted hash is
+// enough.
+func hashKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -1,22 +1,34 @@
 package auth
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"escrow-agent/internal/db"
+	"escrow-agent/internal/lockout"
+	"escrow-agent/internal/logs"
+	"escrow-agent/internal/mfa"
+	"escrow-agent/internal/middleware"
+	"escrow-agent/internal/sessions"
+	"escrow-agent/internal/tokens"
+	"escrow-agent/pkg/models"
 	"log"
+	"math"
 	"net/http"
+	"strconv"
 	"time"
 
-	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/crypto/bcrypt"
 	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
 )
 
 type User struct {
 	ID           uuid.UUID 		`db:"user_id"`
 	Username     string    		`db:"username"`
 	PasswordHash string    		`db:"password_hash"`
-	Role         string    		`db:"role"`
+	Roles        models.Roles	`db:"roles"`
+	TOTPEnabled  bool      		`db:"totp_enabled"`
 	CreatedAt    time.Time 		`db:"created_at"`
 }
 
@@ -25,14 +37,13 @@ type UserCredentials struct {
 	Password string `json:"password"`
 }
 
-type Claims struct {
-	UserID   uuid.UUID    	`json:"user_id"`
-	Username string 		`json:"username"`
-	Role     string 		`json:"role"`
-	jwt.RegisteredClaims
-}
+// errInvalidCredentials is the answer to any wrong username or password, so
+// responses do not reveal which usernames exist.
+const errInvalidCredentials = "Invalid username or password"
 
-var jwtKey = []byte("my_secret_key")
+// dummyHash is compared against when the username is unknown, so a login
+// takes as long whether or not the user exists.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("escrow-agent"), bcrypt.DefaultCost)
 
 func LoginHandler(w http.ResponseWriter, r *http.Request) {
 	var creds UserCredentials
@@ -42,37 +53,133 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var storedCreds User
-	err := db.DB.Get(&storedCreds, "SELECT user_id, username, password_hash, role FROM users WHERE username = $1", creds.Username)
+	service, err := tokens.Current()
+	if err != nil {
+		log.Printf("[ERROR] Cannot issue token: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	ip := middleware.ClientIP(r)
+	now := time.Now()
+
+	tx, err := db.DB.Beginx()
 	if err != nil {
+		log.Printf("[ERROR] Failed to begin transaction: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
 
-		log.Printf("Error fetching user from DB for username %s: %v\n", creds.Username, err)
-		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+	wait, err := lockout.Blocked(tx, creds.Username, ip, now)
+	if err != nil {
+		log.Printf("[ERROR] Failed to check login lockout for %s: %v", ip, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if wait > 0 {
+		tooManyAttempts(w, wait)
 		return
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(storedCreds.PasswordHash), []byte(creds.Password)); err != nil {
-		http.Error(w, "Invalid credentials, password missmatch", http.StatusUnauthorized)
+	var storedCreds User
+	err = tx.Get(&storedCreds, "SELECT user_id, username, password_hash, roles, totp_enabled_at IS NOT NULL AS totp_enabled FROM users WHERE username = $1", creds.Username)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Printf("[ERROR] Failed to fetch user %s: %v", creds.Username, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
+	known := err == nil
+	hash := dummyHash
+	if known {
+		hash = []byte(storedCreds.PasswordHash)
+	}
 
-	claims := Claims{
-		UserID:   storedCreds.ID,
-		Username: storedCreds.Username,
-		Role:     storedCreds.Role,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
-		},
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(creds.Password)); err != nil || !known {
+		var userID *uuid.UUID
+		if known {
+			userID = &storedCreds.ID
+		}
+		if err := recordFailedLogin(tx, userID, creds.Username, ip, now, "LoginFailed", "Invalid username or password"); err != nil {
+			log.Printf("[ERROR] Failed to record failed login for %s: %v", creds.Username, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		http.Error(w, errInvalidCredentials, http.StatusUnauthorized)
+		return
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	// with 2FA enabled the password only earns a challenge, redeemed with a
+	// code at /login/2fa; the failures of the username are only forgotten
+	// once that succeeds
+	if storedCreds.TOTPEnabled {
+		var challenge string
+		err = logs.RecordSecurityEvent(tx, &storedCreds.ID, storedCreds.Username, ip, "PasswordAccepted", "Password accepted, waiting for the second factor")
+		if err == nil {
+			challenge, err = mfa.StartChallenge(tx, storedCreds.ID)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			log.Printf("[ERROR] Failed to start 2FA challenge for user %s: %v", storedCreds.Username, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"mfa_required": true,
+			"mfa_token":    challenge,
+			"expires_in":   int64(mfa.ChallengeTTL.Seconds()),
+		})
+		return
+	}
 
-	tokenString, err := token.SignedString(jwtKey)
+	var pair *sessions.Pair
+	err = lockout.Succeed(tx, storedCreds.Username, now)
+	if err == nil {
+		err = logs.RecordSecurityEvent(tx, &storedCreds.ID, storedCreds.Username, ip, "LoginSucceeded", "Signed in with password")
+	}
+	if err == nil {
+		pair, err = sessions.Start(tx, service, sessions.Subject{
+			UserID:   storedCreds.ID,
+			Username: storedCreds.Username,
+			Roles:    storedCreds.Roles,
+		})
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
 	if err != nil {
+		log.Printf("[ERROR] Failed to start session for user %s: %v", storedCreds.Username, err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"token": tokenString})
+	writeTokens(w, pair)
+}
+
+// recordFailedLogin counts a failed login against the username and address,
+// logs it as event and logs any lockout it caused, then commits tx.
+func recordFailedLogin(tx *sqlx.Tx, userID *uuid.UUID, username, ip string, now time.Time, event, details string) error {
+	outcome, err := lockout.Fail(tx, username, ip, now)
+	if err == nil {
+		err = logs.RecordSecurityEvent(tx, userID, username, ip, event, details)
+	}
+	if err == nil && outcome.UserLocked {
+		err = logs.RecordSecurityEvent(tx, userID, username, ip, "AccountLocked", "Too many failed logins for "+username)
+	}
+	if err == nil && outcome.IPLocked {
+		err = logs.RecordSecurityEvent(tx, userID, username, ip, "AddressLocked", "Too many failed logins from "+ip)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	return err
+}
+
+// tooManyAttempts answers a login attempt that is blocked by lockout.
+func tooManyAttempts(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "Too many failed login attempts, try again later", http.StatusTooManyRequests)
 }
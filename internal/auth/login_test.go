@@ -7,9 +7,13 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"escrow-agent/internal/auth"
 	"escrow-agent/internal/db"
+	"escrow-agent/internal/lockout"
+	"escrow-agent/internal/tokens"
+	"escrow-agent/pkg/models"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/jmoiron/sqlx"
@@ -18,7 +22,44 @@ import (
 	"github.com/google/uuid"
 )
 
+func setupTokens(t *testing.T) *tokens.Service {
+	key, err := tokens.NewEphemeralKey("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	service, err := tokens.NewService(tokens.Config{Keys: []tokens.Key{key}, Issuer: "escrow-agent", Audience: "escrow-agent-api", TTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens.SetService(service)
+	return service
+}
+
+// expectNotBlocked expects the transaction and lockout check every login
+// starts with.
+func expectNotBlocked(mock sqlmock.Sqlmock, username string) {
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT blocked_until FROM login_throttles").
+		WithArgs(lockout.ScopeUser, username, lockout.ScopeIP, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"blocked_until"}))
+}
+
+// expectFailure expects a failed login to be counted and logged.
+func expectFailure(mock sqlmock.Sqlmock, username string, userID interface{}) {
+	mock.ExpectQuery("INSERT INTO login_throttles").
+		WithArgs(lockout.ScopeUser, username, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(1))
+	mock.ExpectQuery("INSERT INTO login_throttles").
+		WithArgs(lockout.ScopeIP, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(1))
+	mock.ExpectExec("INSERT INTO security_logs").
+		WithArgs(userID, username, sqlmock.AnyArg(), "LoginFailed", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+}
+
 func TestLoginHandler_Success(t *testing.T) {
+	service := setupTokens(t)
 
 	mockDB, mock, err := sqlmock.New()
 	if err != nil {
@@ -32,10 +73,23 @@ func TestLoginHandler_Success(t *testing.T) {
 	mockUUID := uuid.New()
 
 	passwordHash, _ := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.DefaultCost)
-	mock.ExpectQuery("SELECT user_id, username, password_hash, role FROM users").
+	expectNotBlocked(mock, "testuser")
+	mock.ExpectQuery("SELECT user_id, username, password_hash, roles, (.+) FROM users").
 		WithArgs("testuser").
-		WillReturnRows(sqlmock.NewRows([]string{"user_id", "username", "password_hash", "role"}).
-			AddRow(mockUUID, "testuser", passwordHash, "buyer"))
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "username", "password_hash", "roles", "totp_enabled"}).
+			AddRow(mockUUID, "testuser", passwordHash, "{buyer,seller}", false))
+	mock.ExpectExec("DELETE FROM login_throttles WHERE scope").
+		WithArgs(lockout.ScopeUser, "testuser").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM login_throttles WHERE last_failure_at").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO security_logs").
+		WithArgs(mockUUID, "testuser", sqlmock.AnyArg(), "LoginSucceeded", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO refresh_tokens").
+		WithArgs(sqlmock.AnyArg(), mockUUID, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), false).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
 
 	loginReq := auth.UserCredentials{
 		Username: "testuser",
@@ -55,13 +109,73 @@ func TestLoginHandler_Success(t *testing.T) {
 
 	assert.Equal(t, http.StatusOK, rr.Code)
 
-	var response map[string]string
+	var response struct {
+		Token        string `json:"token"`
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int64  `json:"expires_in"`
+	}
 	err = json.NewDecoder(rr.Body).Decode(&response)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	assert.NotEmpty(t, response["token"])
+	assert.NotEmpty(t, response.Token)
+	assert.Equal(t, response.Token, response.AccessToken)
+	assert.NotEmpty(t, response.RefreshToken)
+	assert.Equal(t, int64(3600), response.ExpiresIn)
+
+	claims, err := service.Parse(response.AccessToken)
+	assert.NoError(t, err)
+	assert.Equal(t, mockUUID, claims.UserID)
+	assert.Equal(t, models.Roles{"buyer", "seller"}, claims.Roles)
+	assert.NotEmpty(t, claims.ID)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestLoginHandler_RequiresSecondFactor(t *testing.T) {
+	setupTokens(t)
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+
+	db.DB = sqlx.NewDb(mockDB, "sqlmock")
+
+	mockUUID := uuid.New()
+	passwordHash, _ := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.DefaultCost)
+	expectNotBlocked(mock, "testuser")
+	mock.ExpectQuery("SELECT user_id, username, password_hash, roles, (.+) FROM users").
+		WithArgs("testuser").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "username", "password_hash", "roles", "totp_enabled"}).
+			AddRow(mockUUID, "testuser", passwordHash, "{admin}", true))
+	// the username's failures are kept until the second factor passes
+	mock.ExpectExec("INSERT INTO security_logs").
+		WithArgs(mockUUID, "testuser", sqlmock.AnyArg(), "PasswordAccepted", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO mfa_challenges").
+		WithArgs(mockUUID, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	payload, _ := json.Marshal(auth.UserCredentials{Username: "testuser", Password: "password123"})
+	req, err := http.NewRequest("POST", "/login", bytes.NewBuffer(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(auth.LoginHandler).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var response map[string]interface{}
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, true, response["mfa_required"])
+	assert.NotEmpty(t, response["mfa_token"])
+	assert.NotContains(t, response, "access_token")
+	assert.NoError(t, mock.ExpectationsWereMet())
 }
 
 func TestLoginHandler_InvalidPassword(t *testing.T) {
@@ -78,10 +192,12 @@ func TestLoginHandler_InvalidPassword(t *testing.T) {
 	mockUUID := uuid.New()
 
 	passwordHash, _ := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.DefaultCost)
-	mock.ExpectQuery("SELECT user_id, username, password_hash, role FROM users").
+	expectNotBlocked(mock, "testuser")
+	mock.ExpectQuery("SELECT user_id, username, password_hash, roles, (.+) FROM users").
 		WithArgs("testuser").
-		WillReturnRows(sqlmock.NewRows([]string{"user_id", "username", "password_hash", "role"}).
-			AddRow(mockUUID, "testuser", passwordHash, "buyer"))
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "username", "password_hash", "roles", "totp_enabled"}).
+			AddRow(mockUUID, "testuser", passwordHash, "{buyer}", false))
+	expectFailure(mock, "testuser", mockUUID)
 
 	loginReq := auth.UserCredentials{
 		Username: "testuser",
@@ -100,6 +216,8 @@ func TestLoginHandler_InvalidPassword(t *testing.T) {
 	handler.ServeHTTP(rr, req)
 
 	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Equal(t, "Invalid username or password\n", rr.Body.String())
+	assert.NoError(t, mock.ExpectationsWereMet())
 }
 
 func TestLoginHandler_InvalidUsername(t *testing.T) {
@@ -113,9 +231,11 @@ func TestLoginHandler_InvalidUsername(t *testing.T) {
 	sqlxDB := sqlx.NewDb(mockDB, "sqlmock")
 	db.DB = sqlxDB
 
-	mock.ExpectQuery("SELECT user_id, username, password_hash, role FROM users").
+	expectNotBlocked(mock, "testuser")
+	mock.ExpectQuery("SELECT user_id, username, password_hash, roles, (.+) FROM users").
 		WithArgs("testuser").
 		WillReturnError(sql.ErrNoRows)
+	expectFailure(mock, "testuser", nil)
 
 	loginReq := auth.UserCredentials{
 		Username: "testuser",
@@ -134,4 +254,33 @@ func TestLoginHandler_InvalidUsername(t *testing.T) {
 	handler.ServeHTTP(rr, req)
 
 	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Equal(t, "Invalid username or password\n", rr.Body.String())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestLoginHandler_Blocked(t *testing.T) {
+	setupTokens(t)
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+
+	db.DB = sqlx.NewDb(mockDB, "sqlmock")
+
+	// the password is never checked while blocked, so the right one fails too
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT blocked_until FROM login_throttles").
+		WithArgs(lockout.ScopeUser, "testuser", lockout.ScopeIP, "192.0.2.1", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"blocked_until"}).AddRow(time.Now().Add(90 * time.Second)))
+	mock.ExpectRollback()
+
+	payload, _ := json.Marshal(auth.UserCredentials{Username: "testuser", Password: "password123"})
+	req := httptest.NewRequest("POST", "/login", bytes.NewBuffer(payload))
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(auth.LoginHandler).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "90", rr.Header().Get("Retry-After"))
+	assert.NoError(t, mock.ExpectationsWereMet())
 }
@@ -0,0 +1,51 @@
+package auth
+
+import (
+	_ "embed"
+	"errors"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	MinPasswordLength = 8
+	// MaxPasswordLength is in bytes: bcrypt only reads the first 72, so a
+	// longer password would be stored as a shorter one.
+	MaxPasswordLength = 72
+)
+
+var (
+	ErrPasswordTooShort = errors.New("password must be at least 8 characters")
+	ErrPasswordTooLong  = errors.New("password must be at most 72 bytes")
+	ErrPasswordBreached = errors.New("password is too common, choose another")
+)
+
+//go:embed breached_passwords.txt
+var breachedPasswordList string
+
+// breachedPasswords holds the entries of breached_passwords.txt, lowercased.
+var breachedPasswords = func() map[string]struct{} {
+	set := map[string]struct{}{}
+	for _, line := range strings.Split(breachedPasswordList, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			set[strings.ToLower(line)] = struct{}{}
+		}
+	}
+	return set
+}()
+
+// ValidatePassword applies the password policy to a new password, wherever
+// it is set: registration, profile changes and password resets.
+func ValidatePassword(password string) error {
+	if utf8.RuneCountInString(password) < MinPasswordLength {
+		return ErrPasswordTooShort
+	}
+	if len(password) > MaxPasswordLength {
+		return ErrPasswordTooLong
+	}
+	if _, ok := breachedPasswords[strings.ToLower(password)]; ok {
+		return ErrPasswordBreached
+	}
+	return nil
+}
@@ -2,47 +2,125 @@ package auth
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 
 	"escrow-agent/internal/db"
+	"escrow-agent/pkg/models"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
 
+	"github.com/google/uuid"
 	"github.com/jackc/pgconn"
 	"github.com/jackc/pgerrcode"
+	"github.com/jmoiron/sqlx"
 )
 
+var ErrUsernameTaken = errors.New("username already exists")
+
+// SelfServiceRoles are the roles anyone may pick at registration. Admins are
+// created by another admin or with cmd/create-admin.
+var SelfServiceRoles = []string{models.RoleBuyer, models.RoleSeller}
+
+// AllRoles are the roles an admin may assign.
+var AllRoles = []string{models.RoleBuyer, models.RoleSeller, models.RoleAdmin}
+
+// RegisterRequest names the roles the account holds. Role is the older
+// single-role form, still accepted when Roles is empty.
 type RegisterRequest struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
-	Role     string `json:"role"`
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	Roles    []string `json:"roles"`
+	Role     string   `json:"role,omitempty"`
+}
+
+// RoleSet returns the requested roles without duplicates.
+func (req RegisterRequest) RoleSet() models.Roles {
+	requested := req.Roles
+	if len(requested) == 0 && req.Role != "" {
+		requested = []string{req.Role}
+	}
+	return NormalizeRoles(requested)
+}
+
+// NormalizeRoles drops duplicates, keeping the first occurrence of each role.
+func NormalizeRoles(roles []string) models.Roles {
+	set := models.Roles{}
+	for _, role := range roles {
+		if !set.Has(role) {
+			set = append(set, role)
+		}
+	}
+	return set
 }
 
 type RegisterResponse struct {
 	Message   string    `json:"message"`
+	UserID    uuid.UUID `json:"user_id"`
 	CreatedAt time.Time `json:"created_at"`
 }
 
-func validateInput(req RegisterRequest) error {
+// ValidateInput checks a new account against the roles the caller may assign.
+func ValidateInput(req RegisterRequest, roles []string) error {
 
-	if req.Username == "" || req.Password == "" || req.Role == "" {
+	if req.Username == "" || req.Password == "" || len(req.RoleSet()) == 0 {
 		return fmt.Errorf("all required parameters not passed")
 	}
 
-	if len(req.Password) < 8 {
-		return fmt.Errorf("password must be at least 8 characters")
+	if err := ValidatePassword(req.Password); err != nil {
+		return err
 	}
 
-	if req.Role != "buyer" && req.Role != "seller" && req.Role != "admin" {
-		return fmt.Errorf("invalid role")
-	}
+	return ValidateRoles(req.RoleSet(), roles)
+}
 
+// ValidateRoles checks that set is non-empty and drawn from allowed.
+func ValidateRoles(set models.Roles, allowed []string) error {
+	if len(set) == 0 {
+		return fmt.Errorf("at least one role is required")
+	}
+	for _, role := range set {
+		if !ValidRole(role, allowed) {
+			return fmt.Errorf("invalid role")
+		}
+	}
 	return nil
 }
 
+func ValidRole(role string, roles []string) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateUser hashes the password and inserts the account. Callers validate
+// the request first.
+func CreateUser(q sqlx.Queryer, req RegisterRequest) (uuid.UUID, time.Time, error) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return uuid.Nil, time.Time{}, err
+	}
+
+	var userID uuid.UUID
+	var createdAt time.Time
+	err = q.QueryRowx(
+		"INSERT INTO users (username, password_hash, roles, created_at) VALUES ($1, $2, $3, CURRENT_TIMESTAMP) RETURNING user_id, created_at",
+		req.Username, hashedPassword, req.RoleSet(),
+	).Scan(&userID, &createdAt)
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+		return uuid.Nil, time.Time{}, ErrUsernameTaken
+	}
+	return userID, createdAt, err
+}
+
 func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 
 	log.Println("RegisterHandler called")
@@ -53,30 +131,24 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := validateInput(req); err != nil {
+	if err := ValidateInput(req, SelfServiceRoles); err != nil {
+		if req.RoleSet().Has(models.RoleAdmin) {
+			http.Error(w, "Admin accounts cannot be self-registered", http.StatusForbidden)
+			return
+		}
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
-	if err != nil {
-		http.Error(w, "Failed to hash password", http.StatusInternalServerError)
-		return
-	}
-
 	log.Printf("Registering user: %v", req.Username)
 
-	var createdAt time.Time
-	err = db.DB.QueryRow(
-		"INSERT INTO users (username, password_hash, role, created_at) VALUES ($1, $2, $3, CURRENT_TIMESTAMP) RETURNING created_at",
-		req.Username, hashedPassword, req.Role,
-	).Scan(&createdAt)
-
+	userID, createdAt, err := CreateUser(db.DB, req)
 	if err != nil {
-		if pgErr, ok := err.(*pgconn.PgError); ok && pgErr.Code == pgerrcode.UniqueViolation {
+		if errors.Is(err, ErrUsernameTaken) {
 			http.Error(w, "Username already exists", http.StatusConflict)
 			return
 		}
+		log.Printf("[ERROR] Failed to create user %s: %v", req.Username, err)
 		http.Error(w, "Failed to create user", http.StatusInternalServerError)
 		return
 	}
@@ -84,6 +156,7 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(RegisterResponse{
 		Message:   "User registered successfully",
+		UserID:    userID,
 		CreatedAt: createdAt,
 	})
 }
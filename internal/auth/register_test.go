@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -12,6 +13,7 @@ import (
 	"escrow-agent/internal/db"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
 	"github.com/stretchr/testify/assert"
 )
@@ -29,13 +31,13 @@ func TestRegisterHandler_Success(t *testing.T) {
 
 	createdAt := time.Now()
 	mock.ExpectQuery("INSERT INTO users").
-		WithArgs("testuser", sqlmock.AnyArg(), "buyer").
-		WillReturnRows(sqlmock.NewRows([]string{"created_at"}).AddRow(createdAt))
+		WithArgs("testuser", sqlmock.AnyArg(), `{"buyer","seller"}`).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "created_at"}).AddRow(uuid.New(), createdAt))
 
 	registerReq := auth.RegisterRequest{
 		Username: "testuser",
-		Password: "password123",
-		Role:     "buyer",
+		Password: "correct-horse-battery",
+		Roles:    []string{"buyer", "seller"},
 	}
 	payload, _ := json.Marshal(registerReq)
 
@@ -65,7 +67,7 @@ func TestRegisterHandler_InvalidInput(t *testing.T) {
 	invalidReq := auth.RegisterRequest{
 		Username: "",
 		Password: "short",
-		Role:     "invalidrole",
+		Roles:    []string{"invalidrole"},
 	}
 	payload, _ := json.Marshal(invalidReq)
 
@@ -81,3 +83,28 @@ func TestRegisterHandler_InvalidInput(t *testing.T) {
 
 	assert.Equal(t, http.StatusBadRequest, rr.Code)
 }
+
+func TestRegisterHandler_RejectsAdminRole(t *testing.T) {
+	payload, _ := json.Marshal(auth.RegisterRequest{
+		Username: "mallory",
+		Password: "password123",
+		Roles:    []string{"admin"},
+	})
+
+	req, err := http.NewRequest("POST", "/register", bytes.NewBuffer(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(auth.RegisterHandler).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+}
+
+func TestValidatePassword(t *testing.T) {
+	assert.NoError(t, auth.ValidatePassword("correct-horse-battery"))
+	assert.ErrorIs(t, auth.ValidatePassword("short"), auth.ErrPasswordTooShort)
+	assert.ErrorIs(t, auth.ValidatePassword("Password123"), auth.ErrPasswordBreached)
+	assert.ErrorIs(t, auth.ValidatePassword(strings.Repeat("é", 40)), auth.ErrPasswordTooLong)
+}
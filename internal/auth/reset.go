@@ -0,0 +1,199 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"escrow-agent/internal/db"
+	"escrow-agent/internal/lockout"
+	"escrow-agent/internal/logs"
+	"escrow-agent/internal/middleware"
+	"escrow-agent/internal/notify"
+	"escrow-agent/internal/recovery"
+	"escrow-agent/internal/sessions"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// resetRequestedMessage is the answer to every password reset request, so
+// responses do not reveal which usernames exist.
+const resetRequestedMessage = "If the account exists, a password reset link has been sent"
+
+// resetSendTimeout bounds how long delivering a reset link may take once the
+// request was answered.
+const resetSendTimeout = 30 * time.Second
+
+type ForgotPasswordRequest struct {
+	Username string `json:"username"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// ForgotPasswordHandler sends a password reset token to the user through the
+// configured notifier. It answers the same whether or not the user exists,
+// and a user is sent at most one token per cooldown. The token is delivered
+// in the background, so the time the notifier takes does not tell known
+// usernames from unknown ones.
+func ForgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var req ForgotPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Username == "" {
+		http.Error(w, "username is required", http.StatusBadRequest)
+		return
+	}
+
+	notifier, err := notify.Current()
+	if err != nil {
+		log.Printf("[ERROR] Cannot send password reset: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	ip := middleware.ClientIP(r)
+	now := time.Now()
+
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		log.Printf("[ERROR] Failed to begin transaction: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var user struct {
+		ID       uuid.UUID `db:"user_id"`
+		Username string    `db:"username"`
+	}
+	err = tx.Get(&user, "SELECT user_id, username FROM users WHERE username = $1", req.Username)
+	if errors.Is(err, sql.ErrNoRows) {
+		// unknown usernames are logged like any other request
+		err = logs.RecordSecurityEvent(tx, nil, req.Username, ip, "PasswordResetRequested", "No such user")
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			log.Printf("[ERROR] Failed to record password reset request for %s: %v", req.Username, err)
+		}
+		resetRequested(w)
+		return
+	}
+
+	var token string
+	if err == nil {
+		token, err = recovery.Issue(tx, user.ID, now)
+	}
+	if errors.Is(err, recovery.ErrTooSoon) {
+		resetRequested(w)
+		return
+	}
+	if err == nil {
+		err = logs.RecordSecurityEvent(tx, &user.ID, user.Username, ip, "PasswordResetRequested", "Reset token sent")
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to issue password reset for %s: %v", req.Username, err)
+		resetRequested(w)
+		return
+	}
+
+	go sendReset(notifier, notify.Message{
+		UserID:   user.ID,
+		Username: user.Username,
+		Subject:  "Reset your password",
+		Body: fmt.Sprintf("Someone asked to reset the password of %s. To choose a new one, use %s within %s. If it was not you, ignore this message.",
+			user.Username, recovery.Link(token), recovery.CurrentConfig().TTL),
+		SentAt: now,
+	})
+	resetRequested(w)
+}
+
+// sendReset delivers a reset link after the request was answered. A link
+// that never went out leaves its token unused; the user asks again once the
+// cooldown passed.
+func sendReset(notifier notify.Notifier, m notify.Message) {
+	ctx, cancel := context.WithTimeout(context.Background(), resetSendTimeout)
+	defer cancel()
+	if err := notifier.Send(ctx, m); err != nil {
+		log.Printf("[ERROR] Failed to send password reset to %s: %v", m.Username, err)
+	}
+}
+
+// ResetPasswordHandler sets a new password with a reset token. It signs out
+// every session of the user and clears any login lockout; two-factor
+// authentication, if enabled, still applies at the next login.
+func ResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var req ResetPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" || req.Password == "" {
+		http.Error(w, "token and password are required", http.StatusBadRequest)
+		return
+	}
+	if err := ValidatePassword(req.Password); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		log.Printf("[ERROR] Failed to hash password: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		log.Printf("[ERROR] Failed to begin transaction: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	userID, err := recovery.Redeem(tx, req.Token, time.Now())
+	if errors.Is(err, recovery.ErrInvalidToken) {
+		http.Error(w, "Invalid or expired reset token", http.StatusBadRequest)
+		return
+	}
+
+	var username string
+	if err == nil {
+		err = tx.Get(&username, "UPDATE users SET password_hash = $1 WHERE user_id = $2 RETURNING username", hashedPassword, userID)
+	}
+	if err == nil {
+		err = sessions.RevokeUser(tx, userID)
+	}
+	if err == nil {
+		err = lockout.Unlock(tx, username)
+	}
+	if err == nil {
+		err = logs.RecordUserEvent(tx, userID, &userID, "PasswordReset", "Password of "+username+" reset with a reset token")
+	}
+	if err == nil {
+		err = logs.RecordSecurityEvent(tx, &userID, username, middleware.ClientIP(r), "PasswordReset", "Password reset with a reset token")
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to reset password: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Password has been reset; all sessions have been signed out"})
+}
+
+func resetRequested(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"message": resetRequestedMessage})
+}
@@ -0,0 +1,186 @@
+package auth_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"escrow-agent/internal/auth"
+	"escrow-agent/internal/db"
+	"escrow-agent/internal/lockout"
+	"escrow-agent/internal/notify"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+)
+
+func newForgotRequest(t *testing.T, username string) *http.Request {
+	payload, _ := json.Marshal(auth.ForgotPasswordRequest{Username: username})
+	req, err := http.NewRequest("POST", "/password/forgot", bytes.NewBuffer(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestForgotPasswordHandler_SendsToken(t *testing.T) {
+	outbox := notify.NewOutbox()
+	notify.SetNotifier(outbox)
+
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+
+	db.DB = sqlx.NewDb(mockDB, "sqlmock")
+
+	userID := uuid.New()
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT user_id, username FROM users").
+		WithArgs("dave").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "username"}).AddRow(userID, "dave"))
+	mock.ExpectQuery("SELECT EXISTS(.+) FROM password_resets").
+		WithArgs(userID, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectExec("DELETE FROM password_resets").
+		WithArgs(userID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO password_resets").
+		WithArgs(userID, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO security_logs").
+		WithArgs(userID, "dave", sqlmock.AnyArg(), "PasswordResetRequested", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(auth.ForgotPasswordHandler).ServeHTTP(rr, newForgotRequest(t, "dave"))
+
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+	// the link is delivered after the request was answered
+	assert.Eventually(t, func() bool { return len(outbox.Messages()) == 1 }, time.Second, 10*time.Millisecond)
+	messages := outbox.Messages()
+	if assert.Len(t, messages, 1) {
+		assert.Equal(t, userID, messages[0].UserID)
+		assert.Contains(t, messages[0].Body, "dave")
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestForgotPasswordHandler_UnknownUserLooksTheSame(t *testing.T) {
+	outbox := notify.NewOutbox()
+	notify.SetNotifier(outbox)
+
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+
+	db.DB = sqlx.NewDb(mockDB, "sqlmock")
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT user_id, username FROM users").
+		WithArgs("nobody").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "username"}))
+	mock.ExpectExec("INSERT INTO security_logs").
+		WithArgs(nil, "nobody", sqlmock.AnyArg(), "PasswordResetRequested", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(auth.ForgotPasswordHandler).ServeHTTP(rr, newForgotRequest(t, "nobody"))
+
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+	assert.Contains(t, rr.Body.String(), "If the account exists")
+	assert.Empty(t, outbox.Messages())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestResetPasswordHandler_RevokesSessions(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+
+	db.DB = sqlx.NewDb(mockDB, "sqlmock")
+
+	userID, resetID := uuid.New(), uuid.New()
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM password_resets").
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"reset_id", "user_id", "expires_at", "used_at"}).
+			AddRow(resetID, userID, time.Now().Add(time.Minute), nil))
+	mock.ExpectExec("UPDATE password_resets SET used_at").
+		WithArgs(sqlmock.AnyArg(), resetID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("UPDATE users SET password_hash").
+		WithArgs(sqlmock.AnyArg(), userID).
+		WillReturnRows(sqlmock.NewRows([]string{"username"}).AddRow("dave"))
+	mock.ExpectExec("INSERT INTO revoked_tokens (.+) WHERE user_id").
+		WithArgs(userID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE refresh_tokens SET revoked_at").
+		WithArgs(userID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM revoked_tokens").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM login_throttles").
+		WithArgs(lockout.ScopeUser, "dave").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO user_audit_logs").
+		WithArgs(userID, userID, "PasswordReset", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO security_logs").
+		WithArgs(userID, "dave", sqlmock.AnyArg(), "PasswordReset", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	body := `{"token":"reset-token","password":"correct-horse-battery"}`
+	req := httptest.NewRequest("POST", "/password/reset", strings.NewReader(body))
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(auth.ResetPasswordHandler).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestResetPasswordHandler_Rejected(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+
+	db.DB = sqlx.NewDb(mockDB, "sqlmock")
+
+	// a used token
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM password_resets").
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"reset_id", "user_id", "expires_at", "used_at"}).
+			AddRow(uuid.New(), uuid.New(), time.Now().Add(time.Minute), time.Now()))
+	mock.ExpectRollback()
+
+	cases := map[string]string{
+		"used token":      `{"token":"reset-token","password":"correct-horse-battery"}`,
+		"breached":        `{"token":"reset-token","password":"password123"}`,
+		"missing token":   `{"password":"correct-horse-battery"}`,
+		"beyond 72 bytes": `{"token":"reset-token","password":"` + strings.Repeat("x", 73) + `"}`,
+	}
+	for name, body := range cases {
+		req := httptest.NewRequest("POST", "/password/reset", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(auth.ResetPasswordHandler).ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, name)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"escrow-agent/internal/db"
+	"escrow-agent/internal/middleware"
+	"escrow-agent/internal/sessions"
+	"escrow-agent/internal/tokens"
+	"log"
+	"net/http"
+)
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// RefreshHandler trades a refresh token for a new access/refresh pair. Each
+// refresh token works once; replaying one revokes the whole session.
+func RefreshHandler(w http.ResponseWriter, r *http.Request) {
+	var req RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	service, err := tokens.Current()
+	if err != nil {
+		log.Printf("[ERROR] Cannot issue token: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		log.Printf("[ERROR] Failed to begin transaction: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	pair, err := sessions.Rotate(tx, service, req.RefreshToken)
+	if errors.Is(err, sessions.ErrRefreshTokenReused) {
+		log.Printf("[WARN] Refresh token reuse detected, session revoked")
+		if err := tx.Commit(); err != nil {
+			log.Printf("[ERROR] Failed to revoke session: %v", err)
+		}
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	if errors.Is(err, sessions.ErrInvalidRefreshToken) {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to refresh session: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	writeTokens(w, pair)
+}
+
+// LogoutHandler ends the session the caller's access token belongs to,
+// revoking that token and the session's refresh token.
+func LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.ClaimsFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if claims.APIKeyID != nil {
+		http.Error(w, "API keys have no session to log out of; revoke the key instead", http.StatusBadRequest)
+		return
+	}
+
+	if err := sessions.RevokeSession(db.DB, claims.SessionID); err != nil {
+		log.Printf("[ERROR] Failed to revoke session %s: %v", claims.SessionID, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Logged out"})
+}
+
+// writeTokens sends a token pair. token repeats access_token for clients
+// written against the single-token login response.
+func writeTokens(w http.ResponseWriter, pair *sessions.Pair) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":         pair.AccessToken,
+		"access_token":  pair.AccessToken,
+		"refresh_token": pair.RefreshToken,
+		"token_type":    "Bearer",
+		"expires_in":    int64(pair.ExpiresIn.Seconds()),
+	})
+}
@@ -0,0 +1,140 @@
+package auth_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"escrow-agent/internal/auth"
+	"escrow-agent/internal/db"
+	"escrow-agent/internal/middleware"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+)
+
+func refreshTokenRow(userID uuid.UUID, expiresAt time.Time, usedAt interface{}) *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"token_id", "session_id", "expires_at", "used_at", "revoked_at", "user_id", "username", "roles", "mfa"}).
+		AddRow(uuid.New(), uuid.New(), expiresAt, usedAt, nil, userID, "testuser", "{buyer}", false)
+}
+
+func TestRefreshHandler_RotatesToken(t *testing.T) {
+	setupTokens(t)
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+
+	db.DB = sqlx.NewDb(mockDB, "sqlmock")
+
+	userID := uuid.New()
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM refresh_tokens (.+) FOR UPDATE").
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnRows(refreshTokenRow(userID, time.Now().Add(time.Hour), nil))
+	mock.ExpectExec("UPDATE refresh_tokens SET used_at").
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO refresh_tokens").
+		WithArgs(sqlmock.AnyArg(), userID, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), false).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	req, _ := http.NewRequest("POST", "/refresh", bytes.NewBufferString(`{"refresh_token":"opaque"}`))
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(auth.RefreshHandler).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), "refresh_token")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRefreshHandler_ReuseRevokesSession(t *testing.T) {
+	setupTokens(t)
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+
+	db.DB = sqlx.NewDb(mockDB, "sqlmock")
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM refresh_tokens").
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnRows(refreshTokenRow(uuid.New(), time.Now().Add(time.Hour), time.Now().Add(-time.Minute)))
+	mock.ExpectExec("INSERT INTO revoked_tokens (.+) WHERE session_id").
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec("UPDATE refresh_tokens SET revoked_at (.+) WHERE session_id").
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec("DELETE FROM revoked_tokens").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	req, _ := http.NewRequest("POST", "/refresh", bytes.NewBufferString(`{"refresh_token":"replayed"}`))
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(auth.RefreshHandler).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRefreshHandler_Expired(t *testing.T) {
+	setupTokens(t)
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+
+	db.DB = sqlx.NewDb(mockDB, "sqlmock")
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM refresh_tokens").
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnRows(refreshTokenRow(uuid.New(), time.Now().Add(-time.Hour), nil))
+	mock.ExpectRollback()
+
+	req, _ := http.NewRequest("POST", "/refresh", bytes.NewBufferString(`{"refresh_token":"stale"}`))
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(auth.RefreshHandler).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestLogoutHandler_RevokesSession(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+
+	db.DB = sqlx.NewDb(mockDB, "sqlmock")
+
+	sessionID := uuid.New()
+	mock.ExpectExec("INSERT INTO revoked_tokens (.+) WHERE session_id").
+		WithArgs(sessionID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE refresh_tokens SET revoked_at").
+		WithArgs(sessionID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM revoked_tokens").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	claims := &middleware.Claims{UserID: uuid.New(), Username: "testuser", Roles: []string{"buyer"}, SessionID: sessionID}
+	req, _ := http.NewRequest("POST", "/logout", nil)
+	req = req.WithContext(middleware.WithClaims(req.Context(), claims))
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(auth.LogoutHandler).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,287 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"escrow-agent/internal/db"
+	"escrow-agent/internal/lockout"
+	"escrow-agent/internal/logs"
+	"escrow-agent/internal/mfa"
+	"escrow-agent/internal/middleware"
+	"escrow-agent/internal/sessions"
+	"escrow-agent/internal/tokens"
+	"escrow-agent/pkg/models"
+	"log"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+type LoginTOTPRequest struct {
+	MFAToken string `json:"mfa_token"`
+	Code     string `json:"code"`
+}
+
+// LoginTOTPHandler is the second step of a login with 2FA enabled: it
+// redeems the challenge LoginHandler returned with a TOTP or recovery code
+// and starts a session marked as having passed a second factor.
+func LoginTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var req LoginTOTPRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.MFAToken == "" || req.Code == "" {
+		http.Error(w, "mfa_token and code are required", http.StatusBadRequest)
+		return
+	}
+
+	service, err := tokens.Current()
+	if err != nil {
+		log.Printf("[ERROR] Cannot issue token: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		log.Printf("[ERROR] Failed to begin transaction: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	ip := middleware.ClientIP(r)
+	now := time.Now()
+
+	// a locked username or address is turned away before the code is
+	// checked, as at the password step
+	username, err := mfa.ChallengeUsername(tx, req.MFAToken)
+	if errors.Is(err, mfa.ErrInvalidChallenge) {
+		http.Error(w, "Invalid or expired login challenge", http.StatusUnauthorized)
+		return
+	}
+	var wait time.Duration
+	if err == nil {
+		wait, err = lockout.Blocked(tx, username, ip, now)
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to check login lockout for %s: %v", ip, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if wait > 0 {
+		tooManyAttempts(w, wait)
+		return
+	}
+
+	userID, err := mfa.RedeemChallenge(tx, req.MFAToken, req.Code)
+	if errors.Is(err, mfa.ErrInvalidCode) {
+		// a wrong code counts like a wrong password
+		if err := recordFailedLogin(tx, &userID, username, ip, now, "SecondFactorFailed", "Invalid two-factor code"); err != nil {
+			log.Printf("[ERROR] Failed to record failed 2FA attempt: %v", err)
+		}
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+	if errors.Is(err, mfa.ErrInvalidChallenge) {
+		http.Error(w, "Invalid or expired login challenge", http.StatusUnauthorized)
+		return
+	}
+	if errors.Is(err, mfa.ErrTooManyCodes) {
+		http.Error(w, "Too many invalid two-factor codes; try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	var pair *sessions.Pair
+	var subject sessions.Subject
+	if err == nil {
+		err = tx.Get(&subject, "SELECT user_id, username, roles FROM users WHERE user_id = $1", userID)
+	}
+	if err == nil {
+		err = lockout.Succeed(tx, subject.Username, now)
+	}
+	if err == nil {
+		err = logs.RecordSecurityEvent(tx, &userID, subject.Username, ip, "LoginSucceeded", "Signed in with password and second factor")
+	}
+	if err == nil {
+		subject.MFA = true
+		pair, err = sessions.Start(tx, service, subject)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to finish 2FA login: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	writeTokens(w, pair)
+}
+
+// EnrollTOTPHandler starts 2FA enrollment for the caller. The returned secret
+// and provisioning URI go into an authenticator app; enrollment finishes
+// with ConfirmTOTPHandler.
+func EnrollTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := userClaims(w, r)
+	if !ok {
+		return
+	}
+
+	secret, uri, err := mfa.Enroll(db.DB, claims.UserID, claims.Username)
+	if errors.Is(err, mfa.ErrAlreadyEnrolled) {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to start 2FA enrollment for user %s: %v", claims.UserID, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"secret":           secret,
+		"provisioning_uri": uri,
+	})
+}
+
+type TOTPCodeRequest struct {
+	Code     string `json:"code"`
+	Password string `json:"password,omitempty"`
+}
+
+// ConfirmTOTPHandler enables 2FA once the caller sends a valid code from
+// their app, and returns the recovery codes. Every session of the caller is
+// revoked, so the next login goes through the second factor.
+func ConfirmTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := userClaims(w, r)
+	if !ok {
+		return
+	}
+
+	var req TOTPCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		http.Error(w, "code is required", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		log.Printf("[ERROR] Failed to begin transaction: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	codes, err := mfa.Confirm(tx, claims.UserID, req.Code)
+	switch {
+	case errors.Is(err, mfa.ErrInvalidCode):
+		http.Error(w, "Invalid code", http.StatusBadRequest)
+		return
+	case errors.Is(err, mfa.ErrAlreadyEnrolled), errors.Is(err, mfa.ErrNoPendingSecret):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err == nil {
+		err = logs.RecordUserEvent(tx, claims.UserID, &claims.UserID, "TwoFactorEnabled", "Two-factor authentication enabled by "+claims.Username)
+	}
+	if err == nil {
+		err = sessions.RevokeUser(tx, claims.UserID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to confirm 2FA for user %s: %v", claims.UserID, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":        "Two-factor authentication enabled; log in again",
+		"recovery_codes": codes,
+	})
+}
+
+// DisableTOTPHandler turns 2FA off after checking the caller's password and
+// a current code. Admins cannot turn it off, since their role requires it.
+func DisableTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := userClaims(w, r)
+	if !ok {
+		return
+	}
+	if claims.Roles.Has(models.RoleAdmin) {
+		http.Error(w, "Two-factor authentication is mandatory for admins", http.StatusForbidden)
+		return
+	}
+
+	var req TOTPCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" || req.Password == "" {
+		http.Error(w, "password and code are required", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		log.Printf("[ERROR] Failed to begin transaction: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var hash string
+	err = tx.Get(&hash, "SELECT password_hash FROM users WHERE user_id = $1", claims.UserID)
+	if err == nil && bcrypt.CompareHashAndPassword([]byte(hash), []byte(req.Password)) != nil {
+		http.Error(w, "Invalid password or code", http.StatusForbidden)
+		return
+	}
+	if err == nil {
+		err = mfa.Verify(tx, claims.UserID, req.Code)
+		if errors.Is(err, mfa.ErrTooManyCodes) {
+			http.Error(w, "Too many invalid two-factor codes; try again later", http.StatusTooManyRequests)
+			return
+		}
+		if errors.Is(err, mfa.ErrInvalidCode) {
+			// keep the failure counted towards the lockout
+			if err := tx.Commit(); err != nil {
+				log.Printf("[ERROR] Failed to record invalid 2FA code from user %s: %v", claims.UserID, err)
+			}
+		}
+		if errors.Is(err, mfa.ErrInvalidCode) || errors.Is(err, mfa.ErrNotEnrolled) {
+			http.Error(w, "Invalid password or code", http.StatusForbidden)
+			return
+		}
+	}
+	if err == nil {
+		err = mfa.Disable(tx, claims.UserID)
+	}
+	if err == nil {
+		err = logs.RecordUserEvent(tx, claims.UserID, &claims.UserID, "TwoFactorDisabled", "Two-factor authentication disabled by "+claims.Username)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to disable 2FA for user %s: %v", claims.UserID, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Two-factor authentication disabled"})
+}
+
+// userClaims returns the claims of a caller signed in as a user; API keys
+// have no second factor of their own to manage.
+func userClaims(w http.ResponseWriter, r *http.Request) (*middleware.Claims, bool) {
+	claims, ok := middleware.ClaimsFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+	if claims.APIKeyID != nil {
+		http.Error(w, "Two-factor authentication is managed by signing in as the user", http.StatusBadRequest)
+		return nil, false
+	}
+	return claims, true
+}
@@ -0,0 +1,194 @@
+package auth_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"escrow-agent/internal/auth"
+	"escrow-agent/internal/db"
+	"escrow-agent/internal/lockout"
+	"escrow-agent/internal/mfa"
+	"escrow-agent/internal/middleware"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+)
+
+func challengeRow(userID uuid.UUID, attempts int) *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"challenge_id", "user_id", "attempts", "expires_at", "used_at"}).
+		AddRow(uuid.New(), userID, attempts, time.Now().Add(time.Minute), nil)
+}
+
+func newLoginTOTPRequest(t *testing.T, code string) *http.Request {
+	payload, _ := json.Marshal(auth.LoginTOTPRequest{MFAToken: "challenge", Code: code})
+	req, err := http.NewRequest("POST", "/login/2fa", bytes.NewBuffer(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+// expectChallengeNotBlocked expects the second login step to look up the
+// challenge's username and check it and the address against lockout.
+func expectChallengeNotBlocked(mock sqlmock.Sqlmock, username string) {
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT u.username FROM mfa_challenges c JOIN users u").
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"username"}).AddRow(username))
+	mock.ExpectQuery("SELECT blocked_until FROM login_throttles").
+		WithArgs(lockout.ScopeUser, username, lockout.ScopeIP, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"blocked_until"}))
+}
+
+func expectCodeNotBlocked(mock sqlmock.Sqlmock, userID uuid.UUID) {
+	mock.ExpectQuery("SELECT blocked_until FROM login_throttles").
+		WithArgs(lockout.ScopeCode, userID.String(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"blocked_until"}))
+}
+
+func TestLoginTOTPHandler_IssuesMFASession(t *testing.T) {
+	service := setupTokens(t)
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+
+	db.DB = sqlx.NewDb(mockDB, "sqlmock")
+
+	secret, _ := mfa.GenerateSecret()
+	code, _ := mfa.Code(secret, time.Now())
+	userID := uuid.New()
+
+	expectChallengeNotBlocked(mock, "root")
+	mock.ExpectQuery("SELECT (.+) FROM mfa_challenges").
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnRows(challengeRow(userID, 0))
+	expectCodeNotBlocked(mock, userID)
+	mock.ExpectQuery("SELECT totp_secret, (.+) FOR UPDATE").
+		WithArgs(userID).
+		WillReturnRows(sqlmock.NewRows([]string{"totp_secret", "totp_enabled_at", "totp_last_step"}).AddRow(secret, time.Now(), 0))
+	mock.ExpectExec("UPDATE users SET totp_last_step").
+		WithArgs(sqlmock.AnyArg(), userID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM login_throttles").
+		WithArgs(lockout.ScopeCode, userID.String()).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("UPDATE mfa_challenges SET used_at").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM mfa_challenges").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT user_id, username, roles FROM users").
+		WithArgs(userID).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "username", "roles"}).AddRow(userID, "root", "{admin}"))
+	mock.ExpectExec("DELETE FROM login_throttles WHERE scope").
+		WithArgs(lockout.ScopeUser, "root").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM login_throttles WHERE last_failure_at").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO security_logs").
+		WithArgs(userID, "root", sqlmock.AnyArg(), "LoginSucceeded", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO refresh_tokens").
+		WithArgs(sqlmock.AnyArg(), userID, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), true).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(auth.LoginTOTPHandler).ServeHTTP(rr, newLoginTOTPRequest(t, code))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var response struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	claims, err := service.Parse(response.AccessToken)
+	assert.NoError(t, err)
+	assert.True(t, claims.MFA)
+	assert.True(t, middleware.Can(claims, middleware.PermAdminUsersRead))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestLoginTOTPHandler_WrongCodeCountsAttempt(t *testing.T) {
+	setupTokens(t)
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+
+	db.DB = sqlx.NewDb(mockDB, "sqlmock")
+
+	secret, _ := mfa.GenerateSecret()
+	userID := uuid.New()
+
+	expectChallengeNotBlocked(mock, "root")
+	mock.ExpectQuery("SELECT (.+) FROM mfa_challenges").
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnRows(challengeRow(userID, 2))
+	expectCodeNotBlocked(mock, userID)
+	mock.ExpectQuery("SELECT totp_secret, (.+) FOR UPDATE").
+		WithArgs(userID).
+		WillReturnRows(sqlmock.NewRows([]string{"totp_secret", "totp_enabled_at", "totp_last_step"}).AddRow(secret, time.Now(), 0))
+	mock.ExpectExec("UPDATE recovery_codes SET used_at").
+		WithArgs(userID, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("INSERT INTO login_throttles").
+		WithArgs(lockout.ScopeCode, userID.String(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(1))
+	mock.ExpectExec("UPDATE mfa_challenges SET attempts = attempts \\+ 1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	// and against the username and address, like a wrong password
+	mock.ExpectQuery("INSERT INTO login_throttles").
+		WithArgs(lockout.ScopeUser, "root", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(1))
+	mock.ExpectQuery("INSERT INTO login_throttles").
+		WithArgs(lockout.ScopeIP, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(1))
+	mock.ExpectExec("INSERT INTO security_logs").
+		WithArgs(userID, "root", sqlmock.AnyArg(), "SecondFactorFailed", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(auth.LoginTOTPHandler).ServeHTTP(rr, newLoginTOTPRequest(t, "not-a-code"))
+
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestLoginTOTPHandler_Blocked(t *testing.T) {
+	setupTokens(t)
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+
+	db.DB = sqlx.NewDb(mockDB, "sqlmock")
+
+	// new challenges do not get around a username locked by wrong codes
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT u.username FROM mfa_challenges c JOIN users u").
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"username"}).AddRow("root"))
+	mock.ExpectQuery("SELECT blocked_until FROM login_throttles").
+		WithArgs(lockout.ScopeUser, "root", lockout.ScopeIP, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"blocked_until"}).AddRow(time.Now().Add(time.Minute)))
+	mock.ExpectRollback()
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(auth.LoginTOTPHandler).ServeHTTP(rr, newLoginTOTPRequest(t, "123456"))
+
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.NotEmpty(t, rr.Header().Get("Retry-After"))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,154 @@
+// Package crypto encrypts sensitive data at rest with envelope encryption.
+// Every value gets its own random AES-256-GCM data key; the data key is
+// wrapped under a key-encryption key (KEK) and stored beside the ciphertext,
+// together with the version of the KEK that wrapped it. Rotating the KEK only
+// rewraps data keys, leaving the data itself untouched.
+//
+// Values are sealed for a context, such as the table and row they are stored
+// in, and only open for the same context, so ciphertext copied to another row
+// does not decrypt there.
+package crypto
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// envelopeVersion is the format written by Seal.
+const envelopeVersion = 1
+
+var (
+	ErrNotSealed = errors.New("data is not a sealed envelope")
+	ErrCorrupt   = errors.New("sealed data is corrupt or was sealed for another context")
+)
+
+// envelope is the stored form of a sealed value, as JSON.
+type envelope struct {
+	Version int    `json:"v"`
+	KeyID   string `json:"kid"`
+	DEK     []byte `json:"dek"`  // data key wrapped under the KEK
+	Data    []byte `json:"data"` // nonce and ciphertext
+}
+
+// Seal encrypts plaintext for context under a new data key wrapped by the
+// current KEK.
+func Seal(plaintext []byte, context string) ([]byte, error) {
+	k, err := CurrentKEK()
+	if err != nil {
+		return nil, err
+	}
+
+	dek := make([]byte, KeySize)
+	if _, err := rand.Read(dek); err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(dek)
+	if err != nil {
+		return nil, err
+	}
+	data, err := seal(aead, plaintext, []byte(context))
+	if err != nil {
+		return nil, err
+	}
+	kid, wrapped, err := k.Wrap(dek)
+	if err != nil {
+		return nil, fmt.Errorf("wrap data key: %w", err)
+	}
+	return json.Marshal(envelope{Version: envelopeVersion, KeyID: kid, DEK: wrapped, Data: data})
+}
+
+// Open decrypts a value sealed for context.
+func Open(sealed []byte, context string) ([]byte, error) {
+	env, err := parse(sealed)
+	if err != nil {
+		return nil, err
+	}
+	k, err := CurrentKEK()
+	if err != nil {
+		return nil, err
+	}
+	dek, err := k.Unwrap(env.KeyID, env.DEK)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(dek)
+	if err != nil {
+		return nil, err
+	}
+	return open(aead, env.Data, []byte(context))
+}
+
+// SealJSON seals the JSON encoding of v.
+func SealJSON(v interface{}, context string) ([]byte, error) {
+	plaintext, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return Seal(plaintext, context)
+}
+
+// OpenJSON opens a value sealed by SealJSON into v.
+func OpenJSON(sealed []byte, context string, v interface{}) error {
+	plaintext, err := Open(sealed, context)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(plaintext, v)
+}
+
+// KeyID returns the version of the KEK a sealed value's data key is wrapped
+// with.
+func KeyID(sealed []byte) (string, error) {
+	env, err := parse(sealed)
+	if err != nil {
+		return "", err
+	}
+	return env.KeyID, nil
+}
+
+// Rotate brings stored data up to the current KEK. A value sealed under a
+// retired KEK has its data key rewrapped; data that is not sealed at all,
+// written before encryption was introduced, is sealed for context. It
+// reports false, and returns data as is, when nothing needed to change.
+func Rotate(data []byte, context string) ([]byte, bool, error) {
+	k, err := CurrentKEK()
+	if err != nil {
+		return nil, false, err
+	}
+
+	env, err := parse(data)
+	if errors.Is(err, ErrNotSealed) {
+		sealed, err := Seal(data, context)
+		return sealed, err == nil, err
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if env.KeyID == k.CurrentID() {
+		return data, false, nil
+	}
+
+	dek, err := k.Unwrap(env.KeyID, env.DEK)
+	if err != nil {
+		return nil, false, err
+	}
+	env.KeyID, env.DEK, err = k.Wrap(dek)
+	if err != nil {
+		return nil, false, fmt.Errorf("wrap data key: %w", err)
+	}
+	rotated, err := json.Marshal(env)
+	return rotated, err == nil, err
+}
+
+func parse(sealed []byte) (envelope, error) {
+	var env envelope
+	if err := json.Unmarshal(sealed, &env); err != nil || env.Version == 0 {
+		return envelope{}, ErrNotSealed
+	}
+	if env.Version != envelopeVersion || env.KeyID == "" || len(env.DEK) == 0 {
+		return envelope{}, ErrCorrupt
+	}
+	return env, nil
+}
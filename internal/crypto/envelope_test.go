@@ -0,0 +1,99 @@
+package crypto_test
+
+import (
+	"encoding/base64"
+	"fmt"
+	"testing"
+
+	"escrow-agent/internal/crypto"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func keyring(t *testing.T, kids ...string) *crypto.Keyring {
+	spec := "["
+	for i, kid := range kids {
+		if i > 0 {
+			spec += ","
+		}
+		key := make([]byte, crypto.KeySize)
+		copy(key, kid)
+		spec += fmt.Sprintf(`{"kid":%q,"key":%q}`, kid, base64.StdEncoding.EncodeToString(key))
+	}
+	ring, err := crypto.ParseKeyring([]byte(spec + "]"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ring
+}
+
+func TestSealOpen(t *testing.T) {
+	crypto.SetKEK(keyring(t, "2024-07"))
+
+	sealed, err := crypto.Seal([]byte("4111 1111 1111 1111"), "payments:1")
+	assert.NoError(t, err)
+	assert.NotContains(t, string(sealed), "4111")
+
+	plaintext, err := crypto.Open(sealed, "payments:1")
+	assert.NoError(t, err)
+	assert.Equal(t, "4111 1111 1111 1111", string(plaintext))
+
+	_, err = crypto.Open(sealed, "payments:2")
+	assert.ErrorIs(t, err, crypto.ErrCorrupt)
+
+	tampered := append([]byte(nil), sealed...)
+	tampered[len(tampered)-3] ^= 1
+	_, err = crypto.Open(tampered, "payments:1")
+	assert.Error(t, err)
+
+	_, err = crypto.Open([]byte(`{"reference":"legacy"}`), "payments:1")
+	assert.ErrorIs(t, err, crypto.ErrNotSealed)
+}
+
+func TestRotate(t *testing.T) {
+	crypto.SetKEK(keyring(t, "2024-01"))
+	var v struct{ Reference string }
+	old, err := crypto.SealJSON(map[string]string{"Reference": "mock_1"}, "payments:1")
+	assert.NoError(t, err)
+
+	// a new current key, the old one retired but still listed
+	crypto.SetKEK(keyring(t, "2024-07", "2024-01"))
+	assert.NoError(t, crypto.OpenJSON(old, "payments:1", &v))
+	assert.Equal(t, "mock_1", v.Reference)
+
+	rotated, changed, err := crypto.Rotate(old, "payments:1")
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	kid, _ := crypto.KeyID(rotated)
+	assert.Equal(t, "2024-07", kid)
+
+	_, changed, err = crypto.Rotate(rotated, "payments:1")
+	assert.NoError(t, err)
+	assert.False(t, changed)
+
+	// once the old key is dropped only rotated data opens
+	crypto.SetKEK(keyring(t, "2024-07"))
+	assert.NoError(t, crypto.OpenJSON(rotated, "payments:1", &v))
+	_, err = crypto.Open(old, "payments:1")
+	assert.ErrorIs(t, err, crypto.ErrUnknownKey)
+
+	// data from before encryption is sealed
+	legacy, changed, err := crypto.Rotate([]byte("dummy_details"), "payments:1")
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	plaintext, err := crypto.Open(legacy, "payments:1")
+	assert.NoError(t, err)
+	assert.Equal(t, "dummy_details", string(plaintext))
+}
+
+func TestParseKeyring_Invalid(t *testing.T) {
+	for _, spec := range []string{
+		`[]`,
+		`[{"kid":"short","key":"c2hvcnQ="}]`,
+		`[{"kid":"","key":"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="}]`,
+		`[{"kid":"a","key":"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="},{"kid":"a","key":"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="}]`,
+	} {
+		_, err := crypto.ParseKeyring([]byte(spec))
+		assert.ErrorIs(t, err, crypto.ErrInvalidKey, spec)
+	}
+}
@@ -0,0 +1,183 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// KeySize is the length of key-encryption and data keys: AES-256.
+const KeySize = 32
+
+var (
+	ErrInvalidKey = errors.New("invalid encryption key")
+	ErrUnknownKey = errors.New("unknown key-encryption key")
+	ErrNoKEK      = errors.New("no key-encryption key configured")
+)
+
+// KEK wraps and unwraps data keys under a key-encryption key. CurrentID names
+// the key new data keys are wrapped with; Unwrap must still accept the keys
+// retired before it, so existing data stays readable until it is rotated.
+// Keyring keeps the keys in a local file; a KMS client can take its place.
+type KEK interface {
+	CurrentID() string
+	Wrap(dek []byte) (kid string, wrapped []byte, err error)
+	Unwrap(kid string, wrapped []byte) ([]byte, error)
+}
+
+var (
+	mu  sync.RWMutex
+	kek KEK
+)
+
+// SetKEK replaces the key-encryption key used by Seal and Open.
+func SetKEK(k KEK) {
+	mu.Lock()
+	defer mu.Unlock()
+	kek = k
+}
+
+// CurrentKEK returns the key-encryption key in use, or ErrNoKEK if none is
+// set.
+func CurrentKEK() (KEK, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	if kek == nil {
+		return nil, ErrNoKEK
+	}
+	return kek, nil
+}
+
+// Keyring is a set of versioned AES-256 key-encryption keys. The first key
+// is current; the rest are retired keys kept to unwrap older data.
+type Keyring struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// keySpec is one key of a keyring file, which is a JSON list, current key
+// first:
+//
+//	[{"kid": "2024-07", "key": "<base64 of 32 random bytes>"},
+//	 {"kid": "2024-01", "key": "..."}]
+type keySpec struct {
+	ID  string `json:"kid"`
+	Key string `json:"key"`
+}
+
+// LoadKeyring reads a keyring file, see keySpec.
+func LoadKeyring(path string) (*Keyring, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKeyring(data)
+}
+
+// ParseKeyring reads a keyring from its JSON form.
+func ParseKeyring(data []byte) (*Keyring, error) {
+	var specs []keySpec
+	if err := json.Unmarshal(data, &specs); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidKey, err)
+	}
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("%w: keyring is empty", ErrInvalidKey)
+	}
+
+	ring := &Keyring{current: specs[0].ID, keys: map[string]cipher.AEAD{}}
+	for _, spec := range specs {
+		key, err := base64.StdEncoding.DecodeString(spec.Key)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrInvalidKey, spec.ID, err)
+		}
+		if err := ring.add(spec.ID, key); err != nil {
+			return nil, err
+		}
+	}
+	return ring, nil
+}
+
+// NewEphemeralKeyring returns a keyring holding one random key. Data sealed
+// under it cannot be opened once the process exits; it is meant for tests
+// and local development.
+func NewEphemeralKeyring(kid string) (*Keyring, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	ring := &Keyring{current: kid, keys: map[string]cipher.AEAD{}}
+	return ring, ring.add(kid, key)
+}
+
+func (r *Keyring) add(kid string, key []byte) error {
+	if kid == "" {
+		return fmt.Errorf("%w: kid is required", ErrInvalidKey)
+	}
+	if _, dup := r.keys[kid]; dup {
+		return fmt.Errorf("%w: duplicate kid %q", ErrInvalidKey, kid)
+	}
+	if len(key) != KeySize {
+		return fmt.Errorf("%w: %s: key must be %d bytes", ErrInvalidKey, kid, KeySize)
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+	r.keys[kid] = aead
+	return nil
+}
+
+func (r *Keyring) CurrentID() string {
+	return r.current
+}
+
+// Wrap encrypts dek under the current key. The kid is bound in as additional
+// data, so a wrapped key cannot be passed off as wrapped by another key.
+func (r *Keyring) Wrap(dek []byte) (string, []byte, error) {
+	sealed, err := seal(r.keys[r.current], dek, []byte(r.current))
+	return r.current, sealed, err
+}
+
+func (r *Keyring) Unwrap(kid string, wrapped []byte) ([]byte, error) {
+	aead, ok := r.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKey, kid)
+	}
+	return open(aead, wrapped, []byte(kid))
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext with a fresh random nonce, which it prepends to the
+// ciphertext.
+func seal(aead cipher.AEAD, plaintext, additional []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additional), nil
+}
+
+func open(aead cipher.AEAD, sealed, additional []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrCorrupt
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, additional)
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,346 @@
+package disputes
+
+import (
+	"encoding/json"
+	"errors"
+	"escrow-agent/internal/db"
+	"escrow-agent/internal/escrow"
+	"escrow-agent/internal/logs"
+	"escrow-agent/internal/middleware"
+	"escrow-agent/pkg/models"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+type RaiseDisputeRequest struct {
+	Reason string `json:"reason"`
+}
+
+// ResolveDisputeRequest carries the admin's decision. InFavorOf is either
+// "buyer" (escrow refunded) or "seller" (escrow released).
+type ResolveDisputeRequest struct {
+	InFavorOf  string `json:"in_favor_of"`
+	Resolution string `json:"resolution"`
+}
+
+const disputeColumns = `dispute_id, transaction_id, raised_by, reason, dispute_status, resolution, resolved_by, created_at, resolved_at`
+
+func RaiseDisputeHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.ClaimsFromContext(r.Context())
+	if !ok {
+		log.Printf("[ERROR] Unauthorized access attempt - missing or invalid claims")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	transactionID, err := uuid.Parse(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid transaction ID", http.StatusBadRequest)
+		return
+	}
+
+	var req RaiseDisputeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Reason == "" {
+		http.Error(w, "A reason for the dispute is required", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		log.Printf("[ERROR] Failed to begin database transaction: %v", err)
+		http.Error(w, "Failed to raise dispute", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	transaction, err := escrow.LockTransaction(tx, transactionID)
+	if err != nil {
+		log.Printf("[ERROR] Transaction not found with ID %s: %v", transactionID, err)
+		http.Error(w, "Transaction not found", http.StatusNotFound)
+		return
+	}
+
+	actor := middleware.ActorFor(claims, transaction, middleware.PermDisputeRaise)
+	if actor != models.ActorBuyer && actor != models.ActorSeller {
+		log.Printf("[ERROR] Unauthorized dispute attempt on transaction %s by userID %s", transactionID, claims.UserID)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// freeze the escrow so it can be neither released nor refunded until an admin decides
+	err = escrow.Apply(r.Context(), tx, transaction, models.EventDispute, actor)
+	if errors.Is(err, models.ErrIllegalTransition) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to freeze escrow for transaction %s: %v", transactionID, err)
+		http.Error(w, "Failed to raise dispute", http.StatusInternalServerError)
+		return
+	}
+
+	var dispute models.Dispute
+	insertQuery := `
+		INSERT INTO disputes (transaction_id, raised_by, reason, dispute_status, created_at)
+		VALUES ($1, $2, $3, 'open', NOW())
+		RETURNING ` + disputeColumns
+	err = tx.QueryRowx(insertQuery, transactionID, claims.UserID, req.Reason).StructScan(&dispute)
+	if err != nil {
+		log.Printf("[ERROR] Failed to create dispute for transaction %s: %v", transactionID, err)
+		http.Error(w, "Failed to raise dispute", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = tx.Exec("UPDATE transactions SET dispute_id = $1 WHERE transaction_id = $2", dispute.DisputeID, transactionID)
+	if err != nil {
+		log.Printf("[ERROR] Failed to link dispute %s to transaction %s: %v", dispute.DisputeID, transactionID, err)
+		http.Error(w, "Failed to raise dispute", http.StatusInternalServerError)
+		return
+	}
+
+	eventDetails := fmt.Sprintf("Dispute %s raised by %s: %s", dispute.DisputeID, claims.Username, req.Reason)
+	if err := logs.Record(tx, transactionID, "DisputeRaised", eventDetails); err != nil {
+		log.Printf("[ERROR] Failed to insert log for transaction ID %s: %v", transactionID, err)
+		http.Error(w, "Failed to raise dispute", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("[ERROR] Failed to commit dispute for transaction %s: %v", transactionID, err)
+		http.Error(w, "Failed to raise dispute", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(dispute)
+}
+
+func GetDisputesHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.ClaimsFromContext(r.Context())
+	if !ok {
+		log.Printf("[ERROR] Unauthorized access attempt - missing or invalid claims")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	disputes := []models.Dispute{}
+	query := `
+		SELECT d.dispute_id, d.transaction_id, d.raised_by, d.reason, d.dispute_status,
+		       d.resolution, d.resolved_by, d.created_at, d.resolved_at
+		FROM disputes d
+		JOIN transactions t ON t.transaction_id = d.transaction_id
+		WHERE t.buyer_id = $1 OR t.seller_id = $1
+		ORDER BY d.created_at DESC
+	`
+	err := db.DB.Select(&disputes, query, claims.UserID)
+	if err != nil {
+		log.Printf("[ERROR] Failed to fetch disputes for userID %s: %v", claims.UserID, err)
+		http.Error(w, "Failed to fetch disputes", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(disputes)
+}
+
+func GetAllDisputesHandler(w http.ResponseWriter, r *http.Request) {
+	query := "SELECT " + disputeColumns + " FROM disputes"
+	var args []interface{}
+	status := r.URL.Query().Get("status")
+	switch models.DisputeStatus(status) {
+	case "", models.DisputeOpen, models.DisputeResolved, models.DisputeRejected:
+	default:
+		http.Error(w, "Invalid dispute status", http.StatusBadRequest)
+		return
+	}
+	if status != "" {
+		query += " WHERE dispute_status = $1"
+		args = append(args, status)
+	}
+	query += " ORDER BY created_at DESC"
+
+	disputes := []models.Dispute{}
+	err := db.DB.Select(&disputes, query, args...)
+	if err != nil {
+		log.Printf("[ERROR] Failed to fetch disputes: %v", err)
+		http.Error(w, "Failed to fetch disputes", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(disputes)
+}
+
+func GetDisputeHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.ClaimsFromContext(r.Context())
+	if !ok {
+		log.Printf("[ERROR] Unauthorized access attempt - missing or invalid claims")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	disputeID, err := uuid.Parse(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid dispute ID", http.StatusBadRequest)
+		return
+	}
+
+	var dispute models.Dispute
+	err = db.DB.Get(&dispute, "SELECT "+disputeColumns+" FROM disputes WHERE dispute_id = $1", disputeID)
+	if err != nil {
+		log.Printf("[ERROR] Dispute not found with ID %s: %v", disputeID, err)
+		http.Error(w, "Dispute not found", http.StatusNotFound)
+		return
+	}
+
+	if !middleware.Can(claims, middleware.PermAdminDisputesRead) {
+		var transaction models.Transaction
+		err = db.DB.Get(&transaction, "SELECT transaction_id, buyer_id, seller_id FROM transactions WHERE transaction_id = $1", dispute.TransactionID)
+		if err != nil || (transaction.BuyerID != claims.UserID && transaction.SellerID != claims.UserID) {
+			log.Printf("[ERROR] Unauthorized access to dispute %s by userID %s", disputeID, claims.UserID)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(dispute)
+}
+
+func ResolveDisputeHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.ClaimsFromContext(r.Context())
+	if !ok {
+		log.Printf("[ERROR] Unauthorized access attempt - missing or invalid claims")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	disputeID, err := uuid.Parse(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid dispute ID", http.StatusBadRequest)
+		return
+	}
+
+	var req ResolveDisputeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	req.Resolution = strings.TrimSpace(req.Resolution)
+	if req.InFavorOf != "buyer" && req.InFavorOf != "seller" {
+		http.Error(w, "in_favor_of must be either buyer or seller", http.StatusBadRequest)
+		return
+	}
+	if req.Resolution == "" {
+		http.Error(w, "A written resolution is required", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		log.Printf("[ERROR] Failed to begin database transaction: %v", err)
+		http.Error(w, "Failed to resolve dispute", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// lock the transaction before the dispute, in the order raising a
+	// dispute takes them, so the two cannot deadlock
+	var transactionID uuid.UUID
+	err = tx.Get(&transactionID, "SELECT transaction_id FROM disputes WHERE dispute_id = $1", disputeID)
+	if err != nil {
+		log.Printf("[ERROR] Dispute not found with ID %s: %v", disputeID, err)
+		http.Error(w, "Dispute not found", http.StatusNotFound)
+		return
+	}
+
+	transaction, err := escrow.LockTransaction(tx, transactionID)
+	if err != nil {
+		log.Printf("[ERROR] Transaction not found with ID %s: %v", transactionID, err)
+		http.Error(w, "Transaction not found", http.StatusNotFound)
+		return
+	}
+
+	// an admin who is a party to the transaction may not judge its dispute
+	if claims.UserID == transaction.BuyerID || claims.UserID == transaction.SellerID {
+		log.Printf("[ERROR] User %s tried to resolve dispute %s on their own transaction %s", claims.UserID, disputeID, transactionID)
+		http.Error(w, "Parties to a transaction cannot resolve its disputes", http.StatusForbidden)
+		return
+	}
+
+	var dispute models.Dispute
+	err = tx.Get(&dispute, "SELECT "+disputeColumns+" FROM disputes WHERE dispute_id = $1 FOR UPDATE", disputeID)
+	if err != nil {
+		log.Printf("[ERROR] Dispute not found with ID %s: %v", disputeID, err)
+		http.Error(w, "Dispute not found", http.StatusNotFound)
+		return
+	}
+
+	if dispute.Status != string(models.DisputeOpen) {
+		http.Error(w, "Dispute has already been settled", http.StatusConflict)
+		return
+	}
+
+	status := models.DisputeResolved
+	details := fmt.Sprintf("Escrow refunded to buyer after dispute %s was resolved in their favor", disputeID)
+	if req.InFavorOf == "buyer" {
+		err = escrow.RefundEscrow(r.Context(), tx, transaction, models.EventResolveForBuyer, models.ActorAdmin, details)
+	} else {
+		status = models.DisputeRejected
+		details = fmt.Sprintf("Escrow released to seller after dispute %s was rejected", disputeID)
+		err = escrow.ReleaseEscrow(r.Context(), tx, transaction, models.EventResolveForSeller, models.ActorAdmin, details)
+	}
+	if errors.Is(err, models.ErrIllegalTransition) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to settle escrow for dispute %s: %v", disputeID, err)
+		http.Error(w, "Failed to resolve dispute", http.StatusInternalServerError)
+		return
+	}
+
+	updateQuery := `
+		UPDATE disputes
+		SET dispute_status = $1, resolution = $2, resolved_by = $3, resolved_at = NOW()
+		WHERE dispute_id = $4
+		RETURNING ` + disputeColumns
+	err = tx.QueryRowx(updateQuery, status, req.Resolution, claims.UserID, disputeID).StructScan(&dispute)
+	if err != nil {
+		log.Printf("[ERROR] Failed to update dispute %s: %v", disputeID, err)
+		http.Error(w, "Failed to resolve dispute", http.StatusInternalServerError)
+		return
+	}
+
+	eventDetails := fmt.Sprintf("Dispute %s resolved in favor of the %s by %s: %s", disputeID, req.InFavorOf, claims.Username, req.Resolution)
+	if err := logs.Record(tx, dispute.TransactionID, "DisputeResolved", eventDetails); err != nil {
+		log.Printf("[ERROR] Failed to insert log for transaction ID %s: %v", dispute.TransactionID, err)
+		http.Error(w, "Failed to resolve dispute", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("[ERROR] Failed to commit resolution of dispute %s: %v", disputeID, err)
+		http.Error(w, "Failed to resolve dispute", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(dispute)
+}
@@ -0,0 +1,235 @@
+package disputes_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"escrow-agent/internal/db"
+	"escrow-agent/internal/disputes"
+	"escrow-agent/internal/middleware"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+)
+
+var disputeColumns = []string{"dispute_id", "transaction_id", "raised_by", "reason", "dispute_status", "resolution", "resolved_by", "created_at", "resolved_at"}
+
+func newRequest(t *testing.T, method, id string, body interface{}, claims *middleware.Claims) *http.Request {
+	payload, _ := json.Marshal(body)
+	req, err := http.NewRequest(method, "/", bytes.NewBuffer(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = mux.SetURLVars(req, map[string]string{"id": id})
+	return req.WithContext(middleware.WithClaims(req.Context(), claims))
+}
+
+func TestRaiseDisputeHandler_Success(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+
+	db.DB = sqlx.NewDb(mockDB, "sqlmock")
+
+	buyerID, sellerID, transactionID, disputeID := uuid.New(), uuid.New(), uuid.New(), uuid.New()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM transactions").
+		WithArgs(transactionID).
+		WillReturnRows(sqlmock.NewRows([]string{"transaction_id", "buyer_id", "seller_id", "transaction_status", "escrow_status"}).
+			AddRow(transactionID, buyerID, sellerID, "deposited", "funded"))
+	mock.ExpectQuery("SELECT EXISTS").
+		WithArgs(transactionID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectExec("UPDATE escrow_accounts").
+		WithArgs("disputed", transactionID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE transactions").
+		WithArgs("deposited", "disputed", transactionID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("INSERT INTO disputes").
+		WithArgs(transactionID, buyerID, "Damaged goods").
+		WillReturnRows(sqlmock.NewRows(disputeColumns).
+			AddRow(disputeID, transactionID, buyerID, "Damaged goods", "open", nil, nil, time.Now(), nil))
+	mock.ExpectExec("UPDATE transactions SET dispute_id").
+		WithArgs(disputeID, transactionID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO transaction_logs").
+		WithArgs(transactionID, "DisputeRaised", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	claims := &middleware.Claims{UserID: buyerID, Username: "georgia", Roles: []string{"buyer"}}
+	req := newRequest(t, "POST", transactionID.String(), disputes.RaiseDisputeRequest{Reason: "Damaged goods"}, claims)
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(disputes.RaiseDisputeHandler).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRaiseDisputeHandler_NotParty(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+
+	db.DB = sqlx.NewDb(mockDB, "sqlmock")
+
+	transactionID := uuid.New()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM transactions").
+		WithArgs(transactionID).
+		WillReturnRows(sqlmock.NewRows([]string{"transaction_id", "buyer_id", "seller_id", "transaction_status", "escrow_status"}).
+			AddRow(transactionID, uuid.New(), uuid.New(), "deposited", "funded"))
+	mock.ExpectRollback()
+
+	claims := &middleware.Claims{UserID: uuid.New(), Username: "mallory", Roles: []string{"buyer"}}
+	req := newRequest(t, "POST", transactionID.String(), disputes.RaiseDisputeRequest{Reason: "Not mine"}, claims)
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(disputes.RaiseDisputeHandler).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRaiseDisputeHandler_MissingReason(t *testing.T) {
+	claims := &middleware.Claims{UserID: uuid.New(), Username: "georgia", Roles: []string{"buyer"}}
+	req := newRequest(t, "POST", uuid.NewString(), disputes.RaiseDisputeRequest{Reason: "   "}, claims)
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(disputes.RaiseDisputeHandler).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestResolveDisputeHandler_RequiresAdmin(t *testing.T) {
+	claims := &middleware.Claims{UserID: uuid.New(), Username: "georgia", Roles: []string{"buyer"}}
+	body := disputes.ResolveDisputeRequest{InFavorOf: "buyer", Resolution: "Refund"}
+	req := newRequest(t, "PUT", uuid.NewString(), body, claims)
+
+	rr := httptest.NewRecorder()
+	handler := middleware.RequirePermission(middleware.PermDisputeResolve)(http.HandlerFunc(disputes.ResolveDisputeHandler))
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+}
+
+func TestResolveDisputeHandler_AlreadySettled(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+
+	db.DB = sqlx.NewDb(mockDB, "sqlmock")
+
+	disputeID, transactionID := uuid.New(), uuid.New()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT transaction_id FROM disputes WHERE dispute_id = \\$1").
+		WithArgs(disputeID).
+		WillReturnRows(sqlmock.NewRows([]string{"transaction_id"}).AddRow(transactionID))
+	mock.ExpectQuery("SELECT (.+) FROM transactions (.+) FOR UPDATE").
+		WithArgs(transactionID).
+		WillReturnRows(sqlmock.NewRows([]string{"transaction_id", "buyer_id", "seller_id", "amount", "transaction_status", "escrow_status"}).
+			AddRow(transactionID, uuid.New(), uuid.New(), 50.00, "completed", "released"))
+	mock.ExpectQuery("SELECT (.+) FROM disputes WHERE dispute_id = \\$1 FOR UPDATE").
+		WithArgs(disputeID).
+		WillReturnRows(sqlmock.NewRows(disputeColumns).
+			AddRow(disputeID, transactionID, uuid.New(), "Damaged goods", "resolved", "Refunded", uuid.New(), time.Now(), time.Now()))
+	mock.ExpectRollback()
+
+	claims := &middleware.Claims{UserID: uuid.New(), Username: "admin", Roles: []string{"admin"}}
+	body := disputes.ResolveDisputeRequest{InFavorOf: "seller", Resolution: "Item is as described"}
+	req := newRequest(t, "PUT", disputeID.String(), body, claims)
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(disputes.ResolveDisputeHandler).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestResolveDisputeHandler_PartyCannotResolve(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+
+	db.DB = sqlx.NewDb(mockDB, "sqlmock")
+
+	disputeID, transactionID, adminID := uuid.New(), uuid.New(), uuid.New()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT transaction_id FROM disputes WHERE dispute_id = \\$1").
+		WithArgs(disputeID).
+		WillReturnRows(sqlmock.NewRows([]string{"transaction_id"}).AddRow(transactionID))
+	mock.ExpectQuery("SELECT (.+) FROM transactions (.+) FOR UPDATE").
+		WithArgs(transactionID).
+		WillReturnRows(sqlmock.NewRows([]string{"transaction_id", "buyer_id", "seller_id", "amount", "transaction_status", "escrow_status"}).
+			AddRow(transactionID, uuid.New(), adminID, 50.00, "disputed", "funded"))
+	mock.ExpectRollback()
+
+	claims := &middleware.Claims{UserID: adminID, Username: "admin", Roles: []string{"admin", "seller"}, MFA: true}
+	body := disputes.ResolveDisputeRequest{InFavorOf: "seller", Resolution: "Item is as described"}
+	req := newRequest(t, "PUT", disputeID.String(), body, claims)
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(disputes.ResolveDisputeHandler).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetAllDisputesHandler_InvalidStatus(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+
+	db.DB = sqlx.NewDb(mockDB, "sqlmock")
+
+	req := httptest.NewRequest("GET", "/admin/disputes?status=closed", nil)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(disputes.GetAllDisputesHandler).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetAllDisputesHandler_FiltersByStatus(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+
+	db.DB = sqlx.NewDb(mockDB, "sqlmock")
+
+	mock.ExpectQuery("SELECT (.+) FROM disputes WHERE dispute_status = \\$1").
+		WithArgs("open").
+		WillReturnRows(sqlmock.NewRows(disputeColumns))
+
+	req := httptest.NewRequest("GET", "/admin/disputes?status=open", nil)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(disputes.GetAllDisputesHandler).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
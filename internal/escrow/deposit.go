@@ -0,0 +1,117 @@
+package escrow
+
+import (
+	"context"
+	"errors"
+	"escrow-agent/internal/ledger"
+	"escrow-agent/internal/logs"
+	"escrow-agent/internal/payments"
+	"escrow-agent/pkg/models"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+// depositPending reports whether the transaction has a deposit the gateway
+// has not confirmed yet. Such a transaction takes no further deposit until
+// the gateway's webhook settles the pending one.
+func depositPending(q sqlx.Queryer, transactionID uuid.UUID) (bool, error) {
+	var pending bool
+	err := sqlx.Get(q, &pending, "SELECT EXISTS(SELECT 1 FROM escrow_accounts WHERE transaction_id = $1 AND escrow_status = 'pending')", transactionID)
+	return pending, err
+}
+
+// recordDeposit opens the escrow account for a payment and links the payment
+// to both the escrow account and the transaction. A captured payment funds the
+// account straight away; a pending one leaves it pending, without a deadline
+// or ledger entry, until the gateway confirms the capture.
+func recordDeposit(tx *sqlx.Tx, transaction *models.Transaction, payment *models.Payment) (uuid.UUID, error) {
+	transactionID := transaction.TransactionID
+	insertQuery := `
+		INSERT INTO escrow_accounts (transaction_id, escrowed_amount, currency, escrow_status, payment_id, funded_at)
+		VALUES ($1, $2, $3, 'pending', $4, NULL)
+		RETURNING escrow_id
+	`
+	var escrowID uuid.UUID
+	err := tx.QueryRow(insertQuery, transactionID, payment.Amount, payment.Amount.Currency, payment.PaymentID).Scan(&escrowID)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	_, err = tx.Exec("UPDATE transactions SET payment_id = $1 WHERE transaction_id = $2", payment.PaymentID, transactionID)
+	if err != nil || payment.Status == payments.StatusPending.PaymentStatus() {
+		return escrowID, err
+	}
+	return escrowID, fundDeposit(tx, transaction, payment)
+}
+
+// fundDeposit stamps the escrow account funded, starts the seller's
+// fulfillment window and journals the deposit into escrow holding. The
+// account's status itself follows from the deposit event, see
+// syncEscrowAccount.
+func fundDeposit(tx *sqlx.Tx, transaction *models.Transaction, payment *models.Payment) error {
+	expiry := time.Now().Add(CurrentWindows().Fulfillment)
+	_, err := tx.Exec("UPDATE escrow_accounts SET funded_at = NOW(), expiry_date = $1 WHERE transaction_id = $2", expiry, transaction.TransactionID)
+	if err != nil {
+		return err
+	}
+	_, err = ledger.Post(tx, ledger.DepositEntry(transaction, payment.Amount))
+	return err
+}
+
+// ConfirmDeposit funds the escrow of a pending deposit once the gateway
+// reports the capture succeeded. transaction and then payment must be locked
+// in tx, in that order. If the transaction can no longer take the deposit,
+// because it was disputed or cancelled while the capture was pending, the
+// payment is refunded instead.
+func ConfirmDeposit(ctx context.Context, tx *sqlx.Tx, transaction *models.Transaction, payment *models.Payment) error {
+	err := Apply(ctx, tx, transaction, models.EventDeposit, models.ActorBuyer)
+	if errors.Is(err, models.ErrIllegalTransition) {
+		details := fmt.Sprintf("Payment %s captured after the transaction could no longer be funded (%v); refunded", payment.PaymentID, err)
+		if err := payments.RefundPayment(ctx, tx, payment); err != nil {
+			return err
+		}
+		if err := dropPendingDeposit(tx, transaction, payment); err != nil {
+			return err
+		}
+		return logs.Record(tx, transaction.TransactionID, "DepositReversed", details)
+	}
+	if err == nil {
+		err = fundDeposit(tx, transaction, payment)
+	}
+	if err == nil {
+		err = payments.SetStatus(tx, payment.PaymentID, payments.StatusCaptured.PaymentStatus())
+	}
+	if err != nil {
+		return err
+	}
+	details := fmt.Sprintf("Escrow funded with %s via %s (payment %s), confirmed by the gateway", payment.Amount, payment.Method, payment.PaymentID)
+	return logs.Record(tx, transaction.TransactionID, "EscrowDeposited", details)
+}
+
+// FailDeposit drops a pending deposit the gateway reports as failed: the
+// payment is marked failed and the pending escrow account is removed, so the
+// buyer can deposit again. transaction and then payment must be locked in tx.
+func FailDeposit(ctx context.Context, tx *sqlx.Tx, transaction *models.Transaction, payment *models.Payment, reason string) error {
+	if err := payments.SetStatus(tx, payment.PaymentID, payments.StatusFailed.PaymentStatus()); err != nil {
+		return err
+	}
+	if err := dropPendingDeposit(tx, transaction, payment); err != nil {
+		return err
+	}
+	details := fmt.Sprintf("Payment %s of %s failed at the gateway: %s", payment.PaymentID, payment.Amount, reason)
+	return logs.Record(tx, transaction.TransactionID, "DepositFailed", details)
+}
+
+// dropPendingDeposit removes the pending escrow account opened for payment
+// and unlinks the payment from the transaction.
+func dropPendingDeposit(tx *sqlx.Tx, transaction *models.Transaction, payment *models.Payment) error {
+	_, err := tx.Exec("DELETE FROM escrow_accounts WHERE payment_id = $1 AND escrow_status = 'pending'", payment.PaymentID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE transactions SET payment_id = NULL WHERE transaction_id = $1 AND payment_id = $2", transaction.TransactionID, payment.PaymentID)
+	return err
+}
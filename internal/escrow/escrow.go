@@ -2,32 +2,41 @@ package escrow
 
 import (
 	"encoding/json"
+	"errors"
 	"escrow-agent/internal/db"
+	"escrow-agent/internal/logs"
+	"escrow-agent/internal/mfa"
 	"escrow-agent/internal/middleware"
+	"escrow-agent/internal/payments"
 	"escrow-agent/pkg/models"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
-	"strconv"
-	"strings"
-	
+	"time"
+
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
 )
 
 type DepositEscrowRequest struct {
-	Amount float64 `json:"amount"`
+	Amount        models.Money `json:"amount"`
+	Currency      string       `json:"currency"`
+	PaymentMethod string       `json:"payment_method"`
+	PaymentToken  string       `json:"payment_token"`
 }
 
 func DepositEscrowHandler(w http.ResponseWriter, r *http.Request) {
-	claims, ok := r.Context().Value("user").(*middleware.Claims)
-	if !ok || claims.Role != "buyer" {
-		log.Printf("[ERROR] Unauthorized access attempt - missing claims or incorrect role")
+	claims, ok := middleware.ClaimsFromContext(r.Context())
+	if !ok {
+		log.Printf("[ERROR] Unauthorized access attempt - missing or invalid claims")
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
 	vars := mux.Vars(r)
-	transactionID, err := strconv.Atoi(vars["id"])
+	transactionID, err := uuid.Parse(vars["id"])
 	if err != nil {
 		http.Error(w, "Invalid transaction ID", http.StatusBadRequest)
 		return
@@ -39,101 +48,365 @@ func DepositEscrowHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var transaction models.Transaction
-	query := `
-		SELECT transaction_id, buyer_id, seller_id, amount, transaction_status
-		FROM transactions
-		WHERE transaction_id = $1
-	`
-	err = db.DB.Get(&transaction, query, transactionID)
+	if req.PaymentMethod == "" {
+		req.PaymentMethod = "credit_card"
+	}
+
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		log.Printf("[ERROR] Failed to begin database transaction: %v", err)
+		http.Error(w, "Failed to deposit escrow", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	transaction, err := LockTransaction(tx, transactionID)
 	if err != nil {
-		log.Printf("[ERROR] Transaction not found with ID %d: %v", transactionID, err)
+		log.Printf("[ERROR] Transaction not found with ID %s: %v", transactionID, err)
 		http.Error(w, "Transaction not found", http.StatusNotFound)
 		return
 	}
 
-	if transaction.BuyerID != claims.UserID {
-		log.Printf("[ERROR] Unauthorized access to transaction by userID %d", claims.UserID)
+	actor := middleware.ActorFor(claims, transaction, middleware.PermEscrowDeposit)
+	if actor != models.ActorBuyer {
+		log.Printf("[ERROR] Unauthorized access to transaction by userID %s", claims.UserID)
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	log.Printf("Transaction %v", transaction)
+	if req.Currency == "" {
+		req.Currency = transaction.Currency
+	}
+	if req.Currency != transaction.Currency {
+		http.Error(w, "Escrow deposit currency must match the transaction currency", http.StatusBadRequest)
+		return
+	}
+	if req.Amount, err = req.Amount.WithCurrency(req.Currency); err != nil {
+		http.Error(w, "Invalid deposit amount", http.StatusBadRequest)
+		return
+	}
 
-	if req.Amount != transaction.Amount {
+	if !req.Amount.Equal(transaction.Amount) {
 		http.Error(w, "Escrow deposit amount must match the transaction amount", http.StatusBadRequest)
 		return
 	}
 
-	validStatuses := map[string]bool{"pending": true, "deposited": true, "in_progress": true}
-	transactionStatus := strings.ToLower(strings.TrimSpace(transaction.Status))
+	// check before charging so an illegal deposit never reaches the gateway; the
+	// row lock keeps a concurrent deposit from slipping in between
+	if _, err := models.Lifecycle.Can(models.EventDeposit, transaction.State(), models.GuardContext{Actor: actor}); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	pending, err := depositPending(tx, transactionID)
+	if err != nil {
+		log.Printf("[ERROR] Failed to check pending deposits for transaction ID %s: %v", transactionID, err)
+		http.Error(w, "Failed to deposit escrow", http.StatusInternalServerError)
+		return
+	}
+	if pending {
+		http.Error(w, "A deposit is already awaiting payment confirmation", http.StatusConflict)
+		return
+	}
 
-	if !validStatuses[transactionStatus] {
-		http.Error(w, "Transaction cannot be deposited into escrow in its current status", http.StatusBadRequest)
+	payment, err := payments.Charge(r.Context(), tx, transactionID, req.PaymentMethod, req.PaymentToken, req.Amount)
+	if errors.Is(err, payments.ErrUnsupportedMethod) {
+		http.Error(w, "Unsupported payment method", http.StatusBadRequest)
+		return
+	}
+	if err != nil && payment != nil {
+		// keep the failed attempt on record for the payments report
+		details := fmt.Sprintf("Payment of %s by %s via %s failed: %v (payment %s)", payment.Amount, claims.Username, payment.Method, err, payment.PaymentID)
+		recordErr := logs.Record(tx, transactionID, "PaymentFailed", details)
+		if recordErr == nil {
+			recordErr = tx.Commit()
+		}
+		if recordErr != nil {
+			log.Printf("[ERROR] Failed to record failed payment for transaction ID %s: %v", transactionID, recordErr)
+		}
+	}
+	if errors.Is(err, payments.ErrDeclined) {
+		http.Error(w, "Payment declined", http.StatusPaymentRequired)
 		return
 	}
-	insertQuery := `
-		INSERT INTO escrow_accounts (transaction_id, escrowed_amount, escrow_status, created_at)
-		VALUES ($1, $2, 'held', NOW())
-		RETURNING escrow_id
-	`
-	var escrowID uuid.UUID
-	err = db.DB.QueryRow(insertQuery, transactionID, req.Amount).Scan(&escrowID)
 	if err != nil {
-		log.Printf("[ERROR] Failed to deposit escrow for transaction ID %d: %v", transactionID, err)
+		log.Printf("[ERROR] Failed to charge buyer for transaction ID %s: %v", transactionID, err)
+		http.Error(w, "Failed to charge payment", http.StatusBadGateway)
+		return
+	}
+
+	// a capture the gateway confirms later leaves the escrow pending; the
+	// payment webhook or, for crypto, the scheduler funds it, see
+	// ConfirmDeposit
+	confirmed := payment.Status != payments.StatusPending.PaymentStatus()
+	escrowID, err := recordDeposit(tx, transaction, payment)
+	if err == nil && confirmed {
+		err = Apply(r.Context(), tx, transaction, models.EventDeposit, actor)
+	}
+	if err == nil && confirmed {
+		details := fmt.Sprintf("Escrow funded with %s by %s via %s (payment %s)", payment.Amount, claims.Username, payment.Method, payment.PaymentID)
+		err = logs.Record(tx, transactionID, "EscrowDeposited", details)
+	}
+	if err == nil && !confirmed {
+		details := fmt.Sprintf("Deposit of %s by %s via %s awaiting gateway confirmation (payment %s)", payment.Amount, claims.Username, payment.Method, payment.PaymentID)
+		if payment.Method == payments.MethodCrypto {
+			details = fmt.Sprintf("Deposit of %s by %s via %s awaiting transfer to %s (payment %s)", payment.Amount, claims.Username, payment.Method, payment.GatewayReference, payment.PaymentID)
+		}
+		if payment.NextRetryAt != nil {
+			details = fmt.Sprintf("Deposit of %s by %s via %s deferred, gateway unavailable; charge retried from %s (payment %s)", payment.Amount, claims.Username, payment.Method, payment.NextRetryAt.Format(time.RFC3339), payment.PaymentID)
+		}
+		err = logs.Record(tx, transactionID, "DepositPending", details)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to deposit escrow for transaction ID %s: %v", transactionID, err)
+		payments.Reverse(r.Context(), payment)
+		if errors.Is(err, models.ErrIllegalTransition) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
 		http.Error(w, "Failed to deposit escrow", http.StatusInternalServerError)
 		return
 	}
 
+	if !confirmed {
+		response := map[string]interface{}{
+			"message":    "Escrow deposit awaiting payment confirmation",
+			"escrow_id":  escrowID,
+			"payment_id": payment.PaymentID,
+		}
+		// the buyer pays a crypto deposit by sending the amount to its address
+		if payment.Method == payments.MethodCrypto && payment.GatewayReference != "" {
+			response["deposit_address"] = payment.GatewayReference
+		}
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"message":   "Escrow deposit successful",
-		"escrow_id": escrowID,
+		"message":    "Escrow deposit successful",
+		"escrow_id":  escrowID,
+		"payment_id": payment.PaymentID,
 	})
 }
 
+type ReleaseEscrowRequest struct {
+	MilestoneID *uuid.UUID `json:"milestone_id,omitempty"`
+}
+
+// ReleaseEscrowHandler pays the escrow out to the seller. The buyer, an admin
+// or the system may release once the escrow is funded. With a milestone_id
+// only that fulfilled milestone's share is released and the rest stays held.
 func ReleaseEscrowHandler(w http.ResponseWriter, r *http.Request) {
-	claims, ok := r.Context().Value("user").(*middleware.Claims)
-	if !ok || claims.Role != "buyer" {
-		log.Printf("[ERROR] Unauthorized access attempt by userID %d with role %s", claims.UserID, claims.Role)
+	claims, ok := middleware.ClaimsFromContext(r.Context())
+	if !ok {
+		log.Printf("[ERROR] Unauthorized access attempt - missing or invalid claims")
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
 	vars := mux.Vars(r)
-	transactionIDStr := vars["id"]
-	transactionID, err := strconv.Atoi(transactionIDStr)
+	transactionID, err := uuid.Parse(vars["id"])
 	if err != nil {
 		http.Error(w, "Invalid transaction ID", http.StatusBadRequest)
 		return
 	}
 
-	var transaction models.Transaction
-	err = db.DB.Get(&transaction, "SELECT * FROM transactions WHERE transaction_id = $1", transactionID)
+	var req ReleaseEscrowRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		log.Printf("[ERROR] Failed to begin database transaction: %v", err)
+		http.Error(w, "Failed to release funds from escrow", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	transaction, err := LockTransaction(tx, transactionID)
 	if err != nil {
 		http.Error(w, "Transaction not found", http.StatusNotFound)
 		return
 	}
 
-	if transaction.Status != "in_progress" && transaction.Status != "pending" {
-		http.Error(w, "Cannot release funds for this transaction", http.StatusBadRequest)
+	actor := middleware.ActorFor(claims, transaction, middleware.PermEscrowRelease)
+	if middleware.ActorNeedsMFA(claims, transaction, middleware.PermEscrowRelease) {
+		log.Printf("[ERROR] Forbidden: admin %s needs two-factor authentication to release transaction %s", claims.UserID, transactionID)
+		http.Error(w, "Two-factor authentication required", http.StatusForbidden)
+		return
+	}
+	if actor == "" {
+		log.Printf("[ERROR] Unauthorized release attempt on transaction %s by userID %s", transactionID, claims.UserID)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !StepUp(w, r, tx, claims, transaction) {
+		return
+	}
+
+	if req.MilestoneID != nil {
+		milestone, err := ReleaseMilestone(r.Context(), tx, transaction, *req.MilestoneID, actor)
+		if err == nil {
+			err = tx.Commit()
+		}
+		switch {
+		case errors.Is(err, ErrMilestoneNotFound):
+			http.Error(w, "Milestone not found", http.StatusNotFound)
+		case errors.Is(err, ErrMilestoneState), errors.Is(err, models.ErrIllegalTransition):
+			http.Error(w, err.Error(), http.StatusConflict)
+		case err != nil:
+			log.Printf("[ERROR] Failed to release milestone %s of transaction %s: %v", *req.MilestoneID, transactionID, err)
+			http.Error(w, "Failed to release funds from escrow", http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"message":   "Milestone share released to the seller",
+				"milestone": milestone,
+			})
+		}
 		return
 	}
 
-	_, err = db.DB.Exec("UPDATE escrow_accounts SET escrow_status = 'released', escrowed_amount = 0 WHERE transaction_id = $1", transactionID)
+	details := fmt.Sprintf("Escrow released to seller by %s (%s)", claims.Username, actor)
+	err = ReleaseEscrow(r.Context(), tx, transaction, models.EventRelease, actor, details)
+	if errors.Is(err, models.ErrIllegalTransition) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
 	if err != nil {
-		http.Error(w, "Failed to update escrow status", http.StatusInternalServerError)
+		log.Printf("[ERROR] Failed to release escrow for transaction %s: %v", transactionID, err)
+		http.Error(w, "Failed to release funds from escrow", http.StatusInternalServerError)
 		return
 	}
 
-	_, err = db.DB.Exec("UPDATE transactions SET escrow_status = 'completed', updated_at = NOW() WHERE transaction_id = $1", transactionID)
+	if err := tx.Commit(); err != nil {
+		log.Printf("[ERROR] Failed to commit release for transaction %s: %v", transactionID, err)
+		http.Error(w, "Failed to release funds from escrow", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Funds released to the seller; payout scheduled",
+	})
+}
+
+// StepUp checks the caller's two-factor code, sent in the X-OTP-Code header,
+// when the transaction is above the step-up threshold. It writes the error
+// response and returns false when the check fails.
+func StepUp(w http.ResponseWriter, r *http.Request, tx *sqlx.Tx, claims *middleware.Claims, t *models.Transaction) bool {
+	err := mfa.RequireStepUp(r.Context(), tx, claims.UserID, t.Amount, r.Header.Get(mfa.CodeHeader))
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, mfa.ErrStepUpRequired):
+		http.Error(w, "A two-factor code in the "+mfa.CodeHeader+" header is required for this amount", http.StatusForbidden)
+	case errors.Is(err, mfa.ErrNotEnrolled):
+		http.Error(w, "Enable two-factor authentication to move this amount", http.StatusForbidden)
+	case errors.Is(err, mfa.ErrTooManyCodes):
+		http.Error(w, "Too many invalid two-factor codes; try again later", http.StatusTooManyRequests)
+	case errors.Is(err, mfa.ErrInvalidCode):
+		// keep the failure counted towards the lockout; nothing else was written
+		log.Printf("[ERROR] Invalid step-up code from user %s on transaction %s", claims.UserID, t.TransactionID)
+		if err := tx.Commit(); err != nil {
+			log.Printf("[ERROR] Failed to record invalid step-up code from user %s: %v", claims.UserID, err)
+		}
+		http.Error(w, "Invalid two-factor code", http.StatusForbidden)
+	default:
+		log.Printf("[ERROR] Failed step-up check on transaction %s: %v", t.TransactionID, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+	return false
+}
+
+type RefundEscrowRequest struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+// RefundEscrowHandler cancels a funded escrow and refunds the buyer. Admins and
+// the seller may refund at any point before completion; the buyer may only
+// cancel while the seller has not yet fulfilled the transaction.
+func RefundEscrowHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.ClaimsFromContext(r.Context())
+	if !ok {
+		log.Printf("[ERROR] Unauthorized access attempt - missing or invalid claims")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	transactionID, err := uuid.Parse(vars["id"])
 	if err != nil {
-		http.Error(w, "Failed to update transaction status", http.StatusInternalServerError)
+		http.Error(w, "Invalid transaction ID", http.StatusBadRequest)
+		return
+	}
+
+	var req RefundEscrowRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		log.Printf("[ERROR] Failed to begin database transaction: %v", err)
+		http.Error(w, "Failed to refund escrow", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	transaction, err := LockTransaction(tx, transactionID)
+	if err != nil {
+		log.Printf("[ERROR] Transaction not found with ID %s: %v", transactionID, err)
+		http.Error(w, "Transaction not found", http.StatusNotFound)
+		return
+	}
+
+	actor := middleware.ActorFor(claims, transaction, middleware.PermEscrowRefund)
+	if middleware.ActorNeedsMFA(claims, transaction, middleware.PermEscrowRefund) {
+		log.Printf("[ERROR] Forbidden: admin %s needs two-factor authentication to refund transaction %s", claims.UserID, transactionID)
+		http.Error(w, "Two-factor authentication required", http.StatusForbidden)
+		return
+	}
+	if actor == "" {
+		log.Printf("[ERROR] Unauthorized refund attempt on transaction %s by userID %s", transactionID, claims.UserID)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !StepUp(w, r, tx, claims, transaction) {
+		return
+	}
+
+	details := fmt.Sprintf("Escrow refunded to buyer by %s (%s)", claims.Username, actor)
+	if req.Reason != "" {
+		details += ": " + req.Reason
+	}
+
+	err = RefundEscrow(r.Context(), tx, transaction, models.EventRefund, actor, details)
+	if errors.Is(err, models.ErrIllegalTransition) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to refund escrow for transaction %s: %v", transactionID, err)
+		http.Error(w, "Failed to refund escrow", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("[ERROR] Failed to commit refund for transaction %s: %v", transactionID, err)
+		http.Error(w, "Failed to refund escrow", http.StatusInternalServerError)
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{
-		"message": "Funds successfully released to the seller",
+		"message": "Funds successfully refunded to the buyer",
 	})
 }
@@ -0,0 +1,362 @@
+package escrow_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"escrow-agent/internal/db"
+	"escrow-agent/internal/escrow"
+	"escrow-agent/internal/fees"
+	"escrow-agent/internal/lockout"
+	"escrow-agent/internal/mfa"
+	"escrow-agent/internal/middleware"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+)
+
+func newRefundRequest(t *testing.T, transactionID uuid.UUID, claims *middleware.Claims) *http.Request {
+	req, err := http.NewRequest("PUT", "/escrow/"+transactionID.String()+"/refund", strings.NewReader(`{"reason":"changed my mind"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = mux.SetURLVars(req, map[string]string{"id": transactionID.String()})
+	return req.WithContext(middleware.WithClaims(req.Context(), claims))
+}
+
+func transactionRows(transactionID, buyerID, sellerID uuid.UUID, status, escrowStatus string) *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"transaction_id", "buyer_id", "seller_id", "amount", "transaction_status", "escrow_status"}).
+		AddRow(transactionID, buyerID, sellerID, 50.00, status, escrowStatus)
+}
+
+func TestRefundEscrowHandler_BuyerBeforeFulfillment(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+
+	db.DB = sqlx.NewDb(mockDB, "sqlmock")
+
+	buyerID, sellerID, transactionID := uuid.New(), uuid.New(), uuid.New()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM transactions (.+) FOR UPDATE").
+		WithArgs(transactionID).
+		WillReturnRows(transactionRows(transactionID, buyerID, sellerID, "deposited", "funded"))
+	mock.ExpectQuery("SELECT EXISTS").
+		WithArgs(transactionID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectExec("UPDATE milestones").
+		WithArgs("refunded", transactionID).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("UPDATE escrow_accounts SET escrow_status = \\$1, cancelled_at = NOW\\(\\)").
+		WithArgs("cancelled", transactionID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE transactions").
+		WithArgs("cancelled", "cancelled", transactionID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT (.+) FROM payments").
+		WithArgs(transactionID).
+		WillReturnRows(sqlmock.NewRows([]string{"payment_id"}))
+	mock.ExpectQuery("SELECT COALESCE\\(SUM\\(p.amount\\), 0\\)").
+		WithArgs("escrow_holding", transactionID, "USD").
+		WillReturnRows(sqlmock.NewRows([]string{"balance"}).AddRow(50.00))
+	mock.ExpectQuery("INSERT INTO ledger_entries").
+		WithArgs(transactionID, "refund", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"entry_id"}).AddRow(uuid.New()))
+	mock.ExpectQuery("INSERT INTO ledger_accounts").
+		WithArgs("escrow_holding", transactionID, "USD").
+		WillReturnRows(sqlmock.NewRows([]string{"account_id"}).AddRow(uuid.New()))
+	mock.ExpectExec("INSERT INTO ledger_postings").
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), "-50.00").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("INSERT INTO ledger_accounts").
+		WithArgs("buyer_funding", buyerID, "USD").
+		WillReturnRows(sqlmock.NewRows([]string{"account_id"}).AddRow(uuid.New()))
+	mock.ExpectExec("INSERT INTO ledger_postings").
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), "50.00").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO transaction_logs").
+		WithArgs(transactionID, "EscrowRefunded", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	claims := &middleware.Claims{UserID: buyerID, Username: "cathy", Roles: []string{"buyer"}}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(escrow.RefundEscrowHandler).ServeHTTP(rr, newRefundRequest(t, transactionID, claims))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRefundEscrowHandler_BuyerAfterFulfillment(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+
+	db.DB = sqlx.NewDb(mockDB, "sqlmock")
+
+	buyerID, transactionID := uuid.New(), uuid.New()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM transactions").
+		WithArgs(transactionID).
+		WillReturnRows(transactionRows(transactionID, buyerID, uuid.New(), "in_progress", "funded"))
+	mock.ExpectQuery("SELECT EXISTS").
+		WithArgs(transactionID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectRollback()
+
+	claims := &middleware.Claims{UserID: buyerID, Username: "cathy", Roles: []string{"buyer"}}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(escrow.RefundEscrowHandler).ServeHTTP(rr, newRefundRequest(t, transactionID, claims))
+
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRefundEscrowHandler_FrozenByDispute(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+
+	db.DB = sqlx.NewDb(mockDB, "sqlmock")
+
+	sellerID, transactionID := uuid.New(), uuid.New()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM transactions").
+		WithArgs(transactionID).
+		WillReturnRows(transactionRows(transactionID, uuid.New(), sellerID, "in_progress", "funded"))
+	mock.ExpectQuery("SELECT EXISTS").
+		WithArgs(transactionID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectRollback()
+
+	claims := &middleware.Claims{UserID: sellerID, Username: "frank", Roles: []string{"seller"}}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(escrow.RefundEscrowHandler).ServeHTTP(rr, newRefundRequest(t, transactionID, claims))
+
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRefundEscrowHandler_StepUpAboveThreshold(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+
+	db.DB = sqlx.NewDb(mockDB, "sqlmock")
+	if err := mfa.SetConfig(mfa.Config{StepUpThreshold: "10"}); err != nil {
+		t.Fatal(err)
+	}
+	defer mfa.SetConfig(mfa.DefaultConfig)
+
+	sellerID, transactionID := uuid.New(), uuid.New()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM transactions").
+		WithArgs(transactionID).
+		WillReturnRows(transactionRows(transactionID, uuid.New(), sellerID, "in_progress", "funded"))
+	mock.ExpectRollback()
+
+	claims := &middleware.Claims{UserID: sellerID, Username: "frank", Roles: []string{"seller"}}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(escrow.RefundEscrowHandler).ServeHTTP(rr, newRefundRequest(t, transactionID, claims))
+
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Contains(t, rr.Body.String(), mfa.CodeHeader)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRefundEscrowHandler_StepUpCountsWrongCodes(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+
+	db.DB = sqlx.NewDb(mockDB, "sqlmock")
+	if err := mfa.SetConfig(mfa.Config{StepUpThreshold: "10"}); err != nil {
+		t.Fatal(err)
+	}
+	defer mfa.SetConfig(mfa.DefaultConfig)
+
+	secret, _ := mfa.GenerateSecret()
+	sellerID, transactionID := uuid.New(), uuid.New()
+	claims := &middleware.Claims{UserID: sellerID, Username: "frank", Roles: []string{"seller"}}
+	expectTransaction := func() {
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT (.+) FROM transactions").
+			WithArgs(transactionID).
+			WillReturnRows(transactionRows(transactionID, uuid.New(), sellerID, "in_progress", "funded"))
+	}
+
+	// a wrong code is counted and the count committed
+	expectTransaction()
+	mock.ExpectQuery("SELECT blocked_until FROM login_throttles").
+		WithArgs(lockout.ScopeCode, sellerID.String(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"blocked_until"}))
+	mock.ExpectQuery("SELECT totp_secret, (.+) FOR UPDATE").
+		WithArgs(sellerID).
+		WillReturnRows(sqlmock.NewRows([]string{"totp_secret", "totp_enabled_at", "totp_last_step"}).AddRow(secret, time.Now(), 0))
+	mock.ExpectExec("UPDATE recovery_codes SET used_at").
+		WithArgs(sellerID, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("INSERT INTO login_throttles").
+		WithArgs(lockout.ScopeCode, sellerID.String(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(1))
+	mock.ExpectCommit()
+
+	req := newRefundRequest(t, transactionID, claims)
+	req.Header.Set(mfa.CodeHeader, "not-a-code")
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(escrow.RefundEscrowHandler).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	// once locked out no code is checked
+	expectTransaction()
+	mock.ExpectQuery("SELECT blocked_until FROM login_throttles").
+		WithArgs(lockout.ScopeCode, sellerID.String(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"blocked_until"}).AddRow(time.Now().Add(time.Minute)))
+	mock.ExpectRollback()
+
+	req = newRefundRequest(t, transactionID, claims)
+	req.Header.Set(mfa.CodeHeader, "not-a-code")
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(escrow.RefundEscrowHandler).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func expectPosting(mock sqlmock.Sqlmock, accountType string, ownerID uuid.UUID, amount string) {
+	mock.ExpectQuery("INSERT INTO ledger_accounts").
+		WithArgs(accountType, ownerID, "USD").
+		WillReturnRows(sqlmock.NewRows([]string{"account_id"}).AddRow(uuid.New()))
+	mock.ExpectExec("INSERT INTO ledger_postings").
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), amount).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func TestReleaseEscrowHandler_ChargesPlatformFee(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+
+	db.DB = sqlx.NewDb(mockDB, "sqlmock")
+
+	fees.SetSchedule(fees.Percentage{BasisPoints: 1000})
+	defer fees.SetSchedule(nil)
+
+	buyerID, sellerID, transactionID := uuid.New(), uuid.New(), uuid.New()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM transactions (.+) FOR UPDATE").
+		WithArgs(transactionID).
+		WillReturnRows(transactionRows(transactionID, buyerID, sellerID, "in_progress", "funded"))
+	mock.ExpectQuery("SELECT EXISTS").
+		WithArgs(transactionID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectExec("UPDATE milestones").
+		WithArgs("released", transactionID).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("UPDATE escrow_accounts SET escrow_status = \\$1, released_at = NOW\\(\\)").
+		WithArgs("released", transactionID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE transactions").
+		WithArgs("completed", "released", transactionID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT COALESCE\\(SUM\\(p.amount\\), 0\\)").
+		WithArgs("escrow_holding", transactionID, "USD").
+		WillReturnRows(sqlmock.NewRows([]string{"balance"}).AddRow("50.00"))
+	mock.ExpectQuery("INSERT INTO ledger_entries").
+		WithArgs(transactionID, "release", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"entry_id"}).AddRow(uuid.New()))
+	expectPosting(mock, "escrow_holding", transactionID, "-50.00")
+	expectPosting(mock, "seller_payable", sellerID, "50.00")
+	mock.ExpectExec("INSERT INTO transaction_logs").
+		WithArgs(transactionID, "EscrowReleased", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("INSERT INTO ledger_entries").
+		WithArgs(transactionID, "fee", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"entry_id"}).AddRow(uuid.New()))
+	expectPosting(mock, "seller_payable", sellerID, "-5.00")
+	expectPosting(mock, "platform_fees", uuid.Nil, "5.00")
+	mock.ExpectExec("INSERT INTO transaction_logs").
+		WithArgs(transactionID, "PlatformFeeCharged", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO payouts").
+		WithArgs(transactionID, sellerID, "45.00", "USD").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	req, err := http.NewRequest("PUT", "/escrow/"+transactionID.String()+"/release", strings.NewReader(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = mux.SetURLVars(req, map[string]string{"id": transactionID.String()})
+	claims := &middleware.Claims{UserID: buyerID, Username: "cathy", Roles: []string{"buyer"}}
+	req = req.WithContext(middleware.WithClaims(req.Context(), claims))
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(escrow.ReleaseEscrowHandler).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestReleaseEscrowHandler_AdminWithoutMFA(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+
+	db.DB = sqlx.NewDb(mockDB, "sqlmock")
+
+	transactionID := uuid.New()
+
+	// an admin who also buys passes the route check on the buyer role; on a
+	// password-only session that must not make them admin of someone else's
+	// transaction
+	for _, path := range []string{"/release", "/refund"} {
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT (.+) FROM transactions (.+) FOR UPDATE").
+			WithArgs(transactionID).
+			WillReturnRows(transactionRows(transactionID, uuid.New(), uuid.New(), "in_progress", "funded"))
+		mock.ExpectRollback()
+
+		req, err := http.NewRequest("PUT", "/escrow/"+transactionID.String()+path, strings.NewReader(`{"reason":"admin override"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = mux.SetURLVars(req, map[string]string{"id": transactionID.String()})
+		claims := &middleware.Claims{UserID: uuid.New(), Username: "root", Roles: []string{"admin", "buyer"}}
+		req = req.WithContext(middleware.WithClaims(req.Context(), claims))
+
+		handler := escrow.ReleaseEscrowHandler
+		if path == "/refund" {
+			handler = escrow.RefundEscrowHandler
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(handler).ServeHTTP(rr, req)
+
+		assert.Equal(t, http.StatusForbidden, rr.Code, path)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
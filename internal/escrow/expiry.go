@@ -0,0 +1,63 @@
+package escrow
+
+import (
+	"context"
+	"escrow-agent/pkg/models"
+	"sync"
+	"time"
+)
+
+func init() {
+	models.Lifecycle.OnTransition(models.EventFulfill, startInspection)
+	models.Lifecycle.OnTransition(models.EventFulfillMilestone, clearExpiry)
+}
+
+// Windows bounds how long a funded escrow may sit before the scheduler acts
+// on it: the seller has Fulfillment from the deposit to fulfill, and the
+// buyer has Inspection from fulfillment to confirm or dispute.
+type Windows struct {
+	Fulfillment time.Duration
+	Inspection  time.Duration
+}
+
+// DefaultWindows applies until SetWindows is called.
+var DefaultWindows = Windows{
+	Fulfillment: 14 * 24 * time.Hour,
+	Inspection:  7 * 24 * time.Hour,
+}
+
+var (
+	windowsMu sync.RWMutex
+	windows   = DefaultWindows
+)
+
+// SetWindows replaces the expiry windows applied to new deposits and
+// fulfillments. Escrows already carrying an expiry_date keep it.
+func SetWindows(w Windows) {
+	windowsMu.Lock()
+	defer windowsMu.Unlock()
+	windows = w
+}
+
+// CurrentWindows returns the expiry windows in effect.
+func CurrentWindows() Windows {
+	windowsMu.RLock()
+	defer windowsMu.RUnlock()
+	return windows
+}
+
+// startInspection moves the escrow's expiry_date from the fulfillment deadline
+// to the end of the buyer's inspection window.
+func startInspection(ctx context.Context, change models.Change) error {
+	expiry := time.Now().Add(CurrentWindows().Inspection)
+	_, err := change.Exec.Exec("UPDATE escrow_accounts SET expiry_date = $1 WHERE transaction_id = $2", expiry, change.TransactionID)
+	return err
+}
+
+// clearExpiry drops the escrow-wide deadline once milestones start being
+// fulfilled; from then on each fulfilled milestone is inspected on its own,
+// timed from its fulfilled_at.
+func clearExpiry(ctx context.Context, change models.Change) error {
+	_, err := change.Exec.Exec("UPDATE escrow_accounts SET expiry_date = NULL WHERE transaction_id = $1", change.TransactionID)
+	return err
+}
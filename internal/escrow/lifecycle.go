@@ -0,0 +1,195 @@
+package escrow
+
+import (
+	"context"
+	"escrow-agent/internal/fees"
+	"escrow-agent/internal/ledger"
+	"escrow-agent/internal/logs"
+	"escrow-agent/internal/payments"
+	"escrow-agent/internal/payouts"
+	"escrow-agent/pkg/models"
+	"fmt"
+	"math/big"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+func init() {
+	models.Lifecycle.OnAny(syncEscrowAccount)
+}
+
+const lockTransactionQuery = `
+	SELECT transaction_id, buyer_id, seller_id, amount, currency, transaction_status, escrow_status, dispute_id, payment_id, created_at, updated_at
+	FROM transactions
+	WHERE transaction_id = $1
+	FOR UPDATE
+`
+
+// LockTransaction reads a transaction inside tx and holds its row lock until
+// tx ends, so concurrent deposits, releases and refunds on the same
+// transaction run one after the other and each sees the other's result.
+func LockTransaction(tx *sqlx.Tx, transactionID uuid.UUID) (*models.Transaction, error) {
+	var transaction models.Transaction
+	if err := tx.Get(&transaction, lockTransactionQuery, transactionID); err != nil {
+		return nil, err
+	}
+	if err := transaction.AttachCurrency(); err != nil {
+		return nil, err
+	}
+	return &transaction, nil
+}
+
+// Apply fires event for the transaction inside tx and persists the resulting
+// transaction and escrow statuses. transaction must have been read with
+// LockTransaction in the same tx. Illegal moves return an error matching
+// models.ErrIllegalTransition.
+func Apply(ctx context.Context, tx *sqlx.Tx, transaction *models.Transaction, event models.Event, actor models.Actor) error {
+	var disputeOpen bool
+	err := tx.Get(&disputeOpen, "SELECT EXISTS(SELECT 1 FROM disputes WHERE transaction_id = $1 AND dispute_status = 'open')", transaction.TransactionID)
+	if err != nil {
+		return err
+	}
+
+	gc := models.GuardContext{Actor: actor, DisputeOpen: disputeOpen}
+	next, err := models.Lifecycle.Fire(ctx, event, transaction.TransactionID, transaction.State(), gc, tx)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE transactions
+		SET transaction_status = $1, escrow_status = $2, updated_at = NOW()
+		WHERE transaction_id = $3
+	`, next.Transaction, next.Escrow, transaction.TransactionID)
+	if err != nil {
+		return err
+	}
+
+	transaction.Status = string(next.Transaction)
+	transaction.EscrowStatus = string(next.Escrow)
+	return nil
+}
+
+// ReleaseEscrow pays the held funds out to the seller, charges the platform
+// fee on them as a separate ledger entry and log line and queues the rest for
+// payout. event is one of the releasing events (confirm, release or a dispute
+// decided for the seller).
+func ReleaseEscrow(ctx context.Context, tx *sqlx.Tx, transaction *models.Transaction, event models.Event, actor models.Actor, details string) error {
+	if err := Apply(ctx, tx, transaction, event, actor); err != nil {
+		return err
+	}
+	released, err := drainHolding(tx, transaction, ledger.ReleaseEntry)
+	if err != nil {
+		return err
+	}
+	if err := logs.Record(tx, transaction.TransactionID, "EscrowReleased", details); err != nil {
+		return err
+	}
+	return settleRelease(tx, transaction, released, models.NewMoney(0, released.Currency))
+}
+
+// settleRelease charges the platform fee on funds released to the seller,
+// with remaining still held afterwards, and queues what is left for payout.
+func settleRelease(tx *sqlx.Tx, transaction *models.Transaction, released, remaining models.Money) error {
+	fee, err := chargeFee(tx, transaction, released, remaining)
+	if err != nil {
+		return err
+	}
+	return payouts.Queue(tx, transaction, released.Sub(fee))
+}
+
+// chargeFee takes the platform's cut of a release out of the seller's payable
+// balance and returns it. The fee is computed once on the transaction amount,
+// as GET /fees/quote shows it, and each release carries its share, see
+// feeShare.
+func chargeFee(tx *sqlx.Tx, transaction *models.Transaction, released, remaining models.Money) (models.Money, error) {
+	none := models.NewMoney(0, released.Currency)
+	if !released.IsPositive() {
+		return none, nil
+	}
+	fee, err := feeShare(transaction, released, remaining)
+	if err != nil || !fee.IsPositive() {
+		return none, err
+	}
+	if _, err := ledger.Post(tx, ledger.FeeEntry(transaction, fee)); err != nil {
+		return none, err
+	}
+	details := fmt.Sprintf("Platform fee of %s %s charged on release of %s %s", fee, fee.Currency, released, released.Currency)
+	return fee, logs.Record(tx, transaction.TransactionID, "PlatformFeeCharged", details)
+}
+
+// feeShare is the part of the transaction's fee due on releasing released
+// while remaining stays held. Shares are pro rata to the amount released so
+// far, rounded down, so the release that empties the escrow carries the
+// remainder and the shares of all releases add up to the whole fee.
+func feeShare(transaction *models.Transaction, released, remaining models.Money) (models.Money, error) {
+	total, err := fees.Compute(fees.Current(), transaction.Amount)
+	if err != nil {
+		return models.NewMoney(0, released.Currency), err
+	}
+	after := transaction.Amount.Minor - remaining.Minor
+	before := after - released.Minor
+	share := proRata(total.Minor, after, transaction.Amount.Minor) - proRata(total.Minor, before, transaction.Amount.Minor)
+	return models.NewMoney(share, released.Currency), nil
+}
+
+// proRata is fee * part / whole rounded down, clamped to [0, fee].
+func proRata(fee, part, whole int64) int64 {
+	if part <= 0 || whole <= 0 {
+		return 0
+	}
+	if part >= whole {
+		return fee
+	}
+	share := new(big.Int).Mul(big.NewInt(fee), big.NewInt(part))
+	return share.Quo(share, big.NewInt(whole)).Int64()
+}
+
+// RefundEscrow returns the held funds to the buyer: the transaction and its
+// escrow are cancelled, a completed payment is refunded through its gateway,
+// the ledger moves the holding back to the buyer and the refund is written to
+// transaction_logs. event is either a refund or a
+// dispute decided for the buyer.
+func RefundEscrow(ctx context.Context, tx *sqlx.Tx, transaction *models.Transaction, event models.Event, actor models.Actor, details string) error {
+	if err := Apply(ctx, tx, transaction, event, actor); err != nil {
+		return err
+	}
+	if err := payments.Refund(ctx, tx, transaction.TransactionID); err != nil {
+		return err
+	}
+	if _, err := drainHolding(tx, transaction, ledger.RefundEntry); err != nil {
+		return err
+	}
+	return logs.Record(tx, transaction.TransactionID, "EscrowRefunded", details)
+}
+
+// drainHolding journals whatever escrow holding still holds for the
+// transaction out through entry and returns that amount. Escrows that were
+// never funded hold nothing and post no entry.
+func drainHolding(tx *sqlx.Tx, transaction *models.Transaction, entry func(*models.Transaction, models.Money) models.JournalEntry) (models.Money, error) {
+	held, err := ledger.Balance(tx, models.AccountEscrowHolding, transaction.TransactionID, transaction.Currency)
+	if err != nil || !held.IsPositive() {
+		return held, err
+	}
+	_, err = ledger.Post(tx, entry(transaction, held))
+	return held, err
+}
+
+// syncEscrowAccount mirrors escrow status changes onto the escrow_accounts row.
+// Transactions that were never funded have no row and are left alone.
+func syncEscrowAccount(ctx context.Context, change models.Change) error {
+	if change.From.Escrow == change.To.Escrow {
+		return nil
+	}
+
+	query := "UPDATE escrow_accounts SET escrow_status = $1 WHERE transaction_id = $2"
+	switch change.To.Escrow {
+	case models.StatusReleased:
+		query = "UPDATE escrow_accounts SET escrow_status = $1, released_at = NOW() WHERE transaction_id = $2"
+	case models.StatusCancelled:
+		query = "UPDATE escrow_accounts SET escrow_status = $1, cancelled_at = NOW() WHERE transaction_id = $2"
+	}
+	_, err := change.Exec.Exec(query, change.To.Escrow, change.TransactionID)
+	return err
+}
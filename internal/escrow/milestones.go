@@ -0,0 +1,182 @@
+package escrow
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"escrow-agent/internal/ledger"
+	"escrow-agent/internal/logs"
+	"escrow-agent/pkg/models"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+const milestoneColumns = `milestone_id, transaction_id, position, description, amount, currency, due_date, milestone_status, fulfilled_at, settled_at, created_at`
+
+var (
+	ErrMilestoneNotFound = errors.New("milestone not found")
+	ErrMilestoneState    = errors.New("milestone is not in a state that allows this")
+)
+
+func init() {
+	// settling the whole escrow settles every milestone that is still open
+	for _, event := range []models.Event{models.EventConfirm, models.EventRelease, models.EventResolveForSeller} {
+		models.Lifecycle.OnTransition(event, settleMilestones(models.MilestoneReleased))
+	}
+	for _, event := range []models.Event{models.EventRefund, models.EventResolveForBuyer} {
+		models.Lifecycle.OnTransition(event, settleMilestones(models.MilestoneRefunded))
+	}
+}
+
+func settleMilestones(status models.MilestoneStatus) models.Hook {
+	return func(ctx context.Context, change models.Change) error {
+		_, err := change.Exec.Exec(`
+			UPDATE milestones
+			SET milestone_status = $1, settled_at = NOW()
+			WHERE transaction_id = $2 AND milestone_status IN ('pending', 'fulfilled')
+		`, status, change.TransactionID)
+		return err
+	}
+}
+
+// Milestones lists the milestones of a transaction in order.
+func Milestones(q sqlx.Queryer, transactionID uuid.UUID) ([]models.Milestone, error) {
+	milestones := []models.Milestone{}
+	err := sqlx.Select(q, &milestones, "SELECT "+milestoneColumns+" FROM milestones WHERE transaction_id = $1 ORDER BY position", transactionID)
+	for i := 0; err == nil && i < len(milestones); i++ {
+		err = milestones[i].AttachCurrency()
+	}
+	return milestones, err
+}
+
+// CreateMilestones splits a new transaction into milestones. Their amounts
+// must add up to the transaction amount, in its currency.
+func CreateMilestones(tx *sqlx.Tx, transaction *models.Transaction, milestones []models.Milestone) error {
+	total := models.NewMoney(0, transaction.Currency)
+	for _, m := range milestones {
+		if m.Amount.Currency != transaction.Currency || !m.Amount.IsPositive() {
+			return fmt.Errorf("%w: milestone amounts must be positive and in %s", models.ErrInvalidAmount, transaction.Currency)
+		}
+		total = total.Add(m.Amount)
+	}
+	if !total.Equal(transaction.Amount) {
+		return fmt.Errorf("%w: milestones add up to %s, transaction is %s", models.ErrInvalidAmount, total, transaction.Amount)
+	}
+
+	for i, m := range milestones {
+		_, err := tx.Exec(`
+			INSERT INTO milestones (transaction_id, position, description, amount, currency, due_date, milestone_status, created_at)
+			VALUES ($1, $2, $3, $4, $5, $6, 'pending', NOW())
+		`, transaction.TransactionID, i+1, m.Description, m.Amount, m.Amount.Currency, m.DueDate)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lockMilestone reads a milestone of transaction and holds its row lock until
+// tx ends.
+func lockMilestone(tx *sqlx.Tx, transaction *models.Transaction, milestoneID uuid.UUID) (*models.Milestone, error) {
+	var m models.Milestone
+	err := tx.Get(&m, "SELECT "+milestoneColumns+" FROM milestones WHERE milestone_id = $1 AND transaction_id = $2 FOR UPDATE", milestoneID, transaction.TransactionID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrMilestoneNotFound
+	}
+	if err == nil {
+		err = m.AttachCurrency()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// FulfillMilestone records the seller's delivery of one milestone. The first
+// fulfillment moves the transaction in progress.
+func FulfillMilestone(ctx context.Context, tx *sqlx.Tx, transaction *models.Transaction, milestoneID uuid.UUID, actor models.Actor) (*models.Milestone, error) {
+	m, err := lockMilestone(tx, transaction, milestoneID)
+	if err != nil {
+		return nil, err
+	}
+	if m.Status != string(models.MilestonePending) {
+		return nil, fmt.Errorf("%w: milestone is %s", ErrMilestoneState, m.Status)
+	}
+
+	if err := Apply(ctx, tx, transaction, models.EventFulfillMilestone, actor); err != nil {
+		return nil, err
+	}
+
+	err = tx.Get(m, `
+		UPDATE milestones
+		SET milestone_status = 'fulfilled', fulfilled_at = NOW()
+		WHERE milestone_id = $1
+		RETURNING `+milestoneColumns, milestoneID)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.AttachCurrency(); err != nil {
+		return nil, err
+	}
+
+	details := fmt.Sprintf("Milestone %d (%s) fulfilled by seller", m.Position, m.Description)
+	return m, logs.Record(tx, transaction.TransactionID, "MilestoneFulfilled", details)
+}
+
+// ReleaseMilestone pays one fulfilled milestone's share out of escrow holding
+// to the seller, less the platform fee, while the rest stays held. Releasing
+// the last open milestone completes the transaction.
+func ReleaseMilestone(ctx context.Context, tx *sqlx.Tx, transaction *models.Transaction, milestoneID uuid.UUID, actor models.Actor) (*models.Milestone, error) {
+	m, err := lockMilestone(tx, transaction, milestoneID)
+	if err != nil {
+		return nil, err
+	}
+	if m.Status != string(models.MilestoneFulfilled) {
+		return nil, fmt.Errorf("%w: milestone is %s", ErrMilestoneState, m.Status)
+	}
+
+	if err := Apply(ctx, tx, transaction, models.EventReleaseMilestone, actor); err != nil {
+		return nil, err
+	}
+
+	held, err := ledger.Balance(tx, models.AccountEscrowHolding, transaction.TransactionID, transaction.Currency)
+	if err != nil {
+		return nil, err
+	}
+	if held.Minor < m.Amount.Minor {
+		return nil, fmt.Errorf("escrow holds %s, milestone needs %s", held, m.Amount)
+	}
+
+	err = tx.Get(m, `
+		UPDATE milestones
+		SET milestone_status = 'released', settled_at = NOW()
+		WHERE milestone_id = $1
+		RETURNING `+milestoneColumns, milestoneID)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.AttachCurrency(); err != nil {
+		return nil, err
+	}
+
+	if _, err := ledger.Post(tx, ledger.ReleaseEntry(transaction, m.Amount)); err != nil {
+		return nil, err
+	}
+	details := fmt.Sprintf("Milestone %d (%s) released %s %s to seller", m.Position, m.Description, m.Amount, m.Amount.Currency)
+	if err := logs.Record(tx, transaction.TransactionID, "MilestoneReleased", details); err != nil {
+		return nil, err
+	}
+	if err := settleRelease(tx, transaction, m.Amount, held.Sub(m.Amount)); err != nil {
+		return nil, err
+	}
+
+	var open int
+	err = tx.Get(&open, "SELECT COUNT(*) FROM milestones WHERE transaction_id = $1 AND milestone_status IN ('pending', 'fulfilled')", transaction.TransactionID)
+	if err != nil || open > 0 {
+		return m, err
+	}
+	return m, ReleaseEscrow(ctx, tx, transaction, models.EventRelease, models.ActorSystem, "All milestones released; transaction completed")
+}
@@ -0,0 +1,237 @@
+package escrow_test
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"escrow-agent/internal/db"
+	"escrow-agent/internal/escrow"
+	"escrow-agent/internal/fees"
+	"escrow-agent/internal/middleware"
+	"escrow-agent/pkg/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+)
+
+var milestoneColumns = []string{"milestone_id", "transaction_id", "position", "description", "amount", "currency", "due_date", "milestone_status", "fulfilled_at", "settled_at", "created_at"}
+
+func newMilestoneReleaseRequest(t *testing.T, transactionID, milestoneID uuid.UUID, claims *middleware.Claims) *http.Request {
+	body := `{"milestone_id":"` + milestoneID.String() + `"}`
+	req, err := http.NewRequest("PUT", "/escrow/"+transactionID.String()+"/release", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = mux.SetURLVars(req, map[string]string{"id": transactionID.String()})
+	return req.WithContext(middleware.WithClaims(req.Context(), claims))
+}
+
+func TestReleaseEscrowHandler_PartialMilestoneRelease(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+
+	db.DB = sqlx.NewDb(mockDB, "sqlmock")
+
+	buyerID, sellerID, transactionID, milestoneID := uuid.New(), uuid.New(), uuid.New(), uuid.New()
+	now := time.Now()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM transactions (.+) FOR UPDATE").
+		WithArgs(transactionID).
+		WillReturnRows(transactionRows(transactionID, buyerID, sellerID, "in_progress", "funded"))
+	mock.ExpectQuery("SELECT (.+) FROM milestones WHERE milestone_id = \\$1 AND transaction_id = \\$2 FOR UPDATE").
+		WithArgs(milestoneID, transactionID).
+		WillReturnRows(sqlmock.NewRows(milestoneColumns).
+			AddRow(milestoneID, transactionID, 1, "Design", "20.00", "USD", nil, "fulfilled", now, nil, now))
+	mock.ExpectQuery("SELECT EXISTS").
+		WithArgs(transactionID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectExec("UPDATE transactions").
+		WithArgs("in_progress", "funded", transactionID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT COALESCE\\(SUM\\(p.amount\\), 0\\)").
+		WithArgs("escrow_holding", transactionID, "USD").
+		WillReturnRows(sqlmock.NewRows([]string{"balance"}).AddRow("50.00"))
+	mock.ExpectQuery("UPDATE milestones").
+		WithArgs(milestoneID).
+		WillReturnRows(sqlmock.NewRows(milestoneColumns).
+			AddRow(milestoneID, transactionID, 1, "Design", "20.00", "USD", nil, "released", now, now, now))
+	mock.ExpectQuery("INSERT INTO ledger_entries").
+		WithArgs(transactionID, "release", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"entry_id"}).AddRow(uuid.New()))
+	expectPosting(mock, "escrow_holding", transactionID, "-20.00")
+	expectPosting(mock, "seller_payable", sellerID, "20.00")
+	mock.ExpectExec("INSERT INTO transaction_logs").
+		WithArgs(transactionID, "MilestoneReleased", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO payouts").
+		WithArgs(transactionID, sellerID, "20.00", "USD").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM milestones").
+		WithArgs(transactionID).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectCommit()
+
+	claims := &middleware.Claims{UserID: buyerID, Username: "cathy", Roles: []string{"buyer"}}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(escrow.ReleaseEscrowHandler).ServeHTTP(rr, newMilestoneReleaseRequest(t, transactionID, milestoneID, claims))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"milestone_status":"released"`)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestReleaseEscrowHandler_MilestoneNotFulfilled(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+
+	db.DB = sqlx.NewDb(mockDB, "sqlmock")
+
+	buyerID, transactionID, milestoneID := uuid.New(), uuid.New(), uuid.New()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM transactions (.+) FOR UPDATE").
+		WithArgs(transactionID).
+		WillReturnRows(transactionRows(transactionID, buyerID, uuid.New(), "in_progress", "funded"))
+	mock.ExpectQuery("SELECT (.+) FROM milestones").
+		WithArgs(milestoneID, transactionID).
+		WillReturnRows(sqlmock.NewRows(milestoneColumns).
+			AddRow(milestoneID, transactionID, 2, "Build", "30.00", "USD", nil, "pending", nil, nil, time.Now()))
+	mock.ExpectRollback()
+
+	claims := &middleware.Claims{UserID: buyerID, Username: "cathy", Roles: []string{"buyer"}}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(escrow.ReleaseEscrowHandler).ServeHTTP(rr, newMilestoneReleaseRequest(t, transactionID, milestoneID, claims))
+
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// capturedAmounts matches any posting amount and keeps it.
+type capturedAmounts []string
+
+func (c *capturedAmounts) Match(v driver.Value) bool {
+	s, ok := v.(string)
+	*c = append(*c, s)
+	return ok
+}
+
+// expectMilestoneRelease expects a fulfilled milestone of amount to be released
+// out of held, charging a platform fee that lands in charged.
+func expectMilestoneRelease(mock sqlmock.Sqlmock, transactionID, buyerID, sellerID, milestoneID uuid.UUID, amount, held string, charged *capturedAmounts) {
+	now := time.Now()
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM transactions (.+) FOR UPDATE").
+		WithArgs(transactionID).
+		WillReturnRows(transactionRows(transactionID, buyerID, sellerID, "in_progress", "funded"))
+	mock.ExpectQuery("SELECT (.+) FROM milestones WHERE milestone_id = \\$1 AND transaction_id = \\$2 FOR UPDATE").
+		WithArgs(milestoneID, transactionID).
+		WillReturnRows(sqlmock.NewRows(milestoneColumns).
+			AddRow(milestoneID, transactionID, 1, "Stage", amount, "USD", nil, "fulfilled", now, nil, now))
+	mock.ExpectQuery("SELECT EXISTS").
+		WithArgs(transactionID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectExec("UPDATE transactions").
+		WithArgs("in_progress", "funded", transactionID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT COALESCE\\(SUM\\(p.amount\\), 0\\)").
+		WithArgs("escrow_holding", transactionID, "USD").
+		WillReturnRows(sqlmock.NewRows([]string{"balance"}).AddRow(held))
+	mock.ExpectQuery("UPDATE milestones").
+		WithArgs(milestoneID).
+		WillReturnRows(sqlmock.NewRows(milestoneColumns).
+			AddRow(milestoneID, transactionID, 1, "Stage", amount, "USD", nil, "released", now, now, now))
+	mock.ExpectQuery("INSERT INTO ledger_entries").
+		WithArgs(transactionID, "release", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"entry_id"}).AddRow(uuid.New()))
+	expectPosting(mock, "escrow_holding", transactionID, "-"+amount)
+	expectPosting(mock, "seller_payable", sellerID, amount)
+	mock.ExpectExec("INSERT INTO transaction_logs").
+		WithArgs(transactionID, "MilestoneReleased", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("INSERT INTO ledger_entries").
+		WithArgs(transactionID, "fee", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"entry_id"}).AddRow(uuid.New()))
+	mock.ExpectQuery("INSERT INTO ledger_accounts").
+		WithArgs("seller_payable", sellerID, "USD").
+		WillReturnRows(sqlmock.NewRows([]string{"account_id"}).AddRow(uuid.New()))
+	mock.ExpectExec("INSERT INTO ledger_postings").
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("INSERT INTO ledger_accounts").
+		WithArgs("platform_fees", uuid.Nil, "USD").
+		WillReturnRows(sqlmock.NewRows([]string{"account_id"}).AddRow(uuid.New()))
+	mock.ExpectExec("INSERT INTO ledger_postings").
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), charged).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO transaction_logs").
+		WithArgs(transactionID, "PlatformFeeCharged", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO payouts").
+		WithArgs(transactionID, sellerID, sqlmock.AnyArg(), "USD").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM milestones").
+		WithArgs(transactionID).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectCommit()
+}
+
+func TestReleaseEscrowHandler_MilestoneFeesAddUpToQuote(t *testing.T) {
+	schedules := map[string]fees.Schedule{
+		"flat":   fees.Flat{Amount: "1.00"},
+		"capped": fees.Capped{Schedule: fees.Percentage{BasisPoints: 1000}, Max: "3.00"},
+	}
+	for name, schedule := range schedules {
+		t.Run(name, func(t *testing.T) {
+			mockDB, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("Failed to open mock DB: %v", err)
+			}
+			defer mockDB.Close()
+
+			db.DB = sqlx.NewDb(mockDB, "sqlmock")
+
+			fees.SetSchedule(schedule)
+			defer fees.SetSchedule(nil)
+
+			buyerID, sellerID, transactionID := uuid.New(), uuid.New(), uuid.New()
+			claims := &middleware.Claims{UserID: buyerID, Username: "cathy", Roles: []string{"buyer"}}
+			releases := []struct{ amount, held string }{
+				{"16.67", "50.00"},
+				{"16.67", "33.33"},
+				{"16.66", "16.66"},
+			}
+			var charged capturedAmounts
+			for _, release := range releases {
+				milestoneID := uuid.New()
+				expectMilestoneRelease(mock, transactionID, buyerID, sellerID, milestoneID, release.amount, release.held, &charged)
+				rr := httptest.NewRecorder()
+				http.HandlerFunc(escrow.ReleaseEscrowHandler).ServeHTTP(rr, newMilestoneReleaseRequest(t, transactionID, milestoneID, claims))
+				assert.Equal(t, http.StatusOK, rr.Code)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+
+			total := models.NewMoney(0, "USD")
+			for _, fee := range charged {
+				total = total.Add(models.MustParseMoney(fee, "USD"))
+			}
+			quote, err := fees.QuoteFor(models.MustParseMoney("50.00", "USD"))
+			assert.NoError(t, err)
+			assert.Len(t, charged, len(releases))
+			assert.Equal(t, quote.Fee.String(), total.String())
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package fees
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+var (
+	scheduleMu sync.RWMutex
+	current    Schedule = None{}
+)
+
+// SetSchedule installs the schedule applied at release and quoted to buyers.
+func SetSchedule(s Schedule) {
+	scheduleMu.Lock()
+	defer scheduleMu.Unlock()
+	if s == nil {
+		s = None{}
+	}
+	current = s
+}
+
+// Current returns the installed schedule.
+func Current() Schedule {
+	scheduleMu.RLock()
+	defer scheduleMu.RUnlock()
+	return current
+}
+
+// scheduleSpec is the JSON form of a schedule, e.g.
+//
+//	{"type": "capped", "max": "50", "schedule":
+//	    {"type": "sum", "parts": [{"type": "percentage", "basis_points": 290}, {"type": "flat", "amount": "0.30"}]}}
+type scheduleSpec struct {
+	Type        string          `json:"type"`
+	Amount      string          `json:"amount"`
+	BasisPoints int64           `json:"basis_points"`
+	Min         string          `json:"min"`
+	Max         string          `json:"max"`
+	Schedule    *scheduleSpec   `json:"schedule"`
+	Parts       []*scheduleSpec `json:"parts"`
+	Tiers       []struct {
+		UpTo     string        `json:"up_to"`
+		Schedule *scheduleSpec `json:"schedule"`
+	} `json:"tiers"`
+}
+
+// ParseSchedule reads a schedule from its JSON form.
+func ParseSchedule(data []byte) (Schedule, error) {
+	var spec scheduleSpec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSchedule, err)
+	}
+	return spec.build()
+}
+
+func (s *scheduleSpec) build() (Schedule, error) {
+	if s == nil {
+		return nil, fmt.Errorf("%w: missing schedule", ErrInvalidSchedule)
+	}
+
+	switch s.Type {
+	case "none":
+		return None{}, nil
+	case "flat":
+		if s.Amount == "" {
+			return nil, fmt.Errorf("%w: flat fee needs an amount", ErrInvalidSchedule)
+		}
+		return Flat{Amount: s.Amount}, nil
+	case "percentage":
+		if s.BasisPoints < 0 || s.BasisPoints > 10000 {
+			return nil, fmt.Errorf("%w: basis points must be between 0 and 10000", ErrInvalidSchedule)
+		}
+		return Percentage{BasisPoints: s.BasisPoints}, nil
+	case "capped":
+		inner, err := s.Schedule.build()
+		if err != nil {
+			return nil, err
+		}
+		return Capped{Schedule: inner, Min: s.Min, Max: s.Max}, nil
+	case "sum":
+		sum := Sum{}
+		for _, part := range s.Parts {
+			built, err := part.build()
+			if err != nil {
+				return nil, err
+			}
+			sum.Parts = append(sum.Parts, built)
+		}
+		return sum, nil
+	case "tiered":
+		tiered := Tiered{}
+		for _, tier := range s.Tiers {
+			built, err := tier.Schedule.build()
+			if err != nil {
+				return nil, err
+			}
+			tiered.Tiers = append(tiered.Tiers, Tier{UpTo: tier.UpTo, Schedule: built})
+		}
+		if len(tiered.Tiers) == 0 || tiered.Tiers[len(tiered.Tiers)-1].UpTo != "" {
+			return nil, fmt.Errorf("%w: the last tier must be unbounded", ErrInvalidSchedule)
+		}
+		return tiered, nil
+	}
+	return nil, fmt.Errorf("%w: unknown type %q", ErrInvalidSchedule, s.Type)
+}
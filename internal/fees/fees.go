@@ -0,0 +1,141 @@
+package fees
+
+import (
+	"errors"
+	"fmt"
+
+	"escrow-agent/pkg/models"
+)
+
+var ErrInvalidSchedule = errors.New("invalid fee schedule")
+
+// Schedule computes the platform's cut of an amount. Fees are returned in the
+// amount's currency. Decimal settings such as flat fees and caps are read in
+// that currency too, so one schedule serves every currency whose minor unit
+// can express them.
+type Schedule interface {
+	Fee(amount models.Money) (models.Money, error)
+}
+
+// None charges nothing. It is the schedule until one is configured.
+type None struct{}
+
+func (None) Fee(amount models.Money) (models.Money, error) {
+	return models.NewMoney(0, amount.Currency), nil
+}
+
+// Flat charges the same amount on every transaction.
+type Flat struct {
+	Amount string
+}
+
+func (f Flat) Fee(amount models.Money) (models.Money, error) {
+	return models.ParseMoney(f.Amount, amount.Currency)
+}
+
+// Percentage charges basis points of the amount (290 is 2.9%), rounded half
+// up to the minor unit.
+type Percentage struct {
+	BasisPoints int64
+}
+
+func (p Percentage) Fee(amount models.Money) (models.Money, error) {
+	fee := (amount.Minor*p.BasisPoints + 5000) / 10000
+	return models.NewMoney(fee, amount.Currency), nil
+}
+
+// Tier applies Schedule to amounts up to and including UpTo. An empty UpTo
+// has no upper bound.
+type Tier struct {
+	UpTo     string
+	Schedule Schedule
+}
+
+// Tiered picks the first tier whose bound covers the whole amount. Tiers must
+// be in ascending order and the last one should be unbounded.
+type Tiered struct {
+	Tiers []Tier
+}
+
+func (t Tiered) Fee(amount models.Money) (models.Money, error) {
+	for _, tier := range t.Tiers {
+		if tier.UpTo == "" {
+			return tier.Schedule.Fee(amount)
+		}
+		limit, err := models.ParseMoney(tier.UpTo, amount.Currency)
+		if err != nil {
+			return amount, err
+		}
+		if amount.Minor <= limit.Minor {
+			return tier.Schedule.Fee(amount)
+		}
+	}
+	return amount, fmt.Errorf("%w: no tier covers %s %s", ErrInvalidSchedule, amount, amount.Currency)
+}
+
+// Capped keeps the fee of Schedule between Min and Max. Either bound may be
+// empty.
+type Capped struct {
+	Schedule Schedule
+	Min      string
+	Max      string
+}
+
+func (c Capped) Fee(amount models.Money) (models.Money, error) {
+	fee, err := c.Schedule.Fee(amount)
+	if err != nil {
+		return fee, err
+	}
+	if c.Min != "" {
+		min, err := models.ParseMoney(c.Min, amount.Currency)
+		if err != nil {
+			return fee, err
+		}
+		if fee.Minor < min.Minor {
+			fee = min
+		}
+	}
+	if c.Max != "" {
+		max, err := models.ParseMoney(c.Max, amount.Currency)
+		if err != nil {
+			return fee, err
+		}
+		if fee.Minor > max.Minor {
+			fee = max
+		}
+	}
+	return fee, nil
+}
+
+// Sum adds the fees of several schedules, e.g. 2.9% plus a flat 0.30.
+type Sum struct {
+	Parts []Schedule
+}
+
+func (s Sum) Fee(amount models.Money) (models.Money, error) {
+	total := models.NewMoney(0, amount.Currency)
+	for _, part := range s.Parts {
+		fee, err := part.Fee(amount)
+		if err != nil {
+			return total, err
+		}
+		total = total.Add(fee)
+	}
+	return total, nil
+}
+
+// Compute applies schedule to amount and never returns more than the amount
+// itself or less than zero.
+func Compute(schedule Schedule, amount models.Money) (models.Money, error) {
+	fee, err := schedule.Fee(amount)
+	if err != nil {
+		return fee, err
+	}
+	if fee.Minor < 0 {
+		fee = models.NewMoney(0, amount.Currency)
+	}
+	if fee.Minor > amount.Minor {
+		fee = amount
+	}
+	return fee, nil
+}
@@ -0,0 +1,81 @@
+package fees_test
+
+import (
+	"testing"
+
+	"escrow-agent/internal/fees"
+	"escrow-agent/pkg/models"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func usd(amount string) models.Money {
+	return models.MustParseMoney(amount, "USD")
+}
+
+func feeOf(t *testing.T, schedule fees.Schedule, amount models.Money) string {
+	fee, err := fees.Compute(schedule, amount)
+	assert.NoError(t, err)
+	return fee.String()
+}
+
+func TestSchedules(t *testing.T) {
+	assert.Equal(t, "0.00", feeOf(t, fees.None{}, usd("100")))
+	assert.Equal(t, "1.50", feeOf(t, fees.Flat{Amount: "1.5"}, usd("100")))
+	assert.Equal(t, "2.90", feeOf(t, fees.Percentage{BasisPoints: 290}, usd("100")))
+	// 2.9% of 0.50 is 0.0145, rounded half up
+	assert.Equal(t, "0.01", feeOf(t, fees.Percentage{BasisPoints: 290}, usd("0.50")))
+
+	card := fees.Sum{Parts: []fees.Schedule{fees.Percentage{BasisPoints: 290}, fees.Flat{Amount: "0.30"}}}
+	assert.Equal(t, "3.20", feeOf(t, card, usd("100")))
+
+	capped := fees.Capped{Schedule: fees.Percentage{BasisPoints: 500}, Min: "1", Max: "25"}
+	assert.Equal(t, "1.00", feeOf(t, capped, usd("10")))
+	assert.Equal(t, "25.00", feeOf(t, capped, usd("1000")))
+
+	tiered := fees.Tiered{Tiers: []fees.Tier{
+		{UpTo: "100", Schedule: fees.Percentage{BasisPoints: 500}},
+		{UpTo: "1000", Schedule: fees.Percentage{BasisPoints: 300}},
+		{Schedule: fees.Percentage{BasisPoints: 100}},
+	}}
+	assert.Equal(t, "5.00", feeOf(t, tiered, usd("100")))
+	assert.Equal(t, "3.03", feeOf(t, tiered, usd("101")))
+	assert.Equal(t, "50.00", feeOf(t, tiered, usd("5000")))
+
+	// a fee never exceeds the amount it is charged on
+	assert.Equal(t, "0.50", feeOf(t, fees.Flat{Amount: "2"}, usd("0.50")))
+}
+
+func TestParseSchedule(t *testing.T) {
+	schedule, err := fees.ParseSchedule([]byte(`{
+		"type": "capped", "max": "50",
+		"schedule": {"type": "sum", "parts": [
+			{"type": "percentage", "basis_points": 290},
+			{"type": "flat", "amount": "0.30"}
+		]}
+	}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "29.30", feeOf(t, schedule, usd("1000")))
+	assert.Equal(t, "50.00", feeOf(t, schedule, usd("5000")))
+
+	for _, spec := range []string{
+		`{"type": "bogus"}`,
+		`{"type": "flat"}`,
+		`{"type": "percentage", "basis_points": 20000}`,
+		`{"type": "tiered", "tiers": [{"up_to": "100", "schedule": {"type": "none"}}]}`,
+		`{"type": "capped"}`,
+	} {
+		_, err := fees.ParseSchedule([]byte(spec))
+		assert.ErrorIs(t, err, fees.ErrInvalidSchedule, spec)
+	}
+}
+
+func TestQuoteFor(t *testing.T) {
+	fees.SetSchedule(fees.Percentage{BasisPoints: 250})
+	defer fees.SetSchedule(nil)
+
+	quote, err := fees.QuoteFor(usd("80"))
+	assert.NoError(t, err)
+	assert.Equal(t, "2.00", quote.Fee.String())
+	assert.Equal(t, "78.00", quote.SellerReceives.String())
+}
@@ -0,0 +1,56 @@
+package fees
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"escrow-agent/pkg/models"
+)
+
+// Quote is what a transaction of Amount costs the seller under the current
+// schedule.
+type Quote struct {
+	Amount         models.Money `json:"amount"`
+	Currency       string       `json:"currency"`
+	Fee            models.Money `json:"fee"`
+	SellerReceives models.Money `json:"seller_receives"`
+}
+
+// QuoteFor prices amount under the current schedule.
+func QuoteFor(amount models.Money) (Quote, error) {
+	fee, err := Compute(Current(), amount)
+	if err != nil {
+		return Quote{}, err
+	}
+	return Quote{Amount: amount, Currency: amount.Currency, Fee: fee, SellerReceives: amount.Sub(fee)}, nil
+}
+
+// GetFeeQuoteHandler quotes the platform fee for ?amount= in ?currency=
+// (default USD) so a buyer can see it before creating the transaction.
+func GetFeeQuoteHandler(w http.ResponseWriter, r *http.Request) {
+	currency := r.URL.Query().Get("currency")
+	if currency == "" {
+		currency = models.DefaultCurrency
+	}
+	if !models.ValidCurrency(currency) {
+		http.Error(w, "Unsupported currency", http.StatusBadRequest)
+		return
+	}
+
+	amount, err := models.ParseMoney(r.URL.Query().Get("amount"), currency)
+	if err != nil || !amount.IsPositive() {
+		http.Error(w, "A valid amount is required", http.StatusBadRequest)
+		return
+	}
+
+	quote, err := QuoteFor(amount)
+	if err != nil {
+		log.Printf("[ERROR] Failed to quote fee for %s %s: %v", amount, currency, err)
+		http.Error(w, "Failed to quote fee", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(quote)
+}
@@ -0,0 +1,62 @@
+package fx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+
+	"escrow-agent/pkg/models"
+)
+
+var ErrNoRate = errors.New("no exchange rate")
+
+// Provider quotes the rate that converts one unit of from into to. Rates are
+// exact rationals so conversions round only once, at the end.
+type Provider interface {
+	Rate(ctx context.Context, from, to string) (*big.Rat, error)
+}
+
+var (
+	providerMu sync.RWMutex
+	provider   Provider
+)
+
+// SetProvider installs the FX provider used for reporting. Passing nil
+// disables conversion.
+func SetProvider(p Provider) {
+	providerMu.Lock()
+	defer providerMu.Unlock()
+	provider = p
+}
+
+// CurrentProvider returns the installed provider, if any.
+func CurrentProvider() (Provider, bool) {
+	providerMu.RLock()
+	defer providerMu.RUnlock()
+	return provider, provider != nil
+}
+
+// Convert expresses m in currency to, rounding half away from zero to the
+// target currency's minor unit.
+func Convert(ctx context.Context, p Provider, m models.Money, to string) (models.Money, error) {
+	if m.Currency == to {
+		return m, nil
+	}
+	if !models.ValidCurrency(to) {
+		return m, fmt.Errorf("%w: %q", models.ErrUnsupportedCurrency, to)
+	}
+
+	rate, err := p.Rate(ctx, m.Currency, to)
+	if err != nil {
+		return m, err
+	}
+
+	amount, ok := new(big.Rat).SetString(m.String())
+	if !ok {
+		return m, fmt.Errorf("%w: %q", models.ErrInvalidAmount, m.String())
+	}
+	amount.Mul(amount, rate)
+	return models.ParseMoney(amount.FloatString(models.MinorDigits(to)), to)
+}
@@ -0,0 +1,49 @@
+package fx_test
+
+import (
+	"context"
+	"testing"
+
+	"escrow-agent/internal/fx"
+	"escrow-agent/pkg/models"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStaticProvider_Convert(t *testing.T) {
+	rates, err := fx.NewStaticProvider(map[string]string{"EUR/USD": "1.08", "USD/JPY": "151.5"})
+	assert.NoError(t, err)
+	ctx := context.Background()
+
+	usd, err := fx.Convert(ctx, rates, models.MustParseMoney("100.00", "EUR"), "USD")
+	assert.NoError(t, err)
+	assert.True(t, usd.Equal(models.MustParseMoney("108.00", "USD")), usd)
+
+	// inverse of EUR/USD, rounded half away from zero
+	eur, err := fx.Convert(ctx, rates, models.MustParseMoney("1.00", "USD"), "EUR")
+	assert.NoError(t, err)
+	assert.True(t, eur.Equal(models.MustParseMoney("0.93", "EUR")), eur)
+
+	jpy, err := fx.Convert(ctx, rates, models.MustParseMoney("10.01", "USD"), "JPY")
+	assert.NoError(t, err)
+	assert.True(t, jpy.Equal(models.NewMoney(1517, "JPY")), jpy)
+
+	_, err = fx.Convert(ctx, rates, models.MustParseMoney("1", "GBP"), "USD")
+	assert.ErrorIs(t, err, fx.ErrNoRate)
+}
+
+func TestParseStaticRates(t *testing.T) {
+	rates, err := fx.ParseStaticRates("EUR/USD=1.08, gbp/usd=1.27")
+	assert.NoError(t, err)
+
+	rate, err := rates.Rate(context.Background(), "GBP", "USD")
+	assert.NoError(t, err)
+	assert.Equal(t, "1.27", rate.FloatString(2))
+
+	_, err = fx.ParseStaticRates("EUR/USD")
+	assert.Error(t, err)
+	_, err = fx.ParseStaticRates("EURUSD=1.08")
+	assert.Error(t, err)
+	_, err = fx.ParseStaticRates("EUR/USD=-1")
+	assert.Error(t, err)
+}
@@ -0,0 +1,64 @@
+package fx
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// StaticProvider serves rates from a fixed table. A rate for EUR/USD also
+// answers USD/EUR through its inverse. It suits tests and deployments that
+// load rates from configuration.
+type StaticProvider struct {
+	rates map[string]*big.Rat
+}
+
+// NewStaticProvider builds a provider from decimal rates keyed "FROM/TO", e.g.
+// {"EUR/USD": "1.08"}.
+func NewStaticProvider(rates map[string]string) (*StaticProvider, error) {
+	p := &StaticProvider{rates: map[string]*big.Rat{}}
+	for pair, value := range rates {
+		from, to, ok := strings.Cut(pair, "/")
+		if !ok || from == "" || to == "" {
+			return nil, fmt.Errorf("invalid currency pair %q", pair)
+		}
+		rate, ok := new(big.Rat).SetString(value)
+		if !ok || rate.Sign() <= 0 {
+			return nil, fmt.Errorf("invalid rate %q for %s", value, pair)
+		}
+		p.rates[strings.ToUpper(from)+"/"+strings.ToUpper(to)] = rate
+	}
+	return p, nil
+}
+
+// ParseStaticRates reads a comma separated list such as
+// "EUR/USD=1.08,GBP/USD=1.27" into a StaticProvider.
+func ParseStaticRates(spec string) (*StaticProvider, error) {
+	rates := map[string]string{}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		pair, value, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid rate %q", item)
+		}
+		rates[strings.TrimSpace(pair)] = strings.TrimSpace(value)
+	}
+	return NewStaticProvider(rates)
+}
+
+func (p *StaticProvider) Rate(ctx context.Context, from, to string) (*big.Rat, error) {
+	if from == to {
+		return big.NewRat(1, 1), nil
+	}
+	if rate, ok := p.rates[from+"/"+to]; ok {
+		return new(big.Rat).Set(rate), nil
+	}
+	if rate, ok := p.rates[to+"/"+from]; ok {
+		return new(big.Rat).Inv(rate), nil
+	}
+	return nil, fmt.Errorf("%w: %s/%s", ErrNoRate, from, to)
+}
@@ -0,0 +1,78 @@
+package ledger
+
+import (
+	"fmt"
+
+	"escrow-agent/pkg/models"
+
+	"github.com/google/uuid"
+)
+
+// The constructors below describe each escrow money movement. Holding is kept
+// per transaction so its balance is exactly what the escrow still owes. All
+// postings are in the currency of the amount passed in.
+
+// DepositEntry moves the buyer's payment into escrow holding.
+func DepositEntry(t *models.Transaction, amount models.Money) models.JournalEntry {
+	return models.JournalEntry{
+		TransactionID: t.TransactionID,
+		Type:          models.EntryDeposit,
+		Description:   fmt.Sprintf("Buyer funded escrow with %s", amount),
+		Postings: []models.JournalPosting{
+			{AccountType: models.AccountEscrowHolding, OwnerID: t.TransactionID, Amount: amount},
+			{AccountType: models.AccountBuyerFunding, OwnerID: t.BuyerID, Amount: amount.Neg()},
+		},
+	}
+}
+
+// ReleaseEntry moves held funds to the seller's payable account.
+func ReleaseEntry(t *models.Transaction, amount models.Money) models.JournalEntry {
+	return models.JournalEntry{
+		TransactionID: t.TransactionID,
+		Type:          models.EntryRelease,
+		Description:   fmt.Sprintf("Escrow released %s to seller", amount),
+		Postings: []models.JournalPosting{
+			{AccountType: models.AccountEscrowHolding, OwnerID: t.TransactionID, Amount: amount.Neg()},
+			{AccountType: models.AccountSellerPayable, OwnerID: t.SellerID, Amount: amount},
+		},
+	}
+}
+
+// RefundEntry returns held funds to the buyer.
+func RefundEntry(t *models.Transaction, amount models.Money) models.JournalEntry {
+	return models.JournalEntry{
+		TransactionID: t.TransactionID,
+		Type:          models.EntryRefund,
+		Description:   fmt.Sprintf("Escrow refunded %s to buyer", amount),
+		Postings: []models.JournalPosting{
+			{AccountType: models.AccountEscrowHolding, OwnerID: t.TransactionID, Amount: amount.Neg()},
+			{AccountType: models.AccountBuyerFunding, OwnerID: t.BuyerID, Amount: amount},
+		},
+	}
+}
+
+// FeeEntry charges the platform fee against the seller's payable account.
+func FeeEntry(t *models.Transaction, fee models.Money) models.JournalEntry {
+	return models.JournalEntry{
+		TransactionID: t.TransactionID,
+		Type:          models.EntryFee,
+		Description:   fmt.Sprintf("Platform fee of %s", fee),
+		Postings: []models.JournalPosting{
+			{AccountType: models.AccountSellerPayable, OwnerID: t.SellerID, Amount: fee.Neg()},
+			{AccountType: models.AccountPlatformFees, OwnerID: uuid.Nil, Amount: fee},
+		},
+	}
+}
+
+// PayoutEntry moves a payout sent to the seller out of their payable account.
+func PayoutEntry(p *models.Payout) models.JournalEntry {
+	return models.JournalEntry{
+		TransactionID: p.TransactionID,
+		Type:          models.EntryPayout,
+		Description:   fmt.Sprintf("Paid out %s to seller", p.Amount),
+		Postings: []models.JournalPosting{
+			{AccountType: models.AccountSellerPayable, OwnerID: p.SellerID, Amount: p.Amount.Neg()},
+			{AccountType: models.AccountSellerDisbursed, OwnerID: p.SellerID, Amount: p.Amount},
+		},
+	}
+}
@@ -0,0 +1,54 @@
+package ledger
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"escrow-agent/internal/db"
+	"escrow-agent/pkg/models"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// GetTransactionLedgerHandler lists the journal entries of a transaction
+// together with what its escrow currently holds. Admin only.
+func GetTransactionLedgerHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	transactionID, err := uuid.Parse(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid transaction ID", http.StatusBadRequest)
+		return
+	}
+
+	var currency string
+	err = db.DB.Get(&currency, "SELECT currency FROM transactions WHERE transaction_id = $1", transactionID)
+	if err != nil {
+		log.Printf("[ERROR] Transaction not found with ID %s: %v", transactionID, err)
+		http.Error(w, "Transaction not found", http.StatusNotFound)
+		return
+	}
+
+	entries, err := Entries(db.DB, transactionID)
+	if err != nil {
+		log.Printf("[ERROR] Failed to fetch ledger for transaction ID %s: %v", transactionID, err)
+		http.Error(w, "Failed to fetch ledger", http.StatusInternalServerError)
+		return
+	}
+
+	held, err := Balance(db.DB, models.AccountEscrowHolding, transactionID, currency)
+	if err != nil {
+		log.Printf("[ERROR] Failed to compute escrow balance for transaction ID %s: %v", transactionID, err)
+		http.Error(w, "Failed to fetch ledger", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"transaction_id": transactionID,
+		"currency":       currency,
+		"escrow_balance": held,
+		"entries":        entries,
+	})
+}
@@ -0,0 +1,138 @@
+package ledger
+
+import (
+	"errors"
+	"fmt"
+
+	"escrow-agent/pkg/models"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+var ErrUnbalanced = errors.New("journal entry is not balanced")
+
+// Validate checks that an entry has at least two non-zero postings in a single
+// currency and that they sum to zero.
+func Validate(entry models.JournalEntry) error {
+	if len(entry.Postings) < 2 {
+		return fmt.Errorf("%w: needs at least two postings", ErrUnbalanced)
+	}
+
+	sum := models.NewMoney(0, entry.Postings[0].Amount.Currency)
+	for _, p := range entry.Postings {
+		if p.Amount.Currency != sum.Currency {
+			return fmt.Errorf("%w: mixes %s and %s", ErrUnbalanced, sum.Currency, p.Amount.Currency)
+		}
+		if p.Amount.IsZero() {
+			return fmt.Errorf("%w: zero posting to %s", ErrUnbalanced, p.AccountType)
+		}
+		sum = sum.Add(p.Amount)
+	}
+	if !sum.IsZero() {
+		return fmt.Errorf("%w: postings sum to %s", ErrUnbalanced, sum)
+	}
+	return nil
+}
+
+// Post writes a balanced entry and its postings inside tx, opening ledger
+// accounts on first use. Entries are never updated or deleted; corrections are
+// posted as new entries.
+func Post(tx *sqlx.Tx, entry models.JournalEntry) (uuid.UUID, error) {
+	if err := Validate(entry); err != nil {
+		return uuid.Nil, err
+	}
+
+	var entryID uuid.UUID
+	err := tx.QueryRow(`
+		INSERT INTO ledger_entries (transaction_id, entry_type, description, created_at)
+		VALUES ($1, $2, $3, NOW())
+		RETURNING entry_id
+	`, entry.TransactionID, entry.Type, entry.Description).Scan(&entryID)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	for _, p := range entry.Postings {
+		accountID, err := account(tx, p.AccountType, p.OwnerID, p.Amount.Currency)
+		if err != nil {
+			return uuid.Nil, err
+		}
+		_, err = tx.Exec("INSERT INTO ledger_postings (entry_id, account_id, amount) VALUES ($1, $2, $3)", entryID, accountID, p.Amount)
+		if err != nil {
+			return uuid.Nil, err
+		}
+	}
+	return entryID, nil
+}
+
+// account returns the id of the account for accountType, owner and currency,
+// creating it if needed.
+func account(tx *sqlx.Tx, accountType models.LedgerAccountType, ownerID uuid.UUID, currency string) (uuid.UUID, error) {
+	var accountID uuid.UUID
+	err := tx.QueryRow(`
+		INSERT INTO ledger_accounts (account_type, owner_id, currency)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (account_type, owner_id, currency) DO UPDATE SET account_type = EXCLUDED.account_type
+		RETURNING account_id
+	`, accountType, ownerID, currency).Scan(&accountID)
+	return accountID, err
+}
+
+// Balance sums every posting made to an account. Accounts that were never
+// posted to have a zero balance.
+func Balance(q sqlx.Queryer, accountType models.LedgerAccountType, ownerID uuid.UUID, currency string) (models.Money, error) {
+	var balance models.Money
+	err := sqlx.Get(q, &balance, `
+		SELECT COALESCE(SUM(p.amount), 0)
+		FROM ledger_postings p
+		JOIN ledger_accounts a ON a.account_id = p.account_id
+		WHERE a.account_type = $1 AND a.owner_id = $2 AND a.currency = $3
+	`, accountType, ownerID, currency)
+	if err != nil {
+		return balance, err
+	}
+	return balance.WithCurrency(currency)
+}
+
+// Entries returns the journal of a transaction, oldest first, with postings.
+func Entries(q sqlx.Queryer, transactionID uuid.UUID) ([]models.JournalEntry, error) {
+	var entries []models.JournalEntry
+	err := sqlx.Select(q, &entries, `
+		SELECT entry_id, transaction_id, entry_type, description, created_at
+		FROM ledger_entries
+		WHERE transaction_id = $1
+		ORDER BY created_at, entry_id
+	`, transactionID)
+	if err != nil {
+		return nil, err
+	}
+
+	var postings []models.JournalPosting
+	err = sqlx.Select(q, &postings, `
+		SELECT p.posting_id, p.entry_id, a.account_type, a.owner_id, p.amount, a.currency
+		FROM ledger_postings p
+		JOIN ledger_accounts a ON a.account_id = p.account_id
+		JOIN ledger_entries e ON e.entry_id = p.entry_id
+		WHERE e.transaction_id = $1
+		ORDER BY p.posting_id
+	`, transactionID)
+	if err != nil {
+		return nil, err
+	}
+
+	byEntry := map[uuid.UUID]int{}
+	for i := range entries {
+		entries[i].Postings = []models.JournalPosting{}
+		byEntry[entries[i].EntryID] = i
+	}
+	for _, p := range postings {
+		if p.Amount, err = p.Amount.WithCurrency(p.Currency); err != nil {
+			return nil, err
+		}
+		if i, ok := byEntry[p.EntryID]; ok {
+			entries[i].Postings = append(entries[i].Postings, p)
+		}
+	}
+	return entries, nil
+}
@@ -0,0 +1,116 @@
+package ledger_test
+
+import (
+	"testing"
+
+	"escrow-agent/internal/db"
+	"escrow-agent/internal/ledger"
+	"escrow-agent/pkg/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+)
+
+func usd(amount string) models.Money {
+	return models.MustParseMoney(amount, "USD")
+}
+
+func testTransaction() *models.Transaction {
+	return &models.Transaction{TransactionID: uuid.New(), BuyerID: uuid.New(), SellerID: uuid.New(), Amount: usd("120")}
+}
+
+func TestEntriesAreBalanced(t *testing.T) {
+	transaction := testTransaction()
+
+	for _, entry := range []models.JournalEntry{
+		ledger.DepositEntry(transaction, usd("120")),
+		ledger.ReleaseEntry(transaction, usd("120")),
+		ledger.RefundEntry(transaction, usd("120")),
+		ledger.FeeEntry(transaction, usd("3.6")),
+	} {
+		assert.NoError(t, ledger.Validate(entry), entry.Type)
+	}
+}
+
+func TestValidate_RejectsUnbalanced(t *testing.T) {
+	transaction := testTransaction()
+
+	entry := ledger.DepositEntry(transaction, usd("120"))
+	entry.Postings[1].Amount = usd("-119.99")
+	assert.ErrorIs(t, ledger.Validate(entry), ledger.ErrUnbalanced)
+
+	entry = ledger.DepositEntry(transaction, usd("120"))
+	entry.Postings = entry.Postings[:1]
+	assert.ErrorIs(t, ledger.Validate(entry), ledger.ErrUnbalanced)
+
+	assert.ErrorIs(t, ledger.Validate(ledger.FeeEntry(transaction, usd("0"))), ledger.ErrUnbalanced)
+
+	entry = ledger.DepositEntry(transaction, usd("120"))
+	entry.Postings[1].Amount = models.MustParseMoney("-120", "EUR")
+	assert.ErrorIs(t, ledger.Validate(entry), ledger.ErrUnbalanced)
+}
+
+func TestPost_WritesEntryAndPostings(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+
+	db.DB = sqlx.NewDb(mockDB, "sqlmock")
+
+	transaction := testTransaction()
+	entryID, holdingID, fundingID := uuid.New(), uuid.New(), uuid.New()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO ledger_entries").
+		WithArgs(transaction.TransactionID, "deposit", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"entry_id"}).AddRow(entryID))
+	mock.ExpectQuery("INSERT INTO ledger_accounts").
+		WithArgs("escrow_holding", transaction.TransactionID, "USD").
+		WillReturnRows(sqlmock.NewRows([]string{"account_id"}).AddRow(holdingID))
+	mock.ExpectExec("INSERT INTO ledger_postings").
+		WithArgs(entryID, holdingID, "120.00").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("INSERT INTO ledger_accounts").
+		WithArgs("buyer_funding", transaction.BuyerID, "USD").
+		WillReturnRows(sqlmock.NewRows([]string{"account_id"}).AddRow(fundingID))
+	mock.ExpectExec("INSERT INTO ledger_postings").
+		WithArgs(entryID, fundingID, "-120.00").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	tx, err := db.DB.Beginx()
+	assert.NoError(t, err)
+
+	id, err := ledger.Post(tx, ledger.DepositEntry(transaction, usd("120")))
+	assert.NoError(t, err)
+	assert.Equal(t, entryID, id)
+	assert.NoError(t, tx.Commit())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPost_UnbalancedWritesNothing(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+
+	db.DB = sqlx.NewDb(mockDB, "sqlmock")
+
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+
+	tx, err := db.DB.Beginx()
+	assert.NoError(t, err)
+
+	entry := ledger.ReleaseEntry(testTransaction(), usd("50"))
+	entry.Postings[0].Amount = usd("-40")
+	_, err = ledger.Post(tx, entry)
+	assert.ErrorIs(t, err, ledger.ErrUnbalanced)
+	assert.NoError(t, tx.Rollback())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
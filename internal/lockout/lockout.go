@@ -0,0 +1,221 @@
+// Package lockout slows down password guessing. Failed logins are counted
+// per username, whether or not the user exists, and per client address.
+// Past a few free attempts each further failure blocks the username or
+// address for twice as long as the one before, and enough failures lock it
+// for a fixed period. An admin can unlock a username early.
+//
+// Attempts made while blocked are turned away before the password is
+// checked, so they neither count nor reveal anything about the password.
+//
+// Wrong two-factor codes are counted per user the same way, under the
+// username limits, so a stolen session cannot guess its way past step-up.
+package lockout
+
+import (
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Scopes of login_throttles rows.
+const (
+	ScopeUser = "user"
+	ScopeIP   = "ip"
+	ScopeCode = "code"
+)
+
+var ErrInvalidPolicy = errors.New("invalid login lockout policy")
+
+// Limit is how many failures one username or address gets.
+type Limit struct {
+	// FreeAttempts failures are allowed before any backoff.
+	FreeAttempts int
+	// LockAfter failures lock for the policy's LockoutDuration.
+	LockAfter int
+}
+
+// Policy holds the deployment's lockout settings. Shared addresses see many
+// users' mistakes, so IP is usually more lenient than User.
+type Policy struct {
+	User Limit
+	IP   Limit
+	// BaseDelay is the block after the first failure past FreeAttempts; it
+	// doubles with every further failure up to MaxDelay.
+	BaseDelay       time.Duration
+	MaxDelay        time.Duration
+	LockoutDuration time.Duration
+	// Window is how long failures are remembered after the last one.
+	Window time.Duration
+}
+
+// DefaultPolicy applies until SetPolicy is called.
+var DefaultPolicy = Policy{
+	User:            Limit{FreeAttempts: 3, LockAfter: 10},
+	IP:              Limit{FreeAttempts: 10, LockAfter: 50},
+	BaseDelay:       time.Second,
+	MaxDelay:        time.Minute,
+	LockoutDuration: 15 * time.Minute,
+	Window:          time.Hour,
+}
+
+var (
+	mu     sync.RWMutex
+	policy = DefaultPolicy
+)
+
+// SetPolicy replaces the lockout settings.
+func SetPolicy(p Policy) error {
+	for _, l := range []Limit{p.User, p.IP} {
+		if l.FreeAttempts < 0 || l.LockAfter <= l.FreeAttempts {
+			return ErrInvalidPolicy
+		}
+	}
+	if p.BaseDelay <= 0 || p.MaxDelay < p.BaseDelay || p.LockoutDuration <= 0 || p.Window <= 0 {
+		return ErrInvalidPolicy
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	policy = p
+	return nil
+}
+
+// CurrentPolicy returns the lockout settings in use.
+func CurrentPolicy() Policy {
+	mu.RLock()
+	defer mu.RUnlock()
+	return policy
+}
+
+// Outcome reports what a failed login led to.
+type Outcome struct {
+	UserLocked bool
+	IPLocked   bool
+}
+
+// Blocked returns how long a login for username from ip must still wait, or
+// zero if it may go ahead.
+func Blocked(q sqlx.Queryer, username, ip string, now time.Time) (time.Duration, error) {
+	var until time.Time
+	err := sqlx.Get(q, &until, `
+		SELECT blocked_until FROM login_throttles
+		WHERE ((scope = $1 AND subject = $2) OR (scope = $3 AND subject = $4))
+		  AND blocked_until > $5
+		ORDER BY blocked_until DESC
+		LIMIT 1
+	`, ScopeUser, username, ScopeIP, ip, now)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return until.Sub(now), nil
+}
+
+// Fail counts a failed login against username and ip and blocks either once
+// it is past its free attempts.
+func Fail(tx *sqlx.Tx, username, ip string, now time.Time) (Outcome, error) {
+	p := CurrentPolicy()
+	var out Outcome
+	var err error
+	out.UserLocked, err = fail(tx, ScopeUser, username, p.User, p, now)
+	if err != nil {
+		return out, err
+	}
+	out.IPLocked, err = fail(tx, ScopeIP, ip, p.IP, p, now)
+	return out, err
+}
+
+// Succeed forgets the failures of username after a correct password. The
+// address keeps its count, so an attacker cannot clear it by signing in to
+// an account of their own.
+func Succeed(exec sqlx.Execer, username string, now time.Time) error {
+	if err := Unlock(exec, username); err != nil {
+		return err
+	}
+	_, err := exec.Exec(`
+		DELETE FROM login_throttles
+		WHERE last_failure_at < $1 AND (blocked_until IS NULL OR blocked_until < $2)
+	`, now.Add(-CurrentPolicy().Window), now)
+	return err
+}
+
+// CodeBlocked returns how long userID must still wait before another
+// two-factor code is checked, or zero if it may go ahead.
+func CodeBlocked(q sqlx.Queryer, userID string, now time.Time) (time.Duration, error) {
+	var until time.Time
+	err := sqlx.Get(q, &until, `
+		SELECT blocked_until FROM login_throttles
+		WHERE scope = $1 AND subject = $2 AND blocked_until > $3
+	`, ScopeCode, userID, now)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return until.Sub(now), nil
+}
+
+// FailCode counts a wrong two-factor code against userID and reports whether
+// that locked their codes.
+func FailCode(tx *sqlx.Tx, userID string, now time.Time) (bool, error) {
+	p := CurrentPolicy()
+	return fail(tx, ScopeCode, userID, p.User, p, now)
+}
+
+// SucceedCode forgets the wrong codes of userID after a correct one.
+func SucceedCode(exec sqlx.Execer, userID string) error {
+	_, err := exec.Exec("DELETE FROM login_throttles WHERE scope = $1 AND subject = $2", ScopeCode, userID)
+	return err
+}
+
+// Unlock clears the failures and any block of username.
+func Unlock(exec sqlx.Execer, username string) error {
+	_, err := exec.Exec("DELETE FROM login_throttles WHERE scope = $1 AND subject = $2", ScopeUser, username)
+	return err
+}
+
+func fail(tx *sqlx.Tx, scope, subject string, limit Limit, p Policy, now time.Time) (bool, error) {
+	var failures int
+	err := tx.Get(&failures, `
+		INSERT INTO login_throttles (scope, subject, failures, last_failure_at)
+		VALUES ($1, $2, 1, $3)
+		ON CONFLICT (scope, subject) DO UPDATE SET
+			failures = CASE WHEN login_throttles.last_failure_at < $4 THEN 1 ELSE login_throttles.failures + 1 END,
+			last_failure_at = EXCLUDED.last_failure_at
+		RETURNING failures
+	`, scope, subject, now, now.Add(-p.Window))
+	if err != nil {
+		return false, err
+	}
+
+	wait, locked := backoff(failures, limit, p)
+	if wait == 0 {
+		return false, nil
+	}
+	_, err = tx.Exec("UPDATE login_throttles SET blocked_until = $1 WHERE scope = $2 AND subject = $3", now.Add(wait), scope, subject)
+	return locked, err
+}
+
+// backoff is how long to block after the given number of failures, and
+// whether that is a lockout rather than a backoff delay.
+func backoff(failures int, limit Limit, p Policy) (time.Duration, bool) {
+	if failures >= limit.LockAfter {
+		return p.LockoutDuration, true
+	}
+	if failures <= limit.FreeAttempts {
+		return 0, false
+	}
+	wait := p.BaseDelay
+	for i := limit.FreeAttempts + 1; i < failures && wait < p.MaxDelay; i++ {
+		wait *= 2
+	}
+	if wait > p.MaxDelay {
+		wait = p.MaxDelay
+	}
+	return wait, false
+}
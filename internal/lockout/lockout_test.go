@@ -0,0 +1,96 @@
+package lockout_test
+
+import (
+	"testing"
+	"time"
+
+	"escrow-agent/internal/lockout"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFail_BacksOffThenLocks(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+	db := sqlx.NewDb(mockDB, "sqlmock")
+
+	p := lockout.DefaultPolicy
+	now := time.Now()
+	cases := []struct {
+		failures int
+		wait     time.Duration
+		locked   bool
+	}{
+		{p.User.FreeAttempts, 0, false},
+		{p.User.FreeAttempts + 1, p.BaseDelay, false},
+		{p.User.FreeAttempts + 3, 4 * p.BaseDelay, false},
+		{p.User.LockAfter - 1, 32 * p.BaseDelay, false},
+		{p.User.LockAfter, p.LockoutDuration, true},
+	}
+	for _, c := range cases {
+		mock.ExpectBegin()
+		mock.ExpectQuery("INSERT INTO login_throttles").
+			WithArgs(lockout.ScopeUser, "alice", now, now.Add(-p.Window)).
+			WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(c.failures))
+		if c.wait > 0 {
+			mock.ExpectExec("UPDATE login_throttles SET blocked_until").
+				WithArgs(now.Add(c.wait), lockout.ScopeUser, "alice").
+				WillReturnResult(sqlmock.NewResult(0, 1))
+		}
+		mock.ExpectQuery("INSERT INTO login_throttles").
+			WithArgs(lockout.ScopeIP, "192.0.2.1", now, now.Add(-p.Window)).
+			WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(1))
+
+		tx, err := db.Beginx()
+		if err != nil {
+			t.Fatal(err)
+		}
+		outcome, err := lockout.Fail(tx, "alice", "192.0.2.1", now)
+		assert.NoError(t, err)
+		assert.Equal(t, c.locked, outcome.UserLocked, "failures=%d", c.failures)
+		assert.False(t, outcome.IPLocked)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestBlocked(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+	db := sqlx.NewDb(mockDB, "sqlmock")
+
+	now := time.Now()
+	mock.ExpectQuery("SELECT blocked_until FROM login_throttles").
+		WithArgs(lockout.ScopeUser, "alice", lockout.ScopeIP, "192.0.2.1", now).
+		WillReturnRows(sqlmock.NewRows([]string{"blocked_until"}).AddRow(now.Add(time.Minute)))
+	mock.ExpectQuery("SELECT blocked_until FROM login_throttles").
+		WillReturnRows(sqlmock.NewRows([]string{"blocked_until"}))
+
+	wait, err := lockout.Blocked(db, "alice", "192.0.2.1", now)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute, wait)
+
+	wait, err = lockout.Blocked(db, "bob", "192.0.2.1", now)
+	assert.NoError(t, err)
+	assert.Zero(t, wait)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSetPolicy_Invalid(t *testing.T) {
+	p := lockout.DefaultPolicy
+	p.User.LockAfter = p.User.FreeAttempts
+	assert.ErrorIs(t, lockout.SetPolicy(p), lockout.ErrInvalidPolicy)
+
+	p = lockout.DefaultPolicy
+	p.MaxDelay = 0
+	assert.ErrorIs(t, lockout.SetPolicy(p), lockout.ErrInvalidPolicy)
+
+	assert.NoError(t, lockout.SetPolicy(lockout.DefaultPolicy))
+}
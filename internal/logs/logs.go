@@ -8,9 +8,43 @@ import (
 	"net/http"
 	"strconv"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
 )
 
+// Record appends an entry to transaction_logs. Pass the *sqlx.Tx that moves the
+// money or status so the audit trail commits or rolls back with it.
+func Record(exec sqlx.Execer, transactionID interface{}, eventType, eventDetails string) error {
+	logQuery := `
+		INSERT INTO transaction_logs (transaction_id, event_type, event_details, created_at)
+		VALUES ($1, $2, $3, NOW())
+	`
+	_, err := exec.Exec(logQuery, transactionID, eventType, eventDetails)
+	return err
+}
+
+// RecordUserEvent appends an entry to user_audit_logs for a change actorID
+// made to userID's account. A nil actorID marks a command-line change.
+func RecordUserEvent(exec sqlx.Execer, userID uuid.UUID, actorID *uuid.UUID, eventType, eventDetails string) error {
+	_, err := exec.Exec(`
+		INSERT INTO user_audit_logs (user_id, actor_id, event_type, event_details, created_at)
+		VALUES ($1, $2, $3, $4, NOW())
+	`, userID, actorID, eventType, eventDetails)
+	return err
+}
+
+// RecordSecurityEvent appends an entry to security_logs for a sign-in event.
+// username is the name that was tried, which need not exist, and userID is
+// set once the user is known.
+func RecordSecurityEvent(exec sqlx.Execer, userID *uuid.UUID, username, ipAddress, eventType, eventDetails string) error {
+	_, err := exec.Exec(`
+		INSERT INTO security_logs (user_id, username, ip_address, event_type, event_details, created_at)
+		VALUES ($1, NULLIF($2, ''), $3, $4, $5, NOW())
+	`, userID, username, ipAddress, eventType, eventDetails)
+	return err
+}
+
 func GetTransactionLogsHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	transactionIDStr := vars["transaction_id"]
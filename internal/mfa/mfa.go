@@ -0,0 +1,386 @@
+// Package mfa adds TOTP two-factor authentication: enrollment with recovery
+// codes, the second step of a login for users who enrolled, and step-up
+// verification for high-value escrow actions.
+//
+// Enrollment is two-phase. Enroll stores a new secret as pending and Confirm
+// enables it once the user proves their app produces valid codes, returning
+// the recovery codes. A login with 2FA enabled first yields a challenge token;
+// redeeming it with a code finishes the login. Admin permissions are only
+// effective on sessions that passed the second factor, see middleware.Can.
+package mfa
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"escrow-agent/internal/fx"
+	"escrow-agent/internal/lockout"
+	"escrow-agent/pkg/models"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+// CodeHeader carries a TOTP or recovery code on requests that need step-up
+// verification.
+const CodeHeader = "X-OTP-Code"
+
+// ChallengeTTL bounds the time between the password and the code steps of a
+// login.
+const ChallengeTTL = 5 * time.Minute
+
+// maxChallengeAttempts is how many wrong codes a challenge survives.
+const maxChallengeAttempts = 5
+
+// recoveryCodeCount is how many recovery codes enrollment hands out.
+const recoveryCodeCount = 10
+
+var (
+	ErrNotEnrolled      = errors.New("two-factor authentication is not enabled")
+	ErrAlreadyEnrolled  = errors.New("two-factor authentication is already enabled")
+	ErrInvalidCode      = errors.New("invalid two-factor code")
+	ErrTooManyCodes     = errors.New("too many invalid two-factor codes")
+	ErrInvalidChallenge = errors.New("invalid or expired login challenge")
+	ErrStepUpRequired   = errors.New("a two-factor code is required for this amount")
+	ErrNoPendingSecret  = errors.New("no two-factor enrollment in progress")
+	ErrInvalidThreshold = errors.New("invalid step-up threshold")
+)
+
+var recoveryCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Config holds the deployment's 2FA settings. StepUpThreshold is a decimal
+// amount in StepUpCurrency, the default currency when empty; releasing or
+// refunding more than it needs a code, amounts in other currencies being
+// converted through fx first. Empty disables step-up.
+type Config struct {
+	Issuer          string
+	StepUpThreshold string
+	StepUpCurrency  string
+}
+
+// DefaultConfig applies until SetConfig is called.
+var DefaultConfig = Config{Issuer: "escrow-agent", StepUpCurrency: models.DefaultCurrency}
+
+var (
+	mu     sync.RWMutex
+	config = DefaultConfig
+	limit  *models.Money
+)
+
+// SetConfig replaces the 2FA settings. A threshold that is not a valid amount
+// in its currency gives ErrInvalidThreshold.
+func SetConfig(c Config) error {
+	if c.StepUpCurrency == "" {
+		c.StepUpCurrency = DefaultConfig.StepUpCurrency
+	}
+	var threshold *models.Money
+	if c.StepUpThreshold != "" {
+		if !models.ValidCurrency(c.StepUpCurrency) {
+			return ErrInvalidThreshold
+		}
+		m, err := models.ParseMoney(c.StepUpThreshold, c.StepUpCurrency)
+		if err != nil || m.Minor < 0 {
+			return ErrInvalidThreshold
+		}
+		threshold = &m
+	}
+	if c.Issuer == "" {
+		c.Issuer = DefaultConfig.Issuer
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	config = c
+	limit = threshold
+	return nil
+}
+
+// CurrentConfig returns the 2FA settings in use.
+func CurrentConfig() Config {
+	mu.RLock()
+	defer mu.RUnlock()
+	return config
+}
+
+// Enroll stores a new pending secret for the user and returns it with its
+// provisioning URI. A pending secret from an earlier, unconfirmed enrollment
+// is replaced.
+func Enroll(exec sqlx.Execer, userID uuid.UUID, account string) (secret, uri string, err error) {
+	secret, err = GenerateSecret()
+	if err != nil {
+		return "", "", err
+	}
+	res, err := exec.Exec(`
+		UPDATE users SET totp_secret = $1, totp_last_step = 0
+		WHERE user_id = $2 AND totp_enabled_at IS NULL
+	`, secret, userID)
+	if err != nil {
+		return "", "", err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return "", "", err
+	} else if n == 0 {
+		return "", "", ErrAlreadyEnrolled
+	}
+	return secret, ProvisioningURI(CurrentConfig().Issuer, account, secret), nil
+}
+
+// Confirm enables the pending secret once code checks out against it and
+// returns freshly generated recovery codes, which are only ever shown here.
+func Confirm(tx *sqlx.Tx, userID uuid.UUID, code string) ([]string, error) {
+	var state userState
+	err := tx.Get(&state, "SELECT totp_secret, totp_enabled_at, totp_last_step FROM users WHERE user_id = $1 FOR UPDATE", userID)
+	if err != nil {
+		return nil, err
+	}
+	if state.EnabledAt.Valid {
+		return nil, ErrAlreadyEnrolled
+	}
+	if !state.Secret.Valid {
+		return nil, ErrNoPendingSecret
+	}
+	matched, ok := verifyCode(state.Secret.String, code, time.Now(), state.LastStep)
+	if !ok {
+		return nil, ErrInvalidCode
+	}
+	if _, err := tx.Exec("UPDATE users SET totp_enabled_at = NOW(), totp_last_step = $1 WHERE user_id = $2", matched, userID); err != nil {
+		return nil, err
+	}
+	return replaceRecoveryCodes(tx, userID)
+}
+
+// Disable turns 2FA off and drops the secret and recovery codes.
+func Disable(exec sqlx.Execer, userID uuid.UUID) error {
+	if _, err := exec.Exec("UPDATE users SET totp_secret = NULL, totp_enabled_at = NULL, totp_last_step = 0 WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+	_, err := exec.Exec("DELETE FROM recovery_codes WHERE user_id = $1", userID)
+	return err
+}
+
+// Enabled reports whether the user has confirmed a TOTP secret.
+func Enabled(q sqlx.Queryer, userID uuid.UUID) (bool, error) {
+	var enabled bool
+	err := sqlx.Get(q, &enabled, "SELECT totp_enabled_at IS NOT NULL FROM users WHERE user_id = $1", userID)
+	return enabled, err
+}
+
+// Verify checks a TOTP code, or failing that an unused recovery code, for a
+// user with 2FA enabled. A matching TOTP code cannot be used again and a
+// matching recovery code is used up. Wrong codes count towards a lockout,
+// see lockout.FailCode, so tx must be committed even when Verify returns
+// ErrInvalidCode. While locked every code gives ErrTooManyCodes unchecked.
+func Verify(tx *sqlx.Tx, userID uuid.UUID, code string) error {
+	now := time.Now()
+	wait, err := lockout.CodeBlocked(tx, userID.String(), now)
+	if err != nil {
+		return err
+	}
+	if wait > 0 {
+		return ErrTooManyCodes
+	}
+
+	var state userState
+	err = tx.Get(&state, "SELECT totp_secret, totp_enabled_at, totp_last_step FROM users WHERE user_id = $1 FOR UPDATE", userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotEnrolled
+	}
+	if err != nil {
+		return err
+	}
+	if !state.EnabledAt.Valid || !state.Secret.Valid {
+		return ErrNotEnrolled
+	}
+
+	code = strings.TrimSpace(code)
+	if matched, ok := verifyCode(state.Secret.String, code, now, state.LastStep); ok {
+		if _, err := tx.Exec("UPDATE users SET totp_last_step = $1 WHERE user_id = $2", matched, userID); err != nil {
+			return err
+		}
+		return lockout.SucceedCode(tx, userID.String())
+	}
+
+	res, err := tx.Exec(`
+		UPDATE recovery_codes SET used_at = NOW()
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL
+	`, userID, hashSecret(normalizeRecoveryCode(code)))
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		if _, err := lockout.FailCode(tx, userID.String(), now); err != nil {
+			return err
+		}
+		return ErrInvalidCode
+	}
+	return lockout.SucceedCode(tx, userID.String())
+}
+
+// StepUpRequired reports whether releasing or refunding amount needs a code.
+// Amounts in another currency than the threshold are converted with the
+// installed fx provider; without a rate the code is required.
+func StepUpRequired(ctx context.Context, amount models.Money) (bool, error) {
+	mu.RLock()
+	threshold := limit
+	mu.RUnlock()
+	if threshold == nil {
+		return false, nil
+	}
+	if amount.Currency != threshold.Currency {
+		provider, ok := fx.CurrentProvider()
+		if !ok {
+			return true, nil
+		}
+		converted, err := fx.Convert(ctx, provider, amount, threshold.Currency)
+		if errors.Is(err, fx.ErrNoRate) {
+			return true, nil
+		} else if err != nil {
+			return false, err
+		}
+		amount = converted
+	}
+	return amount.Minor > threshold.Minor, nil
+}
+
+// RequireStepUp verifies code when amount is above the step-up threshold.
+// Below it the code is ignored. Above it a missing code gives
+// ErrStepUpRequired and a user without 2FA gets ErrNotEnrolled. As with
+// Verify, tx must be committed when the code is wrong.
+func RequireStepUp(ctx context.Context, tx *sqlx.Tx, userID uuid.UUID, amount models.Money, code string) error {
+	required, err := StepUpRequired(ctx, amount)
+	if err != nil || !required {
+		return err
+	}
+	if strings.TrimSpace(code) == "" {
+		return ErrStepUpRequired
+	}
+	return Verify(tx, userID, code)
+}
+
+// StartChallenge records that userID passed the password step of a login and
+// returns the token that the code step redeems.
+func StartChallenge(exec sqlx.Execer, userID uuid.UUID) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	_, err := exec.Exec(`
+		INSERT INTO mfa_challenges (user_id, token_hash, expires_at)
+		VALUES ($1, $2, $3)
+	`, userID, hashSecret(token), time.Now().Add(ChallengeTTL))
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// ChallengeUsername returns the username a login challenge was started for,
+// so the login can be checked against lockout before a code is tried.
+func ChallengeUsername(q sqlx.Queryer, token string) (string, error) {
+	var username string
+	err := sqlx.Get(q, &username, `
+		SELECT u.username
+		FROM mfa_challenges c
+		JOIN users u ON u.user_id = c.user_id
+		WHERE c.token_hash = $1
+	`, hashSecret(token))
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrInvalidChallenge
+	}
+	return username, err
+}
+
+// RedeemChallenge finishes a login: it checks code for the challenge's user
+// and returns that user. Wrong codes count against the challenge, so tx must
+// be committed even when RedeemChallenge returns ErrInvalidCode; the user is
+// returned with it.
+func RedeemChallenge(tx *sqlx.Tx, token, code string) (uuid.UUID, error) {
+	var challenge struct {
+		ChallengeID uuid.UUID    `db:"challenge_id"`
+		UserID      uuid.UUID    `db:"user_id"`
+		Attempts    int          `db:"attempts"`
+		ExpiresAt   time.Time    `db:"expires_at"`
+		UsedAt      sql.NullTime `db:"used_at"`
+	}
+	err := tx.Get(&challenge, `
+		SELECT challenge_id, user_id, attempts, expires_at, used_at
+		FROM mfa_challenges
+		WHERE token_hash = $1
+		FOR UPDATE
+	`, hashSecret(token))
+	if errors.Is(err, sql.ErrNoRows) {
+		return uuid.Nil, ErrInvalidChallenge
+	}
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if challenge.UsedAt.Valid || challenge.Attempts >= maxChallengeAttempts || time.Now().After(challenge.ExpiresAt) {
+		return uuid.Nil, ErrInvalidChallenge
+	}
+
+	err = Verify(tx, challenge.UserID, code)
+	if errors.Is(err, ErrInvalidCode) {
+		if _, err := tx.Exec("UPDATE mfa_challenges SET attempts = attempts + 1 WHERE challenge_id = $1", challenge.ChallengeID); err != nil {
+			return uuid.Nil, err
+		}
+		return challenge.UserID, ErrInvalidCode
+	}
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	if _, err := tx.Exec("UPDATE mfa_challenges SET used_at = NOW() WHERE challenge_id = $1", challenge.ChallengeID); err != nil {
+		return uuid.Nil, err
+	}
+	_, err = tx.Exec("DELETE FROM mfa_challenges WHERE expires_at < NOW()")
+	return challenge.UserID, err
+}
+
+type userState struct {
+	Secret    sql.NullString `db:"totp_secret"`
+	EnabledAt sql.NullTime   `db:"totp_enabled_at"`
+	LastStep  int64          `db:"totp_last_step"`
+}
+
+// replaceRecoveryCodes drops the user's recovery codes and stores a new set,
+// returning the codes in the form users type them.
+func replaceRecoveryCodes(exec sqlx.Execer, userID uuid.UUID) ([]string, error) {
+	if _, err := exec.Exec("DELETE FROM recovery_codes WHERE user_id = $1", userID); err != nil {
+		return nil, err
+	}
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		encoded := strings.ToLower(recoveryCodeEncoding.EncodeToString(raw))
+		code := encoded[:4] + "-" + encoded[4:]
+		if _, err := exec.Exec("INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)", userID, hashSecret(normalizeRecoveryCode(code))); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
+
+// hashSecret is what mfa_challenges and recovery_codes store; both are
+// random, so an unsalted hash is enough.
+func hashSecret(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
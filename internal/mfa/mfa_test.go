@@ -0,0 +1,178 @@
+package mfa_test
+
+import (
+	"context"
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+
+	"escrow-agent/internal/fx"
+	"escrow-agent/internal/lockout"
+	"escrow-agent/internal/mfa"
+	"escrow-agent/pkg/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+)
+
+// RFC 6238 appendix B, SHA-1, truncated to six digits.
+func TestCode_RFC6238Vectors(t *testing.T) {
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	vectors := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1234567890:  "005924",
+		20000000000: "353130",
+	}
+	for unix, want := range vectors {
+		code, err := mfa.Code(secret, time.Unix(unix, 0))
+		assert.NoError(t, err)
+		assert.Equal(t, want, code, unix)
+	}
+}
+
+func TestVerify_RejectsReplayedCode(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+	db := sqlx.NewDb(mockDB, "sqlmock")
+
+	secret, err := mfa.GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID := uuid.New()
+	now := time.Now()
+	code, _ := mfa.Code(secret, now)
+	step := now.Unix() / 30
+
+	state := func(lastStep int64) *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"totp_secret", "totp_enabled_at", "totp_last_step"}).AddRow(secret, now, lastStep)
+	}
+
+	mock.ExpectBegin()
+	expectNotBlocked(mock, userID)
+	mock.ExpectQuery("SELECT totp_secret, (.+) FOR UPDATE").WithArgs(userID).WillReturnRows(state(0))
+	mock.ExpectExec("UPDATE users SET totp_last_step").WithArgs(step, userID).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM login_throttles").WithArgs(lockout.ScopeCode, userID.String()).WillReturnResult(sqlmock.NewResult(0, 0))
+	// the same code again only gets as far as the recovery codes
+	expectNotBlocked(mock, userID)
+	mock.ExpectQuery("SELECT totp_secret, (.+) FOR UPDATE").WithArgs(userID).WillReturnRows(state(step))
+	mock.ExpectExec("UPDATE recovery_codes SET used_at").WithArgs(userID, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("INSERT INTO login_throttles").
+		WithArgs(lockout.ScopeCode, userID.String(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(1))
+	mock.ExpectRollback()
+
+	tx, err := db.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, mfa.Verify(tx, userID, code))
+	assert.ErrorIs(t, mfa.Verify(tx, userID, code), mfa.ErrInvalidCode)
+	tx.Rollback()
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func expectNotBlocked(mock sqlmock.Sqlmock, userID uuid.UUID) {
+	mock.ExpectQuery("SELECT blocked_until FROM login_throttles").
+		WithArgs(lockout.ScopeCode, userID.String(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"blocked_until"}))
+}
+
+func TestVerify_LocksOutWrongCodes(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+	db := sqlx.NewDb(mockDB, "sqlmock")
+
+	secret, err := mfa.GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID := uuid.New()
+	now := time.Now()
+	code, _ := mfa.Code(secret, now)
+	limit := lockout.CurrentPolicy().User
+
+	mock.ExpectBegin()
+	expectNotBlocked(mock, userID)
+	mock.ExpectQuery("SELECT totp_secret, (.+) FOR UPDATE").
+		WithArgs(userID).
+		WillReturnRows(sqlmock.NewRows([]string{"totp_secret", "totp_enabled_at", "totp_last_step"}).AddRow(secret, now, 0))
+	mock.ExpectExec("UPDATE recovery_codes SET used_at").WithArgs(userID, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("INSERT INTO login_throttles").
+		WithArgs(lockout.ScopeCode, userID.String(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(limit.LockAfter))
+	mock.ExpectExec("UPDATE login_throttles SET blocked_until").
+		WithArgs(sqlmock.AnyArg(), lockout.ScopeCode, userID.String()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	// once locked even the right code is turned away unchecked
+	mock.ExpectQuery("SELECT blocked_until FROM login_throttles").
+		WithArgs(lockout.ScopeCode, userID.String(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"blocked_until"}).AddRow(now.Add(time.Minute)))
+	mock.ExpectRollback()
+
+	tx, err := db.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.ErrorIs(t, mfa.Verify(tx, userID, "not-a-code"), mfa.ErrInvalidCode)
+	assert.ErrorIs(t, mfa.Verify(tx, userID, code), mfa.ErrTooManyCodes)
+	tx.Rollback()
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestProvisioningURI(t *testing.T) {
+	uri := mfa.ProvisioningURI("escrow-agent", "alice", "JBSWY3DPEHPK3PXP")
+	assert.True(t, strings.HasPrefix(uri, "otpauth://totp/escrow-agent:alice?"))
+	assert.Contains(t, uri, "secret=JBSWY3DPEHPK3PXP")
+	assert.Contains(t, uri, "issuer=escrow-agent")
+}
+
+func TestStepUpRequired(t *testing.T) {
+	defer mfa.SetConfig(mfa.DefaultConfig)
+	ctx := context.Background()
+
+	required, err := mfa.StepUpRequired(ctx, models.NewMoney(1000000, "USD"))
+	assert.NoError(t, err)
+	assert.False(t, required, "no threshold configured")
+
+	assert.NoError(t, mfa.SetConfig(mfa.Config{StepUpThreshold: "5000"}))
+	required, _ = mfa.StepUpRequired(ctx, models.NewMoney(500000, "USD"))
+	assert.False(t, required, "at the threshold")
+	required, _ = mfa.StepUpRequired(ctx, models.NewMoney(500001, "USD"))
+	assert.True(t, required)
+	required, _ = mfa.StepUpRequired(ctx, models.NewMoney(100, "EUR"))
+	assert.True(t, required, "no rate to convert with")
+
+	assert.ErrorIs(t, mfa.SetConfig(mfa.Config{StepUpThreshold: "lots"}), mfa.ErrInvalidThreshold)
+	assert.ErrorIs(t, mfa.SetConfig(mfa.Config{StepUpThreshold: "10.005"}), mfa.ErrInvalidThreshold)
+	assert.ErrorIs(t, mfa.SetConfig(mfa.Config{StepUpThreshold: "10", StepUpCurrency: "XYZ"}), mfa.ErrInvalidThreshold)
+}
+
+func TestStepUpRequired_ConvertsOtherCurrencies(t *testing.T) {
+	defer mfa.SetConfig(mfa.DefaultConfig)
+	defer fx.SetProvider(nil)
+	ctx := context.Background()
+
+	rates, err := fx.NewStaticProvider(map[string]string{"USD/JPY": "150"})
+	assert.NoError(t, err)
+	fx.SetProvider(rates)
+	assert.NoError(t, mfa.SetConfig(mfa.Config{StepUpThreshold: "1000.50"}))
+
+	// 150,000 yen is 1,000 dollars, 151,000 yen about 1,006.67
+	required, err := mfa.StepUpRequired(ctx, models.NewMoney(150000, "JPY"))
+	assert.NoError(t, err)
+	assert.False(t, required)
+	required, err = mfa.StepUpRequired(ctx, models.NewMoney(151000, "JPY"))
+	assert.NoError(t, err)
+	assert.True(t, required)
+}
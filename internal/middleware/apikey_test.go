@@ -0,0 +1,73 @@
+package middleware_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"escrow-agent/internal/db"
+	"escrow-agent/internal/middleware"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+)
+
+func serveWithAPIKey(key string, p middleware.Permission) int {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	handler := middleware.JWTAuthMiddleware(middleware.RequirePermission(p)(ok))
+
+	req := httptest.NewRequest("GET", "/api/transactions", nil)
+	req.Header.Set(middleware.APIKeyHeader, key)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr.Code
+}
+
+func TestAPIKey_LimitedToScopes(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+
+	db.DB = sqlx.NewDb(mockDB, "sqlmock")
+
+	keyID, userID := uuid.New(), uuid.New()
+	for i := 0; i < 2; i++ {
+		mock.ExpectQuery("SELECT (.+) FROM api_keys k JOIN users u").
+			WithArgs(sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"key_id", "permissions", "user_id", "username", "roles"}).
+				AddRow(keyID, "{transaction:read,transaction:create}", userID, "marketplace", "{buyer,seller}"))
+		mock.ExpectExec("UPDATE api_keys SET last_used_at").
+			WithArgs(keyID, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+
+	assert.Equal(t, http.StatusNoContent, serveWithAPIKey("eak_valid", middleware.PermTransactionCreate))
+	// the seller role grants fulfil, but the key is not scoped for it
+	assert.Equal(t, http.StatusForbidden, serveWithAPIKey("eak_valid", middleware.PermTransactionFulfill))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAPIKey_Rejected(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+
+	db.DB = sqlx.NewDb(mockDB, "sqlmock")
+
+	// unknown, revoked and expired keys all miss the lookup
+	mock.ExpectQuery("SELECT (.+) FROM api_keys k JOIN users u").
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"key_id", "permissions", "user_id", "username", "roles"}))
+
+	assert.Equal(t, http.StatusUnauthorized, serveWithAPIKey("eak_unknown", middleware.PermTransactionRead))
+	assert.Equal(t, http.StatusUnauthorized, serveWithAPIKey("not-a-key", middleware.PermTransactionRead))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -1,27 +1,33 @@
 package middleware
 
 import (
-	"context"
+	"errors"
+	"escrow-agent/internal/apikeys"
+	"escrow-agent/internal/db"
+	"escrow-agent/internal/sessions"
+	"escrow-agent/internal/tokens"
 	"log"
+	"net"
 	"net/http"
 	"strings"
-
-	"github.com/golang-jwt/jwt/v5"
-	"github.com/google/uuid"
 )
 
-var jwtKey = []byte("my_secret_key")
-
+// Claims are the verified token claims handlers read from the request context.
+type Claims = tokens.Claims
 
-type Claims struct {
-	UserID   uuid.UUID    	`json:"user_id"`
-	Username string 		`json:"username"`
-	Role     string 		`json:"role"`
-	jwt.RegisteredClaims
-}
+// APIKeyHeader carries the API key of server-to-server callers.
+const APIKeyHeader = "X-API-Key"
 
+// JWTAuthMiddleware authenticates the caller from a bearer JWT or, for
+// server-to-server callers, an X-API-Key header, and stores their claims in
+// the request context.
 func JWTAuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if key := r.Header.Get(APIKeyHeader); key != "" {
+			apiKeyAuth(w, r, key, next)
+			return
+		}
+
 		authHeader := r.Header.Get("Authorization")
 		if authHeader == "" {
 			log.Printf("[ERROR] Authorization header is missing")
@@ -36,17 +42,58 @@ func JWTAuthMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
-		claims := &Claims{}
-		token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-			return jwtKey, nil
-		})
+		service, err := tokens.Current()
+		if err != nil {
+			log.Printf("[ERROR] Cannot verify token: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
 
-		if err != nil || !token.Valid {
+		claims, err := service.Parse(tokenString)
+		if err != nil {
+			log.Printf("[ERROR] Rejected token: %v", err)
 			http.Error(w, "Invalid token", http.StatusUnauthorized)
 			return
 		}
 
-		ctx := context.WithValue(r.Context(), "user", claims)
-		next.ServeHTTP(w, r.WithContext(ctx))
+		revoked, err := sessions.IsRevoked(db.DB, claims.ID)
+		if err != nil {
+			log.Printf("[ERROR] Failed to check token revocation: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if revoked {
+			http.Error(w, "Token has been revoked", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(WithClaims(r.Context(), claims)))
 	})
 }
+
+// apiKeyAuth serves the request as the account the API key acts as.
+func apiKeyAuth(w http.ResponseWriter, r *http.Request, key string, next http.Handler) {
+	claims, err := apikeys.Authenticate(db.DB, key)
+	if errors.Is(err, apikeys.ErrInvalidKey) {
+		log.Printf("[ERROR] Rejected API key for %s", r.URL.Path)
+		http.Error(w, "Invalid API key", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to check API key: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	next.ServeHTTP(w, r.WithContext(WithClaims(r.Context(), claims)))
+}
+
+// ClientIP is the address a request came from. The server is exposed
+// directly, so RemoteAddr is used and forwarding headers are not trusted.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,21 @@
+package middleware
+
+import "context"
+
+// contextKey keeps this package's context values from colliding with plain
+// string keys set elsewhere.
+type contextKey int
+
+const claimsKey contextKey = iota
+
+// WithClaims returns a copy of ctx carrying the caller's verified claims.
+func WithClaims(ctx context.Context, claims *Claims) context.Context {
+	return context.WithValue(ctx, claimsKey, claims)
+}
+
+// ClaimsFromContext returns the claims JWTAuthMiddleware stored for the
+// request. ok is false on routes that are not authenticated.
+func ClaimsFromContext(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(claimsKey).(*Claims)
+	return claims, ok && claims != nil
+}
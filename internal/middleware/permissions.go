@@ -0,0 +1,214 @@
+package middleware
+
+import (
+	"escrow-agent/pkg/models"
+	"log"
+	"net/http"
+)
+
+// Permission names one kind of action on the API. Routes declare the
+// permission they need with RequirePermission; which transactions or disputes
+// a caller may touch is still decided by the handler, from whether the caller
+// is a party to them.
+type Permission string
+
+const (
+	PermProfileRead   Permission = "profile:read"
+	PermProfileUpdate Permission = "profile:update"
+
+	PermFeeQuote Permission = "fee:quote"
+
+	PermTransactionCreate  Permission = "transaction:create"
+	PermTransactionRead    Permission = "transaction:read"
+	PermTransactionFulfill Permission = "transaction:fulfill"
+	PermTransactionConfirm Permission = "transaction:confirm"
+	PermMilestoneFulfill   Permission = "milestone:fulfill"
+	PermMilestoneApprove   Permission = "milestone:approve"
+
+	PermEscrowDeposit Permission = "escrow:deposit"
+	PermEscrowRelease Permission = "escrow:release"
+	PermEscrowRefund  Permission = "escrow:refund"
+
+	PermDisputeRaise   Permission = "dispute:raise"
+	PermDisputeRead    Permission = "dispute:read"
+	PermDisputeResolve Permission = "dispute:resolve"
+
+	PermLogRead    Permission = "log:read"
+	PermFileUpload Permission = "file:upload"
+	PermFileRead   Permission = "file:read"
+
+	PermPayoutRead   Permission = "payout:read"
+	PermPayoutManage Permission = "payout:manage"
+
+	PermAdminUsersRead         Permission = "admin:users:read"
+	PermAdminUsersWrite        Permission = "admin:users:write"
+	PermAdminTransactionsRead  Permission = "admin:transactions:read"
+	PermAdminTransactionsWrite Permission = "admin:transactions:write"
+	PermAdminLedgerRead        Permission = "admin:ledger:read"
+	PermAdminReportsRead       Permission = "admin:reports:read"
+	PermAdminDisputesRead      Permission = "admin:disputes:read"
+	PermAdminAPIKeysRead       Permission = "admin:api-keys:read"
+	PermAdminAPIKeysWrite      Permission = "admin:api-keys:write"
+	PermAdminPayoutsRead       Permission = "admin:payouts:read"
+	PermAdminPayoutsWrite      Permission = "admin:payouts:write"
+)
+
+// commonPermissions are granted to every role.
+var commonPermissions = []Permission{
+	PermProfileRead, PermProfileUpdate, PermFeeQuote,
+	PermTransactionRead, PermDisputeRead, PermLogRead, PermFileRead,
+}
+
+// rolePermissions maps each role to what it may do beyond commonPermissions.
+var rolePermissions = map[string][]Permission{
+	"buyer": {
+		PermTransactionCreate, PermTransactionConfirm, PermMilestoneApprove,
+		PermEscrowDeposit, PermEscrowRelease, PermEscrowRefund,
+		PermDisputeRaise, PermFileUpload,
+	},
+	"seller": {
+		PermTransactionFulfill, PermMilestoneFulfill,
+		PermEscrowRefund,
+		PermDisputeRaise, PermFileUpload,
+		PermPayoutRead, PermPayoutManage,
+	},
+	"admin": {
+		PermEscrowRelease, PermEscrowRefund,
+		PermDisputeResolve,
+		PermAdminUsersRead, PermAdminUsersWrite,
+		PermAdminTransactionsRead, PermAdminTransactionsWrite,
+		PermAdminLedgerRead, PermAdminReportsRead, PermAdminDisputesRead,
+		PermAdminAPIKeysRead, PermAdminAPIKeysWrite,
+		PermAdminPayoutsRead, PermAdminPayoutsWrite,
+	},
+}
+
+var grants = buildGrants()
+
+func buildGrants() map[string]map[Permission]bool {
+	grants := map[string]map[Permission]bool{}
+	for role, perms := range rolePermissions {
+		grants[role] = map[Permission]bool{}
+		for _, p := range append(append([]Permission{}, commonPermissions...), perms...) {
+			grants[role][p] = true
+		}
+	}
+	return grants
+}
+
+// HasPermission reports whether role grants p.
+func HasPermission(role string, p Permission) bool {
+	return grants[role][p]
+}
+
+// RolesGrant reports whether any of roles grants p.
+func RolesGrant(roles []string, p Permission) bool {
+	for _, role := range roles {
+		if HasPermission(role, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Can reports whether the caller holding claims may do p through any of
+// their roles. Callers using an API key are further limited to its scopes.
+//
+// The admin role needs a second factor: on a session whose login did not
+// pass one it grants only commonPermissions, which is enough to enroll.
+// API keys are exempt, since only an admin who passed it can create them.
+func Can(claims *Claims, p Permission) bool {
+	if claims == nil || !RolesGrant(effectiveRoles(claims, p), p) {
+		return false
+	}
+	if claims.APIKeyID == nil {
+		return true
+	}
+	for _, scope := range claims.Scopes {
+		if Permission(scope) == p {
+			return true
+		}
+	}
+	return false
+}
+
+// NeedsMFA reports whether the caller lacks p only because their session did
+// not pass a second factor.
+func NeedsMFA(claims *Claims, p Permission) bool {
+	if claims == nil || claims.MFA || Can(claims, p) {
+		return false
+	}
+	withMFA := *claims
+	withMFA.MFA = true
+	return Can(&withMFA, p)
+}
+
+// ActorFor is models.ActorFor for a caller acting under p, so an admin who
+// is not a party only acts as admin once their session passed a second
+// factor.
+func ActorFor(claims *Claims, t *models.Transaction, p Permission) models.Actor {
+	return models.ActorFor(t, claims.UserID, effectiveRoles(claims, p))
+}
+
+// ActorNeedsMFA reports whether the caller has no part in t under p only
+// because their session did not pass a second factor.
+func ActorNeedsMFA(claims *Claims, t *models.Transaction, p Permission) bool {
+	if claims.MFA || ActorFor(claims, t, p) != "" {
+		return false
+	}
+	withMFA := *claims
+	withMFA.MFA = true
+	return ActorFor(&withMFA, t, p) != ""
+}
+
+// effectiveRoles drops the admin role from sessions without a second factor,
+// unless p is one every role has.
+func effectiveRoles(claims *Claims, p Permission) []string {
+	if claims.MFA || claims.APIKeyID != nil || !models.Roles(claims.Roles).Has(models.RoleAdmin) || isCommon(p) {
+		return claims.Roles
+	}
+	roles := make([]string, 0, len(claims.Roles))
+	for _, role := range claims.Roles {
+		if role != models.RoleAdmin {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+func isCommon(p Permission) bool {
+	for _, common := range commonPermissions {
+		if common == p {
+			return true
+		}
+	}
+	return false
+}
+
+// RequirePermission rejects requests whose caller lacks p: 401 when the
+// request carries no claims, 403 when none of the caller's roles grant p or
+// their API key is not scoped for it. Use it on routes behind
+// JWTAuthMiddleware.
+func RequirePermission(p Permission) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := ClaimsFromContext(r.Context())
+			if !ok {
+				log.Printf("[ERROR] Unauthorized access attempt to %s - missing claims", r.URL.Path)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			if NeedsMFA(claims, p) {
+				log.Printf("[ERROR] Forbidden: user %s needs two-factor authentication for %s on %s", claims.UserID, p, r.URL.Path)
+				http.Error(w, "Two-factor authentication required", http.StatusForbidden)
+				return
+			}
+			if !Can(claims, p) {
+				log.Printf("[ERROR] Forbidden: user %s with roles %v lacks %s for %s", claims.UserID, claims.Roles, p, r.URL.Path)
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
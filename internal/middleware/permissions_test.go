@@ -0,0 +1,105 @@
+package middleware_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"escrow-agent/internal/middleware"
+	"escrow-agent/pkg/models"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHasPermission(t *testing.T) {
+	assert.True(t, middleware.HasPermission("buyer", middleware.PermTransactionCreate))
+	assert.False(t, middleware.HasPermission("seller", middleware.PermTransactionCreate))
+	assert.True(t, middleware.HasPermission("seller", middleware.PermTransactionFulfill))
+	assert.False(t, middleware.HasPermission("buyer", middleware.PermAdminUsersRead))
+	assert.True(t, middleware.HasPermission("admin", middleware.PermAdminUsersRead))
+	assert.False(t, middleware.HasPermission("admin", middleware.PermEscrowDeposit))
+	assert.False(t, middleware.HasPermission("", middleware.PermProfileRead))
+
+	for _, role := range []string{"buyer", "seller", "admin"} {
+		assert.True(t, middleware.HasPermission(role, middleware.PermProfileRead), role)
+	}
+}
+
+func TestCan_AnyRoleGrants(t *testing.T) {
+	trader := &middleware.Claims{UserID: uuid.New(), Roles: []string{"buyer", "seller"}}
+	assert.True(t, middleware.Can(trader, middleware.PermTransactionCreate))
+	assert.True(t, middleware.Can(trader, middleware.PermTransactionFulfill))
+	assert.False(t, middleware.Can(trader, middleware.PermAdminUsersRead))
+	assert.False(t, middleware.Can(nil, middleware.PermProfileRead))
+
+	keyID := uuid.New()
+	scoped := &middleware.Claims{UserID: uuid.New(), Roles: []string{"buyer"}, APIKeyID: &keyID,
+		Scopes: []string{"transaction:create", "admin:users:read"}}
+	assert.True(t, middleware.Can(scoped, middleware.PermTransactionCreate))
+	assert.False(t, middleware.Can(scoped, middleware.PermEscrowDeposit), "role grants it, key does not")
+	assert.False(t, middleware.Can(scoped, middleware.PermAdminUsersRead), "key lists it, role does not")
+}
+
+func TestCan_AdminNeedsMFA(t *testing.T) {
+	admin := &middleware.Claims{UserID: uuid.New(), Roles: []string{"admin", "buyer"}}
+	assert.False(t, middleware.Can(admin, middleware.PermAdminUsersRead))
+	assert.True(t, middleware.NeedsMFA(admin, middleware.PermAdminUsersRead))
+	assert.True(t, middleware.Can(admin, middleware.PermProfileUpdate), "enough to enroll")
+	assert.True(t, middleware.Can(admin, middleware.PermEscrowDeposit), "other roles still apply")
+
+	admin.MFA = true
+	assert.True(t, middleware.Can(admin, middleware.PermAdminUsersRead))
+	assert.False(t, middleware.NeedsMFA(admin, middleware.PermAdminUsersRead))
+}
+
+func TestActorFor_AdminNeedsMFA(t *testing.T) {
+	admin := &middleware.Claims{UserID: uuid.New(), Roles: []string{"admin", "buyer"}}
+	other := &models.Transaction{BuyerID: uuid.New(), SellerID: uuid.New()}
+	own := &models.Transaction{BuyerID: admin.UserID, SellerID: uuid.New()}
+
+	assert.Equal(t, models.Actor(""), middleware.ActorFor(admin, other, middleware.PermEscrowRelease))
+	assert.True(t, middleware.ActorNeedsMFA(admin, other, middleware.PermEscrowRelease))
+	assert.Equal(t, models.ActorBuyer, middleware.ActorFor(admin, own, middleware.PermEscrowRelease))
+	assert.False(t, middleware.ActorNeedsMFA(admin, own, middleware.PermEscrowRelease))
+
+	admin.MFA = true
+	assert.Equal(t, models.ActorAdmin, middleware.ActorFor(admin, other, middleware.PermEscrowRelease))
+	assert.False(t, middleware.ActorNeedsMFA(admin, other, middleware.PermEscrowRelease))
+}
+
+func TestRequirePermission(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, found := middleware.ClaimsFromContext(r.Context())
+		assert.True(t, found)
+		assert.Equal(t, models.Roles{"admin"}, claims.Roles)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	handler := middleware.RequirePermission(middleware.PermAdminReportsRead)(ok)
+
+	cases := map[string]struct {
+		claims *middleware.Claims
+		code   int
+	}{
+		"no claims": {nil, http.StatusUnauthorized},
+		"buyer":     {&middleware.Claims{UserID: uuid.New(), Roles: []string{"buyer"}}, http.StatusForbidden},
+		"admin":     {&middleware.Claims{UserID: uuid.New(), Roles: []string{"admin"}, MFA: true}, http.StatusNoContent},
+		"no 2FA":    {&middleware.Claims{UserID: uuid.New(), Roles: []string{"admin"}}, http.StatusForbidden},
+	}
+	for name, c := range cases {
+		req := httptest.NewRequest("GET", "/api/admin/reports/totals", nil)
+		if c.claims != nil {
+			req = req.WithContext(middleware.WithClaims(req.Context(), c.claims))
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(t, c.code, rr.Code, name)
+	}
+}
+
+func TestClaimsFromContext_IgnoresStringKey(t *testing.T) {
+	ctx := context.WithValue(context.Background(), "user", &middleware.Claims{Roles: []string{"admin"}})
+	_, ok := middleware.ClaimsFromContext(ctx)
+	assert.False(t, ok)
+}
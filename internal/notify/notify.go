@@ -0,0 +1,118 @@
+// Package notify delivers messages to users outside the API, such as
+// password reset links. Delivery goes through a Notifier so deployments can
+// plug in e-mail, SMS or a chat integration; a Notifier is handed the user
+// and finds its own way to reach them.
+//
+// Outbox keeps messages in memory for tests and development, and FileOutbox
+// appends them to a file for an operator or a relay process to pick up.
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrNoNotifier = errors.New("no notifier configured")
+
+// Message is one notification for one user.
+type Message struct {
+	UserID   uuid.UUID `json:"user_id"`
+	Username string    `json:"username"`
+	Subject  string    `json:"subject"`
+	Body     string    `json:"body"`
+	SentAt   time.Time `json:"sent_at"`
+}
+
+// Notifier delivers messages. Send returns once the message is delivered or
+// durably queued.
+type Notifier interface {
+	Send(ctx context.Context, m Message) error
+}
+
+var (
+	mu       sync.RWMutex
+	notifier Notifier
+)
+
+// SetNotifier replaces the notifier used by handlers.
+func SetNotifier(n Notifier) {
+	mu.Lock()
+	defer mu.Unlock()
+	notifier = n
+}
+
+// Current returns the notifier in use, or ErrNoNotifier if none is set.
+func Current() (Notifier, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	if notifier == nil {
+		return nil, ErrNoNotifier
+	}
+	return notifier, nil
+}
+
+// Outbox keeps every message it is sent in memory.
+type Outbox struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func NewOutbox() *Outbox {
+	return &Outbox{}
+}
+
+func (o *Outbox) Send(ctx context.Context, m Message) error {
+	if m.SentAt.IsZero() {
+		m.SentAt = time.Now()
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.messages = append(o.messages, m)
+	return nil
+}
+
+// Messages returns a copy of the messages sent so far, oldest first.
+func (o *Outbox) Messages() []Message {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]Message(nil), o.messages...)
+}
+
+// FileOutbox appends every message to a file as one line of JSON. The file
+// holds live reset links, so it is created readable by its owner only.
+type FileOutbox struct {
+	mu   sync.Mutex
+	path string
+}
+
+func NewFileOutbox(path string) *FileOutbox {
+	return &FileOutbox{path: path}
+}
+
+func (o *FileOutbox) Send(ctx context.Context, m Message) error {
+	if m.SentAt.IsZero() {
+		m.SentAt = time.Now()
+	}
+	line, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	f, err := os.OpenFile(o.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
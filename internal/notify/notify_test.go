@@ -0,0 +1,43 @@
+package notify_test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"escrow-agent/internal/notify"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileOutbox_AppendsJSONLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.jsonl")
+	outbox := notify.NewFileOutbox(path)
+
+	userID := uuid.New()
+	assert.NoError(t, outbox.Send(context.Background(), notify.Message{UserID: userID, Username: "dave", Subject: "first"}))
+	assert.NoError(t, outbox.Send(context.Background(), notify.Message{UserID: userID, Username: "dave", Subject: "second"}))
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(raw)), "\n")
+	if assert.Len(t, lines, 2) {
+		var m notify.Message
+		assert.NoError(t, json.Unmarshal([]byte(lines[1]), &m))
+		assert.Equal(t, "second", m.Subject)
+		assert.Equal(t, userID, m.UserID)
+		assert.False(t, m.SentAt.IsZero())
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+}
@@ -0,0 +1,127 @@
+package payments
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+
+	"escrow-agent/pkg/models"
+)
+
+// Receipt is one on-chain transfer to a deposit address.
+type Receipt struct {
+	TxHash        string
+	Amount        models.Money
+	Confirmations int
+}
+
+// ChainWatcher is CryptoGateway's view of a blockchain: it hands out fresh
+// deposit addresses, reports what each received with how many confirmations,
+// and sends refunds. Amounts are in the transaction's currency, as with a
+// stablecoin; a watcher for a coin that floats converts them.
+type ChainWatcher interface {
+	NewAddress(ctx context.Context) (string, error)
+	Receipts(ctx context.Context, address string) ([]Receipt, error)
+	Send(ctx context.Context, address string, amount models.Money) (txHash string, err error)
+}
+
+// SimulatedChain is an in-process ChainWatcher for tests and local
+// development. Nothing happens on it unless the caller pays an address with
+// Pay and confirms the transfer with Mine.
+type SimulatedChain struct {
+	mu       sync.Mutex
+	height   int
+	received map[string][]simulatedTransfer
+	sent     []SentTransfer
+}
+
+// SentTransfer is a transfer SimulatedChain sent out.
+type SentTransfer struct {
+	TxHash  string
+	Address string
+	Amount  models.Money
+}
+
+type simulatedTransfer struct {
+	hash   string
+	amount models.Money
+	height int
+}
+
+func NewSimulatedChain() *SimulatedChain {
+	return &SimulatedChain{received: map[string][]simulatedTransfer{}}
+}
+
+func (c *SimulatedChain) NewAddress(ctx context.Context) (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	address := "sim1" + hex.EncodeToString(b)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.received[address] = nil
+	return address, nil
+}
+
+// Pay sends amount to address in the next block and returns the transfer's
+// hash. The transfer has no confirmations until Mine is called.
+func (c *SimulatedChain) Pay(address string, amount models.Money) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	hash := c.hash()
+	c.received[address] = append(c.received[address], simulatedTransfer{hash: hash, amount: amount, height: c.height + 1})
+	return hash
+}
+
+// Mine adds n blocks, confirming pending transfers once and those already
+// mined n times more.
+func (c *SimulatedChain) Mine(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.height += n
+}
+
+func (c *SimulatedChain) Receipts(ctx context.Context, address string) ([]Receipt, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	transfers, ok := c.received[address]
+	if !ok {
+		return nil, fmt.Errorf("%w: address %s", ErrUnknownReference, address)
+	}
+	receipts := make([]Receipt, 0, len(transfers))
+	for _, t := range transfers {
+		confirmations := 0
+		if t.height <= c.height {
+			confirmations = c.height - t.height + 1
+		}
+		receipts = append(receipts, Receipt{TxHash: t.hash, Amount: t.amount, Confirmations: confirmations})
+	}
+	return receipts, nil
+}
+
+func (c *SimulatedChain) Send(ctx context.Context, address string, amount models.Money) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	hash := c.hash()
+	c.sent = append(c.sent, SentTransfer{TxHash: hash, Address: address, Amount: amount})
+	return hash, nil
+}
+
+// Sent returns the refunds sent so far, oldest first.
+func (c *SimulatedChain) Sent() []SentTransfer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]SentTransfer(nil), c.sent...)
+}
+
+// hash makes a transfer hash. c.mu must be held.
+func (c *SimulatedChain) hash() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return "0x" + hex.EncodeToString(b)
+}
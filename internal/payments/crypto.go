@@ -0,0 +1,264 @@
+package payments
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"escrow-agent/pkg/models"
+)
+
+// MethodCrypto is the payment_method CryptoGateway is registered for.
+const MethodCrypto = "crypto"
+
+// CryptoGateway takes payments on a blockchain through a ChainWatcher. Each
+// charge gets a deposit address of its own, which is its reference, and the
+// charge token is the buyer's address for refunds. Capture leaves the charge
+// pending until the address has received the amount in transfers with at
+// least Confirmations confirmations each; the scheduler checks on it, see
+// Track. A charge not paid in full within Window fails. What the buyer sent
+// beyond the amount, or all of a payment that fell short, is reported in
+// Result.Received for the caller to refund.
+//
+// It keeps its charges in memory. Every Result carries a Deposit, which is
+// sealed in the payment's details, and Restore rebuilds a charge from it
+// after a restart; what the address received is read off the chain again.
+type CryptoGateway struct {
+	Confirmations int
+	Window        time.Duration
+
+	watcher ChainWatcher
+	now     func() time.Time
+	mu      sync.Mutex
+	charges map[string]*cryptoCharge
+}
+
+// Deposit is what CryptoGateway keeps about a charge besides its Result: the
+// buyer's refund address, when the payment window opened, how much was sent
+// back already and the keys of the refunds that sent it.
+type Deposit struct {
+	RefundTo string       `json:"refund_to"`
+	OpenedAt time.Time    `json:"opened_at"`
+	Refunded models.Money `json:"refunded"`
+	Refunds  []string     `json:"refunds,omitempty"`
+}
+
+type cryptoCharge struct {
+	result   Result
+	refundTo string
+	opened   time.Time
+	refunded models.Money
+	refunds  map[string]bool
+}
+
+func NewCryptoGateway(watcher ChainWatcher, confirmations int, window time.Duration) *CryptoGateway {
+	return &CryptoGateway{
+		Confirmations: confirmations,
+		Window:        window,
+		watcher:       watcher,
+		now:           time.Now,
+		charges:       map[string]*cryptoCharge{},
+	}
+}
+
+// SetClock replaces the gateway's clock, so tests can let the payment window
+// run out.
+func (g *CryptoGateway) SetClock(now func() time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.now = now
+}
+
+func (g *CryptoGateway) Authorize(ctx context.Context, req ChargeRequest) (Result, error) {
+	if !req.Amount.IsPositive() {
+		return Result{}, fmt.Errorf("%w: amount must be positive", ErrDeclined)
+	}
+	if req.Token == "" {
+		return Result{}, fmt.Errorf("%w: a refund address is required as the payment token", ErrDeclined)
+	}
+	address, err := g.watcher.NewAddress(ctx)
+	if err != nil {
+		return Result{}, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	charge := &cryptoCharge{
+		result:   Result{Reference: address, Status: StatusAuthorized, Amount: req.Amount},
+		refundTo: req.Token,
+		opened:   g.now(),
+		refunded: models.NewMoney(0, req.Amount.Currency),
+		refunds:  map[string]bool{},
+	}
+	g.charges[address] = charge
+	return g.snapshot(charge), nil
+}
+
+// Restore rebuilds a charge from a Result it reported before a restart.
+// Charges the gateway already knows are left alone.
+func (g *CryptoGateway) Restore(result Result) {
+	if result.Reference == "" || result.Deposit == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.charges[result.Reference]; ok {
+		return
+	}
+	charge := &cryptoCharge{
+		result:   result,
+		refundTo: result.Deposit.RefundTo,
+		opened:   result.Deposit.OpenedAt,
+		refunded: result.Deposit.Refunded,
+		refunds:  map[string]bool{},
+	}
+	for _, key := range result.Deposit.Refunds {
+		charge.refunds[key] = true
+	}
+	charge.result.Deposit = nil
+	g.charges[result.Reference] = charge
+}
+
+// Capture starts waiting for the buyer's transfer.
+func (g *CryptoGateway) Capture(ctx context.Context, reference string) (Result, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	charge, ok := g.charges[reference]
+	if !ok {
+		return Result{}, ErrUnknownReference
+	}
+	if charge.result.Status != StatusAuthorized {
+		return g.snapshot(charge), ErrInvalidState
+	}
+	charge.result.Status = StatusPending
+	return g.snapshot(charge), nil
+}
+
+// Void gives up on a charge nothing was paid to yet.
+func (g *CryptoGateway) Void(ctx context.Context, reference string) (Result, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	charge, ok := g.charges[reference]
+	if !ok {
+		return Result{}, ErrUnknownReference
+	}
+	if charge.result.Status != StatusAuthorized {
+		return g.snapshot(charge), ErrInvalidState
+	}
+	charge.result.Status = StatusVoided
+	return g.snapshot(charge), nil
+}
+
+// Status reads the deposit address off the chain. A pending charge is
+// captured once its confirmed receipts cover the amount, and fails once the
+// window has passed without them and no transfer is still confirming.
+// Settled charges are read too, so Received includes transfers that arrived
+// after the charge settled.
+func (g *CryptoGateway) Status(ctx context.Context, reference string) (Result, error) {
+	g.mu.Lock()
+	charge, ok := g.charges[reference]
+	if !ok {
+		g.mu.Unlock()
+		return Result{}, ErrUnknownReference
+	}
+	if charge.result.Status == StatusAuthorized || charge.result.Status == StatusVoided {
+		defer g.mu.Unlock()
+		return g.snapshot(charge), nil
+	}
+	g.mu.Unlock()
+
+	receipts, err := g.watcher.Receipts(ctx, reference)
+	if err != nil {
+		return Result{}, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	received := models.NewMoney(0, charge.result.Amount.Currency)
+	confirmations, confirming := 0, false
+	for i, r := range receipts {
+		if r.Confirmations < g.Confirmations {
+			confirming = true
+		}
+		if i == 0 || r.Confirmations < confirmations {
+			confirmations = r.Confirmations
+		}
+		received = received.Add(r.Amount)
+	}
+	charge.result.Received = &received
+	charge.result.Confirmations = confirmations
+
+	switch {
+	case charge.result.Status != StatusPending:
+		// settled before, or by another call meanwhile
+	case !confirming && received.Minor >= charge.result.Amount.Minor:
+		charge.result.Status = StatusCaptured
+	case !confirming && g.now().After(charge.opened.Add(g.Window)):
+		charge.result.Status = StatusFailed
+	}
+	return g.snapshot(charge), nil
+}
+
+// Refund sends amount back to the buyer's refund address. Anything the
+// address received and was not refunded yet may be sent back; once a
+// captured charge is no longer covered, it counts as refunded.
+func (g *CryptoGateway) Refund(ctx context.Context, req RefundRequest) (Result, error) {
+	amount := req.Amount
+	g.mu.Lock()
+	charge, ok := g.charges[req.Reference]
+	if !ok {
+		g.mu.Unlock()
+		return Result{}, ErrUnknownReference
+	}
+	if req.Key != "" && charge.refunds[req.Key] {
+		defer g.mu.Unlock()
+		return g.snapshot(charge), nil
+	}
+	refundable := models.NewMoney(0, amount.Currency)
+	if charge.result.Received != nil {
+		refundable = charge.result.Received.Sub(charge.refunded)
+	}
+	settled := charge.result.Status == StatusCaptured || charge.result.Status == StatusRefunded || charge.result.Status == StatusFailed
+	if !settled || !amount.IsPositive() || amount.Minor > refundable.Minor {
+		defer g.mu.Unlock()
+		return g.snapshot(charge), ErrInvalidState
+	}
+	// reserve the amount and key so a concurrent refund cannot send it too
+	charge.refunded = charge.refunded.Add(amount)
+	if req.Key != "" {
+		charge.refunds[req.Key] = true
+	}
+	g.mu.Unlock()
+
+	_, err := g.watcher.Send(ctx, charge.refundTo, amount)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err != nil {
+		charge.refunded = charge.refunded.Sub(amount)
+		delete(charge.refunds, req.Key)
+		return g.snapshot(charge), fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	if charge.result.Status == StatusCaptured && charge.result.Received.Sub(charge.refunded).Minor < charge.result.Amount.Minor {
+		charge.result.Status = StatusRefunded
+	}
+	return g.snapshot(charge), nil
+}
+
+// snapshot copies a charge's result so callers cannot change it, with its
+// Deposit. g.mu must be held.
+func (g *CryptoGateway) snapshot(charge *cryptoCharge) Result {
+	result := charge.result
+	if result.Received != nil {
+		received := *result.Received
+		result.Received = &received
+	}
+	result.Deposit = &Deposit{RefundTo: charge.refundTo, OpenedAt: charge.opened, Refunded: charge.refunded}
+	for key := range charge.refunds {
+		result.Deposit.Refunds = append(result.Deposit.Refunds, key)
+	}
+	sort.Strings(result.Deposit.Refunds)
+	return result
+}
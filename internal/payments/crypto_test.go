@@ -0,0 +1,268 @@
+package payments_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"escrow-agent/internal/crypto"
+	"escrow-agent/internal/payments"
+	"escrow-agent/pkg/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+)
+
+// openCryptoCharge authorizes and captures a crypto charge for amount,
+// returning its deposit address.
+func openCryptoCharge(t *testing.T, gateway *payments.CryptoGateway, amount string) string {
+	ctx := context.Background()
+	authorized, err := gateway.Authorize(ctx, payments.ChargeRequest{TransactionID: uuid.New(), Amount: models.MustParseMoney(amount, "USD"), Token: "sim1buyer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending, err := gateway.Capture(ctx, authorized.Reference)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, payments.StatusPending, pending.Status)
+	return authorized.Reference
+}
+
+func TestCryptoGateway_CapturedOnceConfirmed(t *testing.T) {
+	chain := payments.NewSimulatedChain()
+	gateway := payments.NewCryptoGateway(chain, 3, time.Hour)
+	ctx := context.Background()
+	address := openCryptoCharge(t, gateway, "50")
+
+	chain.Pay(address, models.MustParseMoney("30", "USD"))
+	chain.Pay(address, models.MustParseMoney("25", "USD"))
+	chain.Mine(2)
+	status, err := gateway.Status(ctx, address)
+	assert.NoError(t, err)
+	assert.Equal(t, payments.StatusPending, status.Status)
+	assert.Equal(t, 2, status.Confirmations)
+
+	chain.Mine(1)
+	status, err = gateway.Status(ctx, address)
+	assert.NoError(t, err)
+	assert.Equal(t, payments.StatusCaptured, status.Status)
+	assert.Equal(t, "55.00", status.Received.String())
+
+	// the overpaid 5.00 can go back without refunding the charge
+	refund := payments.RefundRequest{Reference: address, Amount: models.MustParseMoney("5", "USD"), Key: "refund:overpaid"}
+	refunded, err := gateway.Refund(ctx, refund)
+	assert.NoError(t, err)
+	assert.Equal(t, payments.StatusCaptured, refunded.Status)
+	assert.Equal(t, []string{"refund:overpaid"}, refunded.Deposit.Refunds)
+	// asked again, say after the database transaction rolled back
+	_, err = gateway.Refund(ctx, refund)
+	assert.NoError(t, err)
+	_, err = gateway.Refund(ctx, payments.RefundRequest{Reference: address, Amount: models.MustParseMoney("60", "USD")})
+	assert.ErrorIs(t, err, payments.ErrInvalidState)
+
+	sent := chain.Sent()
+	if assert.Len(t, sent, 1) {
+		assert.Equal(t, "sim1buyer", sent[0].Address)
+		assert.Equal(t, "5.00", sent[0].Amount.String())
+	}
+}
+
+func TestCryptoGateway_FailsWhenWindowCloses(t *testing.T) {
+	chain := payments.NewSimulatedChain()
+	gateway := payments.NewCryptoGateway(chain, 1, time.Hour)
+	ctx := context.Background()
+	address := openCryptoCharge(t, gateway, "50")
+
+	chain.Pay(address, models.MustParseMoney("20", "USD"))
+	chain.Mine(1)
+	status, err := gateway.Status(ctx, address)
+	assert.NoError(t, err)
+	assert.Equal(t, payments.StatusPending, status.Status)
+
+	gateway.SetClock(func() time.Time { return time.Now().Add(2 * time.Hour) })
+	status, err = gateway.Status(ctx, address)
+	assert.NoError(t, err)
+	assert.Equal(t, payments.StatusFailed, status.Status)
+	assert.Equal(t, "20.00", status.Received.String())
+
+	_, err = gateway.Refund(ctx, payments.RefundRequest{Reference: address, Amount: models.MustParseMoney("20", "USD")})
+	assert.NoError(t, err)
+}
+
+func TestCryptoGateway_RestoresChargeAfterRestart(t *testing.T) {
+	chain := payments.NewSimulatedChain()
+	ctx := context.Background()
+	first := payments.NewCryptoGateway(chain, 1, time.Hour)
+	opened, err := first.Authorize(ctx, payments.ChargeRequest{TransactionID: uuid.New(), Amount: models.MustParseMoney("50", "USD"), Token: "sim1buyer"})
+	assert.NoError(t, err)
+	pending, err := first.Capture(ctx, opened.Reference)
+	assert.NoError(t, err)
+	if !assert.NotNil(t, pending.Deposit) {
+		return
+	}
+	// the result as Charge sealed it in the payment's details
+	sealed, err := json.Marshal(pending)
+	assert.NoError(t, err)
+	var kept payments.Result
+	assert.NoError(t, json.Unmarshal(sealed, &kept))
+
+	restarted := payments.NewCryptoGateway(chain, 1, time.Hour)
+	_, err = restarted.Status(ctx, kept.Reference)
+	assert.ErrorIs(t, err, payments.ErrUnknownReference)
+	restarted.Restore(kept)
+	chain.Pay(kept.Reference, models.MustParseMoney("60", "USD"))
+	chain.Mine(1)
+	status, err := restarted.Status(ctx, kept.Reference)
+	assert.NoError(t, err)
+	assert.Equal(t, payments.StatusCaptured, status.Status)
+
+	refund := payments.RefundRequest{Reference: kept.Reference, Amount: models.MustParseMoney("10", "USD"), Key: "refund:overpaid"}
+	refunded, err := restarted.Refund(ctx, refund)
+	assert.NoError(t, err)
+	sent := chain.Sent()
+	if assert.Len(t, sent, 1) {
+		assert.Equal(t, "sim1buyer", sent[0].Address)
+	}
+
+	// refunds already sent are known after another restart
+	again := payments.NewCryptoGateway(chain, 1, time.Hour)
+	again.Restore(refunded)
+	_, err = again.Refund(ctx, refund)
+	assert.NoError(t, err)
+	assert.Len(t, chain.Sent(), 1)
+}
+
+func TestTrack_RecordsOverpayment(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+	db := sqlx.NewDb(mockDB, "sqlmock")
+
+	ring, err := crypto.NewEphemeralKeyring("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	crypto.SetKEK(ring)
+
+	chain := payments.NewSimulatedChain()
+	gateway := payments.NewCryptoGateway(chain, 1, time.Hour)
+	payments.Register(payments.MethodCrypto, gateway)
+	address := openCryptoCharge(t, gateway, "50")
+	chain.Pay(address, models.MustParseMoney("70", "USD"))
+	chain.Mine(1)
+
+	payment := &models.Payment{PaymentID: uuid.New(), TransactionID: uuid.New(), Amount: models.MustParseMoney("50", "USD"), Method: payments.MethodCrypto, Status: "pending", GatewayReference: address}
+	now := time.Now()
+	paymentRows := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"payment_id", "transaction_id", "amount", "currency", "method", "payment_status", "gateway_reference", "encrypted_details"}).
+			AddRow(payment.PaymentID, payment.TransactionID, "50.00", "USD", payment.Method, payment.Status, address, payment.EncryptedDetails)
+	}
+
+	mock.ExpectQuery("SELECT (.+) FROM payments WHERE payment_id = \\$1$").
+		WithArgs(payment.PaymentID).
+		WillReturnRows(paymentRows())
+	observed, err := payments.Observe(context.Background(), db, payment.PaymentID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE payments SET encrypted_details").
+		WithArgs(sqlmock.AnyArg(), payment.PaymentID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE payments SET received_amount").
+		WithArgs("70.00", 1, "", now, payment.PaymentID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT COALESCE\\(SUM\\(amount\\), 0\\) FROM payment_deltas").
+		WithArgs(payment.PaymentID).
+		WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow("0"))
+	mock.ExpectQuery("INSERT INTO payment_deltas").
+		WithArgs(payment.PaymentID, payment.TransactionID, payments.DeltaOverpayment, "20.00", "USD").
+		WillReturnRows(sqlmock.NewRows([]string{"delta_id", "payment_id", "transaction_id", "kind", "amount", "currency", "created_at"}).
+			AddRow(uuid.New(), payment.PaymentID, payment.TransactionID, payments.DeltaOverpayment, "20.00", "USD", now))
+
+	tx, err := db.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, delta, err := payments.Track(tx, payment, observed, now)
+	assert.NoError(t, err)
+	assert.Equal(t, payments.StatusCaptured, status)
+	if assert.NotNil(t, delta) {
+		assert.Equal(t, "20.00", delta.Amount.String())
+		assert.Equal(t, "USD", delta.Amount.Currency)
+	}
+	assert.Equal(t, "70.00", payment.ReceivedAmount.String())
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// a transfer arriving after the deposit settled is owed back on its own
+	payment.Status = "completed"
+	chain.Pay(address, models.MustParseMoney("5", "USD"))
+	chain.Mine(1)
+	mock.ExpectQuery("SELECT (.+) FROM payments WHERE payment_id = \\$1$").
+		WithArgs(payment.PaymentID).
+		WillReturnRows(paymentRows())
+	observed, err = payments.Observe(context.Background(), db, payment.PaymentID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectExec("UPDATE payments SET encrypted_details").
+		WithArgs(sqlmock.AnyArg(), payment.PaymentID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE payments SET received_amount").
+		WithArgs("75.00", 1, "", now, payment.PaymentID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT COALESCE\\(SUM\\(amount\\), 0\\) FROM payment_deltas").
+		WithArgs(payment.PaymentID).
+		WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow("20.00"))
+	mock.ExpectQuery("INSERT INTO payment_deltas").
+		WithArgs(payment.PaymentID, payment.TransactionID, payments.DeltaOverpayment, "5.00", "USD").
+		WillReturnRows(sqlmock.NewRows([]string{"delta_id", "payment_id", "transaction_id", "kind", "amount", "currency", "created_at"}).
+			AddRow(uuid.New(), payment.PaymentID, payment.TransactionID, payments.DeltaOverpayment, "5.00", "USD", now))
+
+	status, delta, err = payments.Track(tx, payment, observed, now)
+	assert.NoError(t, err)
+	assert.Equal(t, payments.StatusCaptured, status)
+	if assert.NotNil(t, delta) {
+		assert.Equal(t, "5.00", delta.Amount.String())
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// an observation the payment moved on from is dropped
+	payment.Status = "refunded"
+	status, delta, err = payments.Track(tx, payment, observed, now)
+	assert.NoError(t, err)
+	assert.Equal(t, payments.StatusPending, status)
+	assert.Nil(t, delta)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRefundDelta_AlreadyRefunded(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+	db := sqlx.NewDb(mockDB, "sqlmock")
+
+	deltaID := uuid.New()
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM payment_deltas WHERE delta_id = \\$1 FOR UPDATE").
+		WithArgs(deltaID).
+		WillReturnRows(sqlmock.NewRows([]string{"delta_id", "payment_id", "transaction_id", "kind", "amount", "currency", "created_at", "refunded_at"}).
+			AddRow(deltaID, uuid.New(), uuid.New(), payments.DeltaUnderpayment, "20.00", "USD", time.Now(), time.Now()))
+
+	tx, err := db.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = payments.RefundDelta(context.Background(), tx, deltaID, uuid.New())
+	assert.ErrorIs(t, err, payments.ErrDeltaRefunded)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
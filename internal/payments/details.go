@@ -0,0 +1,127 @@
+package payments
+
+import (
+	"escrow-agent/internal/crypto"
+	"escrow-agent/pkg/models"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+// Details is what the gateway reported about a charge when it was recorded.
+// It is stored sealed in payments.encrypted_details and only leaves this
+// package through OpenDetails. Token is kept only while a charge the gateway
+// never authorized waits for its retry.
+type Details struct {
+	Gateway Result `json:"gateway"`
+	Token   string `json:"token,omitempty"`
+}
+
+// detailsContext binds sealed details to the transaction they were recorded
+// for; payment_id is not known until the row is inserted.
+func detailsContext(transactionID uuid.UUID) string {
+	return "payments.encrypted_details:" + transactionID.String()
+}
+
+func sealDetails(transactionID uuid.UUID, d Details) ([]byte, error) {
+	return crypto.SealJSON(d, detailsContext(transactionID))
+}
+
+// OpenDetails decrypts the details recorded with a payment. Rows written
+// before encryption give crypto.ErrNotSealed until RotateDetails has sealed
+// them.
+func OpenDetails(payment *models.Payment) (Details, error) {
+	var d Details
+	err := crypto.OpenJSON(payment.EncryptedDetails, detailsContext(payment.TransactionID), &d)
+	return d, err
+}
+
+// lookupFor returns the gateway of a payment, restoring the charge from the
+// payment's details first if the gateway is a Restorer.
+func lookupFor(payment *models.Payment) (Gateway, error) {
+	gateway, err := Lookup(payment.Method)
+	if err != nil {
+		return nil, err
+	}
+	restorer, ok := gateway.(Restorer)
+	if !ok || payment.GatewayReference == "" || len(payment.EncryptedDetails) == 0 {
+		return gateway, nil
+	}
+	details, err := OpenDetails(payment)
+	if err != nil {
+		return nil, err
+	}
+	result := details.Gateway
+	if result.Reference != payment.GatewayReference || result.Deposit == nil {
+		return gateway, nil
+	}
+	// amounts decode without their currency; the payment row has it
+	result.Amount = payment.Amount
+	if result.Received != nil {
+		received, err := result.Received.WithCurrency(payment.Amount.Currency)
+		if err != nil {
+			return nil, err
+		}
+		result.Received = &received
+	}
+	if result.Deposit.Refunded, err = result.Deposit.Refunded.WithCurrency(payment.Amount.Currency); err != nil {
+		return nil, err
+	}
+	restorer.Restore(result)
+	return gateway, nil
+}
+
+// keepResult seals the latest result of a charge the gateway can restore as
+// the payment's details, so a restart picks it up where it was.
+func keepResult(exec sqlx.Execer, payment *models.Payment, result Result) error {
+	if result.Deposit == nil {
+		return nil
+	}
+	sealed, err := sealDetails(payment.TransactionID, Details{Gateway: result})
+	if err != nil {
+		return err
+	}
+	if _, err := exec.Exec("UPDATE payments SET encrypted_details = $1 WHERE payment_id = $2", sealed, payment.PaymentID); err != nil {
+		return err
+	}
+	payment.EncryptedDetails = sealed
+	return nil
+}
+
+// RotateDetails brings the details of up to limit payments after the given
+// payment_id to the current key-encryption key, see crypto.Rotate, and
+// returns the last payment_id it looked at, or uuid.Nil when none were left.
+// Callers walk the table by passing that back in, starting from uuid.Nil.
+func RotateDetails(tx *sqlx.Tx, after uuid.UUID, limit int) (last uuid.UUID, rotated int, err error) {
+	var rows []struct {
+		PaymentID     uuid.UUID `db:"payment_id"`
+		TransactionID uuid.UUID `db:"transaction_id"`
+		Details       []byte    `db:"encrypted_details"`
+	}
+	err = tx.Select(&rows, `
+		SELECT payment_id, transaction_id, encrypted_details
+		FROM payments
+		WHERE payment_id > $1
+		ORDER BY payment_id
+		LIMIT $2
+		FOR UPDATE
+	`, after, limit)
+	if err != nil || len(rows) == 0 {
+		return uuid.Nil, 0, err
+	}
+
+	for _, row := range rows {
+		sealed, changed, err := crypto.Rotate(row.Details, detailsContext(row.TransactionID))
+		if err != nil {
+			return uuid.Nil, rotated, err
+		}
+		if !changed {
+			continue
+		}
+		if _, err := tx.Exec("UPDATE payments SET encrypted_details = $1 WHERE payment_id = $2", sealed, row.PaymentID); err != nil {
+			return uuid.Nil, rotated, err
+		}
+		rotated++
+	}
+	return rows[len(rows)-1].PaymentID, rotated, nil
+}
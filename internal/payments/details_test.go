@@ -0,0 +1,68 @@
+package payments_test
+
+import (
+	"database/sql/driver"
+	"testing"
+
+	"escrow-agent/internal/crypto"
+	"escrow-agent/internal/payments"
+	"escrow-agent/pkg/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+)
+
+// captured matches any argument and keeps it.
+type captured struct{ value []byte }
+
+func (c *captured) Match(v driver.Value) bool {
+	c.value, _ = v.([]byte)
+	return true
+}
+
+func TestRotateDetails_SealsLegacyRows(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+	db := sqlx.NewDb(mockDB, "sqlmock")
+
+	ring, err := crypto.NewEphemeralKeyring("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	crypto.SetKEK(ring)
+
+	paymentID, transactionID := uuid.New(), uuid.New()
+	sealed := &captured{}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT payment_id, transaction_id, encrypted_details FROM payments").
+		WithArgs(uuid.Nil, 100).
+		WillReturnRows(sqlmock.NewRows([]string{"payment_id", "transaction_id", "encrypted_details"}).
+			AddRow(paymentID, transactionID, []byte(`{"gateway":{"reference":"mock_1","status":"captured","amount":50}}`)))
+	mock.ExpectExec("UPDATE payments SET encrypted_details").
+		WithArgs(sealed, paymentID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	tx, err := db.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	last, rotated, err := payments.RotateDetails(tx, uuid.Nil, 100)
+	assert.NoError(t, err)
+	assert.Equal(t, paymentID, last)
+	assert.Equal(t, 1, rotated)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	details, err := payments.OpenDetails(&models.Payment{TransactionID: transactionID, EncryptedDetails: sealed.value})
+	assert.NoError(t, err)
+	assert.Equal(t, "mock_1", details.Gateway.Reference)
+
+	// details are bound to their transaction
+	_, err = payments.OpenDetails(&models.Payment{TransactionID: uuid.New(), EncryptedDetails: sealed.value})
+	assert.ErrorIs(t, err, crypto.ErrCorrupt)
+}
@@ -0,0 +1,127 @@
+package payments
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"escrow-agent/pkg/models"
+
+	"github.com/google/uuid"
+)
+
+// Status is the state of a charge as reported by a payment gateway.
+type Status string
+
+const (
+	StatusAuthorized Status = "authorized"
+	// StatusPending is a capture the gateway accepted but confirms later,
+	// through a webhook.
+	StatusPending  Status = "pending"
+	StatusCaptured Status = "captured"
+	StatusRefunded Status = "refunded"
+	StatusVoided   Status = "voided"
+	StatusFailed   Status = "failed"
+)
+
+// PaymentStatus maps a gateway status onto the payment_status enum stored in
+// the payments table.
+func (s Status) PaymentStatus() string {
+	switch s {
+	case StatusCaptured:
+		return "completed"
+	case StatusRefunded:
+		return "refunded"
+	case StatusVoided, StatusFailed:
+		return "failed"
+	default:
+		return "pending"
+	}
+}
+
+var (
+	ErrDeclined          = errors.New("payment declined")
+	ErrUnknownReference  = errors.New("unknown payment reference")
+	ErrInvalidState      = errors.New("operation not allowed in current payment state")
+	ErrUnsupportedMethod = errors.New("unsupported payment method")
+	// ErrUnavailable is a failure the gateway may recover from, such as a
+	// timeout or an outage; the call is retried later.
+	ErrUnavailable = errors.New("payment gateway unavailable")
+)
+
+// ChargeRequest describes a charge against the buyer. Token is the opaque
+// payment instrument reference the client obtained from the gateway.
+type ChargeRequest struct {
+	TransactionID uuid.UUID
+	Amount        models.Money
+	Token         string
+}
+
+// RefundRequest returns captured funds to the buyer. Gateways carry out each
+// Key at most once: repeating the key of a refund that went through answers
+// with the charge as it stands and sends nothing, so a refund asked for again
+// after the database transaction around it rolled back cannot pay twice. An
+// empty Key is never deduplicated.
+type RefundRequest struct {
+	Reference string
+	Amount    models.Money
+	Key       string
+}
+
+// Result is a gateway's view of a single charge. Gateways that can tell what
+// the buyer actually sent, such as CryptoGateway, report it in Received,
+// which may differ from Amount, and how settled it is in Confirmations.
+// Deposit is what CryptoGateway needs to restore the charge, see Restorer.
+type Result struct {
+	Reference     string        `json:"reference"`
+	Status        Status        `json:"status"`
+	Amount        models.Money  `json:"amount"`
+	Received      *models.Money `json:"received,omitempty"`
+	Confirmations int           `json:"confirmations,omitempty"`
+	Deposit       *Deposit      `json:"deposit,omitempty"`
+}
+
+// Gateway is implemented by every payment provider. Authorize places a hold on
+// the buyer's funds, Capture collects it, Void drops an uncaptured hold and
+// Refund returns captured funds. Status queries the provider for the current
+// state of a charge.
+type Gateway interface {
+	Authorize(ctx context.Context, req ChargeRequest) (Result, error)
+	Capture(ctx context.Context, reference string) (Result, error)
+	Refund(ctx context.Context, req RefundRequest) (Result, error)
+	Void(ctx context.Context, reference string) (Result, error)
+	Status(ctx context.Context, reference string) (Result, error)
+}
+
+// Restorer is implemented by gateways that keep their charges in memory. The
+// Result recorded with a payment, sealed in its details, is handed back
+// before the gateway is asked about the payment, so a charge taken before a
+// restart is known again.
+type Restorer interface {
+	Restore(result Result)
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Gateway{}
+)
+
+// Register makes a gateway available for the given payment_method. Registering
+// the same method twice replaces the previous gateway.
+func Register(method string, gateway Gateway) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[method] = gateway
+}
+
+// Lookup returns the gateway registered for a payment_method.
+func Lookup(method string) (Gateway, error) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	gateway, ok := registry[method]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedMethod, method)
+	}
+	return gateway, nil
+}
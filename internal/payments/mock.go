@@ -0,0 +1,154 @@
+package payments
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// DeclineToken makes the mock gateway decline the authorization, so clients
+// and tests can exercise the failure path.
+const DeclineToken = "tok_declined"
+
+// MockGateway is a deterministic in-process gateway. References are derived
+// from the transaction ID and the attempt number, and every operation follows
+// the same rules as a real provider so illegal moves (e.g. refunding a voided
+// charge) are rejected.
+//
+// An async gateway leaves captures pending, as providers that confirm them
+// by webhook do, until Settle decides them.
+type MockGateway struct {
+	mu       sync.Mutex
+	charges  map[string]*Result
+	attempts map[string]int
+	refunds  map[string]bool
+	async    bool
+	outages  int
+}
+
+func NewMockGateway() *MockGateway {
+	return &MockGateway{
+		charges:  map[string]*Result{},
+		attempts: map[string]int{},
+		refunds:  map[string]bool{},
+	}
+}
+
+// NewAsyncMockGateway returns a mock gateway whose captures stay pending
+// until settled.
+func NewAsyncMockGateway() *MockGateway {
+	m := NewMockGateway()
+	m.async = true
+	return m
+}
+
+// FailNext makes the next n authorizations and captures fail with
+// ErrUnavailable, as during a gateway outage.
+func (m *MockGateway) FailNext(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.outages = n
+}
+
+// outage uses up one simulated failure, if any are left. m.mu must be held.
+func (m *MockGateway) outage() bool {
+	if m.outages == 0 {
+		return false
+	}
+	m.outages--
+	return true
+}
+
+func (m *MockGateway) Authorize(ctx context.Context, req ChargeRequest) (Result, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.outage() {
+		return Result{}, ErrUnavailable
+	}
+
+	key := req.TransactionID.String()
+	m.attempts[key]++
+	reference := fmt.Sprintf("mock_%s_%d", key, m.attempts[key])
+
+	if !req.Amount.IsPositive() || req.Token == DeclineToken {
+		m.charges[reference] = &Result{Reference: reference, Status: StatusFailed, Amount: req.Amount}
+		return *m.charges[reference], ErrDeclined
+	}
+
+	m.charges[reference] = &Result{Reference: reference, Status: StatusAuthorized, Amount: req.Amount}
+	return *m.charges[reference], nil
+}
+
+func (m *MockGateway) Capture(ctx context.Context, reference string) (Result, error) {
+	m.mu.Lock()
+	outage := m.outage()
+	m.mu.Unlock()
+	if outage {
+		return Result{}, ErrUnavailable
+	}
+	if m.async {
+		return m.transition(reference, StatusAuthorized, StatusPending)
+	}
+	return m.transition(reference, StatusAuthorized, StatusCaptured)
+}
+
+// Settle completes a pending capture, or fails it when ok is false. It
+// stands in for the gateway deciding; the webhook that reports the decision
+// is sent separately.
+func (m *MockGateway) Settle(reference string, ok bool) (Result, error) {
+	if ok {
+		return m.transition(reference, StatusPending, StatusCaptured)
+	}
+	return m.transition(reference, StatusPending, StatusFailed)
+}
+
+func (m *MockGateway) Void(ctx context.Context, reference string) (Result, error) {
+	return m.transition(reference, StatusAuthorized, StatusVoided)
+}
+
+func (m *MockGateway) Refund(ctx context.Context, req RefundRequest) (Result, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	charge, ok := m.charges[req.Reference]
+	if !ok {
+		return Result{}, ErrUnknownReference
+	}
+	if req.Key != "" && m.refunds[req.Key] {
+		return *charge, nil
+	}
+	if charge.Status != StatusCaptured || !req.Amount.IsPositive() || req.Amount.Minor > charge.Amount.Minor {
+		return *charge, ErrInvalidState
+	}
+	charge.Status = StatusRefunded
+	if req.Key != "" {
+		m.refunds[req.Key] = true
+	}
+	return *charge, nil
+}
+
+func (m *MockGateway) Status(ctx context.Context, reference string) (Result, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	charge, ok := m.charges[reference]
+	if !ok {
+		return Result{}, ErrUnknownReference
+	}
+	return *charge, nil
+}
+
+func (m *MockGateway) transition(reference string, from, to Status) (Result, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	charge, ok := m.charges[reference]
+	if !ok {
+		return Result{}, ErrUnknownReference
+	}
+	if charge.Status != from {
+		return *charge, ErrInvalidState
+	}
+	charge.Status = to
+	return *charge, nil
+}
@@ -0,0 +1,98 @@
+package payments_test
+
+import (
+	"context"
+	"testing"
+
+	"escrow-agent/internal/payments"
+	"escrow-agent/pkg/models"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMockGateway_ChargeAndRefund(t *testing.T) {
+	gateway := payments.NewMockGateway()
+	ctx := context.Background()
+
+	authorized, err := gateway.Authorize(ctx, payments.ChargeRequest{TransactionID: uuid.New(), Amount: models.MustParseMoney("50", "USD"), Token: "tok_visa"})
+	assert.NoError(t, err)
+	assert.Equal(t, payments.StatusAuthorized, authorized.Status)
+
+	captured, err := gateway.Capture(ctx, authorized.Reference)
+	assert.NoError(t, err)
+	assert.Equal(t, payments.StatusCaptured, captured.Status)
+	assert.Equal(t, "completed", captured.Status.PaymentStatus())
+
+	_, err = gateway.Void(ctx, authorized.Reference)
+	assert.ErrorIs(t, err, payments.ErrInvalidState)
+
+	refund := payments.RefundRequest{Reference: authorized.Reference, Amount: models.MustParseMoney("50", "USD"), Key: "refund:1"}
+	refunded, err := gateway.Refund(ctx, refund)
+	assert.NoError(t, err)
+	assert.Equal(t, "refunded", refunded.Status.PaymentStatus())
+	_, err = gateway.Refund(ctx, refund)
+	assert.NoError(t, err, "the same refund asked for again")
+	refund.Key = "refund:2"
+	_, err = gateway.Refund(ctx, refund)
+	assert.ErrorIs(t, err, payments.ErrInvalidState)
+
+	status, err := gateway.Status(ctx, authorized.Reference)
+	assert.NoError(t, err)
+	assert.Equal(t, payments.StatusRefunded, status.Status)
+}
+
+func TestMockGateway_DeterministicReferences(t *testing.T) {
+	transactionID := uuid.New()
+	req := payments.ChargeRequest{TransactionID: transactionID, Amount: models.MustParseMoney("10", "USD"), Token: "tok_visa"}
+
+	first, _ := payments.NewMockGateway().Authorize(context.Background(), req)
+	second, _ := payments.NewMockGateway().Authorize(context.Background(), req)
+
+	assert.Equal(t, first.Reference, second.Reference)
+}
+
+func TestMockGateway_Decline(t *testing.T) {
+	gateway := payments.NewMockGateway()
+
+	result, err := gateway.Authorize(context.Background(), payments.ChargeRequest{TransactionID: uuid.New(), Amount: models.MustParseMoney("50", "USD"), Token: payments.DeclineToken})
+	assert.ErrorIs(t, err, payments.ErrDeclined)
+
+	_, err = gateway.Capture(context.Background(), result.Reference)
+	assert.ErrorIs(t, err, payments.ErrInvalidState)
+}
+
+func TestRegistry(t *testing.T) {
+	gateway := payments.NewMockGateway()
+	payments.Register("credit_card", gateway)
+
+	found, err := payments.Lookup("credit_card")
+	assert.NoError(t, err)
+	assert.Same(t, gateway, found)
+
+	_, err = payments.Lookup("cheque")
+	assert.ErrorIs(t, err, payments.ErrUnsupportedMethod)
+}
+
+func TestMockGateway_AsyncCapture(t *testing.T) {
+	gateway := payments.NewAsyncMockGateway()
+	ctx := context.Background()
+
+	authorized, err := gateway.Authorize(ctx, payments.ChargeRequest{TransactionID: uuid.New(), Amount: models.MustParseMoney("50", "USD"), Token: "tok_visa"})
+	assert.NoError(t, err)
+
+	pending, err := gateway.Capture(ctx, authorized.Reference)
+	assert.NoError(t, err)
+	assert.Equal(t, "pending", pending.Status.PaymentStatus())
+
+	// nothing to refund until the capture settles
+	_, err = gateway.Refund(ctx, payments.RefundRequest{Reference: authorized.Reference, Amount: models.MustParseMoney("50", "USD")})
+	assert.ErrorIs(t, err, payments.ErrInvalidState)
+
+	settled, err := gateway.Settle(authorized.Reference, true)
+	assert.NoError(t, err)
+	assert.Equal(t, payments.StatusCaptured, settled.Status)
+
+	_, err = gateway.Settle(authorized.Reference, false)
+	assert.ErrorIs(t, err, payments.ErrInvalidState)
+}
@@ -0,0 +1,167 @@
+package payments
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"escrow-agent/pkg/models"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+const paymentColumns = `payment_id, transaction_id, amount, currency, method, payment_status, gateway_reference, encrypted_details, attempts, last_error, next_retry_at, reconciled_at, mismatch, received_amount, confirmations, processed_at, created_at`
+
+// Charge authorizes and captures amount through the gateway registered for
+// method and records the payment inside tx: completed, or pending when the
+// gateway confirms captures later by webhook. A charge the gateway could not
+// take for the moment (ErrUnavailable) is recorded pending with a retry
+// scheduled under the current Policy, and no error. Any other gateway failure
+// is recorded as a failed payment, returned together with the error so the
+// caller can commit it for the record. If the payment cannot be recorded the
+// captured funds are refunded before returning the error.
+func Charge(ctx context.Context, tx *sqlx.Tx, transactionID uuid.UUID, method, token string, amount models.Money) (*models.Payment, error) {
+	gateway, err := Lookup(method)
+	if err != nil {
+		return nil, err
+	}
+
+	result, chargeErr := collect(ctx, gateway, ChargeRequest{TransactionID: transactionID, Amount: amount, Token: token}, "")
+	status := result.Status.PaymentStatus()
+	lastError := ""
+	kept := Details{Gateway: result}
+	var nextRetry *time.Time
+	switch {
+	case errors.Is(chargeErr, ErrUnavailable):
+		at := time.Now().Add(CurrentPolicy().delay(1))
+		status, lastError, nextRetry = StatusPending.PaymentStatus(), chargeErr.Error(), &at
+		if result.Reference == "" {
+			kept.Token = token
+		}
+		log.Printf("[WARN] Payment for transaction %s deferred, retry at %s: %v", transactionID, at.Format(time.RFC3339), chargeErr)
+	case chargeErr != nil:
+		status, lastError = StatusFailed.PaymentStatus(), chargeErr.Error()
+	}
+
+	var payment models.Payment
+	insertQuery := `
+		INSERT INTO payments (transaction_id, amount, currency, method, payment_status, gateway_reference, encrypted_details, last_error, next_retry_at, processed_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, ''), $9, NOW(), NOW())
+		RETURNING ` + paymentColumns
+	details, err := sealDetails(transactionID, kept)
+	if err == nil {
+		err = tx.QueryRowx(insertQuery, transactionID, amount, amount.Currency, method, status, result.Reference, details, lastError, nextRetry).StructScan(&payment)
+	}
+	if err == nil {
+		err = payment.AttachCurrency()
+	}
+	if err != nil {
+		if chargeErr == nil {
+			Reverse(ctx, &models.Payment{Method: method, GatewayReference: result.Reference, Amount: amount})
+		}
+		return nil, fmt.Errorf("record payment: %w", err)
+	}
+
+	if chargeErr != nil && nextRetry == nil {
+		return &payment, chargeErr
+	}
+	return &payment, nil
+}
+
+// Reverse refunds a captured payment at the gateway without touching the
+// database. Callers use it when the surrounding database transaction fails
+// after Charge succeeded.
+func Reverse(ctx context.Context, payment *models.Payment) {
+	gateway, err := Lookup(payment.Method)
+	if err != nil {
+		log.Printf("[ERROR] Cannot reverse payment %s: %v", payment.GatewayReference, err)
+		return
+	}
+	req := RefundRequest{Reference: payment.GatewayReference, Amount: payment.Amount, Key: "reverse:" + payment.GatewayReference}
+	if _, err := gateway.Refund(ctx, req); err != nil {
+		log.Printf("[ERROR] Failed to reverse payment %s: %v", payment.GatewayReference, err)
+	}
+}
+
+// Refund returns the completed payment of a transaction to the buyer through
+// its gateway and marks the row refunded. A transaction without a completed
+// payment is left untouched.
+func Refund(ctx context.Context, tx *sqlx.Tx, transactionID uuid.UUID) error {
+	var payment models.Payment
+	query := "SELECT " + paymentColumns + " FROM payments WHERE transaction_id = $1 AND payment_status = 'completed' FOR UPDATE"
+	err := tx.Get(&payment, query, transactionID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err == nil {
+		err = payment.AttachCurrency()
+	}
+	if err != nil {
+		return err
+	}
+	return RefundPayment(ctx, tx, &payment)
+}
+
+// RefundPayment returns a captured payment to the buyer through its gateway
+// and marks the row refunded. payment must be locked in tx. The refund is
+// keyed by the payment_id, so asking again after tx rolled back does not
+// refund twice.
+func RefundPayment(ctx context.Context, tx *sqlx.Tx, payment *models.Payment) error {
+	// payments recorded outside a gateway (manual or legacy rows) carry no reference
+	if payment.GatewayReference != "" {
+		gateway, err := lookupFor(payment)
+		if err != nil {
+			return err
+		}
+		result, err := gateway.Refund(ctx, RefundRequest{Reference: payment.GatewayReference, Amount: payment.Amount, Key: "refund:" + payment.PaymentID.String()})
+		if err != nil {
+			return fmt.Errorf("refund: %w", err)
+		}
+		if err := keepResult(tx, payment, result); err != nil {
+			return err
+		}
+	}
+
+	return SetStatus(tx, payment.PaymentID, StatusRefunded.PaymentStatus())
+}
+
+// TransactionByReference returns the transaction the payment with the gateway
+// reference belongs to, without locking the payment, so that callers can lock
+// the transaction first. Unknown references give ErrUnknownReference.
+func TransactionByReference(q sqlx.Queryer, reference string) (uuid.UUID, error) {
+	var transactionID uuid.UUID
+	err := sqlx.Get(q, &transactionID, "SELECT transaction_id FROM payments WHERE gateway_reference = $1 AND gateway_reference <> ''", reference)
+	if errors.Is(err, sql.ErrNoRows) {
+		return uuid.Nil, ErrUnknownReference
+	}
+	return transactionID, err
+}
+
+// LockByReference reads the payment with the gateway reference inside tx and
+// holds its row lock until tx ends. Unknown references give
+// ErrUnknownReference.
+func LockByReference(tx *sqlx.Tx, reference string) (*models.Payment, error) {
+	var payment models.Payment
+	query := "SELECT " + paymentColumns + " FROM payments WHERE gateway_reference = $1 AND gateway_reference <> '' FOR UPDATE"
+	err := tx.Get(&payment, query, reference)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUnknownReference
+	}
+	if err == nil {
+		err = payment.AttachCurrency()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &payment, nil
+}
+
+// SetStatus records a payment_status the gateway reported for a payment. A
+// retry still scheduled for the payment is called off.
+func SetStatus(exec sqlx.Execer, paymentID uuid.UUID, status string) error {
+	_, err := exec.Exec("UPDATE payments SET payment_status = $1, next_retry_at = NULL, processed_at = NOW() WHERE payment_id = $2", status, paymentID)
+	return err
+}
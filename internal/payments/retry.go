@@ -0,0 +1,219 @@
+package payments
+
+import (
+	"context"
+	"errors"
+	"escrow-agent/pkg/models"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+var ErrInvalidPolicy = errors.New("invalid payment retry policy")
+
+// Policy holds the deployment's retry and reconciliation settings. A charge
+// the gateway could not take (ErrUnavailable) is tried again after BaseDelay,
+// then after twice as long each time up to MaxDelay, until MaxAttempts
+// attempts have been made. Payments are compared with the gateway's records
+// every ReconcileEvery, and pending payments the gateway settles without a
+// webhook, such as crypto deposits, are checked every PollEvery, see Track.
+type Policy struct {
+	MaxAttempts    int
+	BaseDelay      time.Duration
+	MaxDelay       time.Duration
+	ReconcileEvery time.Duration
+	PollEvery      time.Duration
+}
+
+// DefaultPolicy applies until SetPolicy is called.
+var DefaultPolicy = Policy{
+	MaxAttempts:    5,
+	BaseDelay:      time.Minute,
+	MaxDelay:       time.Hour,
+	ReconcileEvery: 24 * time.Hour,
+	PollEvery:      time.Minute,
+}
+
+var (
+	policyMu sync.RWMutex
+	policy   = DefaultPolicy
+)
+
+// SetPolicy replaces the retry and reconciliation settings.
+func SetPolicy(p Policy) error {
+	if p.MaxAttempts < 1 || p.BaseDelay <= 0 || p.MaxDelay < p.BaseDelay || p.ReconcileEvery <= 0 || p.PollEvery <= 0 {
+		return ErrInvalidPolicy
+	}
+	policyMu.Lock()
+	defer policyMu.Unlock()
+	policy = p
+	return nil
+}
+
+// CurrentPolicy returns the retry and reconciliation settings in use.
+func CurrentPolicy() Policy {
+	policyMu.RLock()
+	defer policyMu.RUnlock()
+	return policy
+}
+
+// delay is how long to wait before the retry that follows the given number
+// of attempts.
+func (p Policy) delay(attempts int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < attempts && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	return d
+}
+
+// collect takes a charge as far as the gateway lets it: it authorizes, unless
+// reference names an earlier authorization, and captures. A hold the gateway
+// refuses to capture for good is voided. The result carries the reference
+// from the moment there is one, alongside an error too.
+func collect(ctx context.Context, gateway Gateway, req ChargeRequest, reference string) (Result, error) {
+	var result Result
+	if reference == "" {
+		authorized, err := gateway.Authorize(ctx, req)
+		if err != nil {
+			return authorized, fmt.Errorf("authorize: %w", err)
+		}
+		result = authorized
+	} else {
+		// an earlier attempt may have got further than it heard back about
+		current, err := gateway.Status(ctx, reference)
+		if err != nil {
+			return Result{Reference: reference, Amount: req.Amount}, fmt.Errorf("status: %w", err)
+		}
+		if current.Status != StatusAuthorized {
+			return current, nil
+		}
+		result = current
+	}
+
+	captured, err := gateway.Capture(ctx, result.Reference)
+	if err != nil && !errors.Is(err, ErrUnavailable) {
+		if _, voidErr := gateway.Void(ctx, result.Reference); voidErr != nil {
+			log.Printf("[ERROR] Failed to void authorization %s: %v", result.Reference, voidErr)
+		}
+	}
+	if err != nil {
+		return result, fmt.Errorf("capture: %w", err)
+	}
+	return captured, nil
+}
+
+// Lock reads a payment inside tx and holds its row lock until tx ends.
+func Lock(tx *sqlx.Tx, paymentID uuid.UUID) (*models.Payment, error) {
+	var payment models.Payment
+	err := tx.Get(&payment, "SELECT "+paymentColumns+" FROM payments WHERE payment_id = $1 FOR UPDATE", paymentID)
+	if err == nil {
+		err = payment.AttachCurrency()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &payment, nil
+}
+
+// Retry charges again a payment the gateway could not take earlier. payment
+// must be pending with a retry due, and locked in tx. It returns
+// StatusCaptured once the gateway took the charge and StatusFailed once it
+// declined it or the policy's attempts ran out, with the reason left in
+// payment.LastError; the caller settles the deposit either way. StatusPending
+// means there is nothing to do yet: another retry is scheduled, or the
+// gateway confirms the capture later by webhook.
+func Retry(ctx context.Context, tx *sqlx.Tx, payment *models.Payment, now time.Time) (Status, error) {
+	gateway, err := Lookup(payment.Method)
+	if err != nil {
+		return "", err
+	}
+	details, err := OpenDetails(payment)
+	if err != nil {
+		return "", err
+	}
+
+	req := ChargeRequest{TransactionID: payment.TransactionID, Amount: payment.Amount, Token: details.Token}
+	result, chargeErr := collect(ctx, gateway, req, payment.GatewayReference)
+
+	p := CurrentPolicy()
+	attempts := payment.Attempts + 1
+	status := result.Status
+	lastError := ""
+	var nextRetry *time.Time
+	switch {
+	case errors.Is(chargeErr, ErrUnavailable) && attempts < p.MaxAttempts:
+		at := now.Add(p.delay(attempts))
+		status, lastError, nextRetry = StatusPending, chargeErr.Error(), &at
+	case errors.Is(chargeErr, ErrUnavailable):
+		status, lastError = StatusFailed, fmt.Sprintf("gave up after %d attempts: %v", attempts, chargeErr)
+	case chargeErr != nil:
+		status, lastError = StatusFailed, chargeErr.Error()
+	case status != StatusCaptured && status != StatusPending:
+		status, lastError = StatusFailed, fmt.Sprintf("gateway reports the charge %s", result.Status)
+	}
+
+	kept := Details{Gateway: result}
+	if nextRetry != nil && result.Reference == "" {
+		kept.Token = details.Token
+	}
+	sealed, err := sealDetails(payment.TransactionID, kept)
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.Exec(`
+		UPDATE payments
+		SET attempts = $1, last_error = NULLIF($2, ''), next_retry_at = $3, gateway_reference = $4, encrypted_details = $5, processed_at = NOW()
+		WHERE payment_id = $6
+	`, attempts, lastError, nextRetry, result.Reference, sealed, payment.PaymentID)
+	if err != nil {
+		return "", err
+	}
+
+	payment.Attempts = attempts
+	payment.NextRetryAt = nextRetry
+	payment.GatewayReference = result.Reference
+	payment.EncryptedDetails = sealed
+	payment.LastError = nil
+	if lastError != "" {
+		payment.LastError = &lastError
+	}
+	return status, nil
+}
+
+// Reconcile compares a payment with the gateway's record of the charge and
+// returns how they differ, or "" if they agree. The outcome is stored on the
+// payment, so a mismatch stays flagged until a later run finds them in
+// agreement again. payment must be locked in tx. Gateway errors other than
+// an unknown reference are returned, and the payment is tried again on the
+// next run.
+func Reconcile(ctx context.Context, tx *sqlx.Tx, payment *models.Payment, now time.Time) (string, error) {
+	mismatch := ""
+	var result Result
+	gateway, err := lookupFor(payment)
+	if err == nil {
+		result, err = gateway.Status(ctx, payment.GatewayReference)
+	}
+	switch {
+	case errors.Is(err, ErrUnsupportedMethod):
+		mismatch = "no gateway is registered for " + payment.Method
+	case errors.Is(err, ErrUnknownReference):
+		mismatch = "the gateway has no record of the charge"
+	case err != nil:
+		return "", err
+	case result.Status.PaymentStatus() != payment.Status:
+		mismatch = fmt.Sprintf("the gateway reports the charge %s, recorded here as %s", result.Status, payment.Status)
+	case !result.Amount.Equal(payment.Amount):
+		mismatch = fmt.Sprintf("the gateway reports %s %s, recorded here as %s %s", result.Amount, result.Amount.Currency, payment.Amount, payment.Amount.Currency)
+	}
+
+	_, err = tx.Exec("UPDATE payments SET reconciled_at = $1, mismatch = NULLIF($2, '') WHERE payment_id = $3", now, mismatch, payment.PaymentID)
+	return mismatch, err
+}
@@ -0,0 +1,174 @@
+package payments_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"escrow-agent/internal/crypto"
+	"escrow-agent/internal/payments"
+	"escrow-agent/pkg/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetry_BacksOffUntilCaptured(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+	db := sqlx.NewDb(mockDB, "sqlmock")
+
+	ring, err := crypto.NewEphemeralKeyring("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	crypto.SetKEK(ring)
+	gateway := payments.NewMockGateway()
+	payments.Register("credit_card", gateway)
+	assert.NoError(t, payments.SetPolicy(payments.Policy{MaxAttempts: 3, BaseDelay: time.Minute, MaxDelay: time.Hour, ReconcileEvery: time.Hour, PollEvery: time.Minute}))
+	defer payments.SetPolicy(payments.DefaultPolicy)
+
+	transactionID := uuid.New()
+	details, err := crypto.SealJSON(payments.Details{Token: "tok_visa"}, "payments.encrypted_details:"+transactionID.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	payment := &models.Payment{PaymentID: uuid.New(), TransactionID: transactionID, Amount: models.MustParseMoney("50", "USD"), Method: "credit_card", Status: "pending", EncryptedDetails: details, Attempts: 1}
+	now := time.Now()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE payments SET attempts").
+		WithArgs(2, "authorize: payment gateway unavailable", now.Add(2*time.Minute), "", sqlmock.AnyArg(), payment.PaymentID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE payments SET attempts").
+		WithArgs(3, "", nil, sqlmock.AnyArg(), sqlmock.AnyArg(), payment.PaymentID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	tx, err := db.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gateway.FailNext(1)
+	status, err := payments.Retry(context.Background(), tx, payment, now)
+	assert.NoError(t, err)
+	assert.Equal(t, payments.StatusPending, status)
+	assert.Equal(t, now.Add(2*time.Minute), *payment.NextRetryAt)
+
+	// the token survives the deferred attempt, so the next one can authorize
+	kept, err := payments.OpenDetails(payment)
+	assert.NoError(t, err)
+	assert.Equal(t, "tok_visa", kept.Token)
+
+	status, err = payments.Retry(context.Background(), tx, payment, now)
+	assert.NoError(t, err)
+	assert.Equal(t, payments.StatusCaptured, status)
+	assert.Nil(t, payment.LastError)
+	assert.NotEmpty(t, payment.GatewayReference)
+
+	kept, err = payments.OpenDetails(payment)
+	assert.NoError(t, err)
+	assert.Empty(t, kept.Token)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRetry_GivesUpAfterMaxAttempts(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+	db := sqlx.NewDb(mockDB, "sqlmock")
+
+	ring, err := crypto.NewEphemeralKeyring("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	crypto.SetKEK(ring)
+	gateway := payments.NewMockGateway()
+	payments.Register("credit_card", gateway)
+
+	transactionID := uuid.New()
+	details, err := crypto.SealJSON(payments.Details{Token: "tok_visa"}, "payments.encrypted_details:"+transactionID.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	payment := &models.Payment{PaymentID: uuid.New(), TransactionID: transactionID, Amount: models.MustParseMoney("50", "USD"), Method: "credit_card", Status: "pending", EncryptedDetails: details, Attempts: payments.DefaultPolicy.MaxAttempts - 1}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE payments SET attempts").
+		WithArgs(payments.DefaultPolicy.MaxAttempts, "gave up after 5 attempts: authorize: payment gateway unavailable", nil, "", sqlmock.AnyArg(), payment.PaymentID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	tx, err := db.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gateway.FailNext(1)
+	status, err := payments.Retry(context.Background(), tx, payment, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, payments.StatusFailed, status)
+	assert.Contains(t, *payment.LastError, "gave up")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestReconcile_FlagsMismatch(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+	db := sqlx.NewDb(mockDB, "sqlmock")
+
+	gateway := payments.NewMockGateway()
+	payments.Register("credit_card", gateway)
+	ctx := context.Background()
+
+	amount := models.MustParseMoney("50", "USD")
+	authorized, err := gateway.Authorize(ctx, payments.ChargeRequest{TransactionID: uuid.New(), Amount: amount, Token: "tok_visa"})
+	assert.NoError(t, err)
+	_, err = gateway.Capture(ctx, authorized.Reference)
+	assert.NoError(t, err)
+
+	payment := &models.Payment{PaymentID: uuid.New(), Amount: amount, Method: "credit_card", Status: "completed", GatewayReference: authorized.Reference}
+	now := time.Now()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE payments SET reconciled_at").
+		WithArgs(now, "", payment.PaymentID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE payments SET reconciled_at").
+		WithArgs(now, "the gateway reports the charge refunded, recorded here as completed", payment.PaymentID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE payments SET reconciled_at").
+		WithArgs(now, "the gateway has no record of the charge", payment.PaymentID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	tx, err := db.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mismatch, err := payments.Reconcile(ctx, tx, payment, now)
+	assert.NoError(t, err)
+	assert.Empty(t, mismatch)
+
+	// refunded at the gateway behind our back
+	_, err = gateway.Refund(ctx, payments.RefundRequest{Reference: authorized.Reference, Amount: amount})
+	assert.NoError(t, err)
+	mismatch, err = payments.Reconcile(ctx, tx, payment, now)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, mismatch)
+
+	payment.GatewayReference = "mock_unknown"
+	mismatch, err = payments.Reconcile(ctx, tx, payment, now)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, mismatch)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,230 @@
+package payments
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"escrow-agent/pkg/models"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+var (
+	ErrDeltaNotFound = errors.New("payment delta not found")
+	ErrDeltaRefunded = errors.New("payment delta already refunded")
+)
+
+// Kinds of payment delta.
+const (
+	DeltaOverpayment  = "overpayment"
+	DeltaUnderpayment = "underpayment"
+)
+
+const deltaColumns = `delta_id, payment_id, transaction_id, kind, amount, currency, created_at, refunded_at, refunded_by`
+
+// Observation is where a gateway said a payment stood, see Observe.
+type Observation struct {
+	result Result
+	// err is ErrUnavailable when the gateway could not be asked
+	err error
+	// status and details are the payment's when it was observed
+	status  string
+	details []byte
+}
+
+// Observe asks the gateway of a payment that settles without a webhook where
+// the payment stands, for Track to store. It reads the payment without a
+// lock, so a slow gateway, such as one reading a chain, holds up nobody.
+func Observe(ctx context.Context, q sqlx.Queryer, paymentID uuid.UUID) (*Observation, error) {
+	var payment models.Payment
+	err := sqlx.Get(q, &payment, "SELECT "+paymentColumns+" FROM payments WHERE payment_id = $1", paymentID)
+	if err == nil {
+		err = payment.AttachCurrency()
+	}
+	if err != nil {
+		return nil, err
+	}
+	gateway, err := lookupFor(&payment)
+	if err != nil {
+		return nil, err
+	}
+	result, err := gateway.Status(ctx, payment.GatewayReference)
+	if err != nil && !errors.Is(err, ErrUnavailable) {
+		return nil, err
+	}
+	return &Observation{result: result, err: err, status: payment.Status, details: payment.EncryptedDetails}, nil
+}
+
+// Track stores an observation of a payment whose gateway settles it without
+// a webhook, as CryptoGateway does once a deposit is confirmed on chain,
+// including what the buyer sent so far. payment must be locked in tx; if it
+// changed since it was observed the observation is dropped and
+// StatusPending returned, for the next observation to pick up. It returns
+// StatusCaptured once the charge is covered and StatusFailed once it fell
+// through, with the reason left in payment.LastError; the caller settles a
+// pending deposit either way. Money the escrow does not take, what an
+// overpayment sent beyond the amount or all of a payment that fell short, is
+// recorded as a delta owed back to the buyer and returned too. Payments that
+// settled already are tracked as well, so transfers arriving late are owed
+// back in a delta of their own. StatusPending means there is nothing to do
+// yet; a gateway that is unavailable is asked again on the next run.
+func Track(tx *sqlx.Tx, payment *models.Payment, observed *Observation, now time.Time) (Status, *models.PaymentDelta, error) {
+	if payment.Status != observed.status || !bytes.Equal(payment.EncryptedDetails, observed.details) {
+		return StatusPending, nil, nil
+	}
+	result, err := observed.result, observed.err
+	status := result.Status
+	lastError := ""
+	switch {
+	case err != nil:
+		status, lastError = StatusPending, err.Error()
+	case status == StatusFailed && result.Received != nil && result.Received.IsPositive():
+		lastError = fmt.Sprintf("underpaid: received %s of %s %s before the payment window closed", result.Received, payment.Amount, payment.Amount.Currency)
+	case status == StatusFailed:
+		lastError = "nothing received before the payment window closed"
+	case status != StatusCaptured:
+		status = StatusPending
+	}
+
+	confirmations := payment.Confirmations
+	received := payment.ReceivedAmount
+	if err == nil {
+		confirmations, received = result.Confirmations, result.Received
+		if err := keepResult(tx, payment, result); err != nil {
+			return "", nil, err
+		}
+	}
+	_, err = tx.Exec(`
+		UPDATE payments
+		SET received_amount = $1, confirmations = $2, last_error = NULLIF($3, ''), reconciled_at = $4
+		WHERE payment_id = $5
+	`, received, confirmations, lastError, now, payment.PaymentID)
+	if err != nil {
+		return "", nil, err
+	}
+	payment.ReceivedAmount = received
+	payment.Confirmations = confirmations
+	payment.ReconciledAt = &now
+	payment.LastError = nil
+	if lastError != "" {
+		payment.LastError = &lastError
+	}
+
+	var delta *models.PaymentDelta
+	switch {
+	case received == nil:
+	case status == StatusCaptured || result.Status == StatusRefunded:
+		delta, err = recordDelta(tx, payment, DeltaOverpayment, received.Sub(payment.Amount))
+	case status == StatusFailed:
+		delta, err = recordDelta(tx, payment, DeltaUnderpayment, *received)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	return status, delta, nil
+}
+
+// recordDelta records what of owed the payment's earlier deltas do not cover
+// as owed back to the buyer, and returns nil when they cover all of it. A
+// payment gets a delta when it settles and another for each later transfer.
+func recordDelta(tx *sqlx.Tx, payment *models.Payment, kind string, owed models.Money) (*models.PaymentDelta, error) {
+	var recorded models.Money
+	err := tx.Get(&recorded, "SELECT COALESCE(SUM(amount), 0) FROM payment_deltas WHERE payment_id = $1", payment.PaymentID)
+	if err == nil {
+		recorded, err = recorded.WithCurrency(owed.Currency)
+	}
+	if err != nil {
+		return nil, err
+	}
+	amount := owed.Sub(recorded)
+	if !amount.IsPositive() {
+		return nil, nil
+	}
+
+	var delta models.PaymentDelta
+	err = tx.Get(&delta, `
+		INSERT INTO payment_deltas (payment_id, transaction_id, kind, amount, currency, created_at)
+		VALUES ($1, $2, $3, $4, $5, NOW())
+		RETURNING `+deltaColumns, payment.PaymentID, payment.TransactionID, kind, amount, amount.Currency)
+	if err == nil {
+		err = delta.AttachCurrency()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &delta, nil
+}
+
+// Deltas lists payment deltas, newest first, optionally only those not yet
+// refunded.
+func Deltas(q sqlx.Queryer, open bool, limit int) ([]models.PaymentDelta, error) {
+	deltas := []models.PaymentDelta{}
+	err := sqlx.Select(q, &deltas, `
+		SELECT `+deltaColumns+`
+		FROM payment_deltas
+		WHERE NOT $1 OR refunded_at IS NULL
+		ORDER BY created_at DESC
+		LIMIT $2
+	`, open, limit)
+	for i := range deltas {
+		if err == nil {
+			err = deltas[i].AttachCurrency()
+		}
+	}
+	return deltas, err
+}
+
+// RefundDelta sends a delta back to the buyer through the gateway that took
+// the payment and marks it refunded by actorID. The refund is keyed by the
+// payment and delta, so asking again after tx rolled back does not send the
+// delta twice.
+func RefundDelta(ctx context.Context, tx *sqlx.Tx, deltaID, actorID uuid.UUID) (*models.PaymentDelta, error) {
+	var delta models.PaymentDelta
+	err := tx.Get(&delta, "SELECT "+deltaColumns+" FROM payment_deltas WHERE delta_id = $1 FOR UPDATE", deltaID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrDeltaNotFound
+	}
+	if err == nil {
+		err = delta.AttachCurrency()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if delta.RefundedAt != nil {
+		return &delta, ErrDeltaRefunded
+	}
+
+	payment, err := Lock(tx, delta.PaymentID)
+	if err != nil {
+		return nil, err
+	}
+	gateway, err := lookupFor(payment)
+	if err != nil {
+		return nil, err
+	}
+	key := "refund:" + payment.PaymentID.String() + ":" + delta.DeltaID.String()
+	result, err := gateway.Refund(ctx, RefundRequest{Reference: payment.GatewayReference, Amount: delta.Amount, Key: key})
+	if err != nil {
+		return nil, fmt.Errorf("refund: %w", err)
+	}
+	if err := keepResult(tx, payment, result); err != nil {
+		return nil, err
+	}
+
+	err = tx.Get(&delta, `
+		UPDATE payment_deltas
+		SET refunded_at = NOW(), refunded_by = $1
+		WHERE delta_id = $2
+		RETURNING `+deltaColumns, actorID, deltaID)
+	if err == nil {
+		err = delta.AttachCurrency()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &delta, nil
+}
@@ -0,0 +1,240 @@
+package payouts
+
+import (
+	"database/sql"
+	"errors"
+	"escrow-agent/internal/crypto"
+	"escrow-agent/pkg/models"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+// Kinds of payout account.
+const (
+	KindBankAccount   = "bank_account"
+	KindCryptoAddress = "crypto_address"
+)
+
+// Destination is where a payout account sends money. A bank account needs
+// the holder's name and either an IBAN or an account and routing number; a
+// crypto address needs its network and the address.
+type Destination struct {
+	AccountHolder string `json:"account_holder,omitempty"`
+	IBAN          string `json:"iban,omitempty"`
+	AccountNumber string `json:"account_number,omitempty"`
+	RoutingNumber string `json:"routing_number,omitempty"`
+	Network       string `json:"network,omitempty"`
+	Address       string `json:"address,omitempty"`
+}
+
+var (
+	ibanPattern          = regexp.MustCompile(`^[A-Z]{2}[0-9]{2}[A-Z0-9]{11,30}$`)
+	accountNumberPattern = regexp.MustCompile(`^[0-9]{4,17}$`)
+	routingNumberPattern = regexp.MustCompile(`^[0-9]{9}$`)
+	networkPattern       = regexp.MustCompile(`^[a-z0-9-]{2,32}$`)
+	addressPattern       = regexp.MustCompile(`^[A-Za-z0-9]{20,128}$`)
+)
+
+// normalize checks that d is complete for kind and returns it cleaned up,
+// with the masked label shown for it.
+func (d Destination) normalize(kind string) (Destination, string, error) {
+	switch kind {
+	case KindBankAccount:
+		clean := Destination{
+			AccountHolder: strings.TrimSpace(d.AccountHolder),
+			IBAN:          strings.ToUpper(strings.ReplaceAll(d.IBAN, " ", "")),
+			AccountNumber: strings.TrimSpace(d.AccountNumber),
+			RoutingNumber: strings.TrimSpace(d.RoutingNumber),
+		}
+		if clean.AccountHolder == "" {
+			return Destination{}, "", fmt.Errorf("%w: account holder is required", ErrInvalidDestination)
+		}
+		number := clean.IBAN
+		switch {
+		case clean.IBAN != "" && (clean.AccountNumber != "" || clean.RoutingNumber != ""):
+			return Destination{}, "", fmt.Errorf("%w: give either an IBAN or an account and routing number", ErrInvalidDestination)
+		case clean.IBAN != "" && !ibanPattern.MatchString(clean.IBAN):
+			return Destination{}, "", fmt.Errorf("%w: invalid IBAN", ErrInvalidDestination)
+		case clean.IBAN == "" && (!accountNumberPattern.MatchString(clean.AccountNumber) || !routingNumberPattern.MatchString(clean.RoutingNumber)):
+			return Destination{}, "", fmt.Errorf("%w: an IBAN or an account and 9-digit routing number is required", ErrInvalidDestination)
+		case clean.IBAN == "":
+			number = clean.AccountNumber
+		}
+		return clean, "Bank account ending " + number[len(number)-4:], nil
+
+	case KindCryptoAddress:
+		clean := Destination{
+			Network: strings.ToLower(strings.TrimSpace(d.Network)),
+			Address: strings.TrimSpace(d.Address),
+		}
+		if !networkPattern.MatchString(clean.Network) {
+			return Destination{}, "", fmt.Errorf("%w: network is required", ErrInvalidDestination)
+		}
+		if !addressPattern.MatchString(clean.Address) {
+			return Destination{}, "", fmt.Errorf("%w: invalid address", ErrInvalidDestination)
+		}
+		return clean, clean.Network + " " + clean.Address[:6] + "…" + clean.Address[len(clean.Address)-4:], nil
+	}
+	return Destination{}, "", fmt.Errorf("%w: %q", ErrUnsupportedKind, kind)
+}
+
+// accountContext binds a sealed destination to its payout account.
+func accountContext(accountID uuid.UUID) string {
+	return "payout_accounts.encrypted_details:" + accountID.String()
+}
+
+// OpenDestination decrypts the destination of a payout account.
+func OpenDestination(account *models.PayoutAccount) (Destination, error) {
+	var d Destination
+	err := crypto.OpenJSON(account.EncryptedDetails, accountContext(account.AccountID), &d)
+	return d, err
+}
+
+// RotateAccounts brings the destinations of up to limit payout accounts
+// after the given account_id to the current key-encryption key, see
+// crypto.Rotate, and returns the last account_id it looked at, or uuid.Nil
+// when none were left. Callers walk the table by passing that back in,
+// starting from uuid.Nil. Removed accounts are rotated too.
+func RotateAccounts(tx *sqlx.Tx, after uuid.UUID, limit int) (last uuid.UUID, rotated int, err error) {
+	var rows []struct {
+		AccountID uuid.UUID `db:"account_id"`
+		Details   []byte    `db:"encrypted_details"`
+	}
+	err = tx.Select(&rows, `
+		SELECT account_id, encrypted_details
+		FROM payout_accounts
+		WHERE account_id > $1
+		ORDER BY account_id
+		LIMIT $2
+		FOR UPDATE
+	`, after, limit)
+	if err != nil || len(rows) == 0 {
+		return uuid.Nil, 0, err
+	}
+
+	for _, row := range rows {
+		sealed, changed, err := crypto.Rotate(row.Details, accountContext(row.AccountID))
+		if err != nil {
+			return uuid.Nil, rotated, err
+		}
+		if !changed {
+			continue
+		}
+		if _, err := tx.Exec("UPDATE payout_accounts SET encrypted_details = $1 WHERE account_id = $2", sealed, row.AccountID); err != nil {
+			return uuid.Nil, rotated, err
+		}
+		rotated++
+	}
+	return rows[len(rows)-1].AccountID, rotated, nil
+}
+
+const accountColumns = `account_id, user_id, kind, label, encrypted_details, is_default, created_at, removed_at`
+
+// AddAccount stores a payout account for userID with its destination sealed.
+// The user's first account, or one added with makeDefault, becomes the
+// default their payouts go to, and payouts held on the old one are queued
+// again.
+func AddAccount(tx *sqlx.Tx, userID uuid.UUID, kind string, d Destination, makeDefault bool) (*models.PayoutAccount, error) {
+	d, label, err := d.normalize(kind)
+	if err != nil {
+		return nil, err
+	}
+	accountID := uuid.New()
+	sealed, err := crypto.SealJSON(d, accountContext(accountID))
+	if err != nil {
+		return nil, err
+	}
+
+	var hasDefault bool
+	err = tx.Get(&hasDefault, "SELECT EXISTS(SELECT 1 FROM payout_accounts WHERE user_id = $1 AND is_default)", userID)
+	if err != nil {
+		return nil, err
+	}
+	if makeDefault && hasDefault {
+		if _, err := tx.Exec("UPDATE payout_accounts SET is_default = FALSE WHERE user_id = $1 AND is_default", userID); err != nil {
+			return nil, err
+		}
+	}
+
+	var account models.PayoutAccount
+	err = tx.Get(&account, `
+		INSERT INTO payout_accounts (account_id, user_id, kind, label, encrypted_details, is_default, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, NOW())
+		RETURNING `+accountColumns, accountID, userID, kind, label, sealed, makeDefault || !hasDefault)
+	if err == nil && account.IsDefault {
+		err = requeueHeld(tx, userID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+// Accounts lists a user's payout accounts, default first, leaving out removed
+// ones.
+func Accounts(q sqlx.Queryer, userID uuid.UUID) ([]models.PayoutAccount, error) {
+	accounts := []models.PayoutAccount{}
+	err := sqlx.Select(q, &accounts, `
+		SELECT `+accountColumns+`
+		FROM payout_accounts
+		WHERE user_id = $1 AND removed_at IS NULL
+		ORDER BY is_default DESC, created_at DESC
+	`, userID)
+	return accounts, err
+}
+
+// SetDefault makes one of the user's payout accounts the one their payouts go
+// to, and queues payouts held on the old one again.
+func SetDefault(tx *sqlx.Tx, userID, accountID uuid.UUID) (*models.PayoutAccount, error) {
+	var account models.PayoutAccount
+	err := tx.Get(&account, "SELECT "+accountColumns+" FROM payout_accounts WHERE account_id = $1 AND user_id = $2 AND removed_at IS NULL FOR UPDATE", accountID, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrAccountNotFound
+	}
+	if err != nil || account.IsDefault {
+		return &account, err
+	}
+
+	if _, err := tx.Exec("UPDATE payout_accounts SET is_default = FALSE WHERE user_id = $1 AND is_default", userID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("UPDATE payout_accounts SET is_default = TRUE WHERE account_id = $1", accountID); err != nil {
+		return nil, err
+	}
+	if err := requeueHeld(tx, userID); err != nil {
+		return nil, err
+	}
+	account.IsDefault = true
+	return &account, nil
+}
+
+// requeueHeld hands the user's held payouts back to the batch job with a
+// fresh set of attempts, once they picked a new default account.
+func requeueHeld(exec sqlx.Execer, userID uuid.UUID) error {
+	_, err := exec.Exec("UPDATE payouts SET payout_status = 'pending', attempts = 0 WHERE seller_id = $1 AND payout_status = 'held'", userID)
+	return err
+}
+
+// RemoveAccount retires one of the user's payout accounts. Batches already
+// under way still go to it. When the default is removed, payouts wait until
+// the user picks another account rather than going to one they did not
+// choose.
+func RemoveAccount(tx *sqlx.Tx, userID, accountID uuid.UUID) (*models.PayoutAccount, error) {
+	var account models.PayoutAccount
+	err := tx.Get(&account, `
+		UPDATE payout_accounts
+		SET removed_at = NOW(), is_default = FALSE
+		WHERE account_id = $1 AND user_id = $2 AND removed_at IS NULL
+		RETURNING `+accountColumns, accountID, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrAccountNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
@@ -0,0 +1,213 @@
+package payouts_test
+
+import (
+	"database/sql/driver"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"escrow-agent/internal/crypto"
+	"escrow-agent/internal/payouts"
+	"escrow-agent/pkg/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+)
+
+// captured matches any argument and keeps it.
+type captured struct{ value driver.Value }
+
+func (c *captured) Match(v driver.Value) bool {
+	c.value = v
+	return true
+}
+
+var accountColumns = []string{"account_id", "user_id", "kind", "label", "encrypted_details", "is_default", "created_at", "removed_at"}
+
+func TestAddAccount_RejectsInvalidDestinations(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+	db := sqlx.NewDb(mockDB, "sqlmock")
+
+	mock.ExpectBegin()
+	tx, err := db.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name string
+		kind string
+		d    payouts.Destination
+		want error
+	}{
+		{"unknown kind", "paypal", payouts.Destination{Address: "alice@example.com"}, payouts.ErrUnsupportedKind},
+		{"no holder", payouts.KindBankAccount, payouts.Destination{IBAN: "DE89370400440532013000"}, payouts.ErrInvalidDestination},
+		{"bad IBAN", payouts.KindBankAccount, payouts.Destination{AccountHolder: "Alice", IBAN: "DE89"}, payouts.ErrInvalidDestination},
+		{"IBAN and account number", payouts.KindBankAccount, payouts.Destination{AccountHolder: "Alice", IBAN: "DE89370400440532013000", AccountNumber: "12345678"}, payouts.ErrInvalidDestination},
+		{"no routing number", payouts.KindBankAccount, payouts.Destination{AccountHolder: "Alice", AccountNumber: "12345678"}, payouts.ErrInvalidDestination},
+		{"no network", payouts.KindCryptoAddress, payouts.Destination{Address: "bc1qxy2kgdygjrsqtzq2n0yrf2493p83kkfjhx0wlh"}, payouts.ErrInvalidDestination},
+		{"bad address", payouts.KindCryptoAddress, payouts.Destination{Network: "bitcoin", Address: "not an address"}, payouts.ErrInvalidDestination},
+	}
+	for _, c := range cases {
+		_, err := payouts.AddAccount(tx, uuid.New(), c.kind, c.d, false)
+		assert.True(t, errors.Is(err, c.want), "%s: got %v", c.name, err)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAddAccount_SealsDestinationAndMasksLabel(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+	db := sqlx.NewDb(mockDB, "sqlmock")
+
+	ring, err := crypto.NewEphemeralKeyring("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	crypto.SetKEK(ring)
+
+	userID := uuid.New()
+	accountID, sealed := &captured{}, &captured{}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT EXISTS").
+		WithArgs(userID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectQuery("INSERT INTO payout_accounts").
+		WithArgs(accountID, userID, payouts.KindBankAccount, "Bank account ending 3000", sealed, true).
+		WillReturnRows(sqlmock.NewRows(accountColumns).
+			AddRow(uuid.New(), userID, payouts.KindBankAccount, "Bank account ending 3000", nil, true, time.Now(), nil))
+	mock.ExpectExec("UPDATE payouts SET payout_status = 'pending', attempts = 0").
+		WithArgs(userID).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	tx, err := db.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	account, err := payouts.AddAccount(tx, userID, payouts.KindBankAccount, payouts.Destination{AccountHolder: " Alice ", IBAN: "de89 3704 0044 0532 0130 00"}, false)
+	assert.NoError(t, err)
+	assert.True(t, account.IsDefault)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// the row holds only the sealed destination, bound to the account id
+	assert.NotContains(t, string(sealed.value.([]byte)), "DE89")
+	stored := &models.PayoutAccount{AccountID: uuid.MustParse(accountID.value.(string)), EncryptedDetails: sealed.value.([]byte)}
+	d, err := payouts.OpenDestination(stored)
+	assert.NoError(t, err)
+	assert.Equal(t, payouts.Destination{AccountHolder: "Alice", IBAN: "DE89370400440532013000"}, d)
+}
+
+func TestSetDefault_RequeuesHeldPayouts(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+	db := sqlx.NewDb(mockDB, "sqlmock")
+
+	userID, accountID := uuid.New(), uuid.New()
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM payout_accounts WHERE account_id = \\$1 AND user_id = \\$2 AND removed_at IS NULL FOR UPDATE").
+		WithArgs(accountID, userID).
+		WillReturnRows(sqlmock.NewRows(accountColumns).
+			AddRow(accountID, userID, payouts.KindBankAccount, "Bank account ending 3000", nil, false, time.Now(), nil))
+	mock.ExpectExec("UPDATE payout_accounts SET is_default = FALSE").
+		WithArgs(userID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE payout_accounts SET is_default = TRUE").
+		WithArgs(accountID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE payouts SET payout_status = 'pending', attempts = 0 WHERE seller_id = \\$1 AND payout_status = 'held'").
+		WithArgs(userID).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	tx, err := db.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	account, err := payouts.SetDefault(tx, userID, accountID)
+	assert.NoError(t, err)
+	assert.True(t, account.IsDefault)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// keyring builds a keyring whose first kid is current; keys are derived from
+// the kids so they match across calls.
+func keyring(t *testing.T, kids ...string) *crypto.Keyring {
+	spec := "["
+	for i, kid := range kids {
+		if i > 0 {
+			spec += ","
+		}
+		key := make([]byte, crypto.KeySize)
+		copy(key, kid)
+		spec += fmt.Sprintf(`{"kid":%q,"key":%q}`, kid, base64.StdEncoding.EncodeToString(key))
+	}
+	ring, err := crypto.ParseKeyring([]byte(spec + "]"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ring
+}
+
+func TestRotateAccounts_RewrapsUnderCurrentKey(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+	db := sqlx.NewDb(mockDB, "sqlmock")
+
+	accountID, currentID := uuid.New(), uuid.New()
+	destination := payouts.Destination{AccountHolder: "Alice", IBAN: "DE89370400440532013000"}
+	crypto.SetKEK(keyring(t, "2024-01"))
+	old, err := crypto.SealJSON(destination, "payout_accounts.encrypted_details:"+accountID.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a new current key, the old one retired but still listed
+	crypto.SetKEK(keyring(t, "2024-07", "2024-01"))
+	current, err := crypto.SealJSON(destination, "payout_accounts.encrypted_details:"+currentID.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed := &captured{}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT account_id, encrypted_details FROM payout_accounts").
+		WithArgs(uuid.Nil, 100).
+		WillReturnRows(sqlmock.NewRows([]string{"account_id", "encrypted_details"}).
+			AddRow(accountID, old).
+			AddRow(currentID, current))
+	mock.ExpectExec("UPDATE payout_accounts SET encrypted_details").
+		WithArgs(sealed, accountID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	tx, err := db.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	last, rotated, err := payouts.RotateAccounts(tx, uuid.Nil, 100)
+	assert.NoError(t, err)
+	assert.Equal(t, currentID, last)
+	assert.Equal(t, 1, rotated)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// once the old key is dropped the rotated destination still opens
+	crypto.SetKEK(keyring(t, "2024-07"))
+	d, err := payouts.OpenDestination(&models.PayoutAccount{AccountID: accountID, EncryptedDetails: sealed.value.([]byte)})
+	assert.NoError(t, err)
+	assert.Equal(t, "DE89370400440532013000", d.IBAN)
+}
@@ -0,0 +1,315 @@
+package payouts
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"escrow-agent/internal/db"
+	"escrow-agent/internal/ledger"
+	"escrow-agent/internal/logs"
+	"escrow-agent/pkg/models"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// batchLimit caps how many batches one run opens, and how many it sends, so
+// a backlog cannot hold up the run.
+const batchLimit = 100
+
+// maxPayoutAttempts is how many batches may reject a payout before it is held
+// until the seller picks a new default payout account, see requeueHeld.
+const maxPayoutAttempts = 3
+
+const batchColumns = `batch_id, seller_id, account_id, amount, currency, batch_status, provider_reference, last_error, created_at, attempted_at, settled_at`
+
+// Run calls RunOnce straight away and then every interval until ctx is
+// cancelled.
+func Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := RunOnce(ctx); err != nil {
+			log.Printf("[ERROR] Payout run failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOnce batches the payouts due to every seller with a default payout
+// account and sends the batches under way. Each batch is opened and sent in
+// transactions of its own, so every replica may run it. A batch whose send
+// ended without a clear answer is sent again on the next run.
+func RunOnce(ctx context.Context) error {
+	start := time.Now()
+	var errs []error
+	for i := 0; i < batchLimit && ctx.Err() == nil; i++ {
+		opened, err := openBatch(start)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("open batch: %w", err))
+			break
+		}
+		if !opened {
+			break
+		}
+	}
+	for i := 0; i < batchLimit && ctx.Err() == nil; i++ {
+		sent, err := sendBatch(ctx, start)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("send batch: %w", err))
+			break
+		}
+		if !sent {
+			break
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// openBatch groups the payouts of one seller and currency that were due
+// before cutoff into a new batch for the seller's default account. It
+// reports false when no such payouts are left.
+func openBatch(cutoff time.Time) (bool, error) {
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var group struct {
+		SellerID  uuid.UUID `db:"seller_id"`
+		Currency  string    `db:"currency"`
+		AccountID uuid.UUID `db:"account_id"`
+	}
+	err = tx.Get(&group, `
+		SELECT p.seller_id, p.currency, a.account_id
+		FROM payouts p
+		JOIN payout_accounts a ON a.user_id = p.seller_id AND a.is_default
+		WHERE p.payout_status IN ('pending', 'failed') AND p.created_at < $1
+		ORDER BY p.created_at
+		LIMIT 1
+		FOR UPDATE OF p SKIP LOCKED
+	`, cutoff)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	// the account lock keeps replicas from batching one seller at the same
+	// time and the seller from removing the account midway
+	var accountID uuid.UUID
+	err = tx.Get(&accountID, "SELECT account_id FROM payout_accounts WHERE account_id = $1 AND is_default FOR UPDATE", group.AccountID)
+	if errors.Is(err, sql.ErrNoRows) {
+		// the seller switched accounts meanwhile; the next run picks the new one
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	var due []models.Payout
+	err = tx.Select(&due, `
+		SELECT `+payoutColumns+`
+		FROM payouts
+		WHERE seller_id = $1 AND currency = $2 AND payout_status IN ('pending', 'failed') AND created_at < $3
+		FOR UPDATE SKIP LOCKED
+	`, group.SellerID, group.Currency, cutoff)
+	if err != nil {
+		return false, err
+	}
+
+	total := models.NewMoney(0, group.Currency)
+	ids := make(pq.StringArray, 0, len(due))
+	for i := range due {
+		if err := due[i].AttachCurrency(); err != nil {
+			return false, err
+		}
+		total = total.Add(due[i].Amount)
+		ids = append(ids, due[i].PayoutID.String())
+	}
+	if len(due) == 0 {
+		// another replica batched them while this one waited for the account
+		return true, nil
+	}
+
+	var batchID uuid.UUID
+	err = tx.Get(&batchID, `
+		INSERT INTO payout_batches (seller_id, account_id, amount, currency, created_at)
+		VALUES ($1, $2, $3, $4, NOW())
+		RETURNING batch_id
+	`, group.SellerID, accountID, total, total.Currency)
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.Exec("UPDATE payouts SET payout_status = 'processing', batch_id = $1 WHERE payout_id = ANY($2::uuid[])", batchID, ids)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return false, err
+	}
+
+	log.Printf("[INFO] Payout batch %s opened for seller %s: %d payouts, %s %s", batchID, group.SellerID, len(due), total, total.Currency)
+	return true, nil
+}
+
+// sendBatch sends one batch under way that was not already tried since
+// start, and records the outcome. The batch row stays locked during the send
+// so no other replica sends it at the same time. It reports false when no
+// batch is left to send.
+func sendBatch(ctx context.Context, start time.Time) (bool, error) {
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var batch models.PayoutBatch
+	err = tx.Get(&batch, `
+		SELECT `+batchColumns+`
+		FROM payout_batches
+		WHERE batch_status = 'processing' AND (attempted_at IS NULL OR attempted_at < $1)
+		ORDER BY created_at
+		LIMIT 1
+		FOR UPDATE SKIP LOCKED
+	`, start)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err == nil {
+		err = batch.AttachCurrency()
+	}
+	if err != nil {
+		return false, err
+	}
+
+	var account models.PayoutAccount
+	if err := tx.Get(&account, "SELECT "+accountColumns+" FROM payout_accounts WHERE account_id = $1", batch.AccountID); err != nil {
+		return false, err
+	}
+
+	var reference string
+	var sendErr error
+	if account.RemovedAt != nil && batch.AttemptedAt == nil {
+		sendErr = fmt.Errorf("%w: payout account was removed before the batch was sent", ErrRejected)
+	} else {
+		reference, sendErr = send(ctx, &batch, &account)
+	}
+
+	switch {
+	case sendErr == nil:
+		err = settlePaid(tx, &batch, &account, reference)
+	case errors.Is(sendErr, ErrRejected):
+		err = settleFailed(tx, &batch, sendErr)
+	default:
+		log.Printf("[WARN] Payout batch %s may not have been sent, sending again on the next run: %v", batch.BatchID, sendErr)
+		_, err = tx.Exec("UPDATE payout_batches SET attempted_at = NOW(), last_error = $1 WHERE batch_id = $2", sendErr.Error(), batch.BatchID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return false, fmt.Errorf("batch %s: %w", batch.BatchID, err)
+	}
+	return true, nil
+}
+
+// send hands a batch to the provider for its account's kind. Failures that
+// happen before anything reaches the provider count as rejections.
+func send(ctx context.Context, batch *models.PayoutBatch, account *models.PayoutAccount) (string, error) {
+	provider, err := Lookup(account.Kind)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrRejected, err)
+	}
+	destination, err := OpenDestination(account)
+	if err != nil {
+		return "", fmt.Errorf("%w: cannot read payout account: %v", ErrRejected, err)
+	}
+	return provider.Send(ctx, Transfer{BatchID: batch.BatchID, Amount: batch.Amount, Kind: account.Kind, Destination: destination})
+}
+
+// settlePaid marks a batch and its payouts paid and journals each payout out
+// of the seller's payable balance.
+func settlePaid(tx *sqlx.Tx, batch *models.PayoutBatch, account *models.PayoutAccount, reference string) error {
+	_, err := tx.Exec(`
+		UPDATE payout_batches
+		SET batch_status = 'paid', provider_reference = $1, last_error = NULL, attempted_at = NOW(), settled_at = NOW()
+		WHERE batch_id = $2
+	`, reference, batch.BatchID)
+	if err != nil {
+		return err
+	}
+
+	var paid []models.Payout
+	err = tx.Select(&paid, `
+		UPDATE payouts
+		SET payout_status = 'paid', last_error = NULL, paid_at = NOW()
+		WHERE batch_id = $1 AND payout_status = 'processing'
+		RETURNING `+payoutColumns, batch.BatchID)
+	if err != nil {
+		return err
+	}
+	for i := range paid {
+		if err := paid[i].AttachCurrency(); err != nil {
+			return err
+		}
+		if _, err := ledger.Post(tx, ledger.PayoutEntry(&paid[i])); err != nil {
+			return err
+		}
+		details := fmt.Sprintf("Payout of %s %s sent to the seller's %s in batch %s (%s)", paid[i].Amount, paid[i].Currency, account.Label, batch.BatchID, reference)
+		if err := logs.Record(tx, paid[i].TransactionID, "PayoutSent", details); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// settleFailed marks a rejected batch failed and hands its payouts back to
+// the next run, or holds those rejected maxPayoutAttempts times.
+func settleFailed(tx *sqlx.Tx, batch *models.PayoutBatch, reason error) error {
+	_, err := tx.Exec(`
+		UPDATE payout_batches
+		SET batch_status = 'failed', last_error = $1, attempted_at = NOW(), settled_at = NOW()
+		WHERE batch_id = $2
+	`, reason.Error(), batch.BatchID)
+	if err != nil {
+		return err
+	}
+
+	var rejected []struct {
+		TransactionID uuid.UUID `db:"transaction_id"`
+		Status        string    `db:"payout_status"`
+	}
+	err = tx.Select(&rejected, `
+		UPDATE payouts
+		SET payout_status = CASE WHEN attempts + 1 >= $3 THEN 'held' ELSE 'failed' END, attempts = attempts + 1, last_error = $1
+		WHERE batch_id = $2 AND payout_status = 'processing'
+		RETURNING transaction_id, payout_status
+	`, reason.Error(), batch.BatchID, maxPayoutAttempts)
+	if err != nil {
+		return err
+	}
+	for _, payout := range rejected {
+		event, details := "PayoutFailed", fmt.Sprintf("Payout batch %s to the seller was rejected: %v", batch.BatchID, reason)
+		if payout.Status == string(models.PayoutHeld) {
+			event = "PayoutHeld"
+			details += fmt.Sprintf("; held after %d rejections until the seller picks a new default payout account", maxPayoutAttempts)
+		}
+		if err := logs.Record(tx, payout.TransactionID, event, details); err != nil {
+			return err
+		}
+	}
+	log.Printf("[WARN] Payout batch %s to seller %s rejected: %v", batch.BatchID, batch.SellerID, reason)
+	return nil
+}
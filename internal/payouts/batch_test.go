@@ -0,0 +1,194 @@
+package payouts_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"escrow-agent/internal/crypto"
+	"escrow-agent/internal/db"
+	"escrow-agent/internal/payouts"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	payoutColumns = []string{"payout_id", "transaction_id", "seller_id", "amount", "currency", "payout_status", "batch_id", "last_error", "created_at", "paid_at"}
+	batchColumns  = []string{"batch_id", "seller_id", "account_id", "amount", "currency", "batch_status", "provider_reference", "last_error", "created_at", "attempted_at", "settled_at"}
+)
+
+// setup points db.DB at a mock, registers a fake provider for crypto
+// addresses and returns a sealed destination for accountID.
+func setup(t *testing.T, accountID uuid.UUID) (sqlmock.Sqlmock, *payouts.FakeProvider, []byte) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	t.Cleanup(func() { mockDB.Close() })
+	db.DB = sqlx.NewDb(mockDB, "sqlmock")
+
+	ring, err := crypto.NewEphemeralKeyring("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	crypto.SetKEK(ring)
+	provider := payouts.NewFakeProvider()
+	payouts.Register(payouts.KindCryptoAddress, provider)
+
+	destination := payouts.Destination{Network: "bitcoin", Address: "bc1qxy2kgdygjrsqtzq2n0yrf2493p83kkfjhx0wlh"}
+	sealed, err := crypto.SealJSON(destination, "payout_accounts.encrypted_details:"+accountID.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mock, provider, sealed
+}
+
+// expectBatchOpened expects one seller's two due payouts to be batched
+// together, and then nothing else to be due.
+func expectBatchOpened(mock sqlmock.Sqlmock, sellerID, accountID, batchID uuid.UUID, payoutIDs, transactionIDs [2]uuid.UUID) {
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT p.seller_id, p.currency, a.account_id FROM payouts p JOIN payout_accounts a").
+		WillReturnRows(sqlmock.NewRows([]string{"seller_id", "currency", "account_id"}).AddRow(sellerID, "USD", accountID))
+	mock.ExpectQuery("SELECT account_id FROM payout_accounts WHERE account_id = \\$1 AND is_default FOR UPDATE").
+		WithArgs(accountID).
+		WillReturnRows(sqlmock.NewRows([]string{"account_id"}).AddRow(accountID))
+	mock.ExpectQuery("SELECT (.+) FROM payouts WHERE seller_id = \\$1 AND currency = \\$2").
+		WithArgs(sellerID, "USD", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows(payoutColumns).
+			AddRow(payoutIDs[0], transactionIDs[0], sellerID, "45.00", "USD", "pending", nil, nil, time.Now(), nil).
+			AddRow(payoutIDs[1], transactionIDs[1], sellerID, "18.00", "USD", "failed", nil, "destination refused", time.Now(), nil))
+	mock.ExpectQuery("INSERT INTO payout_batches").
+		WithArgs(sellerID, accountID, "63.00", "USD").
+		WillReturnRows(sqlmock.NewRows([]string{"batch_id"}).AddRow(batchID))
+	mock.ExpectExec("UPDATE payouts SET payout_status = 'processing'").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT p.seller_id, p.currency, a.account_id FROM payouts p").
+		WillReturnRows(sqlmock.NewRows([]string{"seller_id", "currency", "account_id"}))
+	mock.ExpectRollback()
+}
+
+// expectBatchClaimed expects the batch and its account to be loaded for
+// sending.
+func expectBatchClaimed(mock sqlmock.Sqlmock, sellerID, accountID, batchID uuid.UUID, sealed []byte) {
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM payout_batches WHERE batch_status = 'processing'").
+		WillReturnRows(sqlmock.NewRows(batchColumns).
+			AddRow(batchID, sellerID, accountID, "63.00", "USD", "processing", "", nil, time.Now(), nil, nil))
+	mock.ExpectQuery("SELECT (.+) FROM payout_accounts WHERE account_id = \\$1").
+		WithArgs(accountID).
+		WillReturnRows(sqlmock.NewRows(accountColumns).
+			AddRow(accountID, sellerID, payouts.KindCryptoAddress, "bitcoin bc1qxy…0wlh", sealed, true, time.Now(), nil))
+}
+
+func expectNothingToSend(mock sqlmock.Sqlmock) {
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM payout_batches WHERE batch_status = 'processing'").
+		WillReturnRows(sqlmock.NewRows(batchColumns))
+	mock.ExpectRollback()
+}
+
+func TestRunOnce_SendsBatchAndJournalsPayouts(t *testing.T) {
+	sellerID, accountID, batchID := uuid.New(), uuid.New(), uuid.New()
+	payoutIDs := [2]uuid.UUID{uuid.New(), uuid.New()}
+	transactionIDs := [2]uuid.UUID{uuid.New(), uuid.New()}
+	mock, provider, sealed := setup(t, accountID)
+
+	expectBatchOpened(mock, sellerID, accountID, batchID, payoutIDs, transactionIDs)
+	expectBatchClaimed(mock, sellerID, accountID, batchID, sealed)
+	mock.ExpectExec("UPDATE payout_batches SET batch_status = 'paid'").
+		WithArgs("fake_po_1", batchID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("UPDATE payouts SET payout_status = 'paid'").
+		WithArgs(batchID).
+		WillReturnRows(sqlmock.NewRows(payoutColumns).
+			AddRow(payoutIDs[0], transactionIDs[0], sellerID, "45.00", "USD", "paid", batchID, nil, time.Now(), time.Now()).
+			AddRow(payoutIDs[1], transactionIDs[1], sellerID, "18.00", "USD", "paid", batchID, nil, time.Now(), time.Now()))
+	for i, amount := range []string{"45.00", "18.00"} {
+		mock.ExpectQuery("INSERT INTO ledger_entries").
+			WithArgs(transactionIDs[i], "payout", sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"entry_id"}).AddRow(uuid.New()))
+		mock.ExpectQuery("INSERT INTO ledger_accounts").
+			WithArgs("seller_payable", sellerID, "USD").
+			WillReturnRows(sqlmock.NewRows([]string{"account_id"}).AddRow(uuid.New()))
+		mock.ExpectExec("INSERT INTO ledger_postings").
+			WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), "-"+amount).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery("INSERT INTO ledger_accounts").
+			WithArgs("seller_disbursed", sellerID, "USD").
+			WillReturnRows(sqlmock.NewRows([]string{"account_id"}).AddRow(uuid.New()))
+		mock.ExpectExec("INSERT INTO ledger_postings").
+			WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), amount).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("INSERT INTO transaction_logs").
+			WithArgs(transactionIDs[i], "PayoutSent", sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectCommit()
+	expectNothingToSend(mock)
+
+	assert.NoError(t, payouts.RunOnce(context.Background()))
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	sent := provider.Sent()
+	if assert.Len(t, sent, 1) {
+		assert.Equal(t, batchID, sent[0].BatchID)
+		assert.Equal(t, "63.00", sent[0].Amount.String())
+		assert.Equal(t, "bc1qxy2kgdygjrsqtzq2n0yrf2493p83kkfjhx0wlh", sent[0].Destination.Address)
+	}
+}
+
+func TestRunOnce_RejectedBatchFailsPayouts(t *testing.T) {
+	sellerID, accountID, batchID := uuid.New(), uuid.New(), uuid.New()
+	payoutIDs := [2]uuid.UUID{uuid.New(), uuid.New()}
+	transactionIDs := [2]uuid.UUID{uuid.New(), uuid.New()}
+	mock, provider, sealed := setup(t, accountID)
+	provider.RejectNext(1)
+
+	expectBatchOpened(mock, sellerID, accountID, batchID, payoutIDs, transactionIDs)
+	expectBatchClaimed(mock, sellerID, accountID, batchID, sealed)
+	mock.ExpectExec("UPDATE payout_batches SET batch_status = 'failed'").
+		WithArgs(sqlmock.AnyArg(), batchID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	// the second payout was rejected twice before and is now held
+	mock.ExpectQuery("UPDATE payouts SET payout_status = CASE WHEN attempts \\+ 1 >= \\$3 THEN 'held' ELSE 'failed' END").
+		WithArgs(sqlmock.AnyArg(), batchID, 3).
+		WillReturnRows(sqlmock.NewRows([]string{"transaction_id", "payout_status"}).AddRow(transactionIDs[0], "failed").AddRow(transactionIDs[1], "held"))
+	mock.ExpectExec("INSERT INTO transaction_logs").
+		WithArgs(transactionIDs[0], "PayoutFailed", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO transaction_logs").
+		WithArgs(transactionIDs[1], "PayoutHeld", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	expectNothingToSend(mock)
+
+	assert.NoError(t, payouts.RunOnce(context.Background()))
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.Empty(t, provider.Sent())
+}
+
+func TestRunOnce_KeepsBatchWhenOutcomeUnknown(t *testing.T) {
+	sellerID, accountID, batchID := uuid.New(), uuid.New(), uuid.New()
+	mock, provider, sealed := setup(t, accountID)
+	provider.FailNext(1)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT p.seller_id, p.currency, a.account_id FROM payouts p").
+		WillReturnRows(sqlmock.NewRows([]string{"seller_id", "currency", "account_id"}))
+	mock.ExpectRollback()
+	expectBatchClaimed(mock, sellerID, accountID, batchID, sealed)
+	mock.ExpectExec("UPDATE payout_batches SET attempted_at = NOW\\(\\), last_error = \\$1").
+		WithArgs("fake provider timed out", batchID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	expectNothingToSend(mock)
+
+	assert.NoError(t, payouts.RunOnce(context.Background()))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
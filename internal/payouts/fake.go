@@ -0,0 +1,69 @@
+package payouts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// FakeProvider is a Provider that moves no money and only remembers the
+// transfers it was asked to make. It stands in for a real provider in tests
+// and local development.
+type FakeProvider struct {
+	mu         sync.Mutex
+	sent       []Transfer
+	references map[uuid.UUID]string
+	rejections int
+	outages    int
+}
+
+func NewFakeProvider() *FakeProvider {
+	return &FakeProvider{references: map[uuid.UUID]string{}}
+}
+
+// RejectNext makes the next n sends fail with ErrRejected.
+func (f *FakeProvider) RejectNext(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rejections = n
+}
+
+// FailNext makes the next n sends fail without saying whether the transfer
+// was made, as when the provider times out.
+func (f *FakeProvider) FailNext(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.outages = n
+}
+
+func (f *FakeProvider) Send(ctx context.Context, t Transfer) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.rejections > 0 {
+		f.rejections--
+		return "", fmt.Errorf("%w: destination refused by fake provider", ErrRejected)
+	}
+	if f.outages > 0 {
+		f.outages--
+		return "", errors.New("fake provider timed out")
+	}
+	if ref, ok := f.references[t.BatchID]; ok {
+		return ref, nil
+	}
+	ref := fmt.Sprintf("fake_po_%d", len(f.sent)+1)
+	f.references[t.BatchID] = ref
+	f.sent = append(f.sent, t)
+	return ref, nil
+}
+
+// Sent returns the transfers made so far, oldest first. A batch sent again is
+// listed once.
+func (f *FakeProvider) Sent() []Transfer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Transfer(nil), f.sent...)
+}
@@ -0,0 +1,265 @@
+package payouts
+
+import (
+	"encoding/json"
+	"errors"
+	"escrow-agent/internal/db"
+	"escrow-agent/internal/logs"
+	"escrow-agent/internal/middleware"
+	"escrow-agent/pkg/models"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+)
+
+// listLimit caps how many payouts or batches one listing returns.
+const listLimit = 500
+
+type AddAccountRequest struct {
+	Kind        string      `json:"kind"`
+	Destination Destination `json:"destination"`
+	MakeDefault bool        `json:"make_default"`
+}
+
+// AddPayoutAccountHandler registers a payout account for the caller. The
+// destination is validated, stored encrypted and only ever shown back as a
+// masked label.
+func AddPayoutAccountHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.ClaimsFromContext(r.Context())
+	if !ok {
+		log.Printf("[ERROR] Unauthorized access attempt - missing or invalid claims")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req AddAccountRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		log.Printf("[ERROR] Failed to begin transaction: %v", err)
+		http.Error(w, "Failed to add payout account", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	account, err := AddAccount(tx, claims.UserID, req.Kind, req.Destination, req.MakeDefault)
+	if errors.Is(err, ErrUnsupportedKind) || errors.Is(err, ErrInvalidDestination) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err == nil {
+		details := fmt.Sprintf("Payout account %s added: %s", account.AccountID, account.Label)
+		err = logs.RecordUserEvent(tx, claims.UserID, &claims.UserID, "PayoutAccountAdded", details)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to add payout account for user %s: %v", claims.UserID, err)
+		http.Error(w, "Failed to add payout account", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(account)
+}
+
+// GetPayoutAccountsHandler lists the caller's payout accounts, default first.
+func GetPayoutAccountsHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.ClaimsFromContext(r.Context())
+	if !ok {
+		log.Printf("[ERROR] Unauthorized access attempt - missing or invalid claims")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	accounts, err := Accounts(db.DB, claims.UserID)
+	if err != nil {
+		log.Printf("[ERROR] Failed to fetch payout accounts for user %s: %v", claims.UserID, err)
+		http.Error(w, "Failed to fetch payout accounts", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(accounts)
+}
+
+// SetDefaultPayoutAccountHandler makes one of the caller's payout accounts the
+// one the next batches go to.
+func SetDefaultPayoutAccountHandler(w http.ResponseWriter, r *http.Request) {
+	updateAccount(w, r, SetDefault, "PayoutAccountDefaultChanged", "made default")
+}
+
+// RemovePayoutAccountHandler retires one of the caller's payout accounts.
+// Payouts wait for a new default when the default is removed.
+func RemovePayoutAccountHandler(w http.ResponseWriter, r *http.Request) {
+	updateAccount(w, r, RemoveAccount, "PayoutAccountRemoved", "removed")
+}
+
+// updateAccount applies change to the payout account named in the path and
+// records it in the caller's audit log.
+func updateAccount(w http.ResponseWriter, r *http.Request, change func(tx *sqlx.Tx, userID, accountID uuid.UUID) (*models.PayoutAccount, error), event, verb string) {
+	claims, ok := middleware.ClaimsFromContext(r.Context())
+	if !ok {
+		log.Printf("[ERROR] Unauthorized access attempt - missing or invalid claims")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	accountID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid payout account ID", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		log.Printf("[ERROR] Failed to begin transaction: %v", err)
+		http.Error(w, "Failed to update payout account", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	account, err := change(tx, claims.UserID, accountID)
+	if errors.Is(err, ErrAccountNotFound) {
+		http.Error(w, "Payout account not found", http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		details := fmt.Sprintf("Payout account %s (%s) %s", account.AccountID, account.Label, verb)
+		err = logs.RecordUserEvent(tx, claims.UserID, &claims.UserID, event, details)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to update payout account %s: %v", accountID, err)
+		http.Error(w, "Failed to update payout account", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(account)
+}
+
+// GetPayoutsHandler lists the caller's payouts, newest first, optionally
+// only those in one ?status=.
+func GetPayoutsHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.ClaimsFromContext(r.Context())
+	if !ok {
+		log.Printf("[ERROR] Unauthorized access attempt - missing or invalid claims")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	listPayouts(w, r, &claims.UserID)
+}
+
+// GetAllPayoutsHandler lists payouts across sellers, newest first, optionally
+// only those in one ?status= or of one ?seller_id=. Admin only.
+func GetAllPayoutsHandler(w http.ResponseWriter, r *http.Request) {
+	var sellerID *uuid.UUID
+	if raw := r.URL.Query().Get("seller_id"); raw != "" {
+		id, err := uuid.Parse(raw)
+		if err != nil {
+			http.Error(w, "Invalid seller ID", http.StatusBadRequest)
+			return
+		}
+		sellerID = &id
+	}
+	listPayouts(w, r, sellerID)
+}
+
+func listPayouts(w http.ResponseWriter, r *http.Request, sellerID *uuid.UUID) {
+	status := r.URL.Query().Get("status")
+	switch models.PayoutStatus(status) {
+	case "", models.PayoutPending, models.PayoutProcessing, models.PayoutPaid, models.PayoutFailed, models.PayoutHeld:
+	default:
+		http.Error(w, "Invalid payout status", http.StatusBadRequest)
+		return
+	}
+
+	payouts := []models.Payout{}
+	err := db.DB.Select(&payouts, `
+		SELECT `+payoutColumns+`
+		FROM payouts
+		WHERE ($1::uuid IS NULL OR seller_id = $1)
+		  AND ($2 = '' OR payout_status = $2)
+		ORDER BY created_at DESC
+		LIMIT $3
+	`, sellerID, status, listLimit)
+	for i := range payouts {
+		if err == nil {
+			err = payouts[i].AttachCurrency()
+		}
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to fetch payouts: %v", err)
+		http.Error(w, "Failed to fetch payouts", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(payouts)
+}
+
+// GetPayoutBatchesHandler lists payout batches, newest first, optionally only
+// those in one ?status=. Admin only.
+func GetPayoutBatchesHandler(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "", "processing", "paid", "failed":
+	default:
+		http.Error(w, "Invalid batch status", http.StatusBadRequest)
+		return
+	}
+
+	batches := []models.PayoutBatch{}
+	err := db.DB.Select(&batches, `
+		SELECT `+batchColumns+`
+		FROM payout_batches
+		WHERE $1 = '' OR batch_status = $1
+		ORDER BY created_at DESC
+		LIMIT $2
+	`, status, listLimit)
+	for i := range batches {
+		if err == nil {
+			err = batches[i].AttachCurrency()
+		}
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to fetch payout batches: %v", err)
+		http.Error(w, "Failed to fetch payout batches", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(batches)
+}
+
+// RunPayoutsHandler runs the batch job now instead of waiting for its next
+// tick. Admin only.
+func RunPayoutsHandler(w http.ResponseWriter, r *http.Request) {
+	if err := RunOnce(r.Context()); err != nil {
+		log.Printf("[ERROR] Payout run failed: %v", err)
+		http.Error(w, "Payout run failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Payout run completed",
+	})
+}
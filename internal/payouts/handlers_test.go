@@ -0,0 +1,107 @@
+package payouts_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"escrow-agent/internal/crypto"
+	"escrow-agent/internal/db"
+	"escrow-agent/internal/middleware"
+	"escrow-agent/internal/payouts"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+)
+
+func withSeller(req *http.Request, sellerID uuid.UUID) *http.Request {
+	claims := &middleware.Claims{UserID: sellerID, Username: "sam", Roles: []string{"seller"}}
+	return req.WithContext(middleware.WithClaims(req.Context(), claims))
+}
+
+func TestAddPayoutAccountHandler(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+
+	db.DB = sqlx.NewDb(mockDB, "sqlmock")
+	ring, err := crypto.NewEphemeralKeyring("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	crypto.SetKEK(ring)
+
+	sellerID, accountID := uuid.New(), uuid.New()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT EXISTS").
+		WithArgs(sellerID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectExec("UPDATE payout_accounts SET is_default = FALSE").
+		WithArgs(sellerID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("INSERT INTO payout_accounts").
+		WithArgs(sqlmock.AnyArg(), sellerID, payouts.KindBankAccount, "Bank account ending 5678", sqlmock.AnyArg(), true).
+		WillReturnRows(sqlmock.NewRows(accountColumns).
+			AddRow(accountID, sellerID, payouts.KindBankAccount, "Bank account ending 5678", []byte("sealed"), true, time.Now(), nil))
+	mock.ExpectExec("UPDATE payouts SET payout_status = 'pending', attempts = 0").
+		WithArgs(sellerID).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO user_audit_logs").
+		WithArgs(sellerID, sellerID, "PayoutAccountAdded", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	body := `{"kind":"bank_account","destination":{"account_holder":"Sam","account_number":"12345678","routing_number":"021000021"},"make_default":true}`
+	req := withSeller(httptest.NewRequest("POST", "/api/payout-accounts", strings.NewReader(body)), sellerID)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(payouts.AddPayoutAccountHandler).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	var account map[string]interface{}
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &account))
+	assert.Equal(t, "Bank account ending 5678", account["label"])
+	assert.NotContains(t, account, "encrypted_details")
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	req = withSeller(httptest.NewRequest("POST", "/api/payout-accounts", strings.NewReader(`{"kind":"bank_account","destination":{"account_holder":"Sam"}}`)), sellerID)
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(payouts.AddPayoutAccountHandler).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestRemovePayoutAccountHandler_NotFound(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+
+	db.DB = sqlx.NewDb(mockDB, "sqlmock")
+
+	sellerID, accountID := uuid.New(), uuid.New()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE payout_accounts SET removed_at = NOW\\(\\)").
+		WithArgs(accountID, sellerID).
+		WillReturnRows(sqlmock.NewRows(accountColumns))
+	mock.ExpectRollback()
+
+	req := withSeller(httptest.NewRequest("DELETE", "/api/payout-accounts/"+accountID.String(), nil), sellerID)
+	req = mux.SetURLVars(req, map[string]string{"id": accountID.String()})
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(payouts.RemovePayoutAccountHandler).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,82 @@
+// Package payouts sends sellers the funds released to them. Every release
+// queues a payout for what the seller is owed net of the platform fee. The
+// batch job groups a seller's due payouts per currency into one transfer to
+// their default payout account, through the Provider registered for the
+// account's kind, and journals the payouts out of the seller's payable
+// balance once the provider accepted the transfer.
+package payouts
+
+import (
+	"context"
+	"errors"
+	"escrow-agent/pkg/models"
+	"fmt"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+var (
+	ErrUnsupportedKind    = errors.New("unsupported payout account kind")
+	ErrInvalidDestination = errors.New("invalid payout destination")
+	ErrAccountNotFound    = errors.New("payout account not found")
+	// ErrRejected is returned by providers when a transfer was certainly not
+	// made. Any other error leaves the outcome open, and the batch is sent
+	// again later under the same BatchID.
+	ErrRejected = errors.New("payout transfer rejected")
+)
+
+// Transfer is one batch of payouts sent to a seller.
+type Transfer struct {
+	BatchID     uuid.UUID
+	Amount      models.Money
+	Kind        string
+	Destination Destination
+}
+
+// Provider sends transfers to payout destinations. BatchID makes a send
+// idempotent: sending a batch that was sent before must not pay twice and
+// returns the first send's reference.
+type Provider interface {
+	Send(ctx context.Context, t Transfer) (reference string, err error)
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Provider{}
+)
+
+// Register makes provider handle payout accounts of kind.
+func Register(kind string, provider Provider) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[kind] = provider
+}
+
+// Lookup returns the provider registered for a payout account kind.
+func Lookup(kind string) (Provider, error) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	provider, ok := registry[kind]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedKind, kind)
+	}
+	return provider, nil
+}
+
+const payoutColumns = `payout_id, transaction_id, seller_id, amount, currency, payout_status, attempts, batch_id, last_error, created_at, paid_at`
+
+// Queue records that amount, released from the transaction's escrow, is owed
+// to its seller, for the batch job to send. Nothing is queued for a zero
+// amount, such as a release the fee took in full.
+func Queue(exec sqlx.Execer, transaction *models.Transaction, amount models.Money) error {
+	if !amount.IsPositive() {
+		return nil
+	}
+	_, err := exec.Exec(`
+		INSERT INTO payouts (transaction_id, seller_id, amount, currency, created_at)
+		VALUES ($1, $2, $3, $4, NOW())
+	`, transaction.TransactionID, transaction.SellerID, amount, amount.Currency)
+	return err
+}
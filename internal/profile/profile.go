@@ -2,8 +2,10 @@ package profile
 
 import (
 	"encoding/json"
+	"escrow-agent/internal/auth"
 	"escrow-agent/internal/db"
 	"escrow-agent/internal/middleware"
+	"escrow-agent/internal/sessions"
 	"escrow-agent/pkg/models"
 	"log"
 	"net/http"
@@ -18,7 +20,7 @@ import (
 func ProfileHandler(w http.ResponseWriter, r *http.Request) {
 	log.Printf("ProfileHandler has been called")
 
-	claims, ok := r.Context().Value("user").(*middleware.Claims)
+	claims, ok := middleware.ClaimsFromContext(r.Context())
 	if !ok {
 		log.Printf("[ERROR] Unauthorized access attempt - missing or invalid claims by kd")
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
@@ -41,23 +43,28 @@ func ProfileHandler(w http.ResponseWriter, r *http.Request) {
 
 func getUserByID(db *sqlx.DB, userID uuid.UUID) (*models.User, error) {
 	var user models.User
-	err := db.Get(&user, "SELECT user_id, username, role, created_at FROM users WHERE user_id = $1", userID)
+	err := db.Get(&user, "SELECT user_id, username, roles, created_at FROM users WHERE user_id = $1", userID)
 	if err != nil {
 		return nil, err
 	}
 	return &user, nil
 }
 
+// UpdateProfileRequest changes the caller's own account. Changing the
+// password needs the current one; roles are changed only by admins, so Roles
+// and Role are accepted only to reject them explicitly.
 type UpdateProfileRequest struct {
-	Username string `json:"username,omitempty"`
-	Password string `json:"password,omitempty"`
-	Role     string `json:"role,omitempty"`
+	Username        string   `json:"username,omitempty"`
+	Password        string   `json:"password,omitempty"`
+	CurrentPassword string   `json:"current_password,omitempty"`
+	Roles           []string `json:"roles,omitempty"`
+	Role            string   `json:"role,omitempty"`
 }
 
 func ProfileUpdateHandler(w http.ResponseWriter, r *http.Request) {
 	log.Printf("ProfileUpdateHandler has been called")
 
-	claims, ok := r.Context().Value("user").(*middleware.Claims)
+	claims, ok := middleware.ClaimsFromContext(r.Context())
 	if !ok {
 		log.Printf("[ERROR] Unauthorized access attempt - missing or invalid claims")
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
@@ -70,6 +77,33 @@ func ProfileUpdateHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if updateReq.Role != "" || len(updateReq.Roles) > 0 {
+		log.Printf("[ERROR] User %s attempted to change their own roles", claims.UserID)
+		http.Error(w, "Roles can only be changed by an admin", http.StatusForbidden)
+		return
+	}
+
+	if updateReq.Password != "" {
+		if err := auth.ValidatePassword(updateReq.Password); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if updateReq.CurrentPassword == "" {
+			http.Error(w, "Current password is required to change the password", http.StatusBadRequest)
+			return
+		}
+		var currentHash string
+		if err := db.DB.Get(&currentHash, "SELECT password_hash FROM users WHERE user_id = $1", claims.UserID); err != nil {
+			log.Printf("[ERROR] Failed to fetch password for userID %s: %v", claims.UserID, err)
+			http.Error(w, "Failed to update profile", http.StatusInternalServerError)
+			return
+		}
+		if err := bcrypt.CompareHashAndPassword([]byte(currentHash), []byte(updateReq.CurrentPassword)); err != nil {
+			http.Error(w, "Current password is incorrect", http.StatusForbidden)
+			return
+		}
+	}
+
 	query := "UPDATE users SET "
 	var fields []string
 	var args []interface{}
@@ -93,12 +127,6 @@ func ProfileUpdateHandler(w http.ResponseWriter, r *http.Request) {
 		argCount++
 	}
 
-	if updateReq.Role != "" {
-		fields = append(fields, "role = $"+strconv.Itoa(argCount))
-		args = append(args, updateReq.Role)
-		argCount++
-	}
-
 	if len(fields) == 0 {
 		http.Error(w, "No valid fields to update", http.StatusBadRequest)
 		return
@@ -109,14 +137,32 @@ func ProfileUpdateHandler(w http.ResponseWriter, r *http.Request) {
 	query += " WHERE user_id = $" + strconv.Itoa(argCount)
 	args = append(args, claims.UserID)
 
-	log.Printf("Executing update query: %s with args: %+v", query, args)
-	_, err := db.DB.Exec(query, args...)
+	tx, err := db.DB.Beginx()
 	if err != nil {
-		log.Printf("[ERROR] Failed to update user profile for userID %d: %v", claims.UserID, err)
+		log.Printf("[ERROR] Failed to begin transaction: %v", err)
+		http.Error(w, "Failed to update profile", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(query, args...)
+	if err == nil && updateReq.Password != "" {
+		// a new password logs out every session, including a stolen one
+		err = sessions.RevokeUser(tx, claims.UserID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to update user profile for userID %s: %v", claims.UserID, err)
 		http.Error(w, "Failed to update profile", http.StatusInternalServerError)
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
+	if updateReq.Password != "" {
+		w.Write([]byte(`{"message":"Profile updated successfully; all sessions have been signed out"}`))
+		return
+	}
 	w.Write([]byte(`{"message":"Profile updated successfully"}`))
 }
@@ -0,0 +1,60 @@
+package profile_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"escrow-agent/internal/db"
+	"escrow-agent/internal/middleware"
+	"escrow-agent/internal/profile"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func newUpdateRequest(t *testing.T, body string, claims *middleware.Claims) *http.Request {
+	req, err := http.NewRequest("PUT", "/profile", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req.WithContext(middleware.WithClaims(req.Context(), claims))
+}
+
+func TestProfileUpdateHandler_RejectsRoleChange(t *testing.T) {
+	claims := &middleware.Claims{UserID: uuid.New(), Username: "cathy", Roles: []string{"buyer"}}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(profile.ProfileUpdateHandler).ServeHTTP(rr, newUpdateRequest(t, `{"role":"admin"}`, claims))
+
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+}
+
+func TestProfileUpdateHandler_PasswordNeedsCurrentPassword(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+
+	db.DB = sqlx.NewDb(mockDB, "sqlmock")
+
+	claims := &middleware.Claims{UserID: uuid.New(), Username: "cathy", Roles: []string{"buyer"}}
+	hash, _ := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(profile.ProfileUpdateHandler).ServeHTTP(rr, newUpdateRequest(t, `{"password":"newpassword1"}`, claims))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	mock.ExpectQuery("SELECT password_hash FROM users").
+		WithArgs(claims.UserID).
+		WillReturnRows(sqlmock.NewRows([]string{"password_hash"}).AddRow(hash))
+
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(profile.ProfileUpdateHandler).ServeHTTP(rr, newUpdateRequest(t, `{"password":"newpassword1","current_password":"guess"}`, claims))
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,139 @@
+// Package recovery issues and redeems password reset tokens. A token is
+// random, stored only as its hash, expires after the configured TTL and works
+// once. Issuing a new token for a user voids the ones still outstanding.
+package recovery
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+var (
+	ErrInvalidToken  = errors.New("invalid or expired reset token")
+	ErrTooSoon       = errors.New("a reset token was issued moments ago")
+	ErrInvalidConfig = errors.New("invalid password reset settings")
+)
+
+// Config holds the deployment's reset settings. ResetURL is where the
+// message points users, with {token} replaced by the token; when empty the
+// message carries the bare token.
+type Config struct {
+	TTL      time.Duration
+	Cooldown time.Duration
+	ResetURL string
+}
+
+// DefaultConfig applies until SetConfig is called.
+var DefaultConfig = Config{TTL: 30 * time.Minute, Cooldown: time.Minute}
+
+var (
+	mu     sync.RWMutex
+	config = DefaultConfig
+)
+
+// SetConfig replaces the reset settings.
+func SetConfig(c Config) error {
+	if c.TTL <= 0 || c.Cooldown < 0 || c.Cooldown >= c.TTL {
+		return ErrInvalidConfig
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	config = c
+	return nil
+}
+
+// CurrentConfig returns the reset settings in use.
+func CurrentConfig() Config {
+	mu.RLock()
+	defer mu.RUnlock()
+	return config
+}
+
+// Link is what a reset message tells the user to open or enter.
+func Link(token string) string {
+	url := CurrentConfig().ResetURL
+	if url == "" {
+		return token
+	}
+	return strings.ReplaceAll(url, "{token}", token)
+}
+
+// Issue voids the user's outstanding tokens and returns a new one. It gives
+// ErrTooSoon if a token was issued within the cooldown, so repeated requests
+// cannot flood the user with messages.
+func Issue(tx *sqlx.Tx, userID uuid.UUID, now time.Time) (string, error) {
+	c := CurrentConfig()
+
+	var recent bool
+	err := tx.Get(&recent, "SELECT EXISTS(SELECT 1 FROM password_resets WHERE user_id = $1 AND created_at > $2)", userID, now.Add(-c.Cooldown))
+	if err != nil {
+		return "", err
+	}
+	if recent {
+		return "", ErrTooSoon
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	if _, err := tx.Exec("DELETE FROM password_resets WHERE user_id = $1", userID); err != nil {
+		return "", err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO password_resets (user_id, token_hash, expires_at, created_at)
+		VALUES ($1, $2, $3, $4)
+	`, userID, hashToken(token), now.Add(c.TTL), now)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Redeem uses up token and returns the user it was issued to. Unknown,
+// expired and used tokens give ErrInvalidToken.
+func Redeem(tx *sqlx.Tx, token string, now time.Time) (uuid.UUID, error) {
+	var reset struct {
+		ResetID   uuid.UUID    `db:"reset_id"`
+		UserID    uuid.UUID    `db:"user_id"`
+		ExpiresAt time.Time    `db:"expires_at"`
+		UsedAt    sql.NullTime `db:"used_at"`
+	}
+	err := tx.Get(&reset, `
+		SELECT reset_id, user_id, expires_at, used_at
+		FROM password_resets
+		WHERE token_hash = $1
+		FOR UPDATE
+	`, hashToken(token))
+	if errors.Is(err, sql.ErrNoRows) {
+		return uuid.Nil, ErrInvalidToken
+	}
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if reset.UsedAt.Valid || !now.Before(reset.ExpiresAt) {
+		return uuid.Nil, ErrInvalidToken
+	}
+
+	if _, err := tx.Exec("UPDATE password_resets SET used_at = $1 WHERE reset_id = $2", now, reset.ResetID); err != nil {
+		return uuid.Nil, err
+	}
+	return reset.UserID, nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,71 @@
+package recovery_test
+
+import (
+	"testing"
+	"time"
+
+	"escrow-agent/internal/recovery"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIssue_Cooldown(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+	db := sqlx.NewDb(mockDB, "sqlmock")
+
+	userID := uuid.New()
+	now := time.Now()
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT EXISTS(.+) FROM password_resets").
+		WithArgs(userID, now.Add(-recovery.DefaultConfig.Cooldown)).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+
+	tx, err := db.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = recovery.Issue(tx, userID, now)
+	assert.ErrorIs(t, err, recovery.ErrTooSoon)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRedeem_Expired(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+	db := sqlx.NewDb(mockDB, "sqlmock")
+
+	now := time.Now()
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM password_resets").
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"reset_id", "user_id", "expires_at", "used_at"}).
+			AddRow(uuid.New(), uuid.New(), now, nil))
+
+	tx, err := db.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = recovery.Redeem(tx, "token", now)
+	assert.ErrorIs(t, err, recovery.ErrInvalidToken)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestLink(t *testing.T) {
+	assert.Equal(t, "abc", recovery.Link("abc"))
+
+	c := recovery.DefaultConfig
+	c.ResetURL = "https://escrow.example/reset?token={token}"
+	assert.NoError(t, recovery.SetConfig(c))
+	defer recovery.SetConfig(recovery.DefaultConfig)
+	assert.Equal(t, "https://escrow.example/reset?token=abc", recovery.Link("abc"))
+}
@@ -3,12 +3,18 @@ package router
 import (
 	"escrow-agent/internal/admin"
 	"escrow-agent/internal/auth"
+	"escrow-agent/internal/disputes"
 	"escrow-agent/internal/escrow"
+	"escrow-agent/internal/fees"
 	"escrow-agent/internal/fileupload"
+	"escrow-agent/internal/ledger"
 	"escrow-agent/internal/logs"
 	"escrow-agent/internal/middleware"
+	"escrow-agent/internal/payouts"
 	"escrow-agent/internal/profile"
 	"escrow-agent/internal/transactions"
+	"escrow-agent/internal/webhooks"
+	"net/http"
 
 	"github.com/gorilla/mux"
 )
@@ -19,31 +25,86 @@ func SetupRouter() *mux.Router {
 	// public routes
 	r.HandleFunc("/login", auth.LoginHandler).Methods("POST")
 	r.HandleFunc("/register", auth.RegisterHandler).Methods("POST")
+	r.HandleFunc("/login/2fa", auth.LoginTOTPHandler).Methods("POST")
+	r.HandleFunc("/refresh", auth.RefreshHandler).Methods("POST")
+	r.HandleFunc("/password/forgot", auth.ForgotPasswordHandler).Methods("POST")
+	r.HandleFunc("/password/reset", auth.ResetPasswordHandler).Methods("POST")
+	r.Handle("/logout", middleware.JWTAuthMiddleware(http.HandlerFunc(auth.LogoutHandler))).Methods("POST")
 
-	// protected routes with JWT middleware
+	// payment gateway callbacks, authenticated by the provider's signature
+	r.HandleFunc("/webhooks/payments/{provider}", webhooks.PaymentWebhookHandler).Methods("POST")
+
+	// protected routes with JWT middleware, which also accepts an X-API-Key;
+	// each route names the permission it needs, see middleware.rolePermissions
 	api := r.PathPrefix("/api").Subrouter()
 	api.Use(middleware.JWTAuthMiddleware)
 
-	api.HandleFunc("/profile", profile.ProfileHandler).Methods("GET")
-	api.HandleFunc("/profile", profile.ProfileUpdateHandler).Methods("PUT")
+	api.Handle("/profile", allow(middleware.PermProfileRead, profile.ProfileHandler)).Methods("GET")
+	api.Handle("/profile", allow(middleware.PermProfileUpdate, profile.ProfileUpdateHandler)).Methods("PUT")
+	api.Handle("/2fa/enroll", allow(middleware.PermProfileUpdate, auth.EnrollTOTPHandler)).Methods("POST")
+	api.Handle("/2fa/confirm", allow(middleware.PermProfileUpdate, auth.ConfirmTOTPHandler)).Methods("POST")
+	api.Handle("/2fa/disable", allow(middleware.PermProfileUpdate, auth.DisableTOTPHandler)).Methods("POST")
+
+	api.Handle("/fees/quote", allow(middleware.PermFeeQuote, fees.GetFeeQuoteHandler)).Methods("GET")
+
+	api.Handle("/transactions", allow(middleware.PermTransactionCreate, transactions.CreateTransactionHandler)).Methods("POST")
+	api.Handle("/transactions", allow(middleware.PermTransactionRead, transactions.GetTransactionsHandler)).Methods("GET")
+	api.Handle("/transactions/{id}", allow(middleware.PermTransactionRead, transactions.GetTransactionHandler)).Methods("GET")
+	api.Handle("/transactions/{id}/fulfill", allow(middleware.PermTransactionFulfill, transactions.FulfillTransactionHandler)).Methods("PUT")
+	api.Handle("/transactions/{id}/confirm", allow(middleware.PermTransactionConfirm, transactions.ConfirmDeliveryHandler)).Methods("PUT")
+	api.Handle("/transactions/{id}/milestones", allow(middleware.PermTransactionRead, transactions.GetMilestonesHandler)).Methods("GET")
+	api.Handle("/transactions/{id}/milestones/{milestone_id}/fulfill", allow(middleware.PermMilestoneFulfill, transactions.FulfillMilestoneHandler)).Methods("PUT")
+	api.Handle("/transactions/{id}/milestones/{milestone_id}/approve", allow(middleware.PermMilestoneApprove, transactions.ApproveMilestoneHandler)).Methods("PUT")
 
-	api.HandleFunc("/transactions", transactions.CreateTransactionHandler).Methods("POST")
-	api.HandleFunc("/transactions", transactions.GetTransactionsHandler).Methods("GET")
-	api.HandleFunc("/transactions/{id}", transactions.GetTransactionHandler).Methods("GET")
-	api.HandleFunc("/transactions/{id}/fulfill", transactions.FulfillTransactionHandler).Methods("PUT")
-	api.HandleFunc("/transactions/{id}/confirm", transactions.ConfirmDeliveryHandler).Methods("PUT")
+	api.Handle("/transactions/{id}/dispute", allow(middleware.PermDisputeRaise, disputes.RaiseDisputeHandler)).Methods("POST")
+	api.Handle("/disputes", allow(middleware.PermDisputeRead, disputes.GetDisputesHandler)).Methods("GET")
+	api.Handle("/disputes/{id}", allow(middleware.PermDisputeRead, disputes.GetDisputeHandler)).Methods("GET")
+	api.Handle("/disputes/{id}/resolve", allow(middleware.PermDisputeResolve, disputes.ResolveDisputeHandler)).Methods("PUT")
 
-	api.HandleFunc("/escrow/{id}/deposit", escrow.DepositEscrowHandler).Methods("POST")
-	api.HandleFunc("/escrow/{id}/release", escrow.ReleaseEscrowHandler).Methods("PUT")
+	api.Handle("/escrow/{id}/deposit", allow(middleware.PermEscrowDeposit, escrow.DepositEscrowHandler)).Methods("POST")
+	api.Handle("/escrow/{id}/release", allow(middleware.PermEscrowRelease, escrow.ReleaseEscrowHandler)).Methods("PUT")
+	api.Handle("/escrow/{id}/refund", allow(middleware.PermEscrowRefund, escrow.RefundEscrowHandler)).Methods("PUT")
 
-	api.HandleFunc("/admin/users", admin.GetUsersHandler).Methods("GET")
-	api.HandleFunc("/admin/users/{id}", admin.GetUserByIDHandler).Methods("GET")
-	api.HandleFunc("/admin/transactions", admin.GetTransactionsHandler).Methods("GET")
+	api.Handle("/payout-accounts", allow(middleware.PermPayoutRead, payouts.GetPayoutAccountsHandler)).Methods("GET")
+	api.Handle("/payout-accounts", allow(middleware.PermPayoutManage, payouts.AddPayoutAccountHandler)).Methods("POST")
+	api.Handle("/payout-accounts/{id}/default", allow(middleware.PermPayoutManage, payouts.SetDefaultPayoutAccountHandler)).Methods("PUT")
+	api.Handle("/payout-accounts/{id}", allow(middleware.PermPayoutManage, payouts.RemovePayoutAccountHandler)).Methods("DELETE")
+	api.Handle("/payouts", allow(middleware.PermPayoutRead, payouts.GetPayoutsHandler)).Methods("GET")
 
-	api.HandleFunc("/logs/{transaction_id}", logs.GetTransactionLogsHandler).Methods("GET")
+	api.Handle("/admin/users", allow(middleware.PermAdminUsersRead, admin.GetUsersHandler)).Methods("GET")
+	api.Handle("/admin/users", allow(middleware.PermAdminUsersWrite, admin.CreateUserHandler)).Methods("POST")
+	api.Handle("/admin/users/{id}", allow(middleware.PermAdminUsersRead, admin.GetUserByIDHandler)).Methods("GET")
+	api.Handle("/admin/users/{id}/roles", allow(middleware.PermAdminUsersWrite, admin.UpdateUserRolesHandler)).Methods("PUT")
+	api.Handle("/admin/users/{id}/audit", allow(middleware.PermAdminUsersRead, admin.GetUserAuditLogsHandler)).Methods("GET")
+	api.Handle("/admin/users/{id}/unlock", allow(middleware.PermAdminUsersWrite, admin.UnlockUserHandler)).Methods("POST")
+	api.Handle("/admin/security-events", allow(middleware.PermAdminUsersRead, admin.GetSecurityEventsHandler)).Methods("GET")
+	api.Handle("/admin/api-keys", allow(middleware.PermAdminAPIKeysWrite, admin.CreateAPIKeyHandler)).Methods("POST")
+	api.Handle("/admin/api-keys", allow(middleware.PermAdminAPIKeysRead, admin.GetAPIKeysHandler)).Methods("GET")
+	api.Handle("/admin/api-keys/{id}", allow(middleware.PermAdminAPIKeysWrite, admin.RevokeAPIKeyHandler)).Methods("DELETE")
+	api.Handle("/admin/transactions", allow(middleware.PermAdminTransactionsRead, admin.GetTransactionsHandler)).Methods("GET")
+	api.Handle("/admin/transactions/{id}/refund", allow(middleware.PermAdminTransactionsWrite, escrow.RefundEscrowHandler)).Methods("PUT")
+	api.Handle("/admin/webhooks", allow(middleware.PermAdminTransactionsRead, webhooks.GetWebhookEventsHandler)).Methods("GET")
+	api.Handle("/admin/webhooks/{id}/replay", allow(middleware.PermAdminTransactionsWrite, webhooks.ReplayWebhookEventHandler)).Methods("POST")
+	api.Handle("/admin/payment-deltas", allow(middleware.PermAdminTransactionsRead, admin.GetPaymentDeltasHandler)).Methods("GET")
+	api.Handle("/admin/payment-deltas/{id}/refund", allow(middleware.PermAdminTransactionsWrite, admin.RefundPaymentDeltaHandler)).Methods("POST")
+	api.Handle("/admin/transactions/{id}/ledger", allow(middleware.PermAdminLedgerRead, ledger.GetTransactionLedgerHandler)).Methods("GET")
+	api.Handle("/admin/reports/totals", allow(middleware.PermAdminReportsRead, admin.GetTotalsReportHandler)).Methods("GET")
+	api.Handle("/admin/reports/payments", allow(middleware.PermAdminReportsRead, admin.GetPaymentsReportHandler)).Methods("GET")
+	api.Handle("/admin/payouts", allow(middleware.PermAdminPayoutsRead, payouts.GetAllPayoutsHandler)).Methods("GET")
+	api.Handle("/admin/payouts/run", allow(middleware.PermAdminPayoutsWrite, payouts.RunPayoutsHandler)).Methods("POST")
+	api.Handle("/admin/payout-batches", allow(middleware.PermAdminPayoutsRead, payouts.GetPayoutBatchesHandler)).Methods("GET")
+	api.Handle("/admin/disputes", allow(middleware.PermAdminDisputesRead, disputes.GetAllDisputesHandler)).Methods("GET")
+	api.Handle("/admin/disputes/{id}/resolve", allow(middleware.PermDisputeResolve, disputes.ResolveDisputeHandler)).Methods("PUT")
 
-	api.HandleFunc("/upload", fileupload.UploadHandler).Methods("POST")
-	api.HandleFunc("/transactions/{transactionID}/files", fileupload.ListFilesHandler).Methods("GET")
+	api.Handle("/logs/{transaction_id}", allow(middleware.PermLogRead, logs.GetTransactionLogsHandler)).Methods("GET")
+
+	api.Handle("/upload", allow(middleware.PermFileUpload, fileupload.UploadHandler)).Methods("POST")
+	api.Handle("/transactions/{transactionID}/files", allow(middleware.PermFileRead, fileupload.ListFilesHandler)).Methods("GET")
 
 	return r
 }
+
+// allow lets only callers whose roles, and API key if any, grant p reach h.
+func allow(p middleware.Permission, h http.HandlerFunc) http.Handler {
+	return middleware.RequirePermission(p)(h)
+}
@@ -0,0 +1,353 @@
+// Package scheduler settles escrows that nobody acted on in time: funded
+// escrows the seller never fulfilled are refunded once they expire, and
+// fulfilled work the buyer neither confirmed nor disputed within the
+// inspection window is released to the seller. The same runs retry charges
+// the payment gateway could not take, see payments.Retry, settle crypto
+// deposits once they are confirmed on chain, see payments.Track, and compare
+// payments with the gateway's records, see payments.Reconcile.
+//
+// Every replica may run the scheduler. Each due item is claimed with
+// FOR UPDATE SKIP LOCKED inside its own database transaction, so replicas
+// split the work instead of settling the same escrow twice.
+package scheduler
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"escrow-agent/internal/db"
+	"escrow-agent/internal/escrow"
+	"escrow-agent/internal/logs"
+	"escrow-agent/internal/payments"
+	"escrow-agent/pkg/models"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+// batchSize caps how many items one job settles per run so a backlog cannot
+// hold up the other jobs.
+const batchSize = 100
+
+// job is one kind of automatic settlement. claim selects and locks a single
+// due item given the cutoff time, returning its transaction_id and, for
+// milestone jobs, milestone_id or, for payment jobs, payment_id. Claims lock
+// the transactions row only; settle locks anything else after it, in the
+// order the handlers use, so the scheduler cannot deadlock with them.
+//
+// observe, when set, does slow reads such as asking a chain about a deposit
+// between claim and settle. The claim is committed before observe runs, so
+// no lock is held meanwhile, and must therefore lease the item itself; settle
+// then runs in a transaction of its own.
+type job struct {
+	name    string
+	claim   string
+	cutoff  func(now time.Time, w escrow.Windows) time.Time
+	observe func(ctx context.Context, item *due) error
+	settle  func(ctx context.Context, tx *sqlx.Tx, transaction *models.Transaction, item due) error
+}
+
+// due is an item claimed by a job.
+type due struct {
+	TransactionID uuid.UUID     `db:"transaction_id"`
+	MilestoneID   uuid.NullUUID `db:"milestone_id"`
+	PaymentID     uuid.NullUUID `db:"payment_id"`
+	// Observation is what observe found out about a payment.
+	Observation *payments.Observation `db:"-"`
+}
+
+var jobs = []job{
+	{
+		name: "refund expired escrows",
+		claim: `
+			SELECT t.transaction_id, NULL::uuid AS milestone_id
+			FROM transactions t
+			JOIN escrow_accounts e ON e.transaction_id = t.transaction_id
+			WHERE t.transaction_status = 'deposited' AND e.escrow_status = 'funded'
+			  AND e.expiry_date < $1
+			ORDER BY e.expiry_date
+			LIMIT 1
+			FOR UPDATE OF t SKIP LOCKED
+		`,
+		cutoff: func(now time.Time, w escrow.Windows) time.Time { return now },
+		settle: refundExpired,
+	},
+	{
+		name: "release uninspected escrows",
+		claim: `
+			SELECT t.transaction_id, NULL::uuid AS milestone_id
+			FROM transactions t
+			JOIN escrow_accounts e ON e.transaction_id = t.transaction_id
+			WHERE t.transaction_status = 'in_progress' AND e.escrow_status = 'funded'
+			  AND e.expiry_date < $1
+			  AND NOT EXISTS (SELECT 1 FROM disputes d WHERE d.transaction_id = t.transaction_id AND d.dispute_status = 'open')
+			ORDER BY e.expiry_date
+			LIMIT 1
+			FOR UPDATE OF t SKIP LOCKED
+		`,
+		cutoff: func(now time.Time, w escrow.Windows) time.Time { return now },
+		settle: releaseUninspected,
+	},
+	{
+		name: "release uninspected milestones",
+		claim: `
+			SELECT t.transaction_id, m.milestone_id
+			FROM milestones m
+			JOIN transactions t ON t.transaction_id = m.transaction_id
+			JOIN escrow_accounts e ON e.transaction_id = t.transaction_id
+			WHERE m.milestone_status = 'fulfilled' AND e.escrow_status = 'funded'
+			  AND m.fulfilled_at < $1
+			  AND NOT EXISTS (SELECT 1 FROM disputes d WHERE d.transaction_id = t.transaction_id AND d.dispute_status = 'open')
+			ORDER BY m.fulfilled_at
+			LIMIT 1
+			FOR UPDATE OF t SKIP LOCKED
+		`,
+		cutoff: func(now time.Time, w escrow.Windows) time.Time { return now.Add(-w.Inspection) },
+		settle: releaseMilestone,
+	},
+	{
+		name: "retry deferred charges",
+		claim: `
+			SELECT t.transaction_id, p.payment_id
+			FROM payments p
+			JOIN transactions t ON t.transaction_id = p.transaction_id
+			WHERE p.payment_status = 'pending' AND p.next_retry_at < $1
+			ORDER BY p.next_retry_at
+			LIMIT 1
+			FOR UPDATE OF t SKIP LOCKED
+		`,
+		cutoff: func(now time.Time, w escrow.Windows) time.Time { return now },
+		settle: retryCharge,
+	},
+	{
+		// settled deposits are watched for a month for transfers that arrive
+		// late; they are compared with the chain here rather than reconciled.
+		// Stamping reconciled_at leases the deposit until the next poll while
+		// the chain is read.
+		name: "confirm crypto deposits",
+		claim: `
+			UPDATE payments SET reconciled_at = NOW()
+			WHERE payment_id = (
+				SELECT p.payment_id
+				FROM payments p
+				JOIN transactions t ON t.transaction_id = p.transaction_id
+				WHERE p.method = 'crypto' AND p.next_retry_at IS NULL AND p.gateway_reference <> ''
+				  AND (p.payment_status = 'pending' OR p.created_at > $1 - INTERVAL '30 days')
+				  AND (p.reconciled_at IS NULL OR p.reconciled_at < $1)
+				ORDER BY p.reconciled_at NULLS FIRST
+				LIMIT 1
+				FOR UPDATE OF t SKIP LOCKED
+			)
+			RETURNING transaction_id, payment_id
+		`,
+		cutoff: func(now time.Time, w escrow.Windows) time.Time {
+			return now.Add(-payments.CurrentPolicy().PollEvery)
+		},
+		observe: observeCrypto,
+		settle:  confirmCrypto,
+	},
+	{
+		// payments older than a month are left alone; the gateway's records
+		// of them no longer move
+		name: "reconcile payments",
+		claim: `
+			SELECT t.transaction_id, p.payment_id
+			FROM payments p
+			JOIN transactions t ON t.transaction_id = p.transaction_id
+			WHERE p.gateway_reference <> '' AND p.next_retry_at IS NULL AND p.method <> 'crypto'
+			  AND (p.reconciled_at IS NULL OR p.reconciled_at < $1)
+			  AND p.created_at > $1 - INTERVAL '30 days'
+			ORDER BY p.reconciled_at NULLS FIRST
+			LIMIT 1
+			FOR UPDATE OF t SKIP LOCKED
+		`,
+		cutoff: func(now time.Time, w escrow.Windows) time.Time {
+			return now.Add(-payments.CurrentPolicy().ReconcileEvery)
+		},
+		settle: reconcilePayment,
+	},
+}
+
+// Run calls RunOnce straight away and then every interval until ctx is
+// cancelled.
+func Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := RunOnce(ctx); err != nil {
+			log.Printf("[ERROR] Escrow scheduler run failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOnce settles everything that is due now, up to batchSize items per job.
+// A failing job is reported and the remaining jobs still run; the failed item
+// is retried on the next run.
+func RunOnce(ctx context.Context) error {
+	var errs []error
+	for _, j := range jobs {
+		for i := 0; i < batchSize && ctx.Err() == nil; i++ {
+			settled, err := runStep(ctx, j)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", j.name, err))
+				break
+			}
+			if !settled {
+				break
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// runStep claims and settles one due item of j in its own transaction. It
+// reports false when nothing is due or every due item is held by another
+// replica.
+func runStep(ctx context.Context, j job) (bool, error) {
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var item due
+	if err := tx.Get(&item, j.claim, j.cutoff(time.Now(), escrow.CurrentWindows())); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	if j.observe != nil {
+		if err := tx.Commit(); err != nil {
+			return false, err
+		}
+		if err := j.observe(ctx, &item); err != nil {
+			return false, fmt.Errorf("transaction %s: %w", item.TransactionID, err)
+		}
+		if tx, err = db.DB.Beginx(); err != nil {
+			return false, err
+		}
+		defer tx.Rollback()
+	}
+
+	transaction, err := escrow.LockTransaction(tx, item.TransactionID)
+	if err != nil {
+		return false, err
+	}
+	if err := j.settle(ctx, tx, transaction, item); err != nil {
+		return false, fmt.Errorf("transaction %s: %w", item.TransactionID, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+
+	log.Printf("[INFO] Escrow scheduler: %s settled transaction %s", j.name, item.TransactionID)
+	return true, nil
+}
+
+func refundExpired(ctx context.Context, tx *sqlx.Tx, transaction *models.Transaction, _ due) error {
+	if err := logs.Record(tx, transaction.TransactionID, "EscrowExpired", "Seller did not fulfill before the escrow expired; refunding buyer automatically"); err != nil {
+		return err
+	}
+	return escrow.RefundEscrow(ctx, tx, transaction, models.EventRefund, models.ActorSystem, "Escrow refunded to buyer automatically after expiry")
+}
+
+func releaseUninspected(ctx context.Context, tx *sqlx.Tx, transaction *models.Transaction, _ due) error {
+	if err := logs.Record(tx, transaction.TransactionID, "InspectionWindowElapsed", "Buyer neither confirmed nor disputed within the inspection window; releasing to seller automatically"); err != nil {
+		return err
+	}
+	return escrow.ReleaseEscrow(ctx, tx, transaction, models.EventRelease, models.ActorSystem, "Escrow released to seller automatically after the inspection window")
+}
+
+func releaseMilestone(ctx context.Context, tx *sqlx.Tx, transaction *models.Transaction, item due) error {
+	details := fmt.Sprintf("Buyer neither approved nor disputed milestone %s within the inspection window; releasing to seller automatically", item.MilestoneID.UUID)
+	if err := logs.Record(tx, transaction.TransactionID, "MilestoneInspectionElapsed", details); err != nil {
+		return err
+	}
+	_, err := escrow.ReleaseMilestone(ctx, tx, transaction, item.MilestoneID.UUID, models.ActorSystem)
+	return err
+}
+
+// retryCharge charges a deferred payment again and settles its pending
+// deposit once the gateway took or finally refused the charge.
+func retryCharge(ctx context.Context, tx *sqlx.Tx, transaction *models.Transaction, item due) error {
+	payment, err := payments.Lock(tx, item.PaymentID.UUID)
+	if err != nil {
+		return err
+	}
+	status, err := payments.Retry(ctx, tx, payment, time.Now())
+	if err != nil {
+		return err
+	}
+	switch status {
+	case payments.StatusCaptured:
+		return escrow.ConfirmDeposit(ctx, tx, transaction, payment)
+	case payments.StatusFailed:
+		return escrow.FailDeposit(ctx, tx, transaction, payment, *payment.LastError)
+	}
+	return nil
+}
+
+// observeCrypto reads a crypto deposit off the chain, holding no lock.
+func observeCrypto(ctx context.Context, item *due) error {
+	observation, err := payments.Observe(ctx, db.DB, item.PaymentID.UUID)
+	item.Observation = observation
+	return err
+}
+
+// confirmCrypto stores what the chain showed of a crypto deposit and settles
+// it once it is confirmed or its payment window closed. Money owed back to
+// the buyer, including transfers that arrive after the deposit settled, is
+// logged for an admin to refund.
+func confirmCrypto(ctx context.Context, tx *sqlx.Tx, transaction *models.Transaction, item due) error {
+	payment, err := payments.Lock(tx, item.PaymentID.UUID)
+	if err != nil {
+		return err
+	}
+	pending := payment.Status == payments.StatusPending.PaymentStatus()
+	status, delta, err := payments.Track(tx, payment, item.Observation, time.Now())
+	if err != nil {
+		return err
+	}
+	if delta != nil {
+		details := fmt.Sprintf("Payment %s was an %s: received %s for %s; %s is owed back to the buyer (delta %s)", payment.PaymentID, delta.Kind, payment.ReceivedAmount, payment.Amount, delta.Amount, delta.DeltaID)
+		if err := logs.Record(tx, transaction.TransactionID, "PaymentDeltaRecorded", details); err != nil {
+			return err
+		}
+	}
+	if !pending {
+		return nil
+	}
+	switch status {
+	case payments.StatusCaptured:
+		return escrow.ConfirmDeposit(ctx, tx, transaction, payment)
+	case payments.StatusFailed:
+		return escrow.FailDeposit(ctx, tx, transaction, payment, *payment.LastError)
+	}
+	return nil
+}
+
+// reconcilePayment compares a payment with the gateway and logs a mismatch
+// against its transaction the first time it shows up.
+func reconcilePayment(ctx context.Context, tx *sqlx.Tx, transaction *models.Transaction, item due) error {
+	payment, err := payments.Lock(tx, item.PaymentID.UUID)
+	if err != nil {
+		return err
+	}
+	mismatch, err := payments.Reconcile(ctx, tx, payment, time.Now())
+	if err != nil || mismatch == "" || (payment.Mismatch != nil && *payment.Mismatch == mismatch) {
+		return err
+	}
+	details := fmt.Sprintf("Payment %s disagrees with the gateway: %s", payment.PaymentID, mismatch)
+	return logs.Record(tx, transaction.TransactionID, "PaymentMismatch", details)
+}
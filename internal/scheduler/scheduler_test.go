@@ -0,0 +1,275 @@
+package scheduler_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"escrow-agent/internal/crypto"
+	"escrow-agent/internal/db"
+	"escrow-agent/internal/payments"
+	"escrow-agent/internal/scheduler"
+	"escrow-agent/pkg/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+)
+
+const claimQuery = "SELECT (.+) FOR UPDATE OF t SKIP LOCKED"
+
+func expectNothingDue(mock sqlmock.Sqlmock) {
+	mock.ExpectBegin()
+	mock.ExpectQuery(claimQuery).
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"transaction_id", "milestone_id"}))
+	mock.ExpectRollback()
+}
+
+const (
+	paymentClaimQuery = "SELECT t.transaction_id, p.payment_id FROM payments p (.+) FOR UPDATE OF t SKIP LOCKED"
+	cryptoClaimQuery  = "UPDATE payments SET reconciled_at = NOW\\(\\) WHERE payment_id = (.+) FOR UPDATE OF t SKIP LOCKED (.+) RETURNING transaction_id, payment_id"
+)
+
+// expectNoPaymentsDue covers the retry, crypto confirmation and
+// reconciliation jobs.
+func expectNoPaymentsDue(mock sqlmock.Sqlmock) {
+	for _, query := range []string{paymentClaimQuery, cryptoClaimQuery, paymentClaimQuery} {
+		mock.ExpectBegin()
+		mock.ExpectQuery(query).
+			WithArgs(sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"transaction_id", "payment_id"}))
+		mock.ExpectRollback()
+	}
+}
+
+func TestRunOnce_NothingDue(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+
+	db.DB = sqlx.NewDb(mockDB, "sqlmock")
+
+	expectNothingDue(mock)
+	expectNothingDue(mock)
+	expectNothingDue(mock)
+	expectNoPaymentsDue(mock)
+
+	assert.NoError(t, scheduler.RunOnce(context.Background()))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRunOnce_RefundsExpiredEscrow(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+
+	db.DB = sqlx.NewDb(mockDB, "sqlmock")
+
+	buyerID, sellerID, transactionID := uuid.New(), uuid.New(), uuid.New()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(claimQuery).
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"transaction_id", "milestone_id"}).AddRow(transactionID, nil))
+	mock.ExpectQuery("SELECT (.+) FROM transactions (.+) FOR UPDATE").
+		WithArgs(transactionID).
+		WillReturnRows(sqlmock.NewRows([]string{"transaction_id", "buyer_id", "seller_id", "amount", "transaction_status", "escrow_status"}).
+			AddRow(transactionID, buyerID, sellerID, 50.00, "deposited", "funded"))
+	mock.ExpectExec("INSERT INTO transaction_logs").
+		WithArgs(transactionID, "EscrowExpired", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT EXISTS").
+		WithArgs(transactionID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectExec("UPDATE milestones").
+		WithArgs("refunded", transactionID).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("UPDATE escrow_accounts").
+		WithArgs("cancelled", transactionID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE transactions").
+		WithArgs("cancelled", "cancelled", transactionID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT (.+) FROM payments").
+		WithArgs(transactionID).
+		WillReturnRows(sqlmock.NewRows([]string{"payment_id"}))
+	mock.ExpectQuery("SELECT COALESCE\\(SUM\\(p.amount\\), 0\\)").
+		WithArgs("escrow_holding", transactionID, "USD").
+		WillReturnRows(sqlmock.NewRows([]string{"balance"}).AddRow(0))
+	mock.ExpectExec("INSERT INTO transaction_logs").
+		WithArgs(transactionID, "EscrowRefunded", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	expectNothingDue(mock)
+	expectNothingDue(mock)
+	expectNothingDue(mock)
+	expectNoPaymentsDue(mock)
+
+	assert.NoError(t, scheduler.RunOnce(context.Background()))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRunOnce_FlagsPaymentMismatch(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+
+	db.DB = sqlx.NewDb(mockDB, "sqlmock")
+	payments.Register("credit_card", payments.NewMockGateway())
+
+	buyerID, sellerID, transactionID, paymentID := uuid.New(), uuid.New(), uuid.New(), uuid.New()
+
+	expectNothingDue(mock)
+	expectNothingDue(mock)
+	expectNothingDue(mock)
+	for _, query := range []string{paymentClaimQuery, cryptoClaimQuery} {
+		mock.ExpectBegin()
+		mock.ExpectQuery(query).
+			WithArgs(sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"transaction_id", "payment_id"}))
+		mock.ExpectRollback()
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(paymentClaimQuery).
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"transaction_id", "payment_id"}).AddRow(transactionID, paymentID))
+	mock.ExpectQuery("SELECT (.+) FROM transactions (.+) FOR UPDATE").
+		WithArgs(transactionID).
+		WillReturnRows(sqlmock.NewRows([]string{"transaction_id", "buyer_id", "seller_id", "amount", "transaction_status", "escrow_status"}).
+			AddRow(transactionID, buyerID, sellerID, 50.00, "deposited", "funded"))
+	mock.ExpectQuery("SELECT (.+) FROM payments WHERE payment_id = \\$1 FOR UPDATE").
+		WithArgs(paymentID).
+		WillReturnRows(sqlmock.NewRows([]string{"payment_id", "transaction_id", "amount", "currency", "method", "payment_status", "gateway_reference", "mismatch"}).
+			AddRow(paymentID, transactionID, "50.00", "USD", "credit_card", "completed", "mock_lost", nil))
+	mock.ExpectExec("UPDATE payments SET reconciled_at").
+		WithArgs(sqlmock.AnyArg(), "the gateway has no record of the charge", paymentID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO transaction_logs").
+		WithArgs(transactionID, "PaymentMismatch", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery(paymentClaimQuery).
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"transaction_id", "payment_id"}))
+	mock.ExpectRollback()
+
+	assert.NoError(t, scheduler.RunOnce(context.Background()))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRunOnce_FailsUnderpaidCryptoDeposit(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+
+	db.DB = sqlx.NewDb(mockDB, "sqlmock")
+	ring, err := crypto.NewEphemeralKeyring("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	crypto.SetKEK(ring)
+
+	chain := payments.NewSimulatedChain()
+	gateway := payments.NewCryptoGateway(chain, 6, time.Hour)
+	payments.Register(payments.MethodCrypto, gateway)
+	result, err := gateway.Authorize(context.Background(), payments.ChargeRequest{Amount: models.NewMoney(5000, "USD"), Token: "sim1buyer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gateway.Capture(context.Background(), result.Reference); err != nil {
+		t.Fatal(err)
+	}
+	chain.Pay(result.Reference, models.NewMoney(3000, "USD"))
+	chain.Mine(6)
+	gateway.SetClock(func() time.Time { return time.Now().Add(2 * time.Hour) })
+
+	buyerID, sellerID, transactionID, paymentID := uuid.New(), uuid.New(), uuid.New(), uuid.New()
+	transactionRows := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"transaction_id", "buyer_id", "seller_id", "amount", "transaction_status", "escrow_status"}).
+			AddRow(transactionID, buyerID, sellerID, 50.00, "agreed", "pending")
+	}
+	paymentRows := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"payment_id", "transaction_id", "amount", "currency", "method", "payment_status", "gateway_reference"}).
+			AddRow(paymentID, transactionID, "50.00", "USD", payments.MethodCrypto, "pending", result.Reference)
+	}
+
+	expectNothingDue(mock)
+	expectNothingDue(mock)
+	expectNothingDue(mock)
+	mock.ExpectBegin()
+	mock.ExpectQuery(paymentClaimQuery).
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"transaction_id", "payment_id"}))
+	mock.ExpectRollback()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(cryptoClaimQuery).
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"transaction_id", "payment_id"}).AddRow(transactionID, paymentID))
+	mock.ExpectCommit()
+	// the chain is read with no lock held
+	mock.ExpectQuery("SELECT (.+) FROM payments WHERE payment_id = \\$1$").
+		WithArgs(paymentID).
+		WillReturnRows(paymentRows())
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM transactions (.+) FOR UPDATE").
+		WithArgs(transactionID).
+		WillReturnRows(transactionRows())
+	mock.ExpectQuery("SELECT (.+) FROM payments WHERE payment_id = \\$1 FOR UPDATE").
+		WithArgs(paymentID).
+		WillReturnRows(paymentRows())
+	mock.ExpectExec("UPDATE payments SET encrypted_details").
+		WithArgs(sqlmock.AnyArg(), paymentID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE payments SET received_amount").
+		WithArgs("30.00", 6, "underpaid: received 30.00 of 50.00 USD before the payment window closed", sqlmock.AnyArg(), paymentID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT COALESCE\\(SUM\\(amount\\), 0\\) FROM payment_deltas").
+		WithArgs(paymentID).
+		WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow("0"))
+	mock.ExpectQuery("INSERT INTO payment_deltas").
+		WithArgs(paymentID, transactionID, payments.DeltaUnderpayment, "30.00", "USD").
+		WillReturnRows(sqlmock.NewRows([]string{"delta_id", "payment_id", "transaction_id", "kind", "amount", "currency", "created_at"}).
+			AddRow(uuid.New(), paymentID, transactionID, payments.DeltaUnderpayment, "30.00", "USD", time.Now()))
+	mock.ExpectExec("INSERT INTO transaction_logs").
+		WithArgs(transactionID, "PaymentDeltaRecorded", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE payments SET payment_status = \\$1").
+		WithArgs("failed", paymentID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM escrow_accounts").
+		WithArgs(paymentID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE transactions SET payment_id = NULL").
+		WithArgs(transactionID, paymentID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO transaction_logs").
+		WithArgs(transactionID, "DepositFailed", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery(cryptoClaimQuery).
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"transaction_id", "payment_id"}))
+	mock.ExpectRollback()
+	mock.ExpectBegin()
+	mock.ExpectQuery(paymentClaimQuery).
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"transaction_id", "payment_id"}))
+	mock.ExpectRollback()
+
+	assert.NoError(t, scheduler.RunOnce(context.Background()))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,172 @@
+// Package sessions keeps the server-side half of logins: the rotating refresh
+// tokens that mint new access tokens, and the list of revoked access token
+// jtis that JWTAuthMiddleware consults.
+//
+// A session starts at login and every refresh rotates it: the presented
+// refresh token is marked used and a new access/refresh pair is issued in the
+// same session. Presenting a used or revoked refresh token again means it was
+// copied, so the whole session is revoked.
+package sessions
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"escrow-agent/internal/tokens"
+	"escrow-agent/pkg/models"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrRefreshTokenReused  = fmt.Errorf("%w: token was already used, session revoked", ErrInvalidRefreshToken)
+)
+
+// Subject is the user a session is issued to. MFA records that the login
+// passed a second factor; it carries over to every token of the session.
+type Subject struct {
+	UserID   uuid.UUID    `db:"user_id"`
+	Username string       `db:"username"`
+	Roles    models.Roles `db:"roles"`
+	MFA      bool         `db:"mfa"`
+}
+
+// Pair is an access token with the refresh token that replaces it.
+type Pair struct {
+	AccessToken  string
+	RefreshToken string
+	ExpiresIn    time.Duration
+}
+
+// Start opens a new session for user and returns its first token pair.
+func Start(exec sqlx.Execer, service *tokens.Service, user Subject) (*Pair, error) {
+	return issue(exec, service, uuid.New(), user)
+}
+
+// Rotate redeems refreshToken for a new pair in the same session. tx must be
+// committed even when Rotate returns ErrRefreshTokenReused, since that error
+// comes with the session's revocation.
+func Rotate(tx *sqlx.Tx, service *tokens.Service, refreshToken string) (*Pair, error) {
+	var stored struct {
+		Subject
+		TokenID   uuid.UUID    `db:"token_id"`
+		SessionID uuid.UUID    `db:"session_id"`
+		ExpiresAt time.Time    `db:"expires_at"`
+		UsedAt    sql.NullTime `db:"used_at"`
+		RevokedAt sql.NullTime `db:"revoked_at"`
+	}
+	err := tx.Get(&stored, `
+		SELECT rt.token_id, rt.session_id, rt.expires_at, rt.used_at, rt.revoked_at, u.user_id, u.username, u.roles, rt.mfa
+		FROM refresh_tokens rt
+		JOIN users u ON u.user_id = rt.user_id
+		WHERE rt.token_hash = $1
+		FOR UPDATE OF rt
+	`, hashToken(refreshToken))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if stored.UsedAt.Valid || stored.RevokedAt.Valid {
+		if err := RevokeSession(tx, stored.SessionID); err != nil {
+			return nil, err
+		}
+		return nil, ErrRefreshTokenReused
+	}
+	if time.Now().After(stored.ExpiresAt) {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	if _, err := tx.Exec("UPDATE refresh_tokens SET used_at = NOW() WHERE token_id = $1", stored.TokenID); err != nil {
+		return nil, err
+	}
+	return issue(tx, service, stored.SessionID, stored.Subject)
+}
+
+// RevokeSession ends one session: its refresh tokens can no longer be
+// redeemed and the access tokens issued with them are revoked.
+func RevokeSession(exec sqlx.Execer, sessionID uuid.UUID) error {
+	return revoke(exec, "session_id", sessionID)
+}
+
+// RevokeUser ends every session the user has, e.g. after a password change.
+func RevokeUser(exec sqlx.Execer, userID uuid.UUID) error {
+	return revoke(exec, "user_id", userID)
+}
+
+// IsRevoked reports whether the access token with this jti was revoked.
+func IsRevoked(q sqlx.Queryer, jti string) (bool, error) {
+	id, err := uuid.Parse(jti)
+	if err != nil {
+		return true, nil
+	}
+	var revoked bool
+	err = sqlx.Get(q, &revoked, "SELECT EXISTS(SELECT 1 FROM revoked_tokens WHERE jti = $1)", id)
+	return revoked, err
+}
+
+// revoke lists the still-live access tokens of the matching refresh tokens as
+// revoked, marks the refresh tokens revoked and drops list entries whose
+// tokens have expired anyway.
+func revoke(exec sqlx.Execer, column string, id uuid.UUID) error {
+	_, err := exec.Exec(`
+		INSERT INTO revoked_tokens (jti, user_id, expires_at)
+		SELECT access_jti, user_id, access_expires_at
+		FROM refresh_tokens
+		WHERE `+column+` = $1 AND access_expires_at > NOW()
+		ON CONFLICT (jti) DO NOTHING
+	`, id)
+	if err != nil {
+		return err
+	}
+	_, err = exec.Exec("UPDATE refresh_tokens SET revoked_at = NOW() WHERE "+column+" = $1 AND revoked_at IS NULL", id)
+	if err != nil {
+		return err
+	}
+	_, err = exec.Exec("DELETE FROM revoked_tokens WHERE expires_at < NOW()")
+	return err
+}
+
+func issue(exec sqlx.Execer, service *tokens.Service, sessionID uuid.UUID, user Subject) (*Pair, error) {
+	jti := uuid.New()
+	now := time.Now()
+
+	claims := &tokens.Claims{UserID: user.UserID, Username: user.Username, Roles: user.Roles, SessionID: sessionID, MFA: user.MFA}
+	claims.ID = jti.String()
+	access, err := service.Issue(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+	refresh := base64.RawURLEncoding.EncodeToString(raw)
+
+	_, err = exec.Exec(`
+		INSERT INTO refresh_tokens (session_id, user_id, token_hash, access_jti, access_expires_at, expires_at, mfa)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`, sessionID, user.UserID, hashToken(refresh), jti, now.Add(service.TTL()), now.Add(service.RefreshTTL()), user.MFA)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Pair{AccessToken: access, RefreshToken: refresh, ExpiresIn: service.TTL()}, nil
+}
+
+// hashToken is what refresh_tokens stores; the token itself is only ever
+// held by the client.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
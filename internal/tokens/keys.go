@@ -0,0 +1,152 @@
+package tokens
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var ErrInvalidKey = errors.New("invalid signing key")
+
+// Key is one entry of the key set, identified in token headers by its kid.
+// Signing is nil for keys that are kept only to verify tokens issued before a
+// rotation.
+type Key struct {
+	ID        string
+	Method    jwt.SigningMethod
+	Signing   interface{}
+	Verifying interface{}
+}
+
+// CanSign reports whether the key holds the secret or private half.
+func (k Key) CanSign() bool {
+	return k.Signing != nil
+}
+
+// NewHMACKey returns an HS256 key for secret.
+func NewHMACKey(id string, secret []byte) (Key, error) {
+	if len(secret) < 32 {
+		return Key{}, fmt.Errorf("%w: %s: HS256 secret must be at least 32 bytes", ErrInvalidKey, id)
+	}
+	return Key{ID: id, Method: jwt.SigningMethodHS256, Signing: secret, Verifying: secret}, nil
+}
+
+// NewEphemeralKey returns a random HS256 key. Tokens it signs die with the
+// process and are not accepted by other replicas.
+func NewEphemeralKey(id string) (Key, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return Key{}, err
+	}
+	return NewHMACKey(id, secret)
+}
+
+// keySpec is the JSON form of a key. PEM material may be given inline or as
+// a file path, e.g.
+//
+//	[{"kid": "2024-07", "alg": "EdDSA", "private_key_file": "/run/secrets/jwt-2024-07.pem"},
+//	 {"kid": "2024-01", "alg": "RS256", "public_key_file": "/run/secrets/jwt-2024-01.pub"},
+//	 {"kid": "legacy", "alg": "HS256", "secret": "..."}]
+type keySpec struct {
+	ID             string `json:"kid"`
+	Alg            string `json:"alg"`
+	Secret         string `json:"secret"`
+	PrivateKey     string `json:"private_key"`
+	PrivateKeyFile string `json:"private_key_file"`
+	PublicKey      string `json:"public_key"`
+	PublicKeyFile  string `json:"public_key_file"`
+}
+
+// ParseKeys reads a key set from its JSON form.
+func ParseKeys(data []byte) ([]Key, error) {
+	var specs []keySpec
+	if err := json.Unmarshal(data, &specs); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidKey, err)
+	}
+
+	keys := make([]Key, 0, len(specs))
+	for _, spec := range specs {
+		key, err := spec.build()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (s keySpec) build() (Key, error) {
+	if s.ID == "" {
+		return Key{}, fmt.Errorf("%w: kid is required", ErrInvalidKey)
+	}
+
+	switch s.Alg {
+	case "HS256":
+		return NewHMACKey(s.ID, []byte(s.Secret))
+	case "RS256":
+		return s.buildAsymmetric(jwt.SigningMethodRS256,
+			func(pem []byte) (crypto.Signer, error) { return jwt.ParseRSAPrivateKeyFromPEM(pem) },
+			func(pem []byte) (interface{}, error) { return jwt.ParseRSAPublicKeyFromPEM(pem) })
+	case "EdDSA":
+		return s.buildAsymmetric(jwt.SigningMethodEdDSA,
+			func(pem []byte) (crypto.Signer, error) {
+				key, err := jwt.ParseEdPrivateKeyFromPEM(pem)
+				if err != nil {
+					return nil, err
+				}
+				return key.(ed25519.PrivateKey), nil
+			},
+			func(pem []byte) (interface{}, error) { return jwt.ParseEdPublicKeyFromPEM(pem) })
+	default:
+		return Key{}, fmt.Errorf("%w: %s: unsupported alg %q", ErrInvalidKey, s.ID, s.Alg)
+	}
+}
+
+// buildAsymmetric loads the private key when one is configured, deriving the
+// public half from it, or else a verify-only public key.
+func (s keySpec) buildAsymmetric(method jwt.SigningMethod, parsePrivate func([]byte) (crypto.Signer, error), parsePublic func([]byte) (interface{}, error)) (Key, error) {
+	key := Key{ID: s.ID, Method: method}
+
+	private, err := pemMaterial(s.PrivateKey, s.PrivateKeyFile)
+	if err != nil {
+		return Key{}, fmt.Errorf("%w: %s: %v", ErrInvalidKey, s.ID, err)
+	}
+	if private != nil {
+		signer, err := parsePrivate(private)
+		if err != nil {
+			return Key{}, fmt.Errorf("%w: %s: %v", ErrInvalidKey, s.ID, err)
+		}
+		key.Signing = signer
+		key.Verifying = signer.Public()
+		return key, nil
+	}
+
+	public, err := pemMaterial(s.PublicKey, s.PublicKeyFile)
+	if err != nil {
+		return Key{}, fmt.Errorf("%w: %s: %v", ErrInvalidKey, s.ID, err)
+	}
+	if public == nil {
+		return Key{}, fmt.Errorf("%w: %s: %s needs a private or public key", ErrInvalidKey, s.ID, method.Alg())
+	}
+	key.Verifying, err = parsePublic(public)
+	if err != nil {
+		return Key{}, fmt.Errorf("%w: %s: %v", ErrInvalidKey, s.ID, err)
+	}
+	return key, nil
+}
+
+func pemMaterial(inline, path string) ([]byte, error) {
+	if inline != "" {
+		return []byte(inline), nil
+	}
+	if path != "" {
+		return os.ReadFile(path)
+	}
+	return nil, nil
+}
@@ -0,0 +1,186 @@
+// Package tokens issues and verifies the JWTs that authenticate API calls.
+// Tokens are signed with the key set's current signing key and carry its kid,
+// so older keys can stay in the set to verify tokens issued before a rotation.
+package tokens
+
+import (
+	"errors"
+	"escrow-agent/pkg/models"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrNoService    = errors.New("token service is not configured")
+)
+
+// Claims identify the user, the roles they held when the token was issued
+// and, through SessionID, the login session the token belongs to.
+// RegisteredClaims.ID carries the jti checked against the revocation list.
+// MFA is set when the login passed a second factor.
+//
+// Callers authenticated with an API key get Claims too, built from the key
+// rather than parsed from a token: APIKeyID names the key and Scopes lists
+// the only permissions it may use. Neither is ever put in a token.
+type Claims struct {
+	UserID    uuid.UUID    `json:"user_id"`
+	Username  string       `json:"username"`
+	Roles     models.Roles `json:"roles"`
+	SessionID uuid.UUID    `json:"sid"`
+	MFA       bool         `json:"mfa,omitempty"`
+	APIKeyID  *uuid.UUID   `json:"-"`
+	Scopes    []string     `json:"-"`
+	jwt.RegisteredClaims
+}
+
+// DefaultRefreshTTL applies when Config.RefreshTTL is zero.
+const DefaultRefreshTTL = 30 * 24 * time.Hour
+
+// Config describes a token service. SigningKeyID names the key new tokens are
+// signed with and defaults to the first key that can sign. TTL bounds access
+// tokens; RefreshTTL bounds the refresh tokens issued alongside them.
+type Config struct {
+	Keys         []Key
+	SigningKeyID string
+	Issuer       string
+	Audience     string
+	TTL          time.Duration
+	RefreshTTL   time.Duration
+}
+
+// Service signs and verifies tokens against one key set.
+type Service struct {
+	signing    Key
+	keys       map[string]Key
+	methods    []string
+	issuer     string
+	audience   string
+	ttl        time.Duration
+	refreshTTL time.Duration
+}
+
+// NewService checks cfg and builds a service from it.
+func NewService(cfg Config) (*Service, error) {
+	if cfg.Issuer == "" || cfg.Audience == "" {
+		return nil, errors.New("token issuer and audience are required")
+	}
+	if cfg.TTL <= 0 {
+		return nil, errors.New("token lifetime must be positive")
+	}
+
+	if cfg.RefreshTTL == 0 {
+		cfg.RefreshTTL = DefaultRefreshTTL
+	}
+	if cfg.RefreshTTL < cfg.TTL {
+		return nil, errors.New("refresh token lifetime must not be shorter than the access token's")
+	}
+
+	s := &Service{keys: map[string]Key{}, issuer: cfg.Issuer, audience: cfg.Audience, ttl: cfg.TTL, refreshTTL: cfg.RefreshTTL}
+	seen := map[string]bool{}
+	for _, key := range cfg.Keys {
+		if _, dup := s.keys[key.ID]; dup {
+			return nil, fmt.Errorf("%w: duplicate kid %q", ErrInvalidKey, key.ID)
+		}
+		s.keys[key.ID] = key
+		if alg := key.Method.Alg(); !seen[alg] {
+			seen[alg] = true
+			s.methods = append(s.methods, alg)
+		}
+		if s.signing.ID == "" && key.CanSign() && (cfg.SigningKeyID == "" || cfg.SigningKeyID == key.ID) {
+			s.signing = key
+		}
+	}
+
+	if s.signing.ID == "" {
+		if cfg.SigningKeyID != "" {
+			return nil, fmt.Errorf("%w: no signing key with kid %q", ErrInvalidKey, cfg.SigningKeyID)
+		}
+		return nil, fmt.Errorf("%w: no key can sign", ErrInvalidKey)
+	}
+	return s, nil
+}
+
+// TTL is how long issued access tokens stay valid.
+func (s *Service) TTL() time.Duration {
+	return s.ttl
+}
+
+// RefreshTTL is how long a refresh token may be redeemed.
+func (s *Service) RefreshTTL() time.Duration {
+	return s.refreshTTL
+}
+
+// Issue signs claims with the current signing key, filling in the issuer,
+// audience, issue time and expiry. The caller sets the jti.
+func (s *Service) Issue(claims *Claims) (string, error) {
+	now := time.Now()
+	claims.Issuer = s.issuer
+	claims.Audience = jwt.ClaimStrings{s.audience}
+	claims.IssuedAt = jwt.NewNumericDate(now)
+	claims.ExpiresAt = jwt.NewNumericDate(now.Add(s.ttl))
+
+	token := jwt.NewWithClaims(s.signing.Method, claims)
+	token.Header["kid"] = s.signing.ID
+	return token.SignedString(s.signing.Signing)
+}
+
+// Parse verifies tokenString and returns its claims. The token must name a
+// known kid, be signed with that key's algorithm, and carry this service's
+// issuer and audience.
+func (s *Service) Parse(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, s.keyFor,
+		jwt.WithValidMethods(s.methods),
+		jwt.WithIssuer(s.issuer),
+		jwt.WithAudience(s.audience),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if !token.Valid {
+		return nil, ErrInvalidToken
+	}
+	return claims, nil
+}
+
+// keyFor picks the verification key by kid and refuses tokens whose alg does
+// not match it, so a public key can never be used as an HMAC secret.
+func (s *Service) keyFor(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, ok := s.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown kid %q", kid)
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("kid %q expects %s, token uses %s", kid, key.Method.Alg(), token.Method.Alg())
+	}
+	return key.Verifying, nil
+}
+
+var (
+	serviceMu sync.RWMutex
+	current   *Service
+)
+
+// SetService installs the service used by login and the auth middleware.
+func SetService(s *Service) {
+	serviceMu.Lock()
+	defer serviceMu.Unlock()
+	current = s
+}
+
+// Current returns the installed service, or ErrNoService before SetService.
+func Current() (*Service, error) {
+	serviceMu.RLock()
+	defer serviceMu.RUnlock()
+	if current == nil {
+		return nil, ErrNoService
+	}
+	return current, nil
+}
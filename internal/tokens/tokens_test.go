@@ -0,0 +1,203 @@
+package tokens_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"escrow-agent/internal/tokens"
+	"escrow-agent/pkg/models"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+const testSecret = "0123456789abcdef0123456789abcdef"
+
+func newService(t *testing.T, keys []tokens.Key, signingKeyID string) *tokens.Service {
+	t.Helper()
+	s, err := tokens.NewService(tokens.Config{
+		Keys:         keys,
+		SigningKeyID: signingKeyID,
+		Issuer:       "escrow-agent",
+		Audience:     "escrow-agent-api",
+		TTL:          time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func hmacKey(t *testing.T, id string) tokens.Key {
+	t.Helper()
+	key, err := tokens.NewHMACKey(id, []byte(testSecret+id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func privatePEM(t *testing.T, key interface{}) string {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+}
+
+func publicPEM(t *testing.T, key interface{}) string {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func TestIssueAndParse_RoundTrip(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spec := fmt.Sprintf(`[
+		{"kid": "hs", "alg": "HS256", "secret": %q},
+		{"kid": "rs", "alg": "RS256", "private_key": %q},
+		{"kid": "ed", "alg": "EdDSA", "private_key": %q}
+	]`, testSecret, privatePEM(t, rsaKey), privatePEM(t, edKey))
+	keys, err := tokens.ParseKeys([]byte(spec))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userID := uuid.New()
+	for _, kid := range []string{"hs", "rs", "ed"} {
+		s := newService(t, keys, kid)
+		signed, err := s.Issue(&tokens.Claims{UserID: userID, Username: "cathy", Roles: []string{"buyer"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		claims, err := s.Parse(signed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, userID, claims.UserID, kid)
+		assert.Equal(t, models.Roles{"buyer"}, claims.Roles, kid)
+		assert.Equal(t, "escrow-agent", claims.Issuer, kid)
+	}
+}
+
+func TestParse_AcceptsTokensFromRotatedKey(t *testing.T) {
+	oldKey, newKey := hmacKey(t, "2024-01"), hmacKey(t, "2024-07")
+
+	before := newService(t, []tokens.Key{oldKey}, "")
+	signed, err := before.Issue(&tokens.Claims{Username: "cathy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	after := newService(t, []tokens.Key{newKey, oldKey}, "2024-07")
+	_, err = after.Parse(signed)
+	assert.NoError(t, err)
+
+	retired := newService(t, []tokens.Key{newKey}, "")
+	_, err = retired.Parse(signed)
+	assert.True(t, errors.Is(err, tokens.ErrInvalidToken))
+}
+
+func TestParse_RejectsWrongIssuerOrAudience(t *testing.T) {
+	key := hmacKey(t, "k1")
+	s := newService(t, []tokens.Key{key}, "")
+
+	for name, claims := range map[string]jwt.RegisteredClaims{
+		"issuer":   {Issuer: "someone-else", Audience: jwt.ClaimStrings{"escrow-agent-api"}},
+		"audience": {Issuer: "escrow-agent", Audience: jwt.ClaimStrings{"another-api"}},
+		"expiry":   {Issuer: "escrow-agent", Audience: jwt.ClaimStrings{"escrow-agent-api"}},
+	} {
+		if name != "expiry" {
+			claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(time.Hour))
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, &tokens.Claims{RegisteredClaims: claims})
+		token.Header["kid"] = "k1"
+		signed, err := token.SignedString(key.Signing)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = s.Parse(signed)
+		assert.True(t, errors.Is(err, tokens.ErrInvalidToken), name)
+	}
+}
+
+func TestParse_RejectsAlgorithmConfusion(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public := publicPEM(t, &rsaKey.PublicKey)
+
+	keys, err := tokens.ParseKeys([]byte(fmt.Sprintf(`[
+		{"kid": "hs", "alg": "HS256", "secret": %q},
+		{"kid": "rs", "alg": "RS256", "public_key": %q}
+	]`, testSecret, public)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newService(t, keys, "")
+
+	// an HS256 token keyed with the published RSA public key, claiming the RSA kid
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, &tokens.Claims{RegisteredClaims: jwt.RegisteredClaims{
+		Issuer:    "escrow-agent",
+		Audience:  jwt.ClaimStrings{"escrow-agent-api"},
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}})
+	token.Header["kid"] = "rs"
+	forged, err := token.SignedString([]byte(public))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.Parse(forged)
+	assert.True(t, errors.Is(err, tokens.ErrInvalidToken))
+}
+
+func TestNewService_RequiresSigningKey(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := tokens.ParseKeys([]byte(fmt.Sprintf(`[{"kid": "rs", "alg": "RS256", "public_key": %q}]`, publicPEM(t, &rsaKey.PublicKey))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = tokens.NewService(tokens.Config{Keys: keys, Issuer: "i", Audience: "a", TTL: time.Hour})
+	assert.True(t, errors.Is(err, tokens.ErrInvalidKey))
+}
+
+func TestParseKeys_Invalid(t *testing.T) {
+	for _, spec := range []string{
+		`[{"alg": "HS256", "secret": "` + testSecret + `"}]`,
+		`[{"kid": "short", "alg": "HS256", "secret": "too-short"}]`,
+		`[{"kid": "none", "alg": "none"}]`,
+		`[{"kid": "rs", "alg": "RS256"}]`,
+		`{"kid": "not-a-list"}`,
+	} {
+		_, err := tokens.ParseKeys([]byte(spec))
+		assert.True(t, errors.Is(err, tokens.ErrInvalidKey), spec)
+	}
+}
@@ -0,0 +1,143 @@
+package transactions
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"escrow-agent/internal/db"
+	"escrow-agent/internal/escrow"
+	"escrow-agent/internal/middleware"
+	"escrow-agent/pkg/models"
+	"log"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+)
+
+// GetMilestonesHandler lists the milestones of a transaction to its parties and
+// admins.
+func GetMilestonesHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.ClaimsFromContext(r.Context())
+	if !ok {
+		log.Printf("[ERROR] Unauthorized access attempt - missing or invalid claims")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	transactionID, err := uuid.Parse(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid transaction ID", http.StatusBadRequest)
+		return
+	}
+
+	var transaction models.Transaction
+	err = db.DB.Get(&transaction, "SELECT transaction_id, buyer_id, seller_id FROM transactions WHERE transaction_id = $1", transactionID)
+	if err != nil {
+		http.Error(w, "Transaction not found", http.StatusNotFound)
+		return
+	}
+	if middleware.ActorFor(claims, &transaction, middleware.PermTransactionRead) == "" {
+		log.Printf("[ERROR] Unauthorized access to transaction by userID %s", claims.UserID)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	milestones, err := escrow.Milestones(db.DB, transactionID)
+	if err != nil {
+		log.Printf("[ERROR] Failed to fetch milestones for transaction ID %s: %v", transactionID, err)
+		http.Error(w, "Failed to fetch milestones", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(milestones)
+}
+
+// FulfillMilestoneHandler lets the seller mark one milestone delivered.
+func FulfillMilestoneHandler(w http.ResponseWriter, r *http.Request) {
+	milestoneAction(w, r, models.ActorSeller, middleware.PermMilestoneFulfill, false, escrow.FulfillMilestone)
+}
+
+// ApproveMilestoneHandler lets the buyer approve a fulfilled milestone, which
+// releases its share of the escrow to the seller, with a step-up code above
+// the threshold like any other release.
+func ApproveMilestoneHandler(w http.ResponseWriter, r *http.Request) {
+	milestoneAction(w, r, models.ActorBuyer, middleware.PermMilestoneApprove, true, escrow.ReleaseMilestone)
+}
+
+type milestoneOperation func(ctx context.Context, tx *sqlx.Tx, transaction *models.Transaction, milestoneID uuid.UUID, actor models.Actor) (*models.Milestone, error)
+
+// milestoneAction runs op on a milestone for the party the endpoint belongs
+// to, inside one row-locked database transaction. Operations that move money
+// pass releases, which asks for a step-up code, see escrow.StepUp.
+func milestoneAction(w http.ResponseWriter, r *http.Request, party models.Actor, perm middleware.Permission, releases bool, op milestoneOperation) {
+	claims, ok := middleware.ClaimsFromContext(r.Context())
+	if !ok {
+		log.Printf("[ERROR] Unauthorized access attempt - missing or invalid claims")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	transactionID, err := uuid.Parse(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid transaction ID", http.StatusBadRequest)
+		return
+	}
+	milestoneID, err := uuid.Parse(vars["milestone_id"])
+	if err != nil {
+		http.Error(w, "Invalid milestone ID", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		log.Printf("[ERROR] Failed to begin database transaction: %v", err)
+		http.Error(w, "Failed to update milestone", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	transaction, err := escrow.LockTransaction(tx, transactionID)
+	if err != nil {
+		log.Printf("[ERROR] Transaction not found with ID %s: %v", transactionID, err)
+		http.Error(w, "Transaction not found", http.StatusNotFound)
+		return
+	}
+
+	actor := middleware.ActorFor(claims, transaction, perm)
+	if actor != party {
+		log.Printf("[ERROR] Unauthorized access to transaction by userID %s", claims.UserID)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if releases && !escrow.StepUp(w, r, tx, claims, transaction) {
+		return
+	}
+
+	milestone, err := op(r.Context(), tx, transaction, milestoneID, actor)
+	if err == nil {
+		err = tx.Commit()
+	}
+	writeMilestoneResult(w, transactionID, milestone, err)
+}
+
+// writeMilestoneResult maps the outcome of a milestone operation to a
+// response.
+func writeMilestoneResult(w http.ResponseWriter, transactionID uuid.UUID, milestone *models.Milestone, err error) {
+	switch {
+	case errors.Is(err, escrow.ErrMilestoneNotFound):
+		http.Error(w, "Milestone not found", http.StatusNotFound)
+	case errors.Is(err, escrow.ErrMilestoneState), errors.Is(err, models.ErrIllegalTransition):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err != nil:
+		log.Printf("[ERROR] Failed to update milestone of transaction ID %s: %v", transactionID, err)
+		http.Error(w, "Failed to update milestone", http.StatusInternalServerError)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(milestone)
+	}
+}
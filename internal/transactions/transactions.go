@@ -1,29 +1,44 @@
 package transactions
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"escrow-agent/internal/db"
+	"escrow-agent/internal/escrow"
+	"escrow-agent/internal/logs"
 	"escrow-agent/internal/middleware"
 	"escrow-agent/pkg/models"
 	"fmt"
 	"log"
 	"net/http"
-	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/google/uuid"
 )
 
 type CreateTransactionRequest struct {
-	SellerID uuid.UUID     `json:"seller_id"`
-	Amount   float64 `json:"amount"`
-	Status   string  `json:"transaction_status,omitempty"`
+	SellerID   uuid.UUID          `json:"seller_id"`
+	Amount     models.Money       `json:"amount"`
+	Currency   string             `json:"currency"`
+	Status     string             `json:"transaction_status,omitempty"`
+	Milestones []MilestoneRequest `json:"milestones,omitempty"`
+}
+
+// MilestoneRequest describes one share of a transaction split into
+// milestones. The amounts must add up to the transaction amount.
+type MilestoneRequest struct {
+	Description string       `json:"description"`
+	Amount      models.Money `json:"amount"`
+	DueDate     *time.Time   `json:"due_date,omitempty"`
 }
 
 func CreateTransactionHandler(w http.ResponseWriter, r *http.Request) {
-	claims, ok := r.Context().Value("user").(*middleware.Claims)
-	if !ok || claims.Role != "buyer" {
-		log.Printf("[ERROR] Unauthorized access attempt - invalid role or missing claims")
+	claims, ok := middleware.ClaimsFromContext(r.Context())
+	if !ok {
+		log.Printf("[ERROR] Unauthorized access attempt - missing or invalid claims")
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
@@ -35,42 +50,101 @@ func CreateTransactionHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	//validation
-	if req.SellerID == uuid.Nil || req.Amount <= 0 {
+	if req.SellerID == uuid.Nil || !req.Amount.IsPositive() {
 		http.Error(w, "Seller ID and valid amount are required", http.StatusBadRequest)
 		return
 	}
 
-	if req.Status == "" {
-		req.Status = "pending"
+	// users may hold both roles, but never on both sides of one transaction
+	if req.SellerID == claims.UserID {
+		http.Error(w, "Buyer and seller must be different users", http.StatusBadRequest)
+		return
+	}
+
+	if req.Currency == "" {
+		req.Currency = models.DefaultCurrency
+	}
+	if !models.ValidCurrency(req.Currency) {
+		http.Error(w, "Unsupported currency", http.StatusBadRequest)
+		return
+	}
+	amount, err := req.Amount.WithCurrency(req.Currency)
+	if err != nil {
+		http.Error(w, "Amount has more decimal places than the currency allows", http.StatusBadRequest)
+		return
+	}
+
+	milestones := make([]models.Milestone, 0, len(req.Milestones))
+	for _, m := range req.Milestones {
+		milestoneAmount, err := m.Amount.WithCurrency(req.Currency)
+		if err != nil || strings.TrimSpace(m.Description) == "" {
+			http.Error(w, "Every milestone needs a description and a valid amount", http.StatusBadRequest)
+			return
+		}
+		milestones = append(milestones, models.Milestone{Description: strings.TrimSpace(m.Description), Amount: milestoneAmount, DueDate: m.DueDate})
+	}
+
+	// every transaction enters the lifecycle as pending with an unfunded escrow
+	if req.Status != "" && req.Status != string(models.TransactionPending) {
+		http.Error(w, "Transactions can only be created in pending status", http.StatusConflict)
+		return
 	}
+	req.Status = string(models.TransactionPending)
 
 	query := `
-		INSERT INTO transactions (buyer_id, seller_id, amount, transaction_status, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, NOW(), NOW())
-		RETURNING transaction_id, buyer_id, seller_id, amount, transaction_status, created_at, updated_at
+		INSERT INTO transactions (buyer_id, seller_id, amount, currency, transaction_status, escrow_status, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, 'pending', NOW(), NOW())
+		RETURNING transaction_id, buyer_id, seller_id, amount, currency, transaction_status, escrow_status, created_at, updated_at
 	`
-	var transaction models.Transaction
-	err := db.DB.QueryRowx(query, claims.UserID, req.SellerID, req.Amount, req.Status).StructScan(&transaction)
+	tx, err := db.DB.Beginx()
 	if err != nil {
-		log.Printf("[ERROR] Failed to create transaction: %v", err)
+		log.Printf("[ERROR] Failed to begin database transaction: %v", err)
 		http.Error(w, "Failed to create transaction", http.StatusInternalServerError)
 		return
 	}
+	defer tx.Rollback()
 
-	transactionJSON, err := json.Marshal(transaction)
+	var sellerRoles models.Roles
+	err = tx.Get(&sellerRoles, "SELECT roles FROM users WHERE user_id = $1", req.SellerID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !sellerRoles.Has(models.RoleSeller) && !sellerRoles.Has(models.RoleAdmin)) {
+		http.Error(w, "Seller ID does not belong to a seller", http.StatusBadRequest)
+		return
+	}
 	if err != nil {
-		log.Printf("[ERROR] Failed to marshal transaction to JSON: %v", err)
-		transactionJSON = []byte("{}")
+		log.Printf("[ERROR] Failed to look up seller %s: %v", req.SellerID, err)
+		http.Error(w, "Failed to create transaction", http.StatusInternalServerError)
+		return
 	}
 
-	logQuery := `
-		INSERT INTO transaction_logs (transaction_id, event_type, event_details, created_at)
-		VALUES ($1, 'TransactionCreated', $2, NOW())
-	`
-	eventDetails := fmt.Sprintf("Transaction created by buyer: %s", string(transactionJSON))
-	_, err = db.DB.Exec(logQuery, transaction.TransactionID, eventDetails)
+	var transaction models.Transaction
+	err = tx.QueryRowx(query, claims.UserID, req.SellerID, amount, amount.Currency, req.Status).StructScan(&transaction)
+	if err == nil {
+		err = transaction.AttachCurrency()
+	}
 	if err != nil {
-		log.Printf("[ERROR] Failed to insert log for transaction ID %d: %v", transaction.TransactionID, err)
+		log.Printf("[ERROR] Failed to create transaction: %v", err)
+		http.Error(w, "Failed to create transaction", http.StatusInternalServerError)
+		return
+	}
+
+	if len(milestones) > 0 {
+		err = escrow.CreateMilestones(tx, &transaction, milestones)
+		if errors.Is(err, models.ErrInvalidAmount) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if err == nil {
+		eventDetails := fmt.Sprintf("Transaction created by buyer: %s", transactionDetails(&transaction))
+		err = logs.Record(tx, transaction.TransactionID, "TransactionCreated", eventDetails)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to create transaction: %v", err)
+		http.Error(w, "Failed to create transaction", http.StatusInternalServerError)
+		return
 	}
 
 	w.WriteHeader(http.StatusCreated)
@@ -78,7 +152,7 @@ func CreateTransactionHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func GetTransactionsHandler(w http.ResponseWriter, r *http.Request) {
-	claims, ok := r.Context().Value("user").(*middleware.Claims)
+	claims, ok := middleware.ClaimsFromContext(r.Context())
 	if !ok {
 		log.Printf("[ERROR] Unauthorized access attempt - missing or invalid claims")
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
@@ -87,12 +161,15 @@ func GetTransactionsHandler(w http.ResponseWriter, r *http.Request) {
 
 	var transactions []models.Transaction
 	query := `
-		SELECT transaction_id, buyer_id, seller_id, amount, transaction_status, created_at, updated_at
+		SELECT transaction_id, buyer_id, seller_id, amount, currency, transaction_status, escrow_status, dispute_id, payment_id, created_at, updated_at
 		FROM transactions
 		WHERE buyer_id = $1 OR seller_id = $1
 		ORDER BY created_at DESC
 	`
 	err := db.DB.Select(&transactions, query, claims.UserID)
+	for i := 0; err == nil && i < len(transactions); i++ {
+		err = transactions[i].AttachCurrency()
+	}
 	if err != nil {
 		log.Printf("[ERROR] Failed to fetch transactions for userID %d: %v", claims.UserID, err)
 		http.Error(w, "Failed to fetch transactions", http.StatusInternalServerError)
@@ -108,7 +185,7 @@ func GetTransactionsHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func GetTransactionHandler(w http.ResponseWriter, r *http.Request) {
-	claims, ok := r.Context().Value("user").(*middleware.Claims)
+	claims, ok := middleware.ClaimsFromContext(r.Context())
 	if !ok {
 		log.Printf("[ERROR] Unauthorized access attempt - missing or invalid claims")
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
@@ -116,7 +193,7 @@ func GetTransactionHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	vars := mux.Vars(r)
-	transactionID, err := strconv.Atoi(vars["id"])
+	transactionID, err := uuid.Parse(vars["id"])
 	if err != nil {
 		http.Error(w, "Invalid transaction ID", http.StatusBadRequest)
 		return
@@ -124,11 +201,14 @@ func GetTransactionHandler(w http.ResponseWriter, r *http.Request) {
 
 	var transaction models.Transaction
 	query := `
-		SELECT transaction_id, buyer_id, seller_id, amount, transaction_status, created_at, updated_at
+		SELECT transaction_id, buyer_id, seller_id, amount, currency, transaction_status, escrow_status, dispute_id, payment_id, created_at, updated_at
 		FROM transactions
 		WHERE transaction_id = $1
 	`
 	err = db.DB.Get(&transaction, query, transactionID)
+	if err == nil {
+		err = transaction.AttachCurrency()
+	}
 	if err != nil {
 		log.Printf("[ERROR] Transaction not found with ID %d: %v", transactionID, err)
 		http.Error(w, "Transaction not found", http.StatusNotFound)
@@ -150,143 +230,135 @@ func GetTransactionHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func FulfillTransactionHandler(w http.ResponseWriter, r *http.Request) {
-	claims, ok := r.Context().Value("user").(*middleware.Claims)
-	if !ok || claims.Role != "seller" {
-		log.Printf("[ERROR] Unauthorized access attempt - invalid role or missing claims")
+	claims, ok := middleware.ClaimsFromContext(r.Context())
+	if !ok {
+		log.Printf("[ERROR] Unauthorized access attempt - missing or invalid claims")
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
 	vars := mux.Vars(r)
-	transactionID, err := strconv.Atoi(vars["id"])
+	transactionID, err := uuid.Parse(vars["id"])
 	if err != nil {
 		http.Error(w, "Invalid transaction ID", http.StatusBadRequest)
 		return
 	}
 
-	var transaction models.Transaction
-	query := `
-		SELECT transaction_id, buyer_id, seller_id, transaction_status
-		FROM transactions
-		WHERE transaction_id = $1
-	`
-	err = db.DB.Get(&transaction, query, transactionID)
+	tx, err := db.DB.Beginx()
 	if err != nil {
-		log.Printf("[ERROR] Transaction not found with ID %d: %v", transactionID, err)
-		http.Error(w, "Transaction not found", http.StatusNotFound)
+		log.Printf("[ERROR] Failed to begin database transaction: %v", err)
+		http.Error(w, "Failed to update transaction", http.StatusInternalServerError)
 		return
 	}
+	defer tx.Rollback()
 
-	if transaction.SellerID != claims.UserID {
-		log.Printf("[ERROR] Unauthorized access to transaction by userID %d", claims.UserID)
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	transaction, err := escrow.LockTransaction(tx, transactionID)
+	if err != nil {
+		log.Printf("[ERROR] Transaction not found with ID %s: %v", transactionID, err)
+		http.Error(w, "Transaction not found", http.StatusNotFound)
 		return
 	}
 
-	if transaction.Status != "pending" {
-		http.Error(w, "Transaction cannot be fulfilled in its current status", http.StatusBadRequest)
+	actor := middleware.ActorFor(claims, transaction, middleware.PermTransactionFulfill)
+	if actor != models.ActorSeller {
+		log.Printf("[ERROR] Unauthorized access to transaction by userID %s", claims.UserID)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	updateQuery := `
-		UPDATE transactions
-		SET transaction_status = 'deposited', updated_at = NOW()
-		WHERE transaction_id = $1
-	`
-	_, err = db.DB.Exec(updateQuery, transactionID)
-	if err != nil {
-		log.Printf("[ERROR] Failed to update transaction status for ID %d: %v", transactionID, err)
-		http.Error(w, "Failed to update transaction", http.StatusInternalServerError)
+	err = escrow.Apply(r.Context(), tx, transaction, models.EventFulfill, actor)
+	if errors.Is(err, models.ErrIllegalTransition) {
+		http.Error(w, err.Error(), http.StatusConflict)
 		return
 	}
-
-	transactionJSON, err := json.Marshal(transaction)
-	if err != nil {
-		log.Printf("[ERROR] Failed to marshal transaction to JSON: %v", err)
-		transactionJSON = []byte("{}")
+	if err == nil {
+		eventDetails := fmt.Sprintf("Transaction fulfilled by seller: %s", transactionDetails(transaction))
+		err = logs.Record(tx, transactionID, "TransactionFulfilled", eventDetails)
+	}
+	if err == nil {
+		err = tx.Commit()
 	}
-
-	logQuery := `
-		INSERT INTO transaction_logs (transaction_id, event_type, event_details, created_at)
-		VALUES ($1, 'TransactionFulfilled', $2, NOW())
-	`
-	eventDetails := fmt.Sprintf("Transaction fulfilled by seller: %s", string(transactionJSON))
-	_, err = db.DB.Exec(logQuery, transactionID, eventDetails)
 	if err != nil {
-		log.Printf("[ERROR] Failed to insert log for transaction ID %d: %v", transactionID, err)
+		log.Printf("[ERROR] Failed to update transaction status for ID %s: %v", transactionID, err)
+		http.Error(w, "Failed to update transaction", http.StatusInternalServerError)
+		return
 	}
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{"message": "Transaction marked as fulfilled"})
 }
 
+// ConfirmDeliveryHandler records the buyer's acceptance of the delivery, which
+// completes the transaction and releases the escrow to the seller.
 func ConfirmDeliveryHandler(w http.ResponseWriter, r *http.Request) {
-	claims, ok := r.Context().Value("user").(*middleware.Claims)
-	if !ok || claims.Role != "buyer" {
-		log.Printf("[ERROR] Unauthorized access attempt - missing claims or incorrect role")
+	claims, ok := middleware.ClaimsFromContext(r.Context())
+	if !ok {
+		log.Printf("[ERROR] Unauthorized access attempt - missing or invalid claims")
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
 	vars := mux.Vars(r)
-	transactionID, err := strconv.Atoi(vars["id"])
+	transactionID, err := uuid.Parse(vars["id"])
 	if err != nil {
 		http.Error(w, "Invalid transaction ID", http.StatusBadRequest)
 		return
 	}
 
-	var transaction models.Transaction
-	query := `
-		SELECT transaction_id, buyer_id, seller_id, transaction_status
-		FROM transactions
-		WHERE transaction_id = $1
-	`
-	err = db.DB.Get(&transaction, query, transactionID)
+	tx, err := db.DB.Beginx()
 	if err != nil {
-		log.Printf("[ERROR] Transaction not found with ID %d: %v", transactionID, err)
+		log.Printf("[ERROR] Failed to begin database transaction: %v", err)
+		http.Error(w, "Failed to update transaction", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	transaction, err := escrow.LockTransaction(tx, transactionID)
+	if err != nil {
+		log.Printf("[ERROR] Transaction not found with ID %s: %v", transactionID, err)
 		http.Error(w, "Transaction not found", http.StatusNotFound)
 		return
 	}
 
-	if transaction.BuyerID != claims.UserID {
-		log.Printf("[ERROR] Unauthorized access to transaction by userID %d", claims.UserID)
+	actor := middleware.ActorFor(claims, transaction, middleware.PermTransactionConfirm)
+	if actor != models.ActorBuyer {
+		log.Printf("[ERROR] Unauthorized access to transaction by userID %s", claims.UserID)
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
-
-	if transaction.Status != "deposited" {
-		http.Error(w, "Transaction cannot be confirmed in its current status", http.StatusBadRequest)
+	if !escrow.StepUp(w, r, tx, claims, transaction) {
 		return
 	}
 
-	updateQuery := `
-		UPDATE transactions
-		SET transaction_status = 'completed', updated_at = NOW()
-		WHERE transaction_id = $1
-	`
-	_, err = db.DB.Exec(updateQuery, transactionID)
+	details := fmt.Sprintf("Escrow released to seller on delivery confirmation by %s", claims.Username)
+	err = escrow.ReleaseEscrow(r.Context(), tx, transaction, models.EventConfirm, actor, details)
+	if errors.Is(err, models.ErrIllegalTransition) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err == nil {
+		eventDetails := fmt.Sprintf("Transaction confirmed by buyer: %s", transactionDetails(transaction))
+		err = logs.Record(tx, transactionID, "TransactionConfirmed", eventDetails)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
 	if err != nil {
-		log.Printf("[ERROR] Failed to update transaction status for ID %d: %v", transactionID, err)
+		log.Printf("[ERROR] Failed to update transaction status for ID %s: %v", transactionID, err)
 		http.Error(w, "Failed to update transaction", http.StatusInternalServerError)
 		return
 	}
 
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Transaction confirmed by buyer"})
+}
+
+// transactionDetails renders a transaction for the audit log.
+func transactionDetails(transaction *models.Transaction) string {
 	transactionJSON, err := json.Marshal(transaction)
 	if err != nil {
 		log.Printf("[ERROR] Failed to marshal transaction to JSON: %v", err)
-		transactionJSON = []byte("{}")
+		return "{}"
 	}
-
-	logQuery := `
-		INSERT INTO transaction_logs (transaction_id, event_type, event_details, created_at)
-		VALUES ($1, 'TransactionConfirmed', $2, NOW())
-	`
-	eventDetails := fmt.Sprintf("Transaction confirmed by buyer: %s", string(transactionJSON))
-	_, err = db.DB.Exec(logQuery, transactionID, eventDetails)
-	if err != nil {
-		log.Printf("[ERROR] Failed to insert log for transaction ID %d: %v", transactionID, err)
-	}
-
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"message": "Transaction confirmed by buyer"})
+	return string(transactionJSON)
 }
@@ -0,0 +1,84 @@
+package transactions_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"escrow-agent/internal/db"
+	"escrow-agent/internal/mfa"
+	"escrow-agent/internal/middleware"
+	"escrow-agent/internal/transactions"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+)
+
+func transactionRows(transactionID, buyerID, sellerID uuid.UUID, status, escrowStatus string) *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"transaction_id", "buyer_id", "seller_id", "amount", "transaction_status", "escrow_status"}).
+		AddRow(transactionID, buyerID, sellerID, 50.00, status, escrowStatus)
+}
+
+func newRequest(t *testing.T, path string, vars map[string]string, claims *middleware.Claims) *http.Request {
+	req, err := http.NewRequest("PUT", path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = mux.SetURLVars(req, vars)
+	return req.WithContext(middleware.WithClaims(req.Context(), claims))
+}
+
+// expectStepUpRefused sets a step-up threshold below the transaction amount
+// and expects the buyer's request to stop after the transaction is locked.
+func expectStepUpRefused(t *testing.T, transactionID, buyerID uuid.UUID) sqlmock.Sqlmock {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	t.Cleanup(func() { mockDB.Close() })
+	db.DB = sqlx.NewDb(mockDB, "sqlmock")
+
+	if err := mfa.SetConfig(mfa.Config{StepUpThreshold: "10"}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mfa.SetConfig(mfa.DefaultConfig) })
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM transactions (.+) FOR UPDATE").
+		WithArgs(transactionID).
+		WillReturnRows(transactionRows(transactionID, buyerID, uuid.New(), "in_progress", "funded"))
+	mock.ExpectRollback()
+	return mock
+}
+
+func TestConfirmDeliveryHandler_StepUpAboveThreshold(t *testing.T) {
+	buyerID, transactionID := uuid.New(), uuid.New()
+	mock := expectStepUpRefused(t, transactionID, buyerID)
+
+	claims := &middleware.Claims{UserID: buyerID, Username: "cathy", Roles: []string{"buyer"}}
+	req := newRequest(t, "/transactions/"+transactionID.String()+"/confirm", map[string]string{"id": transactionID.String()}, claims)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(transactions.ConfirmDeliveryHandler).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Contains(t, rr.Body.String(), mfa.CodeHeader)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestApproveMilestoneHandler_StepUpAboveThreshold(t *testing.T) {
+	buyerID, transactionID, milestoneID := uuid.New(), uuid.New(), uuid.New()
+	mock := expectStepUpRefused(t, transactionID, buyerID)
+
+	claims := &middleware.Claims{UserID: buyerID, Username: "cathy", Roles: []string{"buyer"}}
+	vars := map[string]string{"id": transactionID.String(), "milestone_id": milestoneID.String()}
+	req := newRequest(t, "/transactions/"+transactionID.String()+"/milestones/"+milestoneID.String()+"/approve", vars, claims)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(transactions.ApproveMilestoneHandler).ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Contains(t, rr.Body.String(), mfa.CodeHeader)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
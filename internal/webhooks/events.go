@@ -0,0 +1,136 @@
+package webhooks
+
+import (
+	"context"
+	"errors"
+	"escrow-agent/internal/db"
+	"escrow-agent/internal/escrow"
+	"escrow-agent/internal/logs"
+	"escrow-agent/internal/payments"
+	"escrow-agent/pkg/models"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+var (
+	ErrAlreadyProcessed = errors.New("webhook event already processed")
+	ErrAmountMismatch   = errors.New("webhook amount does not match the payment")
+)
+
+const webhookEventColumns = `event_id, provider, provider_event_id, event_type, gateway_reference, amount, currency, reason, attempts, last_error, received_at, processed_at`
+
+// Store records a verified event from provider and returns its event_id. A
+// redelivery of an event already stored returns the existing event_id and
+// leaves the row as it was.
+func Store(q sqlx.Queryer, provider string, e Event, payload []byte, now time.Time) (uuid.UUID, error) {
+	var eventID uuid.UUID
+	err := sqlx.Get(q, &eventID, `
+		INSERT INTO webhook_events (provider, provider_event_id, event_type, gateway_reference, amount, currency, reason, payload, received_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (provider, provider_event_id) DO UPDATE SET provider_event_id = EXCLUDED.provider_event_id
+		RETURNING event_id
+	`, provider, e.ID, e.Type, e.Reference, e.Amount, e.Amount.Currency, e.Reason, string(payload), now)
+	return eventID, err
+}
+
+// Process applies a stored event to its payment and marks it processed, all
+// in one database transaction. An event processed before gives
+// ErrAlreadyProcessed. When applying fails the error is recorded on the event
+// so it can be looked into and replayed.
+func Process(ctx context.Context, eventID uuid.UUID) error {
+	err := process(ctx, eventID)
+	if err == nil || errors.Is(err, ErrAlreadyProcessed) {
+		return err
+	}
+	_, recordErr := db.DB.Exec("UPDATE webhook_events SET attempts = attempts + 1, last_error = $1 WHERE event_id = $2", err.Error(), eventID)
+	if recordErr != nil {
+		return fmt.Errorf("%w (recording the failure: %v)", err, recordErr)
+	}
+	return err
+}
+
+func process(ctx context.Context, eventID uuid.UUID) error {
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var event models.WebhookEvent
+	err = tx.Get(&event, "SELECT "+webhookEventColumns+" FROM webhook_events WHERE event_id = $1 FOR UPDATE", eventID)
+	if err == nil {
+		err = event.AttachCurrency()
+	}
+	if err != nil {
+		return err
+	}
+	if event.ProcessedAt != nil {
+		return ErrAlreadyProcessed
+	}
+
+	err = apply(ctx, tx, &event)
+	if err == nil {
+		_, err = tx.Exec("UPDATE webhook_events SET attempts = attempts + 1, last_error = NULL, processed_at = NOW() WHERE event_id = $1", eventID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	return err
+}
+
+// apply moves the payment the event refers to, and its escrow, to where the
+// gateway says it is. Events that find the payment already there change
+// nothing, so the order in which a gateway delivers them does not matter.
+func apply(ctx context.Context, tx *sqlx.Tx, event *models.WebhookEvent) error {
+	switch event.EventType {
+	case EventCaptureSucceeded, EventCaptureFailed, EventRefundSucceeded, EventRefundFailed:
+	default:
+		return nil
+	}
+
+	// lock the transaction before the payment, in the order deposits and
+	// the scheduler take them, so the two cannot deadlock
+	transactionID, err := payments.TransactionByReference(tx, event.GatewayReference)
+	if err != nil {
+		return err
+	}
+	transaction, err := escrow.LockTransaction(tx, transactionID)
+	if err != nil {
+		return err
+	}
+	payment, err := payments.LockByReference(tx, event.GatewayReference)
+	if err != nil {
+		return err
+	}
+	pending := payment.Status == payments.StatusPending.PaymentStatus()
+
+	switch event.EventType {
+	case EventCaptureSucceeded:
+		if !pending {
+			return nil
+		}
+		if !event.Amount.Equal(payment.Amount) {
+			return fmt.Errorf("%w: captured %s %s, expected %s %s", ErrAmountMismatch, event.Amount, event.Amount.Currency, payment.Amount, payment.Amount.Currency)
+		}
+		return escrow.ConfirmDeposit(ctx, tx, transaction, payment)
+	case EventCaptureFailed:
+		if !pending {
+			return nil
+		}
+		return escrow.FailDeposit(ctx, tx, transaction, payment, event.Reason)
+	case EventRefundSucceeded:
+		if payment.Status == payments.StatusRefunded.PaymentStatus() {
+			details := fmt.Sprintf("Gateway confirmed the refund of %s %s (payment %s)", event.Amount, event.Amount.Currency, payment.PaymentID)
+			return logs.Record(tx, payment.TransactionID, "RefundConfirmed", details)
+		}
+		// a refund made at the gateway directly; left for an admin to settle
+		details := fmt.Sprintf("Gateway refunded %s %s of payment %s, which is %s here", event.Amount, event.Amount.Currency, payment.PaymentID, payment.Status)
+		return logs.Record(tx, payment.TransactionID, "RefundUnmatched", details)
+	default:
+		details := fmt.Sprintf("Gateway failed the refund of %s %s (payment %s): %s", event.Amount, event.Amount.Currency, payment.PaymentID, event.Reason)
+		return logs.Record(tx, payment.TransactionID, "RefundFailed", details)
+	}
+}
@@ -0,0 +1,154 @@
+package webhooks
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"escrow-agent/internal/db"
+	"escrow-agent/pkg/models"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// maxBodyBytes bounds a callback body; gateway events are small.
+	maxBodyBytes = 64 << 10
+	// eventsLimit caps how many events one listing returns.
+	eventsLimit = 500
+)
+
+// PaymentWebhookHandler receives a callback from the gateway named in the
+// path. It sits outside the JWT middleware: the provider's signature is what
+// authenticates the request. The event is stored, then applied; a 2xx tells
+// the gateway to stop redelivering it, so anything else is an error it
+// retries.
+func PaymentWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["provider"]
+	provider, err := Lookup(name)
+	if err != nil {
+		http.Error(w, "Unknown payment provider", http.StatusNotFound)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBodyBytes+1))
+	if err != nil || len(body) > maxBodyBytes {
+		http.Error(w, "Invalid webhook payload", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	event, err := provider.Parse(r.Header, body, now)
+	if errors.Is(err, ErrInvalidSignature) {
+		log.Printf("[WARN] Rejected %s webhook with an invalid signature from %s", name, r.RemoteAddr)
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to parse %s webhook: %v", name, err)
+		http.Error(w, "Invalid webhook payload", http.StatusBadRequest)
+		return
+	}
+
+	eventID, err := Store(db.DB, name, event, body, now)
+	if err != nil {
+		log.Printf("[ERROR] Failed to store %s webhook %s: %v", name, event.ID, err)
+		http.Error(w, "Failed to process webhook", http.StatusInternalServerError)
+		return
+	}
+
+	status := "processed"
+	err = Process(r.Context(), eventID)
+	if errors.Is(err, ErrAlreadyProcessed) {
+		status = "duplicate"
+	} else if err != nil {
+		log.Printf("[ERROR] Failed to process %s webhook %s: %v", name, event.ID, err)
+		http.Error(w, "Failed to process webhook", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"event_id": eventID,
+		"status":   status,
+	})
+}
+
+// GetWebhookEventsHandler lists received payment webhooks, newest first,
+// optionally only the ones not yet processed (?unprocessed=true) or those for
+// one gateway reference (?reference=). Admin only.
+func GetWebhookEventsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	unprocessed := query.Get("unprocessed") == "true"
+	limit := eventsLimit
+	if raw := query.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 || n > eventsLimit {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	events := []models.WebhookEvent{}
+	err := db.DB.Select(&events, `
+		SELECT `+webhookEventColumns+`
+		FROM webhook_events
+		WHERE (NOT $1 OR processed_at IS NULL)
+		  AND ($2 = '' OR gateway_reference = $2)
+		ORDER BY received_at DESC
+		LIMIT $3
+	`, unprocessed, query.Get("reference"), limit)
+	for i := range events {
+		if err == nil {
+			err = events[i].AttachCurrency()
+		}
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to fetch webhook events: %v", err)
+		http.Error(w, "Failed to fetch webhook events", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(events)
+}
+
+// ReplayWebhookEventHandler applies a stored event that failed to process,
+// e.g. once the payment it refers to exists. Admin only.
+func ReplayWebhookEventHandler(w http.ResponseWriter, r *http.Request) {
+	eventID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid webhook event ID", http.StatusBadRequest)
+		return
+	}
+
+	err = Process(r.Context(), eventID)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Webhook event not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, ErrAlreadyProcessed) {
+		http.Error(w, "Webhook event already processed", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to replay webhook event %s: %v", eventID, err)
+		http.Error(w, "Failed to process webhook: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"event_id": eventID,
+		"status":   "processed",
+	})
+}
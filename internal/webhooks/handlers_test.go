@@ -0,0 +1,265 @@
+package webhooks_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"escrow-agent/internal/db"
+	"escrow-agent/internal/payments"
+	"escrow-agent/internal/webhooks"
+	"escrow-agent/pkg/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+)
+
+var testProvider = webhooks.NewHMACProvider("whsec_test")
+
+func init() {
+	webhooks.Register("mock", testProvider)
+}
+
+func newWebhookRequest(provider, body string) *http.Request {
+	req := httptest.NewRequest("POST", "/webhooks/payments/"+provider, strings.NewReader(body))
+	req.Header.Set(webhooks.SignatureHeader, testProvider.Sign([]byte(body), time.Now()))
+	return mux.SetURLVars(req, map[string]string{"provider": provider})
+}
+
+var webhookEventColumns = []string{"event_id", "provider", "provider_event_id", "event_type", "gateway_reference", "amount", "currency", "reason", "attempts", "last_error", "received_at", "processed_at"}
+
+var paymentColumns = []string{"payment_id", "transaction_id", "amount", "currency", "method", "payment_status", "gateway_reference", "encrypted_details", "processed_at", "created_at"}
+
+func TestPaymentWebhookHandler_InvalidSignature(t *testing.T) {
+	req := newWebhookRequest("mock", `{"id":"evt_1"}`)
+	req.Header.Set(webhooks.SignatureHeader, "t=1,v1=00")
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(webhooks.PaymentWebhookHandler).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(webhooks.PaymentWebhookHandler).ServeHTTP(rr, newWebhookRequest("unknown", `{}`))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestPaymentWebhookHandler_Duplicate(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+
+	db.DB = sqlx.NewDb(mockDB, "sqlmock")
+
+	eventID := uuid.New()
+	body := `{"id":"evt_1","type":"capture.succeeded","reference":"mock_1","amount":"50.00","currency":"USD"}`
+
+	mock.ExpectQuery("INSERT INTO webhook_events").
+		WithArgs("mock", "evt_1", "capture.succeeded", "mock_1", "50.00", "USD", "", body, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"event_id"}).AddRow(eventID))
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM webhook_events WHERE event_id = \\$1 FOR UPDATE").
+		WithArgs(eventID).
+		WillReturnRows(sqlmock.NewRows(webhookEventColumns).
+			AddRow(eventID, "mock", "evt_1", "capture.succeeded", "mock_1", "50.00", "USD", "", 1, nil, time.Now(), time.Now()))
+	mock.ExpectRollback()
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(webhooks.PaymentWebhookHandler).ServeHTTP(rr, newWebhookRequest("mock", body))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"status":"duplicate"`)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPaymentWebhookHandler_CaptureConfirmsDeposit(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+
+	db.DB = sqlx.NewDb(mockDB, "sqlmock")
+
+	eventID, paymentID, transactionID := uuid.New(), uuid.New(), uuid.New()
+	buyerID, sellerID := uuid.New(), uuid.New()
+	body := `{"id":"evt_1","type":"capture.succeeded","reference":"mock_1","amount":"50.00","currency":"USD"}`
+
+	mock.ExpectQuery("INSERT INTO webhook_events").
+		WillReturnRows(sqlmock.NewRows([]string{"event_id"}).AddRow(eventID))
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM webhook_events WHERE event_id = \\$1 FOR UPDATE").
+		WithArgs(eventID).
+		WillReturnRows(sqlmock.NewRows(webhookEventColumns).
+			AddRow(eventID, "mock", "evt_1", "capture.succeeded", "mock_1", "50.00", "USD", "", 0, nil, time.Now(), nil))
+	mock.ExpectQuery("SELECT transaction_id FROM payments WHERE gateway_reference = \\$1").
+		WithArgs("mock_1").
+		WillReturnRows(sqlmock.NewRows([]string{"transaction_id"}).AddRow(transactionID))
+	mock.ExpectQuery("SELECT (.+) FROM transactions (.+) FOR UPDATE").
+		WithArgs(transactionID).
+		WillReturnRows(sqlmock.NewRows([]string{"transaction_id", "buyer_id", "seller_id", "amount", "transaction_status", "escrow_status"}).
+			AddRow(transactionID, buyerID, sellerID, 50.00, "pending", "pending"))
+	mock.ExpectQuery("SELECT (.+) FROM payments WHERE gateway_reference = \\$1 (.+) FOR UPDATE").
+		WithArgs("mock_1").
+		WillReturnRows(sqlmock.NewRows(paymentColumns).
+			AddRow(paymentID, transactionID, "50.00", "USD", "credit_card", "pending", "mock_1", []byte("{}"), nil, time.Now()))
+	mock.ExpectQuery("SELECT EXISTS").
+		WithArgs(transactionID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectExec("UPDATE escrow_accounts SET escrow_status = \\$1 WHERE").
+		WithArgs("funded", transactionID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE transactions").
+		WithArgs("deposited", "funded", transactionID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE escrow_accounts SET funded_at = NOW\\(\\), expiry_date = \\$1").
+		WithArgs(sqlmock.AnyArg(), transactionID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("INSERT INTO ledger_entries").
+		WithArgs(transactionID, "deposit", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"entry_id"}).AddRow(uuid.New()))
+	for i := 0; i < 2; i++ {
+		mock.ExpectQuery("INSERT INTO ledger_accounts").
+			WillReturnRows(sqlmock.NewRows([]string{"account_id"}).AddRow(uuid.New()))
+		mock.ExpectExec("INSERT INTO ledger_postings").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectExec("UPDATE payments SET payment_status").
+		WithArgs("completed", paymentID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO transaction_logs").
+		WithArgs(transactionID, "EscrowDeposited", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE webhook_events SET (.+) processed_at = NOW\\(\\)").
+		WithArgs(eventID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(webhooks.PaymentWebhookHandler).ServeHTTP(rr, newWebhookRequest("mock", body))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"status":"processed"`)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPaymentWebhookHandler_CaptureAfterCancelIsRefunded(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+
+	db.DB = sqlx.NewDb(mockDB, "sqlmock")
+
+	eventID, paymentID, transactionID := uuid.New(), uuid.New(), uuid.New()
+
+	// the gateway took the charge after the buyer had already cancelled
+	gateway := payments.NewAsyncMockGateway()
+	payments.Register("credit_card", gateway)
+	ctx := context.Background()
+	charge, err := gateway.Authorize(ctx, payments.ChargeRequest{TransactionID: transactionID, Amount: models.MustParseMoney("50", "USD"), Token: "tok_visa"})
+	assert.NoError(t, err)
+	_, err = gateway.Capture(ctx, charge.Reference)
+	assert.NoError(t, err)
+	_, err = gateway.Settle(charge.Reference, true)
+	assert.NoError(t, err)
+
+	body := `{"id":"evt_1","type":"capture.succeeded","reference":"` + charge.Reference + `","amount":"50.00","currency":"USD"}`
+
+	mock.ExpectQuery("INSERT INTO webhook_events").
+		WillReturnRows(sqlmock.NewRows([]string{"event_id"}).AddRow(eventID))
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM webhook_events WHERE event_id = \\$1 FOR UPDATE").
+		WithArgs(eventID).
+		WillReturnRows(sqlmock.NewRows(webhookEventColumns).
+			AddRow(eventID, "mock", "evt_1", "capture.succeeded", charge.Reference, "50.00", "USD", "", 0, nil, time.Now(), nil))
+	mock.ExpectQuery("SELECT transaction_id FROM payments WHERE gateway_reference = \\$1").
+		WithArgs(charge.Reference).
+		WillReturnRows(sqlmock.NewRows([]string{"transaction_id"}).AddRow(transactionID))
+	mock.ExpectQuery("SELECT (.+) FROM transactions (.+) FOR UPDATE").
+		WithArgs(transactionID).
+		WillReturnRows(sqlmock.NewRows([]string{"transaction_id", "buyer_id", "seller_id", "amount", "transaction_status", "escrow_status"}).
+			AddRow(transactionID, uuid.New(), uuid.New(), 50.00, "cancelled", "pending"))
+	mock.ExpectQuery("SELECT (.+) FROM payments WHERE gateway_reference = \\$1 (.+) FOR UPDATE").
+		WithArgs(charge.Reference).
+		WillReturnRows(sqlmock.NewRows(paymentColumns).
+			AddRow(paymentID, transactionID, "50.00", "USD", "credit_card", "pending", charge.Reference, []byte("{}"), nil, time.Now()))
+	mock.ExpectQuery("SELECT EXISTS").
+		WithArgs(transactionID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectExec("UPDATE payments SET payment_status").
+		WithArgs("refunded", paymentID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM escrow_accounts WHERE payment_id = \\$1 AND escrow_status = 'pending'").
+		WithArgs(paymentID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE transactions SET payment_id = NULL").
+		WithArgs(transactionID, paymentID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO transaction_logs").
+		WithArgs(transactionID, "DepositReversed", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE webhook_events SET (.+) processed_at = NOW\\(\\)").
+		WithArgs(eventID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(webhooks.PaymentWebhookHandler).ServeHTTP(rr, newWebhookRequest("mock", body))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	status, err := gateway.Status(ctx, charge.Reference)
+	assert.NoError(t, err)
+	assert.Equal(t, payments.StatusRefunded, status.Status)
+}
+
+func TestPaymentWebhookHandler_AmountMismatchIsRecorded(t *testing.T) {
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to open mock DB: %v", err)
+	}
+	defer mockDB.Close()
+
+	db.DB = sqlx.NewDb(mockDB, "sqlmock")
+
+	eventID, paymentID, transactionID := uuid.New(), uuid.New(), uuid.New()
+	body := `{"id":"evt_1","type":"capture.succeeded","reference":"mock_1","amount":"5.00","currency":"USD"}`
+
+	mock.ExpectQuery("INSERT INTO webhook_events").
+		WillReturnRows(sqlmock.NewRows([]string{"event_id"}).AddRow(eventID))
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM webhook_events WHERE event_id = \\$1 FOR UPDATE").
+		WithArgs(eventID).
+		WillReturnRows(sqlmock.NewRows(webhookEventColumns).
+			AddRow(eventID, "mock", "evt_1", "capture.succeeded", "mock_1", "5.00", "USD", "", 0, nil, time.Now(), nil))
+	mock.ExpectQuery("SELECT transaction_id FROM payments WHERE gateway_reference = \\$1").
+		WithArgs("mock_1").
+		WillReturnRows(sqlmock.NewRows([]string{"transaction_id"}).AddRow(transactionID))
+	mock.ExpectQuery("SELECT (.+) FROM transactions (.+) FOR UPDATE").
+		WithArgs(transactionID).
+		WillReturnRows(sqlmock.NewRows([]string{"transaction_id", "buyer_id", "seller_id", "amount", "transaction_status", "escrow_status"}).
+			AddRow(transactionID, uuid.New(), uuid.New(), 50.00, "pending", "pending"))
+	mock.ExpectQuery("SELECT (.+) FROM payments WHERE gateway_reference = \\$1 (.+) FOR UPDATE").
+		WithArgs("mock_1").
+		WillReturnRows(sqlmock.NewRows(paymentColumns).
+			AddRow(paymentID, transactionID, "50.00", "USD", "credit_card", "pending", "mock_1", []byte("{}"), nil, time.Now()))
+	mock.ExpectRollback()
+	mock.ExpectExec("UPDATE webhook_events SET attempts = attempts \\+ 1, last_error = \\$1").
+		WithArgs(sqlmock.AnyArg(), eventID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(webhooks.PaymentWebhookHandler).ServeHTTP(rr, newWebhookRequest("mock", body))
+
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,190 @@
+// Package webhooks receives payment gateway callbacks. Gateways confirm
+// captures and refunds asynchronously and report the outcome to
+// /webhooks/payments/{provider}; each provider signs its requests and the
+// Provider registered under its name verifies and parses them.
+//
+// Every verified event is stored before it is acted on, keyed by the
+// provider's own event id, so a redelivered event is recognised and applied
+// only once, and an event that failed to apply can be replayed.
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"escrow-agent/pkg/models"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event types a gateway reports. Others are stored and otherwise ignored.
+const (
+	EventCaptureSucceeded = "capture.succeeded"
+	EventCaptureFailed    = "capture.failed"
+	EventRefundSucceeded  = "refund.succeeded"
+	EventRefundFailed     = "refund.failed"
+)
+
+// SignatureHeader carries an HMACProvider signature: the unix time the
+// request was signed at and the hex HMAC-SHA256 of "<time>.<body>", as in
+// "t=1700000000,v1=5257a869...".
+const SignatureHeader = "X-Webhook-Signature"
+
+// DefaultTolerance is how far a signature's time may be from ours.
+const DefaultTolerance = 5 * time.Minute
+
+var (
+	ErrUnknownProvider  = errors.New("unknown payment provider")
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+	ErrInvalidPayload   = errors.New("invalid webhook payload")
+)
+
+// Event is a gateway callback in provider-neutral form. Amount is what the
+// gateway captured, refunded or failed to.
+type Event struct {
+	ID        string
+	Type      string
+	Reference string
+	Amount    models.Money
+	Reason    string
+}
+
+// Provider verifies and parses the callbacks of one gateway. Parse returns
+// ErrInvalidSignature if the request was not signed by the gateway and
+// ErrInvalidPayload if the body cannot be understood.
+type Provider interface {
+	Parse(header http.Header, body []byte, now time.Time) (Event, error)
+}
+
+var (
+	mu        sync.RWMutex
+	providers = map[string]Provider{}
+)
+
+// Register makes a provider's callbacks accepted under name. Registering the
+// same name twice replaces the previous provider.
+func Register(name string, p Provider) {
+	mu.Lock()
+	defer mu.Unlock()
+	providers[name] = p
+}
+
+// Lookup returns the provider registered under name.
+func Lookup(name string) (Provider, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	p, ok := providers[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownProvider, name)
+	}
+	return p, nil
+}
+
+// ParseSecrets reads provider signing secrets in the form
+// "mock=whsec_1,acme=whsec_2".
+func ParseSecrets(spec string) (map[string]string, error) {
+	secrets := map[string]string{}
+	for _, pair := range strings.Split(spec, ",") {
+		name, secret, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || name == "" || secret == "" {
+			return nil, fmt.Errorf("invalid webhook secret %q", pair)
+		}
+		secrets[name] = secret
+	}
+	return secrets, nil
+}
+
+// HMACProvider accepts callbacks signed with a shared secret, see
+// SignatureHeader, whose body is a JSON object such as
+//
+//	{"id": "evt_1", "type": "capture.succeeded", "reference": "mock_..._1",
+//	 "amount": "100.00", "currency": "USD"}
+//
+// The mock gateway and most card processors fit this shape.
+type HMACProvider struct {
+	secret    []byte
+	tolerance time.Duration
+}
+
+func NewHMACProvider(secret string) *HMACProvider {
+	return &HMACProvider{secret: []byte(secret), tolerance: DefaultTolerance}
+}
+
+// Sign returns the SignatureHeader value for body signed at t. Gateway
+// simulators and tests use it to produce callbacks.
+func (p *HMACProvider) Sign(body []byte, t time.Time) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(p.mac(ts, body))
+}
+
+func (p *HMACProvider) Parse(header http.Header, body []byte, now time.Time) (Event, error) {
+	if err := p.verify(header.Get(SignatureHeader), body, now); err != nil {
+		return Event{}, err
+	}
+
+	var payload struct {
+		ID        string      `json:"id"`
+		Type      string      `json:"type"`
+		Reference string      `json:"reference"`
+		Amount    json.Number `json:"amount"`
+		Currency  string      `json:"currency"`
+		Reason    string      `json:"reason"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return Event{}, fmt.Errorf("%w: %v", ErrInvalidPayload, err)
+	}
+	if payload.ID == "" || payload.Type == "" || payload.Reference == "" {
+		return Event{}, fmt.Errorf("%w: id, type and reference are required", ErrInvalidPayload)
+	}
+	amount, err := models.ParseMoney(payload.Amount.String(), payload.Currency)
+	if err != nil || payload.Currency == "" {
+		return Event{}, fmt.Errorf("%w: invalid amount or currency", ErrInvalidPayload)
+	}
+
+	return Event{
+		ID:        payload.ID,
+		Type:      payload.Type,
+		Reference: payload.Reference,
+		Amount:    amount,
+		Reason:    payload.Reason,
+	}, nil
+}
+
+func (p *HMACProvider) verify(signature string, body []byte, now time.Time) error {
+	var ts, sig string
+	for _, part := range strings.Split(signature, ",") {
+		key, value, _ := strings.Cut(part, "=")
+		switch key {
+		case "t":
+			ts = value
+		case "v1":
+			sig = value
+		}
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if skew := now.Sub(time.Unix(unix, 0)); skew > p.tolerance || skew < -p.tolerance {
+		return ErrInvalidSignature
+	}
+	got, err := hex.DecodeString(sig)
+	if err != nil || !hmac.Equal(got, p.mac(ts, body)) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+func (p *HMACProvider) mac(ts string, body []byte) []byte {
+	h := hmac.New(sha256.New, p.secret)
+	h.Write([]byte(ts))
+	h.Write([]byte("."))
+	h.Write(body)
+	return h.Sum(nil)
+}
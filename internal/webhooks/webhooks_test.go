@@ -0,0 +1,79 @@
+package webhooks_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"escrow-agent/internal/webhooks"
+	"escrow-agent/pkg/models"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func signed(p *webhooks.HMACProvider, body string, at time.Time) http.Header {
+	header := http.Header{}
+	header.Set(webhooks.SignatureHeader, p.Sign([]byte(body), at))
+	return header
+}
+
+func TestHMACProvider_Parse(t *testing.T) {
+	p := webhooks.NewHMACProvider("whsec_test")
+	now := time.Now()
+	body := `{"id":"evt_1","type":"capture.succeeded","reference":"mock_1","amount":"100.50","currency":"EUR"}`
+
+	event, err := p.Parse(signed(p, body, now), []byte(body), now)
+	assert.NoError(t, err)
+	assert.Equal(t, "evt_1", event.ID)
+	assert.Equal(t, webhooks.EventCaptureSucceeded, event.Type)
+	assert.Equal(t, "mock_1", event.Reference)
+	assert.True(t, event.Amount.Equal(models.MustParseMoney("100.50", "EUR")))
+
+	// numeric amounts are read exactly too
+	numeric := `{"id":"evt_2","type":"capture.failed","reference":"mock_1","amount":100.5,"currency":"EUR","reason":"insufficient funds"}`
+	event, err = p.Parse(signed(p, numeric, now), []byte(numeric), now)
+	assert.NoError(t, err)
+	assert.Equal(t, "insufficient funds", event.Reason)
+	assert.True(t, event.Amount.Equal(models.MustParseMoney("100.50", "EUR")))
+}
+
+func TestHMACProvider_RejectsBadSignatures(t *testing.T) {
+	p := webhooks.NewHMACProvider("whsec_test")
+	now := time.Now()
+	body := `{"id":"evt_1","type":"capture.succeeded","reference":"mock_1","amount":"100.50","currency":"EUR"}`
+
+	cases := map[string]http.Header{
+		"missing":      {},
+		"wrong secret": signed(webhooks.NewHMACProvider("whsec_other"), body, now),
+		"stale":        signed(p, body, now.Add(-webhooks.DefaultTolerance-time.Second)),
+		"tampered":     signed(p, `{"id":"evt_1","amount":"1.00"}`, now),
+	}
+	for name, header := range cases {
+		_, err := p.Parse(header, []byte(body), now)
+		assert.ErrorIs(t, err, webhooks.ErrInvalidSignature, name)
+	}
+}
+
+func TestHMACProvider_RejectsBadPayloads(t *testing.T) {
+	p := webhooks.NewHMACProvider("whsec_test")
+	now := time.Now()
+
+	for _, body := range []string{
+		`not json`,
+		`{"type":"capture.succeeded","reference":"mock_1","amount":"1.00","currency":"USD"}`,
+		`{"id":"evt_1","type":"capture.succeeded","reference":"mock_1","amount":"1.00"}`,
+		`{"id":"evt_1","type":"capture.succeeded","reference":"mock_1","amount":"1.001","currency":"USD"}`,
+	} {
+		_, err := p.Parse(signed(p, body, now), []byte(body), now)
+		assert.ErrorIs(t, err, webhooks.ErrInvalidPayload, body)
+	}
+}
+
+func TestParseSecrets(t *testing.T) {
+	secrets, err := webhooks.ParseSecrets("mock=whsec_1, acme=whsec_2")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"mock": "whsec_1", "acme": "whsec_2"}, secrets)
+
+	_, err = webhooks.ParseSecrets("mock")
+	assert.Error(t, err)
+}
@@ -6,10 +6,24 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"time"
 
+	"escrow-agent/internal/crypto"
 	"escrow-agent/internal/db"
+	"escrow-agent/internal/escrow"
+	"escrow-agent/internal/fees"
+	"escrow-agent/internal/fx"
+	"escrow-agent/internal/lockout"
+	"escrow-agent/internal/mfa"
+	"escrow-agent/internal/notify"
+	"escrow-agent/internal/payments"
+	"escrow-agent/internal/payouts"
+	"escrow-agent/internal/recovery"
 	"escrow-agent/internal/router"
+	"escrow-agent/internal/scheduler"
+	"escrow-agent/internal/tokens"
+	"escrow-agent/internal/webhooks"
 
 	"github.com/rs/cors"
 )
@@ -18,13 +32,172 @@ func main() {
 	db.InitDB()
 	defer db.DB.Close()
 
+	// JWT key set as JSON, see tokens.ParseKeys; JWT_SIGNING_KEY_ID picks the key new tokens are signed with
+	var keys []tokens.Key
+	if spec := os.Getenv("JWT_KEYS"); spec != "" {
+		parsed, err := tokens.ParseKeys([]byte(spec))
+		if err != nil {
+			log.Fatalf("Invalid JWT_KEYS: %v", err)
+		}
+		keys = parsed
+	} else {
+		log.Println("[WARN] JWT_KEYS is not set; signing with a random key, tokens will not survive a restart or work across replicas")
+		key, err := tokens.NewEphemeralKey("ephemeral")
+		if err != nil {
+			log.Fatalf("Failed to generate JWT key: %v", err)
+		}
+		keys = []tokens.Key{key}
+	}
+	tokenService, err := tokens.NewService(tokens.Config{
+		Keys:         keys,
+		SigningKeyID: os.Getenv("JWT_SIGNING_KEY_ID"),
+		Issuer:       stringEnv("JWT_ISSUER", "escrow-agent"),
+		Audience:     stringEnv("JWT_AUDIENCE", "escrow-agent-api"),
+		TTL:          durationEnv("JWT_TTL", 15*time.Minute),
+		RefreshTTL:   durationEnv("REFRESH_TOKEN_TTL", tokens.DefaultRefreshTTL),
+	})
+	if err != nil {
+		log.Fatalf("Invalid JWT configuration: %v", err)
+	}
+	tokens.SetService(tokenService)
+
+	// TOTP issuer shown in authenticator apps; releases and refunds above
+	// STEP_UP_THRESHOLD in STEP_UP_CURRENCY (other currencies converted with
+	// FX_RATES) need a code
+	if err := mfa.SetConfig(mfa.Config{
+		Issuer:          stringEnv("TOTP_ISSUER", mfa.DefaultConfig.Issuer),
+		StepUpThreshold: os.Getenv("STEP_UP_THRESHOLD"),
+		StepUpCurrency:  stringEnv("STEP_UP_CURRENCY", mfa.DefaultConfig.StepUpCurrency),
+	}); err != nil {
+		log.Fatalf("Invalid STEP_UP_THRESHOLD: %v", err)
+	}
+
+	// failed logins: LOGIN_LOCK_AFTER failures lock a username, LOGIN_IP_LOCK_AFTER
+	// lock a client address, each for LOGIN_LOCKOUT_DURATION; earlier failures back off
+	policy := lockout.DefaultPolicy
+	policy.User.LockAfter = intEnv("LOGIN_LOCK_AFTER", policy.User.LockAfter)
+	policy.IP.LockAfter = intEnv("LOGIN_IP_LOCK_AFTER", policy.IP.LockAfter)
+	policy.LockoutDuration = durationEnv("LOGIN_LOCKOUT_DURATION", policy.LockoutDuration)
+	if err := lockout.SetPolicy(policy); err != nil {
+		log.Fatalf("Invalid login lockout settings: %v", err)
+	}
+
+	// password reset messages go to NOTIFY_OUTBOX_FILE, one JSON line each, for a
+	// relay to deliver; PASSWORD_RESET_URL may contain {token}
+	if path := os.Getenv("NOTIFY_OUTBOX_FILE"); path != "" {
+		notify.SetNotifier(notify.NewFileOutbox(path))
+	} else {
+		log.Println("[WARN] NOTIFY_OUTBOX_FILE is not set; password reset messages are only kept in memory")
+		notify.SetNotifier(notify.NewOutbox())
+	}
+	if err := recovery.SetConfig(recovery.Config{
+		TTL:      durationEnv("PASSWORD_RESET_TTL", recovery.DefaultConfig.TTL),
+		Cooldown: recovery.DefaultConfig.Cooldown,
+		ResetURL: os.Getenv("PASSWORD_RESET_URL"),
+	}); err != nil {
+		log.Fatalf("Invalid PASSWORD_RESET_TTL: %v", err)
+	}
+
+	// key-encryption keys for payment details, see crypto.ParseKeyring; the first key is current
+	if path := os.Getenv("PAYMENT_KEK_FILE"); path != "" {
+		keyring, err := crypto.LoadKeyring(path)
+		if err != nil {
+			log.Fatalf("Invalid PAYMENT_KEK_FILE: %v", err)
+		}
+		crypto.SetKEK(keyring)
+	} else {
+		log.Println("[WARN] PAYMENT_KEK_FILE is not set; encrypting payment details with a random key, they will not be readable after a restart")
+		keyring, err := crypto.NewEphemeralKeyring("ephemeral")
+		if err != nil {
+			log.Fatalf("Failed to generate payment key: %v", err)
+		}
+		crypto.SetKEK(keyring)
+	}
+
+	// payment gateways keyed by payment_method; swap the mock for a real provider here.
+	// MOCK_GATEWAY_ASYNC=true leaves captures pending until a webhook confirms them
+	mockGateway := payments.NewMockGateway()
+	if os.Getenv("MOCK_GATEWAY_ASYNC") == "true" {
+		mockGateway = payments.NewAsyncMockGateway()
+	}
+	payments.Register("credit_card", mockGateway)
+	payments.Register("bank_transfer", mockGateway)
+
+	// crypto deposits settle once confirmed on chain; there is no node-backed ChainWatcher yet, so
+	// CRYPTO_SIMULATED_CHAIN=true takes them against an in-memory chain for development only
+	if os.Getenv("CRYPTO_SIMULATED_CHAIN") == "true" {
+		chain := payments.NewSimulatedChain()
+		payments.Register(payments.MethodCrypto, payments.NewCryptoGateway(chain, intEnv("CRYPTO_CONFIRMATIONS", 6), durationEnv("CRYPTO_PAYMENT_WINDOW", time.Hour)))
+	}
+
+	// webhook signing secrets per provider, e.g. PAYMENT_WEBHOOK_SECRETS="mock=whsec_..."
+	if spec := os.Getenv("PAYMENT_WEBHOOK_SECRETS"); spec != "" {
+		secrets, err := webhooks.ParseSecrets(spec)
+		if err != nil {
+			log.Fatalf("Invalid PAYMENT_WEBHOOK_SECRETS: %v", err)
+		}
+		for name, secret := range secrets {
+			webhooks.Register(name, webhooks.NewHMACProvider(secret))
+		}
+	}
+
+	// retries of charges the gateway could not take, polling of crypto deposits, and reconciliation against its records
+	paymentPolicy := payments.DefaultPolicy
+	paymentPolicy.MaxAttempts = intEnv("PAYMENT_RETRY_MAX_ATTEMPTS", paymentPolicy.MaxAttempts)
+	paymentPolicy.BaseDelay = durationEnv("PAYMENT_RETRY_BASE_DELAY", paymentPolicy.BaseDelay)
+	paymentPolicy.MaxDelay = durationEnv("PAYMENT_RETRY_MAX_DELAY", paymentPolicy.MaxDelay)
+	paymentPolicy.ReconcileEvery = durationEnv("PAYMENT_RECONCILE_INTERVAL", paymentPolicy.ReconcileEvery)
+	paymentPolicy.PollEvery = durationEnv("PAYMENT_POLL_INTERVAL", paymentPolicy.PollEvery)
+	if err := payments.SetPolicy(paymentPolicy); err != nil {
+		log.Fatalf("Invalid payment retry settings: %v", err)
+	}
+
+	// payout providers keyed by payout account kind; swap the fake for a real provider here
+	payoutProvider := payouts.NewFakeProvider()
+	payouts.Register(payouts.KindBankAccount, payoutProvider)
+	payouts.Register(payouts.KindCryptoAddress, payoutProvider)
+
+	// optional static FX table for admin reporting, e.g. FX_RATES="EUR/USD=1.08,GBP/USD=1.27"
+	if spec := os.Getenv("FX_RATES"); spec != "" {
+		rates, err := fx.ParseStaticRates(spec)
+		if err != nil {
+			log.Fatalf("Invalid FX_RATES: %v", err)
+		}
+		fx.SetProvider(rates)
+	}
+
+	// platform fee schedule as JSON, see fees.ParseSchedule; no fee when unset
+	if spec := os.Getenv("FEE_SCHEDULE"); spec != "" {
+		schedule, err := fees.ParseSchedule([]byte(spec))
+		if err != nil {
+			log.Fatalf("Invalid FEE_SCHEDULE: %v", err)
+		}
+		fees.SetSchedule(schedule)
+	}
+
+	// expiry windows as Go durations, e.g. ESCROW_FULFILLMENT_WINDOW=336h
+	windows := escrow.DefaultWindows
+	windows.Fulfillment = durationEnv("ESCROW_FULFILLMENT_WINDOW", windows.Fulfillment)
+	windows.Inspection = durationEnv("ESCROW_INSPECTION_WINDOW", windows.Inspection)
+	escrow.SetWindows(windows)
+
+	// auto-refunds expired escrows, auto-releases uninspected ones, retries deferred
+	// charges and reconciles payments; safe to run on every replica
+	schedulerCtx, stopScheduler := context.WithCancel(context.Background())
+	defer stopScheduler()
+	go scheduler.Run(schedulerCtx, durationEnv("SCHEDULER_INTERVAL", time.Minute))
+
+	// batches released funds per seller and sends them to their default payout
+	// account; safe to run on every replica
+	go payouts.Run(schedulerCtx, durationEnv("PAYOUT_BATCH_INTERVAL", time.Hour))
+
 	r := router.SetupRouter()
 
 	// Setup CORS here
 	c := cors.New(cors.Options{
 		AllowedOrigins:   []string{"*"},
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Content-Type", "Authorization"},
+		AllowedHeaders:   []string{"Content-Type", "Authorization", "X-API-Key", "X-OTP-Code"},
 		AllowCredentials: true,
 		Debug:            true,
 	})
@@ -51,6 +224,7 @@ func main() {
 
 	<-stopChan
 	log.Println("Shutting down server...")
+	stopScheduler()
 
 	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
 	defer cancel()
@@ -61,3 +235,34 @@ func main() {
 
 	log.Println("Server exiting")
 }
+
+func stringEnv(name, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func durationEnv(name string, fallback time.Duration) time.Duration {
+	spec := os.Getenv(name)
+	if spec == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(spec)
+	if err != nil || d <= 0 {
+		log.Fatalf("Invalid %s: %q", name, spec)
+	}
+	return d
+}
+
+func intEnv(name string, fallback int) int {
+	spec := os.Getenv(name)
+	if spec == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(spec)
+	if err != nil || n <= 0 {
+		log.Fatalf("Invalid %s: %q", name, spec)
+	}
+	return n
+}
@@ -19,7 +19,7 @@ type Escrow struct {
 	ID          uuid.UUID       `db:"id"`
 	BuyerID     string       `db:"buyer_id"`
 	SellerID    string       `db:"seller_id"`
-	Amount      float64      `db:"amount"`
+	Amount      Money        `db:"amount"`
 	Status      EscrowStatus `db:"escrow_status"`
 	CreatedAt   time.Time    `db:"created_at"`
 	ReleasedAt  *time.Time   `db:"released_at"`
@@ -31,14 +31,14 @@ type User struct {
 	ID        uuid.UUID       `db:"user_id" json:"id"`
 	Username  string    `db:"username" json:"username"`
 	Password  string    `db:"password_hash" json:"-"`
-	Role      string    `db:"role" json:"role"`
+	Roles     Roles     `db:"roles" json:"roles"`
 	CreatedAt time.Time `db:"created_at" json:"created_at"`
 }
 
 type Claims struct {
 	UserID   uuid.UUID    `json:"user_id"`
 	Username string `json:"username"`
-	Role     string `json:"role"`
+	Roles    Roles  `json:"roles"`
 	jwt.RegisteredClaims
 }
 
@@ -47,16 +47,32 @@ type Transaction struct {
 	TransactionID uuid.UUID       `db:"transaction_id" json:"transaction_id"`
 	BuyerID       uuid.UUID       `db:"buyer_id" json:"buyer_id"`
 	SellerID      uuid.UUID       `db:"seller_id" json:"seller_id"`
-	Amount        float64   `db:"amount" json:"amount"`
+	Amount        Money     `db:"amount" json:"amount"`
+	Currency      string    `db:"currency" json:"currency"`
 	Status        string    `db:"transaction_status" json:"transaction_status"`
+	EscrowStatus  string    `db:"escrow_status" json:"escrow_status"`
+	DisputeID     *uuid.UUID `db:"dispute_id" json:"dispute_id,omitempty"`
+	PaymentID     *uuid.UUID `db:"payment_id" json:"payment_id,omitempty"`
 	CreatedAt     time.Time `db:"created_at" json:"created_at"`
 	UpdatedAt     time.Time `db:"updated_at" json:"updated_at"`
 }
 
+// AttachCurrency denominates the scanned amount in the transaction's currency
+// column. Call it after reading a transaction from the database.
+func (t *Transaction) AttachCurrency() error {
+	return attachCurrency(&t.Amount, &t.Currency)
+}
+
+// State returns the transaction's position in the Lifecycle state machine.
+func (t *Transaction) State() LifecycleState {
+	return LifecycleState{Transaction: TransactionStatus(t.Status), Escrow: EscrowStatus(t.EscrowStatus)}
+}
+
 type EscrowAccount struct {
 	ID            uuid.UUID       `db:"escrow_id" json:"id"`
 	TransactionID uuid.UUID       `db:"transaction_id" json:"transaction_id"`
-	Amount        float64   `db:"escrowed_amount" json:"escrowed_amount"`
+	Amount        Money     `db:"escrowed_amount" json:"escrowed_amount"`
+	Currency      string    `db:"currency" json:"currency"`
 	Status        string    `db:"escrow_status" json:"escrow_status"`
 	CreatedAt     time.Time `db:"created_at" json:"created_at"`
 }
@@ -68,3 +84,170 @@ type TransactionLog struct {
 	EventDetails  string    `db:"event_details" json:"event_details"`
 	CreatedAt     time.Time `db:"created_at" json:"created_at"`
 }
+
+// UserAuditLog records a change to an account: who (ActorID) did what to
+// whom (UserID). ActorID is nil for changes made from the command line.
+type UserAuditLog struct {
+	LogID        uuid.UUID  `db:"log_id" json:"log_id"`
+	UserID       uuid.UUID  `db:"user_id" json:"user_id"`
+	ActorID      *uuid.UUID `db:"actor_id" json:"actor_id"`
+	EventType    string     `db:"event_type" json:"event_type"`
+	EventDetails string     `db:"event_details" json:"event_details"`
+	CreatedAt    time.Time  `db:"created_at" json:"created_at"`
+}
+
+// SecurityLog records a sign-in event. Username is the name that was tried
+// and UserID is nil when it matched no user.
+type SecurityLog struct {
+	LogID        uuid.UUID  `db:"log_id" json:"log_id"`
+	UserID       *uuid.UUID `db:"user_id" json:"user_id"`
+	Username     *string    `db:"username" json:"username"`
+	IPAddress    string     `db:"ip_address" json:"ip_address"`
+	EventType    string     `db:"event_type" json:"event_type"`
+	EventDetails string     `db:"event_details" json:"event_details"`
+	CreatedAt    time.Time  `db:"created_at" json:"created_at"`
+}
+
+type DisputeStatus string
+
+const (
+	DisputeOpen     DisputeStatus = "open"
+	DisputeResolved DisputeStatus = "resolved"
+	DisputeRejected DisputeStatus = "rejected"
+)
+
+// Dispute is raised by a party to a transaction and settled by an admin.
+// A dispute resolved in the buyer's favor ends as "resolved" (refund), one
+// decided for the seller ends as "rejected" (release).
+type Dispute struct {
+	DisputeID     uuid.UUID  `db:"dispute_id" json:"dispute_id"`
+	TransactionID uuid.UUID  `db:"transaction_id" json:"transaction_id"`
+	RaisedBy      uuid.UUID  `db:"raised_by" json:"raised_by"`
+	Reason        string     `db:"reason" json:"reason"`
+	Status        string     `db:"dispute_status" json:"dispute_status"`
+	Resolution    *string    `db:"resolution" json:"resolution,omitempty"`
+	ResolvedBy    *uuid.UUID `db:"resolved_by" json:"resolved_by,omitempty"`
+	CreatedAt     time.Time  `db:"created_at" json:"created_at"`
+	ResolvedAt    *time.Time `db:"resolved_at" json:"resolved_at,omitempty"`
+}
+
+// Payment is a charge against the buyer recorded in the payments table.
+type Payment struct {
+	PaymentID        uuid.UUID  `db:"payment_id" json:"payment_id"`
+	TransactionID    uuid.UUID  `db:"transaction_id" json:"transaction_id"`
+	Amount           Money      `db:"amount" json:"amount"`
+	Currency         string     `db:"currency" json:"currency"`
+	Method           string     `db:"method" json:"method"`
+	Status           string     `db:"payment_status" json:"payment_status"`
+	GatewayReference string     `db:"gateway_reference" json:"gateway_reference"`
+	EncryptedDetails []byte     `db:"encrypted_details" json:"-"`
+	Attempts         int        `db:"attempts" json:"attempts"`
+	LastError        *string    `db:"last_error" json:"last_error,omitempty"`
+	NextRetryAt      *time.Time `db:"next_retry_at" json:"next_retry_at,omitempty"`
+	ReconciledAt     *time.Time `db:"reconciled_at" json:"reconciled_at,omitempty"`
+	Mismatch         *string    `db:"mismatch" json:"mismatch,omitempty"`
+	ReceivedAmount   *Money     `db:"received_amount" json:"received_amount,omitempty"`
+	Confirmations    int        `db:"confirmations" json:"confirmations"`
+	ProcessedAt      *time.Time `db:"processed_at" json:"processed_at,omitempty"`
+	CreatedAt        time.Time  `db:"created_at" json:"created_at"`
+}
+
+// AttachCurrency denominates the scanned amount in the payment's currency
+// column.
+func (p *Payment) AttachCurrency() error {
+	if p.ReceivedAmount != nil {
+		if err := attachCurrency(p.ReceivedAmount, &p.Currency); err != nil {
+			return err
+		}
+	}
+	return attachCurrency(&p.Amount, &p.Currency)
+}
+
+// PaymentDelta is money a buyer sent that the escrow did not take and that is
+// owed back to them: the excess of an overpayment, or all of a deposit too
+// small to fund the escrow.
+type PaymentDelta struct {
+	DeltaID       uuid.UUID  `db:"delta_id" json:"delta_id"`
+	PaymentID     uuid.UUID  `db:"payment_id" json:"payment_id"`
+	TransactionID uuid.UUID  `db:"transaction_id" json:"transaction_id"`
+	Kind          string     `db:"kind" json:"kind"`
+	Amount        Money      `db:"amount" json:"amount"`
+	Currency      string     `db:"currency" json:"currency"`
+	CreatedAt     time.Time  `db:"created_at" json:"created_at"`
+	RefundedAt    *time.Time `db:"refunded_at" json:"refunded_at,omitempty"`
+	RefundedBy    *uuid.UUID `db:"refunded_by" json:"refunded_by,omitempty"`
+}
+
+// AttachCurrency denominates the scanned amount in the delta's currency
+// column.
+func (d *PaymentDelta) AttachCurrency() error {
+	return attachCurrency(&d.Amount, &d.Currency)
+}
+
+// WebhookEvent is a payment gateway callback as received and verified.
+// ProcessedAt stays nil until its effect is committed.
+type WebhookEvent struct {
+	EventID          uuid.UUID  `db:"event_id" json:"event_id"`
+	Provider         string     `db:"provider" json:"provider"`
+	ProviderEventID  string     `db:"provider_event_id" json:"provider_event_id"`
+	EventType        string     `db:"event_type" json:"event_type"`
+	GatewayReference string     `db:"gateway_reference" json:"gateway_reference"`
+	Amount           Money      `db:"amount" json:"amount"`
+	Currency         string     `db:"currency" json:"currency"`
+	Reason           string     `db:"reason" json:"reason,omitempty"`
+	Attempts         int        `db:"attempts" json:"attempts"`
+	LastError        *string    `db:"last_error" json:"last_error,omitempty"`
+	ReceivedAt       time.Time  `db:"received_at" json:"received_at"`
+	ProcessedAt      *time.Time `db:"processed_at" json:"processed_at,omitempty"`
+}
+
+// AttachCurrency denominates the scanned amount in the event's currency
+// column.
+func (e *WebhookEvent) AttachCurrency() error {
+	return attachCurrency(&e.Amount, &e.Currency)
+}
+
+// attachCurrency reinterprets a scanned amount in the currency read from its
+// sibling column; rows written before currencies existed are in the default.
+func attachCurrency(amount *Money, currency *string) error {
+	if *currency == "" {
+		*currency = DefaultCurrency
+	}
+	m, err := amount.WithCurrency(*currency)
+	if err != nil {
+		return err
+	}
+	*amount = m
+	return nil
+}
+
+type MilestoneStatus string
+
+const (
+	MilestonePending   MilestoneStatus = "pending"
+	MilestoneFulfilled MilestoneStatus = "fulfilled"
+	MilestoneReleased  MilestoneStatus = "released"
+	MilestoneRefunded  MilestoneStatus = "refunded"
+)
+
+// Milestone is one share of a transaction's escrow. The seller fulfills it and
+// the buyer's approval releases its amount while the rest stays held.
+type Milestone struct {
+	MilestoneID   uuid.UUID  `db:"milestone_id" json:"milestone_id"`
+	TransactionID uuid.UUID  `db:"transaction_id" json:"transaction_id"`
+	Position      int        `db:"position" json:"position"`
+	Description   string     `db:"description" json:"description"`
+	Amount        Money      `db:"amount" json:"amount"`
+	Currency      string     `db:"currency" json:"currency"`
+	DueDate       *time.Time `db:"due_date" json:"due_date,omitempty"`
+	Status        string     `db:"milestone_status" json:"milestone_status"`
+	FulfilledAt   *time.Time `db:"fulfilled_at" json:"fulfilled_at,omitempty"`
+	SettledAt     *time.Time `db:"settled_at" json:"settled_at,omitempty"`
+	CreatedAt     time.Time  `db:"created_at" json:"created_at"`
+}
+
+// AttachCurrency denominates the scanned amount in the milestone's currency
+// column.
+func (m *Milestone) AttachCurrency() error {
+	return attachCurrency(&m.Amount, &m.Currency)
+}
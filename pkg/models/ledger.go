@@ -0,0 +1,54 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// LedgerAccountType names the role an account plays in the escrow ledger.
+type LedgerAccountType string
+
+const (
+	AccountBuyerFunding  LedgerAccountType = "buyer_funding"
+	AccountEscrowHolding LedgerAccountType = "escrow_holding"
+	AccountSellerPayable LedgerAccountType = "seller_payable"
+	// AccountSellerDisbursed counts what has been paid out to the seller.
+	AccountSellerDisbursed LedgerAccountType = "seller_disbursed"
+	AccountPlatformFees    LedgerAccountType = "platform_fees"
+)
+
+type JournalEntryType string
+
+const (
+	EntryDeposit JournalEntryType = "deposit"
+	EntryRelease JournalEntryType = "release"
+	EntryRefund  JournalEntryType = "refund"
+	EntryFee     JournalEntryType = "fee"
+	EntryPayout  JournalEntryType = "payout"
+)
+
+// JournalEntry is one immutable, balanced movement of money between ledger
+// accounts. The amounts of its postings always sum to zero.
+type JournalEntry struct {
+	EntryID       uuid.UUID        `db:"entry_id" json:"entry_id"`
+	TransactionID uuid.UUID        `db:"transaction_id" json:"transaction_id"`
+	Type          JournalEntryType `db:"entry_type" json:"entry_type"`
+	Description   string           `db:"description" json:"description"`
+	CreatedAt     time.Time        `db:"created_at" json:"created_at"`
+	Postings      []JournalPosting `db:"-" json:"postings"`
+}
+
+// JournalPosting debits (positive amount) or credits (negative amount) a
+// single account. Accounts are identified by type, owner and currency: the
+// owner is the buyer or seller for their accounts, the transaction for escrow
+// holding and uuid.Nil for the platform. The account currency is taken from
+// Amount.
+type JournalPosting struct {
+	PostingID   uuid.UUID         `db:"posting_id" json:"posting_id"`
+	EntryID     uuid.UUID         `db:"entry_id" json:"entry_id"`
+	AccountType LedgerAccountType `db:"account_type" json:"account_type"`
+	OwnerID     uuid.UUID         `db:"owner_id" json:"owner_id"`
+	Amount      Money             `db:"amount" json:"amount"`
+	Currency    string            `db:"currency" json:"currency"`
+}
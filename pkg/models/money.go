@@ -0,0 +1,223 @@
+package models
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DefaultCurrency is assumed for amounts that arrive without one.
+const DefaultCurrency = "USD"
+
+var (
+	ErrInvalidAmount       = errors.New("invalid amount")
+	ErrUnsupportedCurrency = errors.New("unsupported currency")
+)
+
+// currencies lists the ISO-4217 codes we trade in with the number of decimal
+// places of their minor unit. Amount columns are DECIMAL(_, 2), so currencies
+// with three decimals cannot be supported without a schema change.
+var currencies = map[string]int{
+	"AUD": 2,
+	"CAD": 2,
+	"CHF": 2,
+	"CNY": 2,
+	"EUR": 2,
+	"GBP": 2,
+	"INR": 2,
+	"JPY": 0,
+	"KRW": 0,
+	"NPR": 2,
+	"SGD": 2,
+	"USD": 2,
+}
+
+// ValidCurrency reports whether code is a supported ISO-4217 currency code.
+func ValidCurrency(code string) bool {
+	_, ok := currencies[code]
+	return ok
+}
+
+// Money is an exact amount held as an integer number of minor units (cents
+// for USD). Use it instead of float64 for anything that is compared, summed
+// or stored, so values such as 0.1+0.2 stay exact.
+//
+// In SQL and JSON a Money is its decimal amount; the currency is carried
+// alongside it rather than inside the column or field.
+type Money struct {
+	Minor    int64
+	Currency string
+}
+
+// NewMoney returns minor units of currency.
+func NewMoney(minor int64, currency string) Money {
+	if currency == "" {
+		currency = DefaultCurrency
+	}
+	return Money{Minor: minor, Currency: currency}
+}
+
+// ParseMoney reads a decimal amount such as "12.34" or "-0.5". Amounts with
+// more fractional digits than the currency allows are rejected rather than
+// rounded.
+func ParseMoney(s, currency string) (Money, error) {
+	m := NewMoney(0, currency)
+	digits := MinorDigits(m.Currency)
+
+	s = strings.TrimSpace(s)
+	negative := strings.HasPrefix(s, "-")
+	if negative || strings.HasPrefix(s, "+") {
+		s = s[1:]
+	}
+
+	whole, frac, _ := strings.Cut(s, ".")
+	if whole == "" && frac == "" {
+		return m, fmt.Errorf("%w: %q", ErrInvalidAmount, s)
+	}
+	frac = strings.TrimRight(frac, "0")
+	if len(frac) > digits {
+		return m, fmt.Errorf("%w: %q has more than %d decimal places", ErrInvalidAmount, s, digits)
+	}
+	frac += strings.Repeat("0", digits-len(frac))
+	if whole == "" {
+		whole = "0"
+	}
+
+	for _, part := range []string{whole, frac} {
+		if strings.TrimLeft(part, "0123456789") != "" {
+			return m, fmt.Errorf("%w: %q", ErrInvalidAmount, s)
+		}
+	}
+
+	minor, err := strconv.ParseInt(whole+frac, 10, 64)
+	if err != nil {
+		return m, fmt.Errorf("%w: %q", ErrInvalidAmount, s)
+	}
+	if negative {
+		minor = -minor
+	}
+	m.Minor = minor
+	return m, nil
+}
+
+// MustParseMoney is ParseMoney for literals known to be valid.
+func MustParseMoney(s, currency string) Money {
+	m, err := ParseMoney(s, currency)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// MinorDigits is the number of decimal places of a currency's minor unit.
+func MinorDigits(currency string) int {
+	if digits, ok := currencies[currency]; ok {
+		return digits
+	}
+	return 2
+}
+
+// WithCurrency reads the same decimal amount in another currency, e.g. 1000.00
+// scanned before its currency column was known becomes JPY 1000. Amounts with
+// more decimals than the currency allows are rejected.
+func (m Money) WithCurrency(currency string) (Money, error) {
+	if !ValidCurrency(currency) {
+		return m, fmt.Errorf("%w: %q", ErrUnsupportedCurrency, currency)
+	}
+	if m.Currency == currency {
+		return m, nil
+	}
+	return ParseMoney(m.String(), currency)
+}
+
+// String formats the amount with the currency's decimal places, e.g. "12.30".
+func (m Money) String() string {
+	digits := MinorDigits(m.Currency)
+	minor := m.Minor
+	sign := ""
+	if minor < 0 {
+		sign = "-"
+		minor = -minor
+	}
+	s := strconv.FormatInt(minor, 10)
+	if digits == 0 {
+		return sign + s
+	}
+	if len(s) <= digits {
+		s = strings.Repeat("0", digits-len(s)+1) + s
+	}
+	return sign + s[:len(s)-digits] + "." + s[len(s)-digits:]
+}
+
+func (m Money) Add(o Money) Money { return Money{Minor: m.Minor + o.Minor, Currency: m.Currency} }
+func (m Money) Sub(o Money) Money { return Money{Minor: m.Minor - o.Minor, Currency: m.Currency} }
+func (m Money) Neg() Money        { return Money{Minor: -m.Minor, Currency: m.Currency} }
+
+func (m Money) IsZero() bool     { return m.Minor == 0 }
+func (m Money) IsPositive() bool { return m.Minor > 0 }
+
+// Equal reports whether both amount and currency match.
+func (m Money) Equal(o Money) bool {
+	return m.Minor == o.Minor && m.Currency == o.Currency
+}
+
+// Value stores the decimal amount, matching the DECIMAL/NUMERIC columns.
+func (m Money) Value() (driver.Value, error) {
+	return m.String(), nil
+}
+
+// Scan reads a DECIMAL/NUMERIC column. The currency is kept if already set and
+// otherwise defaults to DefaultCurrency.
+func (m *Money) Scan(src interface{}) error {
+	var s string
+	switch v := src.(type) {
+	case nil:
+		s = "0"
+	case []byte:
+		s = string(v)
+	case string:
+		s = v
+	case int64:
+		s = strconv.FormatInt(v, 10)
+	case float64:
+		s = strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Errorf("cannot scan %T into Money", src)
+	}
+
+	parsed, err := ParseMoney(s, m.Currency)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+// MarshalJSON writes the amount as a JSON number, e.g. 100.50.
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalJSON accepts a JSON number or a quoted decimal string and parses
+// its text exactly, without passing through float64.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if bytes.Equal(data, []byte("null")) {
+		*m = NewMoney(0, m.Currency)
+		return nil
+	}
+	s := strings.Trim(string(data), `"`)
+	if strings.ContainsAny(s, "eE") {
+		return fmt.Errorf("%w: %q uses exponent notation", ErrInvalidAmount, s)
+	}
+
+	parsed, err := ParseMoney(s, m.Currency)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
@@ -0,0 +1,84 @@
+package models_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"escrow-agent/pkg/models"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMoney(t *testing.T) {
+	cases := map[string]int64{
+		"12.34": 1234,
+		"12.3":  1230,
+		"12":    1200,
+		".5":    50,
+		"-0.05": -5,
+		"1.500": 150,
+		"+5":    500,
+	}
+	for in, minor := range cases {
+		m, err := models.ParseMoney(in, "USD")
+		assert.NoError(t, err, in)
+		assert.Equal(t, minor, m.Minor, in)
+	}
+
+	for _, in := range []string{"", "abc", "1.234", "1..2", "1e3", "-+5", "+-5", "--5", "++5"} {
+		_, err := models.ParseMoney(in, "USD")
+		assert.ErrorIs(t, err, models.ErrInvalidAmount, in)
+	}
+}
+
+func TestMoney_ExactArithmetic(t *testing.T) {
+	sum := models.MustParseMoney("0.1", "USD").Add(models.MustParseMoney("0.2", "USD"))
+
+	var deposit struct {
+		Amount models.Money `json:"amount"`
+	}
+	assert.NoError(t, json.Unmarshal([]byte(`{"amount": 0.3}`), &deposit))
+	assert.True(t, sum.Equal(deposit.Amount))
+
+	var stored models.Money
+	assert.NoError(t, stored.Scan([]byte("0.30")))
+	assert.True(t, sum.Equal(stored))
+}
+
+func TestMoney_JSONAndSQL(t *testing.T) {
+	m := models.MustParseMoney("-100.5", "USD")
+	assert.Equal(t, "-100.50", m.String())
+
+	out, err := json.Marshal(map[string]models.Money{"amount": m})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"amount": -100.50}`, string(out))
+
+	value, err := m.Value()
+	assert.NoError(t, err)
+	assert.Equal(t, "-100.50", value)
+
+	var scanned models.Money
+	assert.NoError(t, scanned.Scan(float64(50)))
+	assert.Equal(t, int64(5000), scanned.Minor)
+	assert.Equal(t, models.DefaultCurrency, scanned.Currency)
+
+	var quoted models.Money
+	assert.NoError(t, json.Unmarshal([]byte(`"7.25"`), &quoted))
+	assert.Equal(t, int64(725), quoted.Minor)
+}
+
+func TestMoney_WithCurrency(t *testing.T) {
+	var scanned models.Money
+	assert.NoError(t, scanned.Scan([]byte("1500.00")))
+
+	yen, err := scanned.WithCurrency("JPY")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1500), yen.Minor)
+	assert.Equal(t, "1500", yen.String())
+
+	_, err = models.MustParseMoney("10.50", "USD").WithCurrency("JPY")
+	assert.ErrorIs(t, err, models.ErrInvalidAmount)
+
+	_, err = scanned.WithCurrency("XXX")
+	assert.ErrorIs(t, err, models.ErrUnsupportedCurrency)
+}
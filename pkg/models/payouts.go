@@ -0,0 +1,75 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type PayoutStatus string
+
+const (
+	PayoutPending    PayoutStatus = "pending"
+	PayoutProcessing PayoutStatus = "processing"
+	PayoutPaid       PayoutStatus = "paid"
+	PayoutFailed     PayoutStatus = "failed"
+	PayoutHeld       PayoutStatus = "held"
+)
+
+// PayoutAccount is a destination a seller's payouts are sent to. The
+// destination itself is stored encrypted; Label is a masked form of it that
+// is safe to show.
+type PayoutAccount struct {
+	AccountID        uuid.UUID  `db:"account_id" json:"account_id"`
+	UserID           uuid.UUID  `db:"user_id" json:"user_id"`
+	Kind             string     `db:"kind" json:"kind"`
+	Label            string     `db:"label" json:"label"`
+	EncryptedDetails []byte     `db:"encrypted_details" json:"-"`
+	IsDefault        bool       `db:"is_default" json:"is_default"`
+	CreatedAt        time.Time  `db:"created_at" json:"created_at"`
+	RemovedAt        *time.Time `db:"removed_at" json:"removed_at,omitempty"`
+}
+
+// Payout is what one release owes the seller, net of the platform fee, and
+// how far its disbursement got.
+type Payout struct {
+	PayoutID      uuid.UUID  `db:"payout_id" json:"payout_id"`
+	TransactionID uuid.UUID  `db:"transaction_id" json:"transaction_id"`
+	SellerID      uuid.UUID  `db:"seller_id" json:"seller_id"`
+	Amount        Money      `db:"amount" json:"amount"`
+	Currency      string     `db:"currency" json:"currency"`
+	Status        string     `db:"payout_status" json:"payout_status"`
+	Attempts      int        `db:"attempts" json:"attempts"`
+	BatchID       *uuid.UUID `db:"batch_id" json:"batch_id,omitempty"`
+	LastError     *string    `db:"last_error" json:"last_error,omitempty"`
+	CreatedAt     time.Time  `db:"created_at" json:"created_at"`
+	PaidAt        *time.Time `db:"paid_at" json:"paid_at,omitempty"`
+}
+
+// AttachCurrency denominates the scanned amount in the payout's currency
+// column.
+func (p *Payout) AttachCurrency() error {
+	return attachCurrency(&p.Amount, &p.Currency)
+}
+
+// PayoutBatch is one transfer of a seller's due payouts in one currency to
+// their payout account.
+type PayoutBatch struct {
+	BatchID           uuid.UUID  `db:"batch_id" json:"batch_id"`
+	SellerID          uuid.UUID  `db:"seller_id" json:"seller_id"`
+	AccountID         uuid.UUID  `db:"account_id" json:"account_id"`
+	Amount            Money      `db:"amount" json:"amount"`
+	Currency          string     `db:"currency" json:"currency"`
+	Status            string     `db:"batch_status" json:"batch_status"`
+	ProviderReference string     `db:"provider_reference" json:"provider_reference"`
+	LastError         *string    `db:"last_error" json:"last_error,omitempty"`
+	CreatedAt         time.Time  `db:"created_at" json:"created_at"`
+	AttemptedAt       *time.Time `db:"attempted_at" json:"attempted_at,omitempty"`
+	SettledAt         *time.Time `db:"settled_at" json:"settled_at,omitempty"`
+}
+
+// AttachCurrency denominates the scanned amount in the batch's currency
+// column.
+func (b *PayoutBatch) AttachCurrency() error {
+	return attachCurrency(&b.Amount, &b.Currency)
+}
@@ -0,0 +1,57 @@
+package models
+
+import (
+	"database/sql/driver"
+
+	"github.com/lib/pq"
+)
+
+// Account roles. A user holds one or more; whether they act as buyer or
+// seller on a given transaction is decided by its buyer_id and seller_id,
+// not by the roles they hold.
+const (
+	RoleBuyer  = "buyer"
+	RoleSeller = "seller"
+	RoleAdmin  = "admin"
+)
+
+// Roles is the set of roles a user holds, stored in a user_role[] column.
+type Roles []string
+
+// Has reports whether role is in the set.
+func (r Roles) Has(role string) bool {
+	for _, held := range r {
+		if held == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Equal reports whether both sets hold the same roles, in any order.
+func (r Roles) Equal(other Roles) bool {
+	if len(r) != len(other) {
+		return false
+	}
+	for _, role := range r {
+		if !other.Has(role) {
+			return false
+		}
+	}
+	return true
+}
+
+// Scan reads a Postgres array literal such as {buyer,seller}.
+func (r *Roles) Scan(src interface{}) error {
+	var a pq.StringArray
+	if err := a.Scan(src); err != nil {
+		return err
+	}
+	*r = Roles(a)
+	return nil
+}
+
+// Value writes the set as a Postgres array literal.
+func (r Roles) Value() (driver.Value, error) {
+	return pq.StringArray(r).Value()
+}
@@ -0,0 +1,357 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+type TransactionStatus string
+
+const (
+	TransactionPending    TransactionStatus = "pending"
+	TransactionDeposited  TransactionStatus = "deposited"
+	TransactionInProgress TransactionStatus = "in_progress"
+	TransactionCompleted  TransactionStatus = "completed"
+	TransactionCancelled  TransactionStatus = "cancelled"
+)
+
+const (
+	StatusFunded    EscrowStatus = "funded"
+	StatusCancelled EscrowStatus = "cancelled"
+)
+
+// LifecycleState is the pair of statuses stored on a transactions row.
+type LifecycleState struct {
+	Transaction TransactionStatus `json:"transaction_status"`
+	Escrow      EscrowStatus      `json:"escrow_status"`
+}
+
+func (s LifecycleState) String() string {
+	return fmt.Sprintf("%s/%s", s.Transaction, s.Escrow)
+}
+
+type Event string
+
+const (
+	EventDeposit          Event = "deposit"
+	EventFulfill          Event = "fulfill"
+	EventConfirm          Event = "confirm"
+	EventRelease          Event = "release"
+	EventRefund           Event = "refund"
+	EventDispute          Event = "dispute"
+	EventResolveForBuyer  Event = "resolve_for_buyer"
+	EventResolveForSeller Event = "resolve_for_seller"
+
+	// milestone events move money or progress for one milestone; the
+	// transaction completes through a regular release once all are settled
+	EventFulfillMilestone Event = "fulfill_milestone"
+	EventReleaseMilestone Event = "release_milestone"
+)
+
+// Actor is the capacity in which a caller acts on a transaction.
+type Actor string
+
+const (
+	ActorBuyer  Actor = "buyer"
+	ActorSeller Actor = "seller"
+	ActorAdmin  Actor = "admin"
+	ActorSystem Actor = "system"
+)
+
+// ActorFor works out how a user relates to a transaction. Parties act as buyer
+// or seller according to the transaction, whatever roles they hold; admins
+// who are not a party act as admin. Anyone else gets "".
+func ActorFor(t *Transaction, userID uuid.UUID, roles Roles) Actor {
+	switch {
+	case t.BuyerID == userID:
+		return ActorBuyer
+	case t.SellerID == userID:
+		return ActorSeller
+	case roles.Has(RoleAdmin):
+		return ActorAdmin
+	}
+	return ""
+}
+
+// GuardContext carries the facts guards need beyond the current state.
+type GuardContext struct {
+	Actor       Actor
+	DisputeOpen bool
+}
+
+// Guard vetoes a transition by returning a reason.
+type Guard func(from LifecycleState, gc GuardContext) error
+
+// Transition declares one legal move. An empty To or EscrowTo leaves that
+// status unchanged.
+type Transition struct {
+	Event      Event
+	Actors     []Actor
+	From       []TransactionStatus
+	EscrowFrom []EscrowStatus
+	To         TransactionStatus
+	EscrowTo   EscrowStatus
+	Guards     []Guard
+}
+
+// Change describes a transition that passed its guards. Hooks receive it
+// together with the database handle of the surrounding transaction.
+type Change struct {
+	Event         Event
+	TransactionID uuid.UUID
+	Actor         Actor
+	From          LifecycleState
+	To            LifecycleState
+	Exec          sqlx.Execer
+}
+
+// Hook runs a side effect of a transition. An error aborts the transition.
+type Hook func(ctx context.Context, change Change) error
+
+var ErrIllegalTransition = errors.New("illegal state transition")
+
+// TransitionError explains why an event was rejected. It matches
+// ErrIllegalTransition with errors.Is.
+type TransitionError struct {
+	Event  Event
+	From   LifecycleState
+	Reason string
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("cannot %s transaction in state %s: %s", strings.ReplaceAll(string(e.Event), "_", " "), e.From, e.Reason)
+}
+
+func (e *TransitionError) Unwrap() error {
+	return ErrIllegalTransition
+}
+
+type StateMachine struct {
+	transitions map[Event]Transition
+	hooks       map[Event][]Hook
+	anyHooks    []Hook
+}
+
+func NewStateMachine(transitions ...Transition) *StateMachine {
+	m := &StateMachine{
+		transitions: map[Event]Transition{},
+		hooks:       map[Event][]Hook{},
+	}
+	for _, t := range transitions {
+		m.transitions[t.Event] = t
+	}
+	return m
+}
+
+// OnTransition registers a hook for one event.
+func (m *StateMachine) OnTransition(event Event, hook Hook) {
+	m.hooks[event] = append(m.hooks[event], hook)
+}
+
+// OnAny registers a hook that runs after the event-specific hooks of every
+// transition.
+func (m *StateMachine) OnAny(hook Hook) {
+	m.anyHooks = append(m.anyHooks, hook)
+}
+
+// Can reports whether event is legal from the given state and returns the
+// state it leads to.
+func (m *StateMachine) Can(event Event, from LifecycleState, gc GuardContext) (LifecycleState, error) {
+	t, ok := m.transitions[event]
+	if !ok {
+		return from, &TransitionError{Event: event, From: from, Reason: "unknown event"}
+	}
+
+	if !containsActor(t.Actors, gc.Actor) {
+		return from, &TransitionError{Event: event, From: from, Reason: fmt.Sprintf("not allowed for %s", actorName(gc.Actor))}
+	}
+	if !containsStatus(t.From, from.Transaction) {
+		return from, &TransitionError{Event: event, From: from, Reason: "transaction is not in an allowed status"}
+	}
+	if !containsEscrowStatus(t.EscrowFrom, from.Escrow) {
+		return from, &TransitionError{Event: event, From: from, Reason: "escrow is not in an allowed status"}
+	}
+	for _, guard := range t.Guards {
+		if err := guard(from, gc); err != nil {
+			return from, &TransitionError{Event: event, From: from, Reason: err.Error()}
+		}
+	}
+
+	to := from
+	if t.To != "" {
+		to.Transaction = t.To
+	}
+	if t.EscrowTo != "" {
+		to.Escrow = t.EscrowTo
+	}
+	return to, nil
+}
+
+// Fire validates event and runs its hooks. The caller persists the returned
+// state.
+func (m *StateMachine) Fire(ctx context.Context, event Event, transactionID uuid.UUID, from LifecycleState, gc GuardContext, exec sqlx.Execer) (LifecycleState, error) {
+	to, err := m.Can(event, from, gc)
+	if err != nil {
+		return from, err
+	}
+
+	change := Change{Event: event, TransactionID: transactionID, Actor: gc.Actor, From: from, To: to, Exec: exec}
+	for _, hook := range append(append([]Hook{}, m.hooks[event]...), m.anyHooks...) {
+		if err := hook(ctx, change); err != nil {
+			return from, err
+		}
+	}
+	return to, nil
+}
+
+func noOpenDispute(from LifecycleState, gc GuardContext) error {
+	if gc.DisputeOpen {
+		return errors.New("escrow is frozen by an open dispute")
+	}
+	return nil
+}
+
+func disputeOpen(from LifecycleState, gc GuardContext) error {
+	if !gc.DisputeOpen {
+		return errors.New("there is no open dispute")
+	}
+	return nil
+}
+
+// buyerBeforeFulfillment lets the buyer cancel only until the seller has
+// started fulfilling; sellers, admins and the system may refund later too.
+func buyerBeforeFulfillment(from LifecycleState, gc GuardContext) error {
+	if gc.Actor == ActorBuyer && from.Transaction != TransactionDeposited {
+		return errors.New("the buyer can only cancel before the seller fulfills")
+	}
+	return nil
+}
+
+// Lifecycle is the transition table every handler consults before moving a
+// transaction or its escrow.
+var Lifecycle = NewStateMachine(
+	Transition{
+		Event:      EventDeposit,
+		Actors:     []Actor{ActorBuyer},
+		From:       []TransactionStatus{TransactionPending},
+		EscrowFrom: []EscrowStatus{StatusPending},
+		To:         TransactionDeposited,
+		EscrowTo:   StatusFunded,
+		Guards:     []Guard{noOpenDispute},
+	},
+	Transition{
+		Event:      EventFulfill,
+		Actors:     []Actor{ActorSeller},
+		From:       []TransactionStatus{TransactionDeposited},
+		EscrowFrom: []EscrowStatus{StatusFunded},
+		To:         TransactionInProgress,
+		Guards:     []Guard{noOpenDispute},
+	},
+	Transition{
+		Event:      EventFulfillMilestone,
+		Actors:     []Actor{ActorSeller},
+		From:       []TransactionStatus{TransactionDeposited, TransactionInProgress},
+		EscrowFrom: []EscrowStatus{StatusFunded},
+		To:         TransactionInProgress,
+		Guards:     []Guard{noOpenDispute},
+	},
+	Transition{
+		Event:      EventConfirm,
+		Actors:     []Actor{ActorBuyer},
+		From:       []TransactionStatus{TransactionInProgress},
+		EscrowFrom: []EscrowStatus{StatusFunded},
+		To:         TransactionCompleted,
+		EscrowTo:   StatusReleased,
+		Guards:     []Guard{noOpenDispute},
+	},
+	Transition{
+		Event:      EventRelease,
+		Actors:     []Actor{ActorBuyer, ActorAdmin, ActorSystem},
+		From:       []TransactionStatus{TransactionDeposited, TransactionInProgress},
+		EscrowFrom: []EscrowStatus{StatusFunded},
+		To:         TransactionCompleted,
+		EscrowTo:   StatusReleased,
+		Guards:     []Guard{noOpenDispute},
+	},
+	Transition{
+		Event:      EventReleaseMilestone,
+		Actors:     []Actor{ActorBuyer, ActorAdmin, ActorSystem},
+		From:       []TransactionStatus{TransactionInProgress},
+		EscrowFrom: []EscrowStatus{StatusFunded},
+		Guards:     []Guard{noOpenDispute},
+	},
+	Transition{
+		Event:      EventRefund,
+		Actors:     []Actor{ActorBuyer, ActorSeller, ActorAdmin, ActorSystem},
+		From:       []TransactionStatus{TransactionDeposited, TransactionInProgress},
+		EscrowFrom: []EscrowStatus{StatusFunded},
+		To:         TransactionCancelled,
+		EscrowTo:   StatusCancelled,
+		Guards:     []Guard{noOpenDispute, buyerBeforeFulfillment},
+	},
+	Transition{
+		Event:      EventDispute,
+		Actors:     []Actor{ActorBuyer, ActorSeller},
+		From:       []TransactionStatus{TransactionPending, TransactionDeposited, TransactionInProgress},
+		EscrowFrom: []EscrowStatus{StatusPending, StatusFunded},
+		EscrowTo:   StatusDisputed,
+		Guards:     []Guard{noOpenDispute},
+	},
+	Transition{
+		Event:      EventResolveForBuyer,
+		Actors:     []Actor{ActorAdmin},
+		From:       []TransactionStatus{TransactionPending, TransactionDeposited, TransactionInProgress},
+		EscrowFrom: []EscrowStatus{StatusDisputed},
+		To:         TransactionCancelled,
+		EscrowTo:   StatusCancelled,
+		Guards:     []Guard{disputeOpen},
+	},
+	Transition{
+		Event:      EventResolveForSeller,
+		Actors:     []Actor{ActorAdmin},
+		From:       []TransactionStatus{TransactionDeposited, TransactionInProgress},
+		EscrowFrom: []EscrowStatus{StatusDisputed},
+		To:         TransactionCompleted,
+		EscrowTo:   StatusReleased,
+		Guards:     []Guard{disputeOpen},
+	},
+)
+
+func containsActor(actors []Actor, actor Actor) bool {
+	for _, a := range actors {
+		if a == actor {
+			return true
+		}
+	}
+	return false
+}
+
+func containsStatus(statuses []TransactionStatus, status TransactionStatus) bool {
+	for _, s := range statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+func containsEscrowStatus(statuses []EscrowStatus, status EscrowStatus) bool {
+	for _, s := range statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+func actorName(actor Actor) string {
+	if actor == "" {
+		return "non-parties"
+	}
+	return string(actor) + "s"
+}
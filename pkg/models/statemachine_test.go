@@ -0,0 +1,105 @@
+package models_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"escrow-agent/pkg/models"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func state(t models.TransactionStatus, e models.EscrowStatus) models.LifecycleState {
+	return models.LifecycleState{Transaction: t, Escrow: e}
+}
+
+func TestLifecycle_HappyPath(t *testing.T) {
+	s := state(models.TransactionPending, models.StatusPending)
+
+	steps := []struct {
+		event models.Event
+		actor models.Actor
+		want  models.LifecycleState
+	}{
+		{models.EventDeposit, models.ActorBuyer, state(models.TransactionDeposited, models.StatusFunded)},
+		{models.EventFulfill, models.ActorSeller, state(models.TransactionInProgress, models.StatusFunded)},
+		{models.EventConfirm, models.ActorBuyer, state(models.TransactionCompleted, models.StatusReleased)},
+	}
+
+	for _, step := range steps {
+		next, err := models.Lifecycle.Can(step.event, s, models.GuardContext{Actor: step.actor})
+		assert.NoError(t, err, step.event)
+		assert.Equal(t, step.want, next, step.event)
+		s = next
+	}
+}
+
+func TestLifecycle_RejectsIllegalMoves(t *testing.T) {
+	cases := []struct {
+		name  string
+		event models.Event
+		from  models.LifecycleState
+		gc    models.GuardContext
+	}{
+		{"deposit twice", models.EventDeposit, state(models.TransactionDeposited, models.StatusFunded), models.GuardContext{Actor: models.ActorBuyer}},
+		{"fulfill unfunded", models.EventFulfill, state(models.TransactionPending, models.StatusPending), models.GuardContext{Actor: models.ActorSeller}},
+		{"seller confirms", models.EventConfirm, state(models.TransactionInProgress, models.StatusFunded), models.GuardContext{Actor: models.ActorSeller}},
+		{"release during dispute", models.EventRelease, state(models.TransactionInProgress, models.StatusFunded), models.GuardContext{Actor: models.ActorAdmin, DisputeOpen: true}},
+		{"buyer refunds after fulfillment", models.EventRefund, state(models.TransactionInProgress, models.StatusFunded), models.GuardContext{Actor: models.ActorBuyer}},
+		{"refund completed", models.EventRefund, state(models.TransactionCompleted, models.StatusReleased), models.GuardContext{Actor: models.ActorAdmin}},
+		{"resolve without dispute", models.EventResolveForBuyer, state(models.TransactionDeposited, models.StatusDisputed), models.GuardContext{Actor: models.ActorAdmin}},
+		{"seller wins unfunded", models.EventResolveForSeller, state(models.TransactionPending, models.StatusDisputed), models.GuardContext{Actor: models.ActorAdmin, DisputeOpen: true}},
+	}
+
+	for _, c := range cases {
+		_, err := models.Lifecycle.Can(c.event, c.from, c.gc)
+		assert.ErrorIs(t, err, models.ErrIllegalTransition, c.name)
+	}
+}
+
+func TestStateMachine_Hooks(t *testing.T) {
+	machine := models.NewStateMachine(models.Transition{
+		Event:      models.EventRelease,
+		Actors:     []models.Actor{models.ActorSystem},
+		From:       []models.TransactionStatus{models.TransactionInProgress},
+		EscrowFrom: []models.EscrowStatus{models.StatusFunded},
+		To:         models.TransactionCompleted,
+		EscrowTo:   models.StatusReleased,
+	})
+
+	var calls []string
+	machine.OnTransition(models.EventRelease, func(ctx context.Context, c models.Change) error {
+		calls = append(calls, "release")
+		return nil
+	})
+	machine.OnAny(func(ctx context.Context, c models.Change) error {
+		calls = append(calls, "any")
+		return nil
+	})
+
+	from := state(models.TransactionInProgress, models.StatusFunded)
+	to, err := machine.Fire(context.Background(), models.EventRelease, uuid.New(), from, models.GuardContext{Actor: models.ActorSystem}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, state(models.TransactionCompleted, models.StatusReleased), to)
+	assert.Equal(t, []string{"release", "any"}, calls)
+
+	machine.OnAny(func(ctx context.Context, c models.Change) error {
+		return errors.New("ledger unavailable")
+	})
+	to, err = machine.Fire(context.Background(), models.EventRelease, uuid.New(), from, models.GuardContext{Actor: models.ActorSystem}, nil)
+	assert.EqualError(t, err, "ledger unavailable")
+	assert.Equal(t, from, to)
+}
+
+func TestActorFor_UsesPartyNotRoles(t *testing.T) {
+	buyer, seller, admin, other := uuid.New(), uuid.New(), uuid.New(), uuid.New()
+	tx := &models.Transaction{BuyerID: buyer, SellerID: seller}
+	both := models.Roles{models.RoleBuyer, models.RoleSeller}
+
+	assert.Equal(t, models.ActorBuyer, models.ActorFor(tx, buyer, both))
+	assert.Equal(t, models.ActorSeller, models.ActorFor(tx, seller, both))
+	assert.Equal(t, models.Actor(""), models.ActorFor(tx, other, both))
+	assert.Equal(t, models.ActorAdmin, models.ActorFor(tx, admin, models.Roles{models.RoleAdmin}))
+}
@@ -214,8 +214,8 @@ func cleanTables(t *testing.T, db *sql.DB) {
 func createUser(t *testing.T, db *sql.DB, username, pwdHash, role string) string {
 	var userID string
 	query := `
-		INSERT INTO users (username, password_hash, role)
-		VALUES ($1, $2, $3)
+		INSERT INTO users (username, password_hash, roles)
+		VALUES ($1, $2, ARRAY[$3]::user_role[])
 		RETURNING user_id;
 	`
 